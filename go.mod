@@ -1,3 +1,9 @@
 module ServerController
 
 go 1.25.0
+
+require (
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/net v0.57.0
+	golang.org/x/sys v0.47.0
+)
@@ -5,6 +5,20 @@ let logEntries = [];
 let serverOnline = true;
 let isAuthenticated = false;
 let currentUser = null;
+let apiSocket = null;
+
+// Commands sent by the page itself (the file browser) carry an id, their answers don't go to the console
+let nextRequestId = 1;
+const pendingRequests = new Map();
+let activeDownload = null;
+
+let filesUser = null;
+let filesPath = '';
+let filesSort = 'name';
+let filesDescending = false;
+let filesPage = 1;
+const FILES_PER_PAGE = 50;
+const FRAME_CHUNK = 256 * 1024;
 
 const enumValue = (name) => Object.freeze({toString: () => name});
 
@@ -29,6 +43,11 @@ function init(){
 
     // Enable filter function
     document.getElementById('log-filter').addEventListener('input', filterLogs);
+
+    document.getElementById('files-upload').addEventListener('change', function(e) {
+        uploadFiles(Array.from(e.target.files));
+        e.target.value = '';
+    });
     addLog('Dashboard initialized');
 }
 
@@ -51,6 +70,12 @@ function processCommand(){
     input.value = '';
     let params = parse_cmdline(command);
     const cmd = params.shift();
+    if(cmd == "api"){
+        // api [tcp_command] [args...] goes through the WebSocket gateway
+        addLog(`> ${command}`, 'info');
+        sendApiCommand(params.shift(), params);
+        return;
+    }
     if(cmd != "login" && cmd != "change_password"){
         addLog(`> ${command}`, 'info');
     }
@@ -100,6 +125,308 @@ function parse_cmdline(cmdline) {
     return args;
 }
 
+// Opens the WebSocket that carries the TCP API commands, the session comes from the login cookie
+function openApiSocket(){
+    if (apiSocket && apiSocket.readyState <= WebSocket.OPEN) return apiSocket;
+    const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
+    apiSocket = new WebSocket(`${protocol}//${location.host}/api/ws`);
+    apiSocket.binaryType = 'arraybuffer';
+    // Names the console in the admins' list of connections
+    const socket = apiSocket;
+    socket.addEventListener('open', () => socket.send(JSON.stringify({cmd: 'hello', args: ['client=web-console']})), {once: true});
+    apiSocket.onmessage = (message) => {
+        if (message.data instanceof ArrayBuffer) {
+            receiveFrame(message.data);
+            return;
+        }
+        let data;
+        try {
+            data = JSON.parse(message.data);
+        } catch (error) {
+            addLog('Invalid message from the API: ' + message.data, 'error');
+            return;
+        }
+        if (data.process_type === 'hello') {
+            return;
+        }
+        if (data.id !== undefined && pendingRequests.has(data.id)) {
+            answerRequest(data);
+            return;
+        }
+        if (data.status === 'event') {
+            addLog(`[${data.topic} #${data.seq}] ${data.message}`, 'info');
+        } else if (data.status === 'server_shutting_down' || data.status === 'connection_kicked') {
+            addLog(data.message, 'warning');
+        } else {
+            const ok = data.status && data.status.toLowerCase() === 'success';
+            addLog(`${data.process_type}: ${data.message || data.status}`, ok ? 'success' : 'error');
+        }
+    };
+    apiSocket.onclose = () => {
+        apiSocket = null;
+        activeDownload = null;
+        for (const request of pendingRequests.values()) {
+            request.reject(new Error('Connection to the server lost'));
+        }
+        pendingRequests.clear();
+    };
+    return apiSocket;
+}
+
+function sendApiCommand(cmd, args = []){
+    if (!cmd) {
+        addLog('Usage: api [command] [args...]', 'error');
+        return;
+    }
+    const socket = openApiSocket();
+    const frame = JSON.stringify({cmd, args});
+    if (socket.readyState === WebSocket.OPEN) {
+        socket.send(frame);
+    } else {
+        socket.addEventListener('open', () => socket.send(frame), {once: true});
+    }
+}
+
+function whenApiSocketOpen(){
+    const socket = openApiSocket();
+    if (socket.readyState === WebSocket.OPEN) return Promise.resolve(socket);
+    return new Promise((resolve, reject) => {
+        socket.addEventListener('open', () => resolve(socket), {once: true});
+        socket.addEventListener('close', () => reject(new Error('Unable to reach the server')), {once: true});
+    });
+}
+
+// Sends a TCP API command and resolves with its answer. content (a Blob) goes as binary frames,
+// with download the binary frames that follow the answer are collected in answer.content
+function apiRequest(cmd, args = [], {content = null, download = false} = {}){
+    return whenApiSocketOpen().then(socket => new Promise((resolve, reject) => {
+        const id = nextRequestId++;
+        pendingRequests.set(id, {resolve, reject, download});
+        socket.send(JSON.stringify({cmd, args, id, binary: content !== null}));
+        if (content !== null) {
+            sendStream(socket, content).catch(reject);
+        }
+    }));
+}
+
+function encodeFrame(payload){
+    const frame = new Uint8Array(6 + payload.byteLength);
+    new DataView(frame.buffer).setUint32(2, payload.byteLength);
+    frame.set(new Uint8Array(payload), 6);
+    return frame;
+}
+
+// A stream is a run of frames (marker 0, codec 0 for none, length, payload) ended by an empty one
+async function sendStream(socket, blob){
+    for (let offset = 0; offset < blob.size; offset += FRAME_CHUNK) {
+        socket.send(encodeFrame(await blob.slice(offset, offset + FRAME_CHUNK).arrayBuffer()));
+    }
+    socket.send(encodeFrame(new ArrayBuffer(0)));
+}
+
+function answerRequest(data){
+    const request = pendingRequests.get(data.id);
+    const ok = data.status && data.status.toLowerCase() === 'success';
+    if (request.download && ok) {
+        // The content comes next, the answer waits for the end of the stream
+        activeDownload = {request, data, chunks: []};
+        pendingRequests.delete(data.id);
+        return;
+    }
+    pendingRequests.delete(data.id);
+    if (ok) {
+        request.resolve(data);
+    } else {
+        request.reject(new Error(data.message || data.status));
+    }
+}
+
+function receiveFrame(buffer){
+    if (!activeDownload) return;
+    const payload = buffer.slice(6);
+    if (payload.byteLength > 0) {
+        activeDownload.chunks.push(payload);
+        return;
+    }
+    const {request, data, chunks} = activeDownload;
+    activeDownload = null;
+    data.content = new Blob(chunks);
+    request.resolve(data);
+}
+
+// ===========================
+// File browser
+// ===========================
+
+function formatSize(bytes){
+    const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    let unit = 0;
+    while (bytes >= 1024 && unit < units.length - 1) {
+        bytes /= 1024;
+        unit++;
+    }
+    return (unit === 0 ? bytes : bytes.toFixed(1)) + ' ' + units[unit];
+}
+
+function joinPath(folder, name){
+    return folder ? `${folder}/${name}` : name;
+}
+
+function loadFiles(){
+    const args = [filesPath, `sort=${filesSort}`, `order=${filesDescending ? 'desc' : 'asc'}`, `page=${filesPage}`, `per_page=${FILES_PER_PAGE}`];
+    return apiRequest('list_user_folder', args)
+        .then(answer => renderFiles(JSON.parse(answer.message)))
+        .catch(error => addLog('Unable to list the files: ' + error.message, 'error'));
+}
+
+function renderFiles(page){
+    document.getElementById('files-path').textContent = '/' + filesPath;
+    const list = document.getElementById('files-list');
+    list.innerHTML = '';
+    for (const entry of page.items) {
+        const folder = entry.type.startsWith('d');
+        const row = document.createElement('tr');
+        const name = document.createElement('td');
+        const link = document.createElement('a');
+        link.href = '#';
+        link.textContent = entry.name + (folder ? '/' : '');
+        link.onclick = (event) => {
+            event.preventDefault();
+            folder ? openFolder(joinPath(filesPath, entry.name)) : downloadFile(entry);
+        };
+        if (!folder && /\.(jpe?g|png|gif)$/i.test(entry.name)) name.appendChild(thumbnailImage(entry));
+        name.appendChild(link);
+        row.appendChild(name);
+        for (const value of [folder ? '' : formatSize(entry.size), new Date(entry.modified).toLocaleString(), entry.mode]) {
+            const cell = document.createElement('td');
+            cell.textContent = value;
+            row.appendChild(cell);
+        }
+        const actions = document.createElement('td');
+        actions.className = 'files-actions';
+        for (const [label, action] of [['Rename', renamePath], ['Copy', copyPath], ['Delete', deletePath]]) {
+            const button = document.createElement('button');
+            button.className = 'files-btn';
+            button.textContent = label;
+            button.onclick = () => action(entry);
+            actions.appendChild(button);
+        }
+        row.appendChild(actions);
+        list.appendChild(row);
+    }
+    const pages = Math.max(1, Math.ceil(page.total / page.per_page));
+    document.getElementById('files-page-info').textContent = `Page ${page.page} of ${pages} (${page.total} items)`;
+    document.getElementById('files-prev').disabled = page.page <= 1;
+    document.getElementById('files-next').disabled = page.page >= pages;
+}
+
+function openFolder(path){
+    filesPath = path;
+    filesPage = 1;
+    loadFiles();
+}
+
+function filesUp(){
+    openFolder(filesPath.split('/').slice(0, -1).join('/'));
+}
+
+function filesChangePage(delta){
+    filesPage = Math.max(1, filesPage + delta);
+    loadFiles();
+}
+
+function filesSortBy(key){
+    filesDescending = filesSort === key ? !filesDescending : false;
+    filesSort = key;
+    loadFiles();
+}
+
+function filesNewFolder(){
+    const name = prompt('Folder name:');
+    if (!name) return;
+    apiRequest('create_user_folder', [joinPath(filesPath, name)])
+        .then(() => loadFiles())
+        .catch(error => addLog('Unable to create the folder: ' + error.message, 'error'));
+}
+
+function uploadFiles(files){
+    // One after the other, the content of each goes through the connection
+    let chain = Promise.resolve();
+    for (const file of files) {
+        chain = chain.then(() => apiRequest('upload_user_file', [joinPath(filesPath, file.name)], {content: file}))
+            .then(() => addLog(`Uploaded ${file.name}`, 'success'))
+            .catch(error => addLog(`Unable to upload ${file.name}: ${error.message}`, 'error'));
+    }
+    chain.then(() => loadFiles());
+}
+
+function downloadFile(entry){
+    apiRequest('download_user_file', [joinPath(filesPath, entry.name)], {download: true})
+        .then(answer => {
+            const link = document.createElement('a');
+            link.href = URL.createObjectURL(answer.content);
+            link.download = entry.name;
+            link.click();
+            setTimeout(() => URL.revokeObjectURL(link.href), 60000);
+        })
+        .catch(error => addLog(`Unable to download ${entry.name}: ${error.message}`, 'error'));
+}
+
+// The thumbnail comes later, an image the server can't read simply doesn't get one
+function thumbnailImage(entry){
+    const image = document.createElement('img');
+    image.className = 'files-thumb';
+    image.alt = '';
+    apiRequest('get_thumbnail', [joinPath(filesPath, entry.name), '128'], {download: true})
+        .then(answer => {
+            image.src = URL.createObjectURL(answer.content);
+            image.onload = () => URL.revokeObjectURL(image.src);
+        })
+        .catch(() => image.remove());
+    return image;
+}
+
+function renamePath(entry){
+    const from = joinPath(filesPath, entry.name);
+    const to = prompt('New path:', from);
+    if (!to || to === from) return;
+    apiRequest('move_user_path', [from, to])
+        .then(() => loadFiles())
+        .catch(error => addLog(`Unable to move ${entry.name}: ${error.message}`, 'error'));
+}
+
+function copyPath(entry){
+    const from = joinPath(filesPath, entry.name);
+    const to = prompt('Copy to:', from + ' copy');
+    if (!to) return;
+    apiRequest('copy_user_path', [from, to])
+        .then(() => loadFiles())
+        .catch(error => addLog(`Unable to copy ${entry.name}: ${error.message}`, 'error'));
+}
+
+function deletePath(entry){
+    if (!confirm(`Move ${entry.name}${entry.type.startsWith('d') ? ' and everything in it' : ''} to the trash?`)) return;
+    apiRequest('delete_user_path', [joinPath(filesPath, entry.name)])
+        .then(() => loadFiles())
+        .catch(error => addLog(`Unable to delete ${entry.name}: ${error.message}`, 'error'));
+}
+
+// Shows the files of whoever is logged in, the socket belongs to the previous user otherwise
+function updateFilesPanel(){
+    const panel = document.getElementById('files-panel');
+    if (!panel) return;
+    const user = isAuthenticated ? currentUser : null;
+    if (user === filesUser) return;
+    filesUser = user;
+    if (apiSocket) apiSocket.close();
+    panel.style.display = user ? '' : 'none';
+    if (user) {
+        filesPath = '';
+        filesPage = 1;
+        loadFiles();
+    }
+}
+
 function sendActivitie(Activity){
     return fetch('/api/activities', {
         method: 'POST',
@@ -189,6 +516,7 @@ function updateAuthUI() {
         statusContainer.appendChild(authDiv);
         authStatus = authDiv;
     }
+    updateFilesPanel();
     if (isAuthenticated) {
         authStatus.innerHTML = `
             <span class="auth-indicator online"></span>
@@ -356,6 +684,7 @@ function quickLogin() {
 }
 
 function logout(){
+    if (apiSocket) apiSocket.close();
     sendCommand("logout")
 }
 
@@ -367,4 +696,9 @@ window.quickLogin = quickLogin;
 window.logout = logout;
 window.serverAction = sendActivitie;
 window.toggleAutoScroll = toggleAutoScroll;
-window.clearConsole = clearConsole;
\ No newline at end of file
+window.clearConsole = clearConsole;
+window.filesUp = filesUp;
+window.filesNewFolder = filesNewFolder;
+window.filesSortBy = filesSortBy;
+window.filesChangePage = filesChangePage;
+window.loadFiles = loadFiles;
\ No newline at end of file
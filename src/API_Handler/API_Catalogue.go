@@ -0,0 +1,259 @@
+package API_Handler
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Who may call a command
+const (
+	PermissionPublic = "public"
+	PermissionUser   = "user"
+	PermissionAdmin  = "admin"
+)
+
+type command_argument struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+	Variadic    bool   `json:"variadic,omitempty"` // Takes all the remaining arguments
+	Description string `json:"description"`
+}
+
+type api_command struct {
+	description string
+	arguments   []command_argument
+	permission  string
+	since       int  // Protocol version the command was added in
+	binary      bool // The content may come as binary frames instead of the last argument
+	// Changes the session, so it never runs async: it waits for the running commands, and the next ones wait for it
+	session bool
+	handler func(*request_format, *user_info) []byte
+}
+
+var commandsMap = map[string]api_command{
+	"console_cmd": {"Runs a shell command on the server", []command_argument{
+		{"command", "string", true, false, "program to run"},
+		{"args", "string", false, true, "arguments of the program"},
+	}, PermissionAdmin, 1, false, false, runCommandInConsole},
+	"login_attempt": {"Logs the session in", []command_argument{
+		{"username", "string", true, false, ""},
+		{"password", "string", true, false, ""},
+	}, PermissionPublic, 1, false, true, login_attempt},
+	"request_account": {"Asks the admins for an account", []command_argument{
+		{"username", "string", true, false, ""},
+		{"password", "string", true, false, ""},
+	}, PermissionPublic, 1, false, false, request_account},
+	"list_account_requests": {"Lists the pending account requests", nil,
+		PermissionAdmin, 1, false, false, list_account_requests},
+	"accept_account_request": {"Turns an account request into a user", []command_argument{
+		{"username", "string", true, false, ""},
+		{"is_admin", "bool", true, false, "true to make the user an admin"},
+		{"admin_level", "int", true, false, "grade of the admin, 5 when invalid"},
+	}, PermissionAdmin, 1, false, false, accept_account_request},
+	"list_user_folder": {"Lists a folder of the user's storage with the size, modification time and mode of each entry, \"Shared with me\" holds what the others share", []command_argument{
+		{"path", "path", true, false, "folder, relative to the user's storage"},
+		{"options", "string", false, true, "recursive=true, sort=name|size|modified|type, order=asc|desc, page=N, per_page=N (a page comes with the total)"},
+	}, PermissionUser, 1, false, false, list_user_folder},
+	"stat_user_path": {"Gives the size, modification time and mode of a file or folder", []command_argument{
+		{"path", "path", true, false, "relative to the user's storage"},
+	}, PermissionUser, 8, false, false, stat_user_path},
+	"delete_user_path": {"Moves a file, or a folder with everything in it, to the trash", []command_argument{
+		{"path", "path", true, false, "relative to the user's storage"},
+	}, PermissionUser, 8, false, false, delete_user_path},
+	"move_user_path": {"Renames or moves a file or folder, the destination must not exist", []command_argument{
+		{"from", "path", true, false, "relative to the user's storage"},
+		{"to", "path", true, false, "relative to the user's storage"},
+	}, PermissionUser, 8, false, false, move_user_path},
+	"copy_user_path": {"Copies a file, or a folder with everything in it, the destination must not exist", []command_argument{
+		{"from", "path", true, false, "relative to the user's storage"},
+		{"to", "path", true, false, "relative to the user's storage"},
+	}, PermissionUser, 8, false, false, copy_user_path},
+	"list_trash": {"Lists the deleted files and folders, newest first", nil,
+		PermissionUser, 9, false, false, list_trash},
+	"restore_from_trash": {"Puts a deleted file or folder back, nothing gets overwritten", []command_argument{
+		{"trash_id", "string", true, false, "id given by list_trash"},
+		{"destination", "path", false, false, "where to restore it (default: where it was deleted from)"},
+	}, PermissionUser, 9, false, false, restore_from_trash},
+	"empty_trash": {"Deletes everything in the trash for good", nil,
+		PermissionUser, 9, false, false, empty_trash},
+	"list_file_versions": {"Lists the previous versions of an overwritten file, newest first", []command_argument{
+		{"path", "path", true, false, "file, relative to the user's storage"},
+	}, PermissionUser, 9, false, false, list_file_versions},
+	"restore_file_version": {"Brings a previous version back, the current content becomes a version", []command_argument{
+		{"path", "path", true, false, "file, relative to the user's storage"},
+		{"version_id", "string", true, false, "id given by list_file_versions"},
+	}, PermissionUser, 9, false, false, restore_file_version},
+	"purge_history": {"Deletes the trash entries and versions older than the given age for good", []command_argument{
+		{"older_than_days", "int", true, false, "0 removes all of them"},
+	}, PermissionUser, 9, false, false, purge_history},
+	"storage_usage": {"Gives the space taken by the user's files, trash and versions", nil,
+		PermissionUser, 9, false, false, storage_usage},
+	"share_path": {"Gives another user read or read-write access to a file or folder, sharing it again changes the access", []command_argument{
+		{"path", "path", true, false, "relative to the user's storage"},
+		{"username", "string", true, false, "user to share it with"},
+		{"access", "string", true, false, "read or read-write"},
+	}, PermissionUser, 10, false, false, share_path},
+	"list_shares": {"Lists what the user shares with the others", nil,
+		PermissionUser, 10, false, false, list_shares},
+	"list_shared_with_me": {"Lists what the others share with the user, found under \"Shared with me\"", nil,
+		PermissionUser, 10, false, false, list_shared_with_me},
+	"revoke_share": {"Stops a share, from its owner or from the user it was shared with", []command_argument{
+		{"share_id", "string", true, false, "id given by share_path or the share listings"},
+	}, PermissionUser, 10, false, false, revoke_share},
+	"create_share_link": {"Makes a public link to a file or folder of the user's storage, a folder is downloaded as a zip", []command_argument{
+		{"path", "path", true, false, "relative to the user's storage"},
+		{"options", "string", false, true, "password=TEXT, expires_in=DURATION (like 72h), max_downloads=N"},
+	}, PermissionUser, 11, false, false, create_share_link},
+	"list_share_links": {"Lists the user's share links, or with all=true the active links of every user (admins only)", []command_argument{
+		{"options", "string", false, true, "all=true"},
+	}, PermissionUser, 11, false, false, list_share_links},
+	"revoke_share_link": {"Disables a share link, admins can revoke any link", []command_argument{
+		{"link_id", "string", true, false, "id given by create_share_link or list_share_links"},
+	}, PermissionUser, 11, false, false, revoke_share_link},
+	"storage_report": {"Gives the space the users' files take as they see it, the space really taken and what the deduplication saves", nil,
+		PermissionAdmin, 12, false, false, storage_report},
+	"blob_gc": {"Deletes the blobs no file uses anymore, the janitor does it every hour", nil,
+		PermissionAdmin, 12, false, false, blob_gc},
+	"blob_fsck": {"Hashes every blob again and lists the damaged ones with how many files use them", nil,
+		PermissionAdmin, 12, false, false, blob_fsck},
+	"blob_scan": {"Deduplicates the files written before deduplicate_files was turned on", nil,
+		PermissionAdmin, 12, false, false, blob_scan},
+	"sync_changes": {"Gives the changes of the user's storage after a cursor, without a cursor only the current one to start from", []command_argument{
+		{"since", "int", false, false, "cursor given by the previous call"},
+	}, PermissionUser, 13, false, false, sync_changes},
+	"search_files": {"Searches the names, paths and text contents of the user's files and of the ones shared with them, the last modified first", []command_argument{
+		{"query", "string", true, false, "words (a trailing * matches the beginning of words) and filters: name:PATTERN, type:image|pdf|folder|..., path:FOLDER, after:2006-01-02, before:2006-01-02, size>10MB, size<=1k"},
+		{"options", "string", false, true, "limit=N (default: 100, at most 1000), the total tells how many matched"},
+	}, PermissionUser, 15, false, false, search_files},
+	"get_thumbnail": {"Sends a thumbnail of a JPEG, PNG or GIF file: the details first, then the image as binary frames", []command_argument{
+		{"path", "path", true, false, "image, relative to the user's storage"},
+		{"size", "int", false, false, "longest side: 128, 256 or 512 (default: 256), a smaller image keeps its size"},
+	}, PermissionUser, 16, false, false, get_thumbnail},
+	"create_user_folder": {"Creates a folder in the user's storage", []command_argument{
+		{"path", "path", true, false, "folder, relative to the user's storage"},
+	}, PermissionUser, 1, false, false, create_user_folder},
+	"upload_user_file": {"Writes a file in the user's storage", []command_argument{
+		{"path", "path", true, false, "file, relative to the user's storage"},
+		{"file_content", "string", false, false, "content of the file, left out when sent as binary frames"},
+	}, PermissionUser, 1, true, false, upload_user_file},
+	"download_user_file": {"Sends a file of the user's storage: the details first, then the content as binary frames", []command_argument{
+		{"path", "path", true, false, "file, relative to the user's storage"},
+		{"offset", "int", false, false, "first byte to send (default: 0)"},
+		{"length", "int", false, false, "how many bytes to send (default: up to the end)"},
+	}, PermissionUser, 6, false, false, download_user_file},
+	"upload_begin": {"Starts a resumable upload, or returns the unfinished one with the same arguments", []command_argument{
+		{"path", "path", true, false, "file, relative to the user's storage"},
+		{"size", "int", true, false, "size of the whole file"},
+		{"sha256", "string", true, false, "hex encoded sha256 of the whole file"},
+		{"options", "string", false, true, "base=SHA256 of the content it was changed from, or base=none for a new file: if the file changed since, the upload goes to a conflict copy"},
+	}, PermissionUser, 7, false, false, upload_begin},
+	"upload_chunk": {"Adds a chunk to an upload, it has to start where the upload stopped", []command_argument{
+		{"upload_id", "string", true, false, "id given by upload_begin"},
+		{"offset", "int", true, false, "position of the chunk in the file"},
+		{"bytes", "string", false, false, "content of the chunk, left out when sent as binary frames"},
+	}, PermissionUser, 7, true, false, upload_chunk},
+	"upload_commit": {"Checks the hash of a complete upload and moves the file in place, gives the path it went to", []command_argument{
+		{"upload_id", "string", true, false, "id given by upload_begin"},
+	}, PermissionUser, 7, false, false, upload_commit},
+	"upload_abort": {"Cancels an upload", []command_argument{
+		{"upload_id", "string", true, false, "id given by upload_begin"},
+	}, PermissionUser, 7, false, false, upload_abort},
+	"file_signature": {"Sends the signature of a file's blocks, to upload a new version of it with upload_file_delta: the size and block size first, then the blocks as binary frames", []command_argument{
+		{"path", "path", true, false, "file, relative to the user's storage"},
+		{"block_size", "int", false, false, "between 2048 and 1048576 (default: about the square root of the size)"},
+	}, PermissionUser, 14, false, false, file_signature},
+	"upload_file_delta": {"Rebuilds a file from its current content and a delta sent as binary frames, checked against the size and hash before it replaces the file", []command_argument{
+		{"path", "path", true, false, "file, relative to the user's storage"},
+		{"block_size", "int", true, false, "block size of the signature the delta was made against"},
+		{"size", "int", true, false, "size of the new version"},
+		{"sha256", "string", true, false, "hex encoded sha256 of the new version"},
+	}, PermissionUser, 14, true, false, upload_file_delta},
+	"upload_script": {"Adds a script", []command_argument{
+		{"is_public", "bool", true, false, "true to let every user run it"},
+		{"name", "string", true, false, "name of the script"},
+		{"script_content", "string", false, false, "content of the script, left out when sent as binary frames"},
+	}, PermissionUser, 1, true, false, upload_script},
+	"list_scripts": {"Lists the scripts, private ones included for the admins", nil,
+		PermissionUser, 1, false, false, list_scripts},
+	"run_script": {"Runs a script and returns its output", []command_argument{
+		{"script_path", "string", true, false, "name of the script"},
+		{"visibility", "string", false, false, "anything but public runs a private script (admins only)"},
+	}, PermissionUser, 1, false, false, run_script},
+	"subscribe": {"Receives the events of the given topics", []command_argument{
+		{"topics", "string", false, true, "topics, prefix.* or * (default: all)"},
+	}, PermissionPublic, 2, false, true, subscribe},
+	"unsubscribe": {"Stops receiving the events of the given topics", []command_argument{
+		{"topics", "string", false, true, "topics (default: all)"},
+	}, PermissionPublic, 2, false, true, unsubscribe},
+	"hello": {"Agrees on the compression of the binary frames", []command_argument{
+		{"codecs", "string", false, true, "zstd, gzip or none by order of preference, client=NAME to name the client"},
+	}, PermissionPublic, 3, false, true, hello},
+	"list_connections": {"Lists the live connections", nil,
+		PermissionAdmin, 4, false, false, list_connections},
+	"kick_connection": {"Closes a connection", []command_argument{
+		{"connection_id", "int", true, false, "id given by list_connections"},
+	}, PermissionAdmin, 4, false, false, kick_connection},
+	"exit": {"Closes the connection", nil,
+		PermissionPublic, 1, false, true, close_user_connection},
+}
+
+func init() {
+	// Registered here, as describe reads commandsMap itself
+	commandsMap["describe"] = api_command{"Lists the commands this session may call", []command_argument{
+		{"command", "string", false, false, "describes only this command"},
+	}, PermissionPublic, 5, false, false, describe}
+}
+
+type command_description struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Arguments   []command_argument `json:"arguments"`
+	Permission  string             `json:"permission"`
+	Since       int                `json:"since"`
+	Binary      bool               `json:"binary"`
+	Async       bool               `json:"async"` // Can be marked async
+}
+
+func (command api_command) allowed(username string, is_admin bool) bool {
+	switch command.permission {
+	case PermissionAdmin:
+		return is_admin
+	case PermissionUser:
+		return username != ""
+	}
+	return true
+}
+
+func describe(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "describe"
+	results := []command_description{}
+	username, is_admin := info.identity()
+	for name, command := range commandsMap {
+		if len(request.Args) > 0 && request.Args[0] != name {
+			continue
+		}
+		if !command.allowed(username, is_admin) {
+			continue
+		}
+		arguments := command.arguments
+		if arguments == nil {
+			arguments = []command_argument{}
+		}
+		results = append(results, command_description{name, command.description, arguments,
+			command.permission, command.since, command.binary, !command.session})
+	}
+	if len(request.Args) > 0 && len(results) == 0 {
+		res.Status = Fail
+		res.Message = "Unknown command, or not available to this session"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	encoded, _ := json.Marshal(results)
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
@@ -1,19 +1,24 @@
 package API_Handler
 
 import (
+	common "ServerController/src/Common"
 	"ServerController/src/Internal_Process_Handler"
 	"ServerController/src/User_Handler"
 	"encoding/json"
 	"errors"
-	"io/fs"
-	"os"
+	"fmt"
+	"io"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	Success      = "success"
 	Fail         = "fail"
 	Unauthorized = "Unauthorized"
+	ShuttingDown = "server_shutting_down"
+	Kicked       = "connection_kicked"
 )
 
 type response struct {
@@ -22,39 +27,25 @@ type response struct {
 	Message      string `json:"message"`
 }
 
-func exists(path string) (bool, error) {
-	_, err := os.Stat(path)
-	if err == nil {
-		return true, nil
-	}
-	if errors.Is(err, fs.ErrNotExist) {
-		return false, nil
-	}
-	return false, err
-}
-
-func list_private_scripts() []string {
-	var result []string
-	publicEntries, err := os.ReadDir("scripts/private/")
-	if err != nil {
-		return result
-	}
-	for i := 0; i < len(publicEntries); i++ {
-		result = append(result, publicEntries[i].Name())
-	}
-	return result
+func unknownCommand(request *request_format) []byte {
+	var res response
+	res.Status = Fail
+	res.Process_Type = request.Command
+	res.Message = "Unknown command"
+	out, _ := json.Marshal(res)
+	return out
 }
 
-func list_public_scripts() []string {
-	var result []string
-	publicEntries, err := os.ReadDir("scripts/public/")
-	if err != nil {
-		return result
-	}
-	for i := 0; i < len(publicEntries); i++ {
-		result = append(result, publicEntries[i].Name())
+func unauthorizedCommand(request *request_format, command api_command) []byte {
+	var res response
+	res.Status = Unauthorized
+	res.Process_Type = request.Command
+	res.Message = "You need to be logged in"
+	if command.permission == PermissionAdmin {
+		res.Message = "You need to be an admin to use this command"
 	}
-	return result
+	out, _ := json.Marshal(res)
+	return out
 }
 
 func close_user_connection(request *request_format, info *user_info) []byte {
@@ -66,6 +57,38 @@ func close_user_connection(request *request_format, info *user_info) []byte {
 	return r
 }
 
+// Handshake: the client lists the codecs it can decompress, the server picks the one used for the binary frames it sends
+func hello(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "hello"
+	type hello_result struct {
+		Protocol  int    `json:"protocol"`
+		Codec     string `json:"codec"`
+		Max_Frame int    `json:"max_frame"`
+		Max_Async int    `json:"max_async"`
+	}
+	info.codec = common.CodecNone
+	codec_chosen := false
+	for _, arg := range request.Args {
+		// client=NAME tells who is connecting, for list_connections
+		if name, found := strings.CutPrefix(arg, "client="); found {
+			info.mutex.Lock()
+			info.client = name
+			info.mutex.Unlock()
+			continue
+		}
+		if codec, exists := common.CodecByName(arg); exists && !codec_chosen {
+			info.codec = codec
+			codec_chosen = true
+		}
+	}
+	encoded, _ := json.Marshal(hello_result{ProtocolVersion, common.CodecName(info.codec), common.MaxFramePayload, maxAsyncCommands})
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
 func runCommandInConsole(request *request_format, info *user_info) []byte {
 	var res response
 	res.Process_Type = "console_cmd"
@@ -109,8 +132,7 @@ func login_attempt(request *request_format, info *user_info) []byte {
 	}
 	if User_Handler.Authenticate_user(request.Args[0], request.Args[1]) {
 		user := User_Handler.LoadedUsers[request.Args[0]]
-		info.is_admin = user.Admin
-		info.username = user.Username
+		info.setIdentity(user.Username, user.Admin)
 
 		res.Status = "Success"
 		res.Message = "Logged in successfully"
@@ -188,7 +210,7 @@ func accept_account_request(request *request_format, info *user_info) []byte {
 	if err != nil {
 		admin_level = 5
 	}
-	User_Handler.Accept_account_request(request.Args[0], is_admin, uint8(admin_level))
+	User_Handler.Accept_account_request(request.Args[0], is_admin, uint8(admin_level), info.username)
 	res.Status = Success
 	res.Message = "User request has been accepted"
 	out, _ := json.Marshal(res)
@@ -198,9 +220,9 @@ func accept_account_request(request *request_format, info *user_info) []byte {
 func run_script(request *request_format, info *user_info) []byte {
 	var res response
 	res.Process_Type = "run_script"
-	path := "scripts/public/"
+	private := false
 	if info.is_admin && len(request.Args) == 2 && request.Args[1] != "public" {
-		path = "scripts/private/"
+		private = true
 	} else if len(request.Args) < 1 {
 		res.Status = Unauthorized
 		res.Message = "You need 1 argument: script_path"
@@ -209,10 +231,14 @@ func run_script(request *request_format, info *user_info) []byte {
 	}
 	type script_result struct {
 		Results string `json:"results"`
-		Errors  error  `json:"errors"`
+		Errors  string `json:"errors"`
+	}
+	job := Internal_Process_Handler.Start_job(info.username, request.Args[0], private).Wait()
+	scr := script_result{job.Output, job.Error}
+	res.Status = Success
+	if job.Status == Internal_Process_Handler.JobFailed {
+		res.Status = Fail
 	}
-	var scr script_result
-	scr.Results, scr.Errors = Internal_Process_Handler.RunScript([]string{path + request.Args[0]})
 	script_out_marsh, _ := json.Marshal(scr)
 	res.Message = string(script_out_marsh)
 	out, _ := json.Marshal(res)
@@ -233,9 +259,9 @@ func list_scripts(request *request_format, info *user_info) []byte {
 		Private_scripts []string `json:"private,omitempty"`
 	}
 	var all_scripts total_scripts
-	all_scripts.Public_scripts = list_public_scripts()
+	all_scripts.Public_scripts = Internal_Process_Handler.List_scripts(false)
 	if info.is_admin {
-		all_scripts.Private_scripts = list_private_scripts()
+		all_scripts.Private_scripts = Internal_Process_Handler.List_scripts(true)
 	}
 	encoded, _ := json.Marshal(all_scripts)
 	res.Message = string(encoded)
@@ -253,25 +279,29 @@ func upload_script(request *request_format, info *user_info) []byte {
 		out, _ := json.Marshal(res)
 		return out
 	}
-	if len(request.Args) != 3 {
+	// With a binary request the content comes as a stream instead of the last argument
+	content := io.Reader(request.body)
+	if request.body == nil && len(request.Args) == 3 {
+		content = strings.NewReader(request.Args[2])
+	} else if request.body == nil || len(request.Args) != 2 {
 		res.Status = Fail
 		res.Message = "You need 3 arguments: is_public(default false, in case you misspell), name_of_the_script, script_content"
 		out, _ := json.Marshal(res)
 		return out
 	}
-	is_public := "private"
-	if request.Args[0] == "true" {
-		is_public = "public"
+	err := Internal_Process_Handler.Save_script_from(request.Args[0] != "true", request.Args[1], content)
+	if errors.Is(err, common.ErrInvalidPath) {
+		res.Status = Fail
+		res.Message = "Invalid script name"
+		out, _ := json.Marshal(res)
+		return out
 	}
-	result_path := "scripts/" + is_public + "/" + request.Args[1]
-	exist, err := exists(result_path)
-	if exist || err != nil {
+	if errors.Is(err, Internal_Process_Handler.ErrScriptExists) {
 		res.Status = Fail
 		res.Message = "Script already exists under this name"
 		out, _ := json.Marshal(res)
 		return out
 	}
-	err = os.WriteFile(result_path, []byte(request.Args[2]), 0700)
 	if err != nil {
 		res.Status = Fail
 		res.Message = "Unable to upload script"
@@ -294,18 +324,18 @@ func upload_user_file(request *request_format, info *user_info) []byte {
 		out, _ := json.Marshal(res)
 		return out
 	}
-	if len(request.Args) != 2 {
+	// With a binary request the content comes as a stream instead of the last argument
+	content := io.Reader(request.body)
+	if request.body == nil && len(request.Args) == 2 {
+		content = strings.NewReader(request.Args[1])
+	} else if request.body == nil || len(request.Args) != 1 {
 		res.Status = Fail
 		res.Message = "You need 2 arguments for this: path, file_content"
 		out, _ := json.Marshal(res)
 		return out
 	}
-	err := os.WriteFile("users_data/"+info.username+"/"+request.Args[0], []byte(request.Args[1]), 0700)
-	if err != nil {
-		res.Status = Fail
-		res.Message = "Unable to upload file"
-		out, _ := json.Marshal(res)
-		return out
+	if err := User_Handler.Save_user_file(info.username, request.Args[0], content); err != nil {
+		return fileFailure(res, err, "Unable to upload file")
 	}
 
 	res.Status = Success
@@ -323,13 +353,15 @@ func create_user_folder(request *request_format, info *user_info) []byte {
 		out, _ := json.Marshal(res)
 		return out
 	}
-	err := os.MkdirAll("users_data/"+info.username+"/"+request.Args[0], 0700)
-	if err != nil {
+	if len(request.Args) != 1 {
 		res.Status = Fail
-		res.Message = "Unable to create folder"
+		res.Message = "You need 1 argument: path"
 		out, _ := json.Marshal(res)
 		return out
 	}
+	if err := User_Handler.Create_user_folder(info.username, request.Args[0]); err != nil {
+		return fileFailure(res, err, "Unable to create folder")
+	}
 
 	res.Status = Success
 	res.Message = "Folder created successfully"
@@ -337,59 +369,80 @@ func create_user_folder(request *request_format, info *user_info) []byte {
 	return out
 }
 
-func list_user_folder(request *request_format, info *user_info) []byte {
+// Answers with the details of the file, then sends its content (or the requested part of it) as a stream of binary frames
+func download_user_file(request *request_format, info *user_info) []byte {
 	var res response
-	res.Process_Type = "list_user_folder"
+	res.Process_Type = "download_user_file"
 	if info.username == "" {
 		res.Status = Fail
 		res.Message = "You need to be logged in"
 		out, _ := json.Marshal(res)
 		return out
 	}
-	path := "users_data/" + info.username
-	exist, err := exists(path)
-	if !exist || err != nil {
-		os.MkdirAll(path, 0700)
-	}
-	if len(request.Args) != 1 {
+	if len(request.Args) < 1 || len(request.Args) > 3 {
 		res.Status = Fail
-		res.Message = "You need 1 argument: path"
+		res.Message = "You need 1 to 3 arguments: path, offset(optional), length(optional)"
 		out, _ := json.Marshal(res)
 		return out
 	}
-	path += request.Args[0]
-	exist, err = exists(path)
-	if !exist || err != nil {
+	file, file_info, err := User_Handler.Open_user_file(info.username, request.Args[0])
+	if errors.Is(err, common.ErrInvalidPath) {
 		res.Status = Fail
-		res.Message = "Unkown path"
+		res.Message = "Invalid path"
 		out, _ := json.Marshal(res)
 		return out
 	}
-	entries, err := os.ReadDir("users_data/" + info.username + "/")
-	if err != nil {
+	if errors.Is(err, User_Handler.ErrUnknownPath) || errors.Is(err, User_Handler.ErrNotAFile) {
 		res.Status = Fail
-		res.Message = "An error ocluded while trying to read folder content"
+		res.Message = "Unknown file"
 		out, _ := json.Marshal(res)
 		return out
 	}
-	type item struct {
-		Name string `json:"name"`
-		Type string `json:"type"`
-	}
-	var results []item
-
-	for _, e := range entries {
-		results = append(results, item{e.Name(), e.Type().String()})
-	}
-
-	out, err := json.Marshal(results)
 	if err != nil {
-		println("First error:", err.Error())
+		res.Status = Fail
+		res.Message = "Unable to read file"
+		out, _ := json.Marshal(res)
+		return out
 	}
-	res.Message = string(out)
-	out, err = json.Marshal(res)
-	if err != nil {
-		println("Second error:", err.Error())
+	defer file.Close()
+
+	size := file_info.Size()
+	var offset int64
+	length := size
+	if len(request.Args) > 1 {
+		offset, err = strconv.ParseInt(request.Args[1], 10, 64)
+		if err != nil || offset < 0 || offset > size {
+			res.Status = Fail
+			res.Message = "Invalid offset"
+			out, _ := json.Marshal(res)
+			return out
+		}
+		length = size - offset
+	}
+	if len(request.Args) > 2 {
+		requested, err := strconv.ParseInt(request.Args[2], 10, 64)
+		if err != nil || requested < 0 {
+			res.Status = Fail
+			res.Message = "Invalid length"
+			out, _ := json.Marshal(res)
+			return out
+		}
+		length = min(requested, size-offset)
+	}
+
+	type download_details struct {
+		Name     string    `json:"name"`
+		Size     int64     `json:"size"`
+		Modified time.Time `json:"modified"`
+		Offset   int64     `json:"offset"`
+		Length   int64     `json:"length"`
+	}
+	details, _ := json.Marshal(download_details{file_info.Name(), size, file_info.ModTime(), offset, length})
+	res.Status = Success
+	res.Message = string(details)
+	out, _ := json.Marshal(res)
+	if err := info.writeStream(tagResponse(out, request.ID), io.NewSectionReader(file, offset, length)); err != nil {
+		fmt.Printf("Unable to send %s: %s\n", request.Args[0], err)
 	}
-	return out
+	return nil
 }
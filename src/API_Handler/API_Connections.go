@@ -0,0 +1,154 @@
+package API_Handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var ErrUnknownConnection = errors.New("unknown connection")
+
+type Connection_Details struct {
+	ID              uint64    `json:"id"`
+	Transport       string    `json:"transport"`
+	Remote_Address  string    `json:"remote_address"`
+	Username        string    `json:"username"`
+	Client          string    `json:"client"`
+	Connected_At    time.Time `json:"connected_at"`
+	Bytes_In        uint64    `json:"bytes_in"`
+	Bytes_Out       uint64    `json:"bytes_out"`
+	Last_Command    string    `json:"last_command"`
+	Last_Command_At time.Time `json:"last_command_at,omitzero"`
+}
+
+// Counts the bytes read from the connection
+type countingReader struct {
+	reader io.Reader
+	count  *atomic.Uint64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count.Add(uint64(n))
+	return n, err
+}
+
+func (info *user_info) details() Connection_Details {
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+	return Connection_Details{
+		ID:              info.id,
+		Transport:       info.transport,
+		Remote_Address:  info.current_connection.RemoteAddr().String(),
+		Username:        info.username,
+		Client:          info.client,
+		Connected_At:    info.connected_at,
+		Bytes_In:        info.bytes_in.Load(),
+		Bytes_Out:       info.bytes_out.Load(),
+		Last_Command:    info.last_command,
+		Last_Command_At: info.last_command_at,
+	}
+}
+
+// Every live connection, the oldest first
+func List_connections() []Connection_Details {
+	connectionsMutex.Lock()
+	sessions := make([]*user_info, 0, len(activeConnections))
+	for _, info := range activeConnections {
+		sessions = append(sessions, info)
+	}
+	connectionsMutex.Unlock()
+
+	results := make([]Connection_Details, 0, len(sessions))
+	for _, info := range sessions {
+		results = append(results, info.details())
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+	return results
+}
+
+// Tells the client it was disconnected, then closes its connection. The handler notices and cleans up
+func Kick_connection(id uint64) error {
+	connectionsMutex.Lock()
+	var target *user_info
+	for _, info := range activeConnections {
+		if info.id == id {
+			target = info
+			break
+		}
+	}
+	connectionsMutex.Unlock()
+	if target == nil {
+		return ErrUnknownConnection
+	}
+
+	var res response
+	res.Status = Kicked
+	res.Process_Type = Kicked
+	res.Message = "Your connection was closed by an admin"
+	out, _ := json.Marshal(res)
+	target.current_connection.SetWriteDeadline(time.Now().Add(time.Second))
+	target.write(out)
+	target.current_connection.Close()
+	return nil
+}
+
+func list_connections(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "list_connections"
+	if !info.is_admin {
+		res.Status = Unauthorized
+		res.Message = "You need to be logged in to have access to this functionality"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	list, _ := json.Marshal(List_connections())
+	res.Status = Success
+	res.Message = string(list)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func kick_connection(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "kick_connection"
+	if !info.is_admin {
+		res.Status = Unauthorized
+		res.Message = "You need to be logged in to have access to this functionality"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) != 1 {
+		res.Status = Fail
+		res.Message = "You need 1 argument: connection_id"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	id, err := strconv.ParseUint(request.Args[0], 10, 64)
+	if err != nil {
+		res.Status = Fail
+		res.Message = "Invalid connection id"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if id == info.id {
+		res.Status = Fail
+		res.Message = "Use exit to close your own connection"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if err := Kick_connection(id); err != nil {
+		res.Status = Fail
+		res.Message = "Unknown connection"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	res.Status = Success
+	res.Message = "Connection closed"
+	out, _ := json.Marshal(res)
+	return out
+}
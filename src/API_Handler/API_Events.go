@@ -0,0 +1,117 @@
+package API_Handler
+
+import (
+	"ServerController/src/Event_Handler"
+	"encoding/json"
+	"time"
+)
+
+const EventStatus = "event"
+
+// Pushed to subscribed clients in between the command responses
+type event_frame struct {
+	Status   string    `json:"status"`
+	Topic    string    `json:"topic"`
+	Sequence uint64    `json:"seq"`
+	Missed   uint64    `json:"missed,omitempty"`
+	Time     time.Time `json:"time"`
+	Message  string    `json:"message"`
+}
+
+func canSeeEvent(event Event_Handler.Event, info *user_info) bool {
+	username, is_admin := info.identity()
+	if is_admin {
+		return true
+	}
+	if event.Admin_only || username == "" {
+		return event.Topic == Event_Handler.ServerStopping
+	}
+	return event.Username == "" || event.Username == username
+}
+
+// Forwards the session's events to the client until the pump is stopped.
+// Whatever is still buffered at that point is flushed before returning
+func pumpEvents(info *user_info) {
+	defer close(info.events_done)
+	send := func(event Event_Handler.Event) {
+		if !canSeeEvent(event, info) {
+			return
+		}
+		data, _ := json.Marshal(event.Data)
+		frame := event_frame{
+			Status:   EventStatus,
+			Topic:    event.Topic,
+			Sequence: event.Sequence,
+			Missed:   info.subscription.TakeDropped(),
+			Time:     event.Time,
+			Message:  string(data),
+		}
+		out, _ := json.Marshal(frame)
+		info.write(out)
+	}
+	for {
+		select {
+		case event := <-info.subscription.C:
+			send(event)
+		case <-info.stop_events:
+			for {
+				select {
+				case event := <-info.subscription.C:
+					send(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func stopEvents(info *user_info) {
+	if info.subscription == nil {
+		return
+	}
+	Event_Handler.Unsubscribe(info.subscription)
+	close(info.stop_events)
+	<-info.events_done
+	info.subscription = nil
+}
+
+func subscribe(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "subscribe"
+	topics := request.Args
+	if len(topics) == 0 {
+		topics = []string{"*"}
+	}
+	if info.subscription == nil {
+		info.subscription = Event_Handler.Subscribe(Event_Handler.DefaultBufferSize)
+		info.stop_events = make(chan struct{})
+		info.events_done = make(chan struct{})
+		go pumpEvents(info)
+	}
+	info.subscription.AddTopics(topics...)
+
+	encoded, _ := json.Marshal(info.subscription.Topics())
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func unsubscribe(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "unsubscribe"
+	topics := []string{}
+	if info.subscription != nil {
+		info.subscription.RemoveTopics(request.Args...)
+		topics = info.subscription.Topics()
+		if len(topics) == 0 {
+			stopEvents(info)
+		}
+	}
+	encoded, _ := json.Marshal(topics)
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
@@ -0,0 +1,752 @@
+package API_Handler
+
+import (
+	common "ServerController/src/Common"
+	"ServerController/src/User_Handler"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Biggest page of a folder listing
+const maxListingPage = 1000
+
+type folder_page struct {
+	Items    []User_Handler.Folder_Entry `json:"items"`
+	Page     int                         `json:"page"`
+	Per_Page int                         `json:"per_page"`
+	Total    int                         `json:"total"`
+}
+
+func fileFailure(res response, err error, fallback string) []byte {
+	res.Status = Fail
+	switch {
+	case errors.Is(err, common.ErrInvalidPath):
+		res.Message = "Invalid path"
+	case errors.Is(err, User_Handler.ErrUnknownPath):
+		res.Message = "Unknown path"
+	case errors.Is(err, User_Handler.ErrUnknownTrashEntry):
+		res.Message = "Unknown trash entry"
+	case errors.Is(err, User_Handler.ErrUnknownVersion):
+		res.Message = "Unknown version"
+	case errors.Is(err, User_Handler.ErrUnknownShare):
+		res.Message = "Unknown share"
+	case errors.Is(err, User_Handler.ErrUnknownShareLink):
+		res.Message = "Unknown share link"
+	case errors.Is(err, User_Handler.ErrPathExists),
+		errors.Is(err, User_Handler.ErrReadOnly),
+		errors.Is(err, User_Handler.ErrSharedFolder),
+		errors.Is(err, User_Handler.ErrInvalidShare),
+		errors.Is(err, User_Handler.ErrInvalidShareLink),
+		errors.Is(err, User_Handler.ErrInvalidMove),
+		errors.Is(err, User_Handler.ErrInvalidSort),
+		errors.Is(err, User_Handler.ErrNotAnImage),
+		errors.Is(err, User_Handler.ErrImageTooBig),
+		errors.Is(err, User_Handler.ErrInvalidThumbnailSize):
+		res.Message = err.Error()
+	default:
+		res.Message = fallback
+	}
+	out, _ := json.Marshal(res)
+	return out
+}
+
+// Options given as name=value arguments, like the client= of hello
+func parseOptions(args []string, allowed ...string) (map[string]string, bool) {
+	options := map[string]string{}
+	for _, arg := range args {
+		name, value, found := strings.Cut(arg, "=")
+		if !found {
+			return nil, false
+		}
+		known := false
+		for _, option := range allowed {
+			known = known || option == name
+		}
+		if !known {
+			return nil, false
+		}
+		options[name] = value
+	}
+	return options, true
+}
+
+// Without page or per_page the answer is the whole listing, otherwise a page of it with the total
+func list_user_folder(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "list_user_folder"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	options, valid := map[string]string(nil), len(request.Args) >= 1
+	if valid {
+		options, valid = parseOptions(request.Args[1:], "recursive", "sort", "order", "page", "per_page")
+	}
+	if !valid {
+		res.Status = Fail
+		res.Message = "You need 1 argument: path, then the options recursive=true, sort=name|size|modified|type, order=asc|desc, page=N, per_page=N"
+		out, _ := json.Marshal(res)
+		return out
+	}
+
+	var results []User_Handler.Folder_Entry
+	var err error
+	if options["recursive"] == "true" {
+		results, err = User_Handler.List_user_folder_recursive(info.username, request.Args[0])
+	} else {
+		results, err = User_Handler.List_user_folder(info.username, request.Args[0])
+	}
+	if err == nil {
+		err = User_Handler.Sort_folder_entries(results, options["sort"], options["order"] == "desc")
+	}
+	if err != nil {
+		return fileFailure(res, err, "An error ocluded while trying to read folder content")
+	}
+
+	var listing any = results
+	_, paged := options["page"]
+	_, sized := options["per_page"]
+	if paged || sized {
+		page, per_page := 1, maxListingPage
+		if paged {
+			page, err = strconv.Atoi(options["page"])
+		}
+		if sized && err == nil {
+			per_page, err = strconv.Atoi(options["per_page"])
+		}
+		if err != nil || page < 1 || per_page < 1 || per_page > maxListingPage {
+			res.Status = Fail
+			res.Message = "page must be a positive number and per_page between 1 and " + strconv.Itoa(maxListingPage)
+			out, _ := json.Marshal(res)
+			return out
+		}
+		start := min((page-1)*per_page, len(results))
+		end := min(start+per_page, len(results))
+		listing = folder_page{results[start:end], page, per_page, len(results)}
+	}
+
+	out, err := json.Marshal(listing)
+	if err != nil {
+		println("First error:", err.Error())
+	}
+	res.Status = Success
+	res.Message = string(out)
+	out, err = json.Marshal(res)
+	if err != nil {
+		println("Second error:", err.Error())
+	}
+	return out
+}
+
+func stat_user_path(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "stat_user_path"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) != 1 {
+		res.Status = Fail
+		res.Message = "You need 1 argument: path"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	entry, err := User_Handler.Stat_user_path(info.username, request.Args[0])
+	if err != nil {
+		return fileFailure(res, err, "Unable to read the path")
+	}
+	encoded, _ := json.Marshal(entry)
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func delete_user_path(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "delete_user_path"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) != 1 {
+		res.Status = Fail
+		res.Message = "You need 1 argument: path"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if err := User_Handler.Delete_user_path(info.username, request.Args[0]); err != nil {
+		return fileFailure(res, err, "Unable to delete the path")
+	}
+	res.Status = Success
+	res.Message = "Moved to the trash"
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func move_user_path(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "move_user_path"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) != 2 {
+		res.Status = Fail
+		res.Message = "You need 2 arguments: from, to"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if err := User_Handler.Move_user_path(info.username, request.Args[0], request.Args[1]); err != nil {
+		return fileFailure(res, err, "Unable to move the path")
+	}
+	res.Status = Success
+	res.Message = "Moved successfully"
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func copy_user_path(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "copy_user_path"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) != 2 {
+		res.Status = Fail
+		res.Message = "You need 2 arguments: from, to"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if err := User_Handler.Copy_user_path(info.username, request.Args[0], request.Args[1]); err != nil {
+		return fileFailure(res, err, "Unable to copy the path")
+	}
+	res.Status = Success
+	res.Message = "Copied successfully"
+	out, _ := json.Marshal(res)
+	return out
+}
+
+// ===========================
+// Trash and versions
+// ===========================
+
+func list_trash(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "list_trash"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	encoded, _ := json.Marshal(User_Handler.List_trash(info.username))
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func restore_from_trash(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "restore_from_trash"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) < 1 || len(request.Args) > 2 {
+		res.Status = Fail
+		res.Message = "You need 1 or 2 arguments: trash_id, destination(optional, default: where it was deleted from)"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	destination := ""
+	if len(request.Args) == 2 {
+		destination = request.Args[1]
+	}
+	restored, err := User_Handler.Restore_from_trash(info.username, request.Args[0], destination)
+	if err != nil {
+		return fileFailure(res, err, "Unable to restore from the trash")
+	}
+	res.Status = Success
+	res.Message = "Restored to " + restored
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func empty_trash(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "empty_trash"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if err := User_Handler.Empty_trash(info.username); err != nil {
+		return fileFailure(res, err, "Unable to empty the trash")
+	}
+	res.Status = Success
+	res.Message = "Trash emptied"
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func list_file_versions(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "list_file_versions"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) != 1 {
+		res.Status = Fail
+		res.Message = "You need 1 argument: path"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	versions, err := User_Handler.List_file_versions(info.username, request.Args[0])
+	if err != nil {
+		return fileFailure(res, err, "Unable to list the versions")
+	}
+	encoded, _ := json.Marshal(versions)
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func restore_file_version(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "restore_file_version"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) != 2 {
+		res.Status = Fail
+		res.Message = "You need 2 arguments: path, version_id"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if err := User_Handler.Restore_file_version(info.username, request.Args[0], request.Args[1]); err != nil {
+		return fileFailure(res, err, "Unable to restore the version")
+	}
+	res.Status = Success
+	res.Message = "Version restored"
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func purge_history(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "purge_history"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	days := -1
+	if len(request.Args) == 1 {
+		days, _ = strconv.Atoi(request.Args[0])
+	}
+	if days < 0 {
+		res.Status = Fail
+		res.Message = "You need 1 argument: older_than_days"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	removed := User_Handler.Purge_history(info.username, time.Duration(days)*24*time.Hour)
+	res.Status = Success
+	res.Message = strconv.Itoa(removed) + " trash entries and versions removed"
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func storage_usage(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "storage_usage"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	encoded, _ := json.Marshal(User_Handler.Get_storage_usage(info.username))
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+// ===========================
+// Sharing
+// ===========================
+
+func share_path(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "share_path"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) != 3 {
+		res.Status = Fail
+		res.Message = "You need 3 arguments: path, username, access(read or read-write)"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	share, err := User_Handler.Share_path(info.username, request.Args[0], request.Args[1], request.Args[2])
+	if err != nil {
+		return fileFailure(res, err, "Unable to share the path")
+	}
+	encoded, _ := json.Marshal(share)
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func list_shares(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "list_shares"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	encoded, _ := json.Marshal(User_Handler.List_shares(info.username))
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func list_shared_with_me(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "list_shared_with_me"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	encoded, _ := json.Marshal(User_Handler.List_incoming_shares(info.username))
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func revoke_share(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "revoke_share"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) != 1 {
+		res.Status = Fail
+		res.Message = "You need 1 argument: share_id"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if err := User_Handler.Revoke_share(info.username, request.Args[0]); err != nil {
+		return fileFailure(res, err, "Unable to revoke the share")
+	}
+	res.Status = Success
+	res.Message = "Share revoked"
+	out, _ := json.Marshal(res)
+	return out
+}
+
+// ===========================
+// Share links
+// ===========================
+
+func create_share_link(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "create_share_link"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	options, valid := map[string]string(nil), len(request.Args) >= 1
+	if valid {
+		options, valid = parseOptions(request.Args[1:], "password", "expires_in", "max_downloads")
+	}
+	var expires_in time.Duration
+	max_downloads := 0
+	var err error
+	if value, given := options["expires_in"]; valid && given {
+		expires_in, err = time.ParseDuration(value)
+		valid = err == nil
+	}
+	if value, given := options["max_downloads"]; valid && given {
+		max_downloads, err = strconv.Atoi(value)
+		valid = err == nil
+	}
+	if !valid {
+		res.Status = Fail
+		res.Message = "You need 1 argument: path, then the options password=TEXT, expires_in=DURATION (like 72h), max_downloads=N"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	link, err := User_Handler.Create_share_link(info.username, request.Args[0], options["password"], expires_in, max_downloads)
+	if err != nil {
+		return fileFailure(res, err, "Unable to create the link")
+	}
+	encoded, _ := json.Marshal(link)
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+// all=true lists the active links of every user, for the admins
+func list_share_links(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "list_share_links"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	options, valid := parseOptions(request.Args, "all")
+	if !valid {
+		res.Status = Fail
+		res.Message = "The only option is all=true, for the admins"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	links := User_Handler.List_share_links(info.username)
+	if options["all"] == "true" {
+		if !info.is_admin {
+			res.Status = Fail
+			res.Message = "You need to be an admin to see every link"
+			out, _ := json.Marshal(res)
+			return out
+		}
+		links = User_Handler.List_active_share_links()
+	}
+	encoded, _ := json.Marshal(links)
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func revoke_share_link(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "revoke_share_link"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) != 1 {
+		res.Status = Fail
+		res.Message = "You need 1 argument: link_id"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if err := User_Handler.Revoke_share_link(info.username, info.is_admin, request.Args[0]); err != nil {
+		return fileFailure(res, err, "Unable to revoke the link")
+	}
+	res.Status = Success
+	res.Message = "Link revoked"
+	out, _ := json.Marshal(res)
+	return out
+}
+
+// ===========================
+// Sync
+// ===========================
+
+func sync_changes(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "sync_changes"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) > 1 {
+		res.Status = Fail
+		res.Message = "You need at most 1 argument: since"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	var since *uint64
+	if len(request.Args) == 1 {
+		cursor, err := strconv.ParseUint(request.Args[0], 10, 64)
+		if err != nil {
+			res.Status = Fail
+			res.Message = "Invalid cursor"
+			out, _ := json.Marshal(res)
+			return out
+		}
+		since = &cursor
+	}
+	encoded, _ := json.Marshal(User_Handler.Sync_changes(info.username, since))
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+// ===========================
+// Search
+// ===========================
+
+func search_files(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "search_files"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	var options map[string]string
+	valid := len(request.Args) > 0
+	if valid {
+		options, valid = parseOptions(request.Args[1:], "limit")
+	}
+	if !valid {
+		res.Status = Fail
+		res.Message = "You need 1 argument: query, then the option limit=N"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	limit := User_Handler.Search_Default_Limit
+	if value, given := options["limit"]; given {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > User_Handler.Search_Max_Limit {
+			res.Status = Fail
+			res.Message = "limit must be between 1 and " + strconv.Itoa(User_Handler.Search_Max_Limit)
+			out, _ := json.Marshal(res)
+			return out
+		}
+	}
+	results, err := User_Handler.Search_files(info.username, request.Args[0], limit)
+	if err != nil {
+		res.Status = Fail
+		res.Message = err.Error()
+		out, _ := json.Marshal(res)
+		return out
+	}
+	encoded, _ := json.Marshal(results)
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+// ===========================
+// Blob store
+// ===========================
+
+// The blob store commands are all the same: no argument, one report
+func blobCommand(process_type string, info *user_info, run func() any) []byte {
+	var res response
+	res.Process_Type = process_type
+	if !info.is_admin {
+		res.Status = Unauthorized
+		res.Message = "You need to be logged in to have access to this functionality"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	encoded, _ := json.Marshal(run())
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func storage_report(request *request_format, info *user_info) []byte {
+	return blobCommand("storage_report", info, func() any { return User_Handler.Get_storage_report() })
+}
+
+func blob_gc(request *request_format, info *user_info) []byte {
+	return blobCommand("blob_gc", info, func() any { return User_Handler.Collect_blobs() })
+}
+
+func blob_fsck(request *request_format, info *user_info) []byte {
+	return blobCommand("blob_fsck", info, func() any { return User_Handler.Check_blobs() })
+}
+
+func blob_scan(request *request_format, info *user_info) []byte {
+	return blobCommand("blob_scan", info, func() any { return User_Handler.Scan_blobs() })
+}
+
+// Answers with the details of the thumbnail, then sends the image as a stream of binary frames
+func get_thumbnail(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "get_thumbnail"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) < 1 || len(request.Args) > 2 {
+		res.Status = Fail
+		res.Message = "You need 1 or 2 arguments: path, size(optional)"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	size := User_Handler.Thumbnail_Default_Size
+	if len(request.Args) == 2 {
+		var err error
+		if size, err = strconv.Atoi(request.Args[1]); err != nil {
+			return fileFailure(res, User_Handler.ErrInvalidThumbnailSize, "")
+		}
+	}
+	thumbnail, file, err := User_Handler.Open_thumbnail(info.username, request.Args[0], size)
+	if err != nil {
+		return fileFailure(res, err, "Unable to make the thumbnail")
+	}
+	defer file.Close()
+
+	details, _ := json.Marshal(thumbnail)
+	res.Status = Success
+	res.Message = string(details)
+	out, _ := json.Marshal(res)
+	if err := info.writeStream(tagResponse(out, request.ID), file); err != nil {
+		fmt.Printf("Unable to send the thumbnail of %s: %s\n", request.Args[0], err)
+	}
+	return nil
+}
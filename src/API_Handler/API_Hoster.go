@@ -1,50 +1,119 @@
 package API_Handler
 
 import (
-	"bufio"
+	common "ServerController/src/Common"
+	"ServerController/src/Event_Handler"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Version of the TCP protocol, advertised to clients so they know what to expect
+const ProtocolVersion = 16
+
+// How many async commands a connection may have running at once, the next ones wait for a free slot
+const maxAsyncCommands = 8
+
+// How long in-flight commands get to finish once the server starts shutting down
+const shutdownGracePeriod = 10 * time.Second
+
 var listener net.Listener
-var numberOfConnections int
-var connectionsMutex sync.Mutex // Mutex to protect the counter
+var activeConnections = map[net.Conn]*user_info{}
+var connectionsMutex sync.Mutex // Mutex to protect the connections map and the shutdown flag
+var shuttingDown bool
 var wg sync.WaitGroup
 var StartTime time.Time
-var serverPort int
+var serverPort atomic.Int32
+var lastConnectionID atomic.Uint64
 
 type user_info struct {
 	username           string
 	current_connection net.Conn
 	is_admin           bool
 	close_connection   bool
+	reader             *common.FrameReader
+	codec              byte // Compression of the binary frames sent to the client, agreed on with hello
+
+	// Protects the fields read outside the handler goroutine
+	mutex sync.Mutex
+	// Keeps the frames from running into each other, held for a whole stream
+	write_mutex  sync.Mutex
+	subscription *Event_Handler.Subscription
+	stop_events  chan struct{}
+	events_done  chan struct{}
+
+	async_slots chan struct{}
+	inflight    sync.WaitGroup // Async commands still running
+
+	// Shown to the admins by list_connections
+	id              uint64
+	transport       string
+	connected_at    time.Time
+	client          string // Name sent by the client in hello
+	last_command    string
+	last_command_at time.Time
+	bytes_in        atomic.Uint64
+	bytes_out       atomic.Uint64
+}
+
+// Sends one frame to the client. Every frame ends with a new line, so responses and events can't run into each other
+func (info *user_info) write(data []byte) error {
+	info.write_mutex.Lock()
+	defer info.write_mutex.Unlock()
+	return info.writeRaw(append(data, '\n'))
+}
+
+// Sends a frame followed by the content as a stream of binary frames, compressed with the codec agreed on with the client.
+// Nothing else is written in between, so the client can't mix the stream up with another one
+func (info *user_info) writeStream(data []byte, content io.Reader) error {
+	info.write_mutex.Lock()
+	defer info.write_mutex.Unlock()
+	if err := info.writeRaw(append(data, '\n')); err != nil {
+		return err
+	}
+	return common.WriteStream(info.writeRaw, info.codec, content)
+}
+
+func (info *user_info) writeRaw(data []byte) error {
+	n, err := info.current_connection.Write(data)
+	info.bytes_out.Add(uint64(n))
+	return err
+}
+
+// Username and admin flag, safe to call from any goroutine
+func (info *user_info) identity() (string, bool) {
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+	return info.username, info.is_admin
+}
+
+func (info *user_info) setIdentity(username string, is_admin bool) {
+	info.mutex.Lock()
+	defer info.mutex.Unlock()
+	info.username = username
+	info.is_admin = is_admin
 }
 
 type request_format struct {
 	Status  string   `json:"status"`
 	Command string   `json:"cmd"`
 	Args    []string `json:"args"`
-}
+	// The content follows the command as a stream of binary frames, instead of being an argument
+	Binary bool `json:"binary"`
+	// Echoed in the response, so the answers of async commands can be told apart
+	ID json.RawMessage `json:"id,omitempty"`
+	// Runs next to the other async commands instead of blocking the connection
+	Async bool `json:"async"`
 
-var commandsMap = map[string]func(*request_format, *user_info) []byte{
-	"console_cmd":            runCommandInConsole,
-	"login_attempt":          login_attempt,
-	"request_account":        request_account,
-	"list_account_requests":  list_account_requests,
-	"accept_account_request": accept_account_request,
-	"list_user_folder":       list_user_folder,
-	"create_user_folder":     create_user_folder,
-	"upload_user_file":       upload_user_file,
-	"upload_script":          upload_script,
-	"list_scripts":           list_scripts,
-	"run_script":             run_script,
-	"exit":                   close_user_connection,
+	body *common.FrameStream
 }
 
 func formatPort() {
@@ -52,10 +121,27 @@ func formatPort() {
 	resultPort, err := strconv.Atoi(address[strings.LastIndex(address, ":")+1:])
 	if err != nil {
 		println("Unable to format port")
-		serverPort = 5050 // set to default port
-		return
+		resultPort = common.DefaultAPIPort
+	}
+	serverPort.Store(int32(resultPort))
+}
+
+// Listens on the configured port. When it's taken and the dynamic fallback is allowed,
+// the last used port is tried before letting the OS pick a free one
+func openListener() (net.Listener, error) {
+	config := common.Config
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(config.API_Port))
+	if err == nil || !config.Allow_Dynamic_Port {
+		return l, err
 	}
-	serverPort = resultPort
+	fmt.Printf("Port %d is not available (%s), looking for another one\n", config.API_Port, err)
+	if config.Last_API_Port != 0 && config.Last_API_Port != config.API_Port {
+		l, err = net.Listen("tcp", ":"+strconv.Itoa(config.Last_API_Port))
+		if err == nil {
+			return l, nil
+		}
+	}
+	return net.Listen("tcp", ":0")
 }
 
 func StartAPIHoster(ctx context.Context, stopChannel chan bool) {
@@ -74,7 +160,7 @@ func StartAPIHoster(ctx context.Context, stopChannel chan bool) {
 		// 	MinVersion:   tls.VersionTLS12,
 		// }
 		var err error
-		listener, err = net.Listen("tcp", ":0")
+		listener, err = openListener()
 		if err != nil {
 			fmt.Printf("Error starting TCP server: %s\n", err)
 			stopChannel <- false
@@ -82,92 +168,261 @@ func StartAPIHoster(ctx context.Context, stopChannel chan bool) {
 		}
 		defer listener.Close()
 		formatPort()
-		fmt.Println("TCP server is running on port ", serverPort)
+		common.SetLastAPIPort(GetServerPort())
+		fmt.Println("TCP server is running on port ", GetServerPort())
+
+		// Accept blocks, so the context is watched separately and closing the listener unblocks it
+		go func() {
+			<-ctx.Done()
+			StopAPIHoster()
+		}()
 
 		for {
-			select {
-			case <-ctx.Done():
-				fmt.Println("Shutting down TCP server...")
-				return
-			default:
-				conn, err := listener.Accept()
-				if err != nil {
-					fmt.Printf("Error accepting connection: %s\n", err)
-					continue
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					fmt.Println("Shutting down TCP server...")
+					return
 				}
-				go handleConnection(conn)
+				fmt.Printf("Error accepting connection: %s\n", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
 			}
+			if !trackConnection(conn, "tcp") {
+				conn.Close()
+				continue
+			}
+			go handleConnection(conn)
 		}
 	}()
 }
 
+// Runs the command loop over a connection accepted somewhere else (e.g. a WebSocket from the web server).
+// The session starts already logged in as the given user
+func ServeConnection(conn net.Conn, username string, is_admin bool) {
+	if !trackConnection(conn, "websocket") {
+		conn.Close()
+		return
+	}
+	getSession(conn).setIdentity(username, is_admin)
+	handleConnection(conn)
+}
+
 func handleConnection(conn net.Conn) {
+	defer wg.Done()
 	defer conn.Close()
-
-	incrementConnections()
-	defer decrementConnections()
+	defer untrackConnection(conn)
 
 	fmt.Printf("New connection established: %s\n", conn.RemoteAddr())
-	scanner := bufio.NewScanner(conn)
 
 	// Setting up the user info
-	var session_info user_info
-	session_info.is_admin = false
-	session_info.username = ""
-	session_info.close_connection = false
-	session_info.current_connection = conn
+	session_info := getSession(conn)
+	session_info.reader = common.NewFrameReader(countingReader{conn, &session_info.bytes_in})
+	defer stopEvents(session_info)
 	// Start handling commands
-	for scanner.Scan() {
-		text := scanner.Text()
+	var err error
+	for {
+		var frame common.Frame
+		frame, err = session_info.reader.ReadFrame()
+		if err != nil {
+			break
+		}
+		if frame.Binary {
+			println("Binary frame received outside of a command, skipping it")
+			continue
+		}
 		var m request_format
-		err := json.Unmarshal([]byte(text), &m)
+		err = json.Unmarshal(frame.Data, &m)
 		if err != nil {
-			println("Unable to parse API command: %s", err)
+			println("Unable to parse API command:", err.Error())
 			continue
 		}
+		if m.Binary {
+			m.body = session_info.reader.Stream()
+		}
+		session_info.mutex.Lock()
+		session_info.last_command = m.Command
+		session_info.last_command_at = time.Now()
+		session_info.mutex.Unlock()
 
-		conn.Write(commandsMap[m.Command](&m, &session_info))
+		if commandsMap[m.Command].session {
+			session_info.inflight.Wait()
+		} else if m.Async && m.body == nil {
+			// The content of a binary command is read from the connection, so those always run in order
+			session_info.async_slots <- struct{}{}
+			session_info.inflight.Add(1)
+			go func() {
+				defer session_info.inflight.Done()
+				defer func() { <-session_info.async_slots }()
+				// Commands streaming their result have already answered
+				if out := runCommand(&m, session_info); out != nil {
+					session_info.write(tagResponse(out, m.ID))
+				}
+			}()
+			continue
+		}
+
+		out := runCommand(&m, session_info)
+		// Whatever the handler didn't read of the content is skipped, so it isn't taken for commands
+		if m.body != nil {
+			if err = m.body.Drain(); err != nil {
+				break
+			}
+		}
+		// Commands streaming their result have already answered
+		if out != nil {
+			session_info.write(tagResponse(out, m.ID))
+		}
 
 		if session_info.close_connection {
 			fmt.Printf("Closing connection: %s\n", conn.RemoteAddr())
+			return
+		}
+		if isShuttingDown() {
 			break
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
+	session_info.inflight.Wait()
+	if isShuttingDown() {
+		// Pending events (server.stopping included) go out before the goodbye
+		stopEvents(session_info)
+		notifyShutdown(session_info)
+		return
+	}
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
 		fmt.Printf("Error reading from connection: %s\n", err)
 	}
 }
 
-func incrementConnections() {
+func runCommand(request *request_format, info *user_info) []byte {
+	command, exists := commandsMap[request.Command]
+	if !exists {
+		return unknownCommand(request)
+	}
+	// The catalogue is the reference, so describe never shows a command the session can't run or the other way round
+	if !command.allowed(info.identity()) {
+		return unauthorizedCommand(request, command)
+	}
+	return command.handler(request, info)
+}
+
+// Adds the ID of the request to its response
+func tagResponse(out []byte, id json.RawMessage) []byte {
+	if len(id) == 0 {
+		return out
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(out, &fields); err != nil {
+		return out
+	}
+	fields["id"] = id
+	tagged, _ := json.Marshal(fields)
+	return tagged
+}
+
+// Tells the client that the server is going away, so it doesn't mistake the closed socket for a network error
+func notifyShutdown(info *user_info) {
+	var res response
+	res.Status = ShuttingDown
+	res.Process_Type = ShuttingDown
+	res.Message = "Server is shutting down, the connection will be closed"
+	out, _ := json.Marshal(res)
+	info.current_connection.SetWriteDeadline(time.Now().Add(time.Second))
+	info.write(out)
+}
+
+// Registers the connection as active. Returns false when the server no longer accepts connections
+func trackConnection(conn net.Conn, transport string) bool {
 	connectionsMutex.Lock()
-	numberOfConnections++
-	connectionsMutex.Unlock()
+	defer connectionsMutex.Unlock()
+	if shuttingDown {
+		return false
+	}
+	activeConnections[conn] = &user_info{
+		current_connection: conn,
+		async_slots:        make(chan struct{}, maxAsyncCommands),
+		id:                 lastConnectionID.Add(1),
+		transport:          transport,
+		connected_at:       time.Now(),
+	}
+	wg.Add(1)
+	return true
 }
 
-func decrementConnections() {
+func untrackConnection(conn net.Conn) {
 	connectionsMutex.Lock()
-	numberOfConnections--
+	delete(activeConnections, conn)
 	connectionsMutex.Unlock()
 }
 
+func getSession(conn net.Conn) *user_info {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	return activeConnections[conn]
+}
+
+func isShuttingDown() bool {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	return shuttingDown
+}
+
 func GetNumberOfConnections() int {
 	connectionsMutex.Lock()
 	defer connectionsMutex.Unlock()
-	return numberOfConnections
+	return len(activeConnections)
 }
 
+// Stops accepting new connections and wakes up the idle ones, so they can say goodbye to their clients.
+// Connections that are in the middle of a command finish it first.
 func StopAPIHoster() {
+	connectionsMutex.Lock()
+	if shuttingDown {
+		connectionsMutex.Unlock()
+		return
+	}
+	shuttingDown = true
+	for conn := range activeConnections {
+		conn.SetReadDeadline(time.Now())
+	}
+	connectionsMutex.Unlock()
+
 	if listener != nil {
 		listener.Close()
 		fmt.Println("TCP server stopped.")
 	}
 }
 
+// Waits for the connection handlers to finish. The ones still busy after the grace period get their sockets closed
 func WaitForAPIHoster() {
-	wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(shutdownGracePeriod):
+	}
+
+	connectionsMutex.Lock()
+	fmt.Printf("Forcing %d connection(s) to close\n", len(activeConnections))
+	for conn := range activeConnections {
+		conn.Close()
+	}
+	connectionsMutex.Unlock()
+
+	// A command stuck outside of the socket (e.g. a script that never ends) can't be interrupted, so don't wait for it forever
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		println("Some connection handlers did not finish in time")
+	}
 }
 
+// Port the TCP server is listening on, 0 while it isn't running
 func GetServerPort() int {
-	return serverPort
+	return int(serverPort.Load())
 }
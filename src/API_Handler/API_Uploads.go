@@ -0,0 +1,252 @@
+package API_Handler
+
+import (
+	common "ServerController/src/Common"
+	"ServerController/src/User_Handler"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type upload_progress struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"` // Where the next chunk starts
+	Size   int64  `json:"size"`
+}
+
+func uploadFailure(res response, err error) []byte {
+	res.Status = Fail
+	switch {
+	case errors.Is(err, User_Handler.ErrUnknownUpload):
+		res.Message = "Unknown upload"
+	case errors.Is(err, common.ErrInvalidPath):
+		res.Message = "Invalid path"
+	case errors.Is(err, User_Handler.ErrUnknownPath):
+		res.Message = "Unknown path"
+	case errors.Is(err, User_Handler.ErrReadOnly),
+		errors.Is(err, User_Handler.ErrSharedFolder),
+		errors.Is(err, User_Handler.ErrInvalidHash),
+		errors.Is(err, User_Handler.ErrUploadOffset),
+		errors.Is(err, User_Handler.ErrUploadTooBig),
+		errors.Is(err, User_Handler.ErrNotEnoughSpace),
+		errors.Is(err, User_Handler.ErrUploadIncomplete),
+		errors.Is(err, User_Handler.ErrHashMismatch),
+		errors.Is(err, User_Handler.ErrNotAFile),
+		errors.Is(err, common.ErrInvalidBlockSize),
+		errors.Is(err, common.ErrInvalidDelta):
+		res.Message = err.Error()
+	default:
+		res.Message = "Unable to store the upload"
+	}
+	out, _ := json.Marshal(res)
+	return out
+}
+
+// After a failure, upload_begin with the same arguments tells the client where to continue from
+func uploadProgress(res response, session User_Handler.Upload_Session, err error) []byte {
+	if err != nil {
+		return uploadFailure(res, err)
+	}
+	progress, _ := json.Marshal(upload_progress{session.ID, session.Received, session.Size})
+	res.Status = Success
+	res.Message = string(progress)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func upload_begin(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "upload_begin"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) < 3 {
+		res.Status = Fail
+		res.Message = "You need 3 arguments: path, size, sha256"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	options, valid := parseOptions(request.Args[3:], "base")
+	if !valid {
+		res.Status = Fail
+		res.Message = "The only option is base=SHA256, or base=none for a new file"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	size, err := strconv.ParseInt(request.Args[1], 10, 64)
+	if err != nil {
+		res.Status = Fail
+		res.Message = "Invalid size"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	session, err := User_Handler.Begin_upload(info.username, request.Args[0], size, request.Args[2], options["base"])
+	return uploadProgress(res, session, err)
+}
+
+func upload_chunk(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "upload_chunk"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	// With a binary request the bytes come as a stream instead of the last argument
+	content := io.Reader(request.body)
+	if request.body == nil && len(request.Args) == 3 {
+		content = strings.NewReader(request.Args[2])
+	} else if request.body == nil || len(request.Args) != 2 {
+		res.Status = Fail
+		res.Message = "You need 3 arguments: upload_id, offset, bytes"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	offset, err := strconv.ParseInt(request.Args[1], 10, 64)
+	if err != nil {
+		res.Status = Fail
+		res.Message = "Invalid offset"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	session, err := User_Handler.Write_upload_chunk(info.username, request.Args[0], offset, content)
+	return uploadProgress(res, session, err)
+}
+
+func upload_commit(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "upload_commit"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) != 1 {
+		res.Status = Fail
+		res.Message = "You need 1 argument: upload_id"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	result, err := User_Handler.Commit_upload(info.username, request.Args[0])
+	if err != nil {
+		return uploadFailure(res, err)
+	}
+	encoded, _ := json.Marshal(result)
+	res.Status = Success
+	res.Message = string(encoded)
+	out, _ := json.Marshal(res)
+	return out
+}
+
+func upload_abort(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "upload_abort"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) != 1 {
+		res.Status = Fail
+		res.Message = "You need 1 argument: upload_id"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if err := User_Handler.Abort_upload(info.username, request.Args[0]); err != nil {
+		return uploadFailure(res, err)
+	}
+	res.Status = Success
+	res.Message = "Upload cancelled"
+	out, _ := json.Marshal(res)
+	return out
+}
+
+// Answers with the size and block size of the file, then sends the signature of its blocks as binary frames
+func file_signature(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "file_signature"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if len(request.Args) < 1 || len(request.Args) > 2 {
+		res.Status = Fail
+		res.Message = "You need 1 or 2 arguments: path, block_size(optional)"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	block_size := 0
+	if len(request.Args) == 2 {
+		var err error
+		if block_size, err = strconv.Atoi(request.Args[1]); err != nil || block_size <= 0 {
+			res.Status = Fail
+			res.Message = "Invalid block size"
+			out, _ := json.Marshal(res)
+			return out
+		}
+	}
+	signature, blocks, err := User_Handler.Open_file_signature(info.username, request.Args[0], block_size)
+	if err != nil {
+		return uploadFailure(res, err)
+	}
+	defer blocks.Close()
+
+	details, _ := json.Marshal(signature)
+	res.Status = Success
+	res.Message = string(details)
+	out, _ := json.Marshal(res)
+	if err := info.writeStream(tagResponse(out, request.ID), blocks); err != nil {
+		fmt.Printf("Unable to send the signature of %s: %s\n", request.Args[0], err)
+	}
+	return nil
+}
+
+func upload_file_delta(request *request_format, info *user_info) []byte {
+	var res response
+	res.Process_Type = "upload_file_delta"
+	if info.username == "" {
+		res.Status = Fail
+		res.Message = "You need to be logged in"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	// The delta is binary, it can't be an argument
+	if request.body == nil || len(request.Args) != 4 {
+		res.Status = Fail
+		res.Message = "You need 4 arguments and the delta as binary frames: path, block_size, size, sha256"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	block_size, err := strconv.Atoi(request.Args[1])
+	if err != nil {
+		res.Status = Fail
+		res.Message = "Invalid block size"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	size, err := strconv.ParseInt(request.Args[2], 10, 64)
+	if err != nil {
+		res.Status = Fail
+		res.Message = "Invalid size"
+		out, _ := json.Marshal(res)
+		return out
+	}
+	if err := User_Handler.Apply_file_delta(info.username, request.Args[0], block_size, size, request.Args[3], request.body); err != nil {
+		return uploadFailure(res, err)
+	}
+	res.Status = Success
+	res.Message = "File updated successfully"
+	out, _ := json.Marshal(res)
+	return out
+}
@@ -0,0 +1,376 @@
+package common
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// A file that changed a little is sent as a delta against the copy the other side already has, like rsync.
+// The side holding the old copy cuts it into blocks and gives a signature per block:
+//
+//	uint32 big endian rolling checksum | 16 bytes strong checksum
+//
+// The side holding the new copy slides over it byte by byte, looking for the blocks it knows, and sends a run of
+// instructions rebuilding the new copy from the old one:
+//
+//	'C' | uint64 big endian first block | uint32 big endian block count    copy blocks of the old copy
+//	'D' | uint32 big endian length | data                                  literal bytes
+//
+// Both signatures and deltas travel as streams of binary frames. The last block of the old copy may be short,
+// it is only matched at the end of the new one
+const (
+	DeltaMinBlockSize = 2 << 10
+	DeltaMaxBlockSize = 1 << 20
+	// Longest literal instruction, the bytes no block matched are cut into pieces of this size
+	DeltaMaxLiteral = 256 << 10
+)
+
+const (
+	deltaCopy    byte = 'C'
+	deltaLiteral byte = 'D'
+)
+
+const strongChecksumSize = 16
+
+const blockSignatureSize = 4 + strongChecksumSize
+
+var (
+	ErrInvalidBlockSize = errors.New("the block size must be between 2KiB and 1MiB")
+	ErrInvalidDelta     = errors.New("invalid delta")
+)
+
+type BlockSignature struct {
+	Weak   uint32
+	Strong [strongChecksumSize]byte
+}
+
+// Signature of the old copy, Blocks travel as binary frames after the rest
+type FileSignature struct {
+	Size       int64            `json:"size"`
+	Block_Size int              `json:"block_size"`
+	Blocks     []BlockSignature `json:"-"`
+}
+
+// What a delta is made of, Literal is about what it costs to send
+type DeltaStats struct {
+	Copied  int64 `json:"copied"`
+	Literal int64 `json:"literal"`
+}
+
+// Around the square root of the size, so a big file doesn't have millions of blocks nor a small one a single block
+func DeltaBlockSize(size int64) int {
+	block := int(math.Sqrt(float64(size)))
+	block = (block + 1023) &^ 1023
+	return min(max(block, DeltaMinBlockSize), DeltaMaxBlockSize)
+}
+
+func ValidDeltaBlockSize(size int) bool {
+	return size >= DeltaMinBlockSize && size <= DeltaMaxBlockSize
+}
+
+// Checksum of rsync: a is the sum of the bytes and b the sum of the a's, both mod 2^16.
+// It can be moved one byte forward without reading the whole window again
+type rollingChecksum struct {
+	a, b   uint32
+	length uint32
+}
+
+func newRollingChecksum(window []byte) rollingChecksum {
+	sum := rollingChecksum{length: uint32(len(window))}
+	for i, c := range window {
+		sum.a += uint32(c)
+		sum.b += uint32(len(window)-i) * uint32(c)
+	}
+	sum.a &= 0xffff
+	sum.b &= 0xffff
+	return sum
+}
+
+// Drops out from the front of the window and adds in at its end
+func (sum *rollingChecksum) roll(out, in byte) {
+	sum.a = (sum.a - uint32(out) + uint32(in)) & 0xffff
+	sum.b = (sum.b - sum.length*uint32(out) + sum.a) & 0xffff
+}
+
+func (sum rollingChecksum) value() uint32 {
+	return sum.a | sum.b<<16
+}
+
+func strongChecksum(block []byte) [strongChecksumSize]byte {
+	hash := sha256.Sum256(block)
+	return [strongChecksumSize]byte(hash[:strongChecksumSize])
+}
+
+// Writes the signature of each block of r
+func WriteSignature(w io.Writer, r io.Reader, blockSize int) error {
+	if !ValidDeltaBlockSize(blockSize) {
+		return ErrInvalidBlockSize
+	}
+	writer := bufio.NewWriter(w)
+	block := make([]byte, blockSize)
+	var record [blockSignatureSize]byte
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			binary.BigEndian.PutUint32(record[:4], newRollingChecksum(block[:n]).value())
+			strong := strongChecksum(block[:n])
+			copy(record[4:], strong[:])
+			if _, writeErr := writer.Write(record[:]); writeErr != nil {
+				return writeErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return writer.Flush()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func ReadSignature(r io.Reader) ([]BlockSignature, error) {
+	reader := bufio.NewReader(r)
+	var signatures []BlockSignature
+	var record [blockSignatureSize]byte
+	for {
+		_, err := io.ReadFull(reader, record[:])
+		if err == io.EOF {
+			return signatures, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalidDelta
+		}
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, BlockSignature{binary.BigEndian.Uint32(record[:4]), [strongChecksumSize]byte(record[4:])})
+	}
+}
+
+type deltaWriter struct {
+	writer *bufio.Writer
+	stats  DeltaStats
+	// Copy waiting to be written, following blocks are merged into it
+	first, count uint64
+}
+
+func (d *deltaWriter) copyBlock(index uint64, length int) error {
+	d.stats.Copied += int64(length)
+	if d.count > 0 && d.first+d.count == index && d.count < math.MaxUint32 {
+		d.count++
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.first, d.count = index, 1
+	return nil
+}
+
+func (d *deltaWriter) flushCopy() error {
+	if d.count == 0 {
+		return nil
+	}
+	var op [13]byte
+	op[0] = deltaCopy
+	binary.BigEndian.PutUint64(op[1:9], d.first)
+	binary.BigEndian.PutUint32(op[9:], uint32(d.count))
+	d.count = 0
+	_, err := d.writer.Write(op[:])
+	return err
+}
+
+func (d *deltaWriter) literal(data []byte) error {
+	if len(data) > 0 {
+		if err := d.flushCopy(); err != nil {
+			return err
+		}
+	}
+	for len(data) > 0 {
+		piece := data[:min(len(data), DeltaMaxLiteral)]
+		data = data[len(piece):]
+		d.stats.Literal += int64(len(piece))
+		var op [5]byte
+		op[0] = deltaLiteral
+		binary.BigEndian.PutUint32(op[1:], uint32(len(piece)))
+		if _, err := d.writer.Write(op[:]); err != nil {
+			return err
+		}
+		if _, err := d.writer.Write(piece); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the instructions rebuilding r from the copy the signature was made of
+func WriteDelta(w io.Writer, r io.Reader, signature FileSignature) (DeltaStats, error) {
+	blockSize := signature.Block_Size
+	if !ValidDeltaBlockSize(blockSize) {
+		return DeltaStats{}, ErrInvalidBlockSize
+	}
+	blocks := map[uint32][]int{}
+	// A table on the low bits of the rolling checksum, most windows match nothing and never reach the map
+	var known [1 << 16]bool
+	for i, block := range signature.Blocks {
+		blocks[block.Weak] = append(blocks[block.Weak], i)
+		known[block.Weak&0xffff] = true
+	}
+
+	delta := &deltaWriter{writer: bufio.NewWriter(w)}
+	reader := bufio.NewReaderSize(r, 1<<20)
+	// buffer[:start] is waiting to be sent as a literal, buffer[start:] is the window looked for in the blocks
+	buffer := make([]byte, 0, DeltaMaxLiteral+blockSize)
+	start := 0
+	// Reads up to a full window, true when the end of r came first
+	fill := func() (bool, error) {
+		for len(buffer)-start < blockSize {
+			c, err := reader.ReadByte()
+			if err == io.EOF {
+				return true, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			buffer = append(buffer, c)
+		}
+		return false, nil
+	}
+	match := func(weak uint32, window []byte) int {
+		if !known[weak&0xffff] || len(blocks[weak]) == 0 {
+			return -1
+		}
+		strong := strongChecksum(window)
+		for _, i := range blocks[weak] {
+			if signature.Blocks[i].Strong == strong {
+				return i
+			}
+		}
+		return -1
+	}
+
+	ended, err := fill()
+	if err != nil {
+		return delta.stats, err
+	}
+	sum := newRollingChecksum(buffer[start:])
+	for !ended {
+		if i := match(sum.value(), buffer[start:]); i >= 0 {
+			if err := delta.literal(buffer[:start]); err != nil {
+				return delta.stats, err
+			}
+			if err := delta.copyBlock(uint64(i), blockSize); err != nil {
+				return delta.stats, err
+			}
+			buffer, start = buffer[:0], 0
+			if ended, err = fill(); err != nil {
+				return delta.stats, err
+			}
+			sum = newRollingChecksum(buffer)
+			continue
+		}
+		c, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return delta.stats, err
+		}
+		sum.roll(buffer[start], c)
+		buffer = append(buffer, c)
+		start++
+		if start >= DeltaMaxLiteral {
+			if err := delta.literal(buffer[:start]); err != nil {
+				return delta.stats, err
+			}
+			buffer = append(buffer[:0], buffer[start:]...)
+			start = 0
+		}
+	}
+
+	// What is left is shorter than a block or matched nothing, only a short last block can still match its end
+	last := len(signature.Blocks) - 1
+	if last >= 0 {
+		length := int(signature.Size - int64(last)*int64(blockSize))
+		if length > 0 && length < blockSize && len(buffer) >= length {
+			window := buffer[len(buffer)-length:]
+			if signature.Blocks[last].Weak == newRollingChecksum(window).value() && signature.Blocks[last].Strong == strongChecksum(window) {
+				if err := delta.literal(buffer[:len(buffer)-length]); err != nil {
+					return delta.stats, err
+				}
+				buffer = buffer[:0]
+				if err := delta.copyBlock(uint64(last), length); err != nil {
+					return delta.stats, err
+				}
+			}
+		}
+	}
+	if err := delta.literal(buffer); err != nil {
+		return delta.stats, err
+	}
+	if err := delta.flushCopy(); err != nil {
+		return delta.stats, err
+	}
+	return delta.stats, delta.writer.Flush()
+}
+
+// Rebuilds the new copy in w from the old one in base. A copy going past the end of base is invalid
+func ApplyDelta(w io.Writer, base io.ReaderAt, baseSize int64, blockSize int, delta io.Reader) (int64, error) {
+	if !ValidDeltaBlockSize(blockSize) {
+		return 0, ErrInvalidBlockSize
+	}
+	reader := bufio.NewReader(delta)
+	var written int64
+	for {
+		op, err := reader.ReadByte()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		switch op {
+		case deltaCopy:
+			var args [12]byte
+			if _, err := io.ReadFull(reader, args[:]); err != nil {
+				return written, ErrInvalidDelta
+			}
+			first := binary.BigEndian.Uint64(args[:8])
+			count := uint64(binary.BigEndian.Uint32(args[8:]))
+			blocks := uint64((baseSize + int64(blockSize) - 1) / int64(blockSize))
+			if count == 0 || first >= blocks || count > blocks-first {
+				return written, ErrInvalidDelta
+			}
+			offset := int64(first) * int64(blockSize)
+			length := min(int64(count)*int64(blockSize), baseSize-offset)
+			n, err := io.Copy(w, io.NewSectionReader(base, offset, length))
+			written += n
+			if err != nil {
+				return written, err
+			}
+		case deltaLiteral:
+			var args [4]byte
+			if _, err := io.ReadFull(reader, args[:]); err != nil {
+				return written, ErrInvalidDelta
+			}
+			length := int64(binary.BigEndian.Uint32(args[:]))
+			if length == 0 || length > DeltaMaxLiteral {
+				return written, ErrInvalidDelta
+			}
+			n, err := io.CopyN(w, reader, length)
+			written += n
+			if err == io.EOF {
+				return written, ErrInvalidDelta
+			}
+			if err != nil {
+				return written, err
+			}
+		default:
+			return written, ErrInvalidDelta
+		}
+	}
+}
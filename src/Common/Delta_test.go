@@ -0,0 +1,199 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+const testBlockSize = DeltaMinBlockSize
+
+// The same bytes on every run
+func randomBytes(seed uint64, n int) []byte {
+	data := make([]byte, n)
+	random := rand.New(rand.NewPCG(seed, seed))
+	for i := range data {
+		data[i] = byte(random.Uint32())
+	}
+	return data
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// Signature of base, a delta of updated against it, and updated rebuilt from both
+func roundTrip(t *testing.T, base, updated []byte) (DeltaStats, []byte) {
+	t.Helper()
+	var signature bytes.Buffer
+	if err := WriteSignature(&signature, bytes.NewReader(base), testBlockSize); err != nil {
+		t.Fatalf("WriteSignature: %v", err)
+	}
+	blocks, err := ReadSignature(&signature)
+	if err != nil {
+		t.Fatalf("ReadSignature: %v", err)
+	}
+	var delta bytes.Buffer
+	stats, err := WriteDelta(&delta, bytes.NewReader(updated), FileSignature{int64(len(base)), testBlockSize, blocks})
+	if err != nil {
+		t.Fatalf("WriteDelta: %v", err)
+	}
+	encoded := bytes.Clone(delta.Bytes())
+	var rebuilt bytes.Buffer
+	written, err := ApplyDelta(&rebuilt, bytes.NewReader(base), int64(len(base)), testBlockSize, &delta)
+	if err != nil {
+		t.Fatalf("ApplyDelta: %v", err)
+	}
+	if written != int64(len(updated)) || !bytes.Equal(rebuilt.Bytes(), updated) {
+		t.Fatalf("rebuilt %d bytes that differ from the %d expected", written, len(updated))
+	}
+	return stats, encoded
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	base := randomBytes(1, 10*testBlockSize+700)
+	blocks := make([][]byte, 10)
+	for i := range blocks {
+		blocks[i] = base[i*testBlockSize : (i+1)*testBlockSize]
+	}
+	tail := base[10*testBlockSize:]
+	extra := randomBytes(2, 1000)
+	tests := []struct {
+		name    string
+		base    []byte
+		updated []byte
+		literal int64 // What can't be taken from the base
+	}{
+		{"identical", base, base, 0},
+		// The short last block is only looked for at the end
+		{"appended", base, join(base, extra), int64(len(tail) + len(extra))},
+		{"appended to full blocks", base[:10*testBlockSize], join(base[:10*testBlockSize], extra), int64(len(extra))},
+		{"prepended", base, join(extra[:100], base), 100},
+		{"inserted in the middle", base, join(base[:5*testBlockSize], extra, base[5*testBlockSize:]), int64(len(extra))},
+		{"shifted blocks", base, join(join(blocks[5:]...), join(blocks[:5]...), tail), 0},
+		{"repeated blocks", base, join(blocks[3], blocks[3], blocks[3], tail), 0},
+		{"one byte changed", base, join(base[:4*testBlockSize+10], []byte{^base[4*testBlockSize+10]}, base[4*testBlockSize+11:]), testBlockSize},
+		{"truncated", base, base[:3*testBlockSize], 0},
+		{"empty base", nil, extra, int64(len(extra))},
+		{"emptied", base, nil, 0},
+		{"both empty", nil, nil, 0},
+		{"shorter than a block", base[:100], base[:100], 0},
+		{"longer than a literal", nil, randomBytes(3, DeltaMaxLiteral+testBlockSize+1), DeltaMaxLiteral + testBlockSize + 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats, _ := roundTrip(t, test.base, test.updated)
+			if stats.Literal != test.literal {
+				t.Errorf("%d literal bytes, want %d", stats.Literal, test.literal)
+			}
+			if stats.Copied+stats.Literal != int64(len(test.updated)) {
+				t.Errorf("%d copied and %d literal bytes for %d bytes", stats.Copied, stats.Literal, len(test.updated))
+			}
+		})
+	}
+}
+
+func TestDeltaInvalidBlockSize(t *testing.T) {
+	for _, size := range []int{0, -1, DeltaMinBlockSize - 1, DeltaMaxBlockSize + 1} {
+		if err := WriteSignature(&bytes.Buffer{}, bytes.NewReader(nil), size); !errors.Is(err, ErrInvalidBlockSize) {
+			t.Errorf("WriteSignature with blocks of %d: %v", size, err)
+		}
+		if _, err := WriteDelta(&bytes.Buffer{}, bytes.NewReader(nil), FileSignature{Block_Size: size}); !errors.Is(err, ErrInvalidBlockSize) {
+			t.Errorf("WriteDelta with blocks of %d: %v", size, err)
+		}
+		if _, err := ApplyDelta(&bytes.Buffer{}, bytes.NewReader(nil), 0, size, bytes.NewReader(nil)); !errors.Is(err, ErrInvalidBlockSize) {
+			t.Errorf("ApplyDelta with blocks of %d: %v", size, err)
+		}
+	}
+}
+
+func copyOp(first uint64, count uint32) []byte {
+	op := []byte{deltaCopy}
+	op = binary.BigEndian.AppendUint64(op, first)
+	return binary.BigEndian.AppendUint32(op, count)
+}
+
+func literalOp(length uint32, data []byte) []byte {
+	op := binary.BigEndian.AppendUint32([]byte{deltaLiteral}, length)
+	return append(op, data...)
+}
+
+func TestApplyInvalidDelta(t *testing.T) {
+	base := randomBytes(4, 3*testBlockSize+10)
+	tests := []struct {
+		name  string
+		delta []byte
+	}{
+		{"unknown instruction", []byte("X")},
+		{"copy cut short", copyOp(0, 1)[:6]},
+		{"literal length cut short", literalOp(4, nil)[:3]},
+		{"literal cut short", literalOp(10, []byte("abc"))},
+		{"empty literal", literalOp(0, nil)},
+		{"literal too long", literalOp(DeltaMaxLiteral+1, make([]byte, DeltaMaxLiteral+1))},
+		{"copy of no block", copyOp(0, 0)},
+		{"copy after the last block", copyOp(4, 1)},
+		{"copy going past the last block", copyOp(2, 3)},
+		{"copy wrapping around", copyOp(math.MaxUint64, 2)},
+		{"garbage after a valid copy", append(copyOp(0, 1), 0xff)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ApplyDelta(&bytes.Buffer{}, bytes.NewReader(base), int64(len(base)), testBlockSize, bytes.NewReader(test.delta))
+			if !errors.Is(err, ErrInvalidDelta) {
+				t.Errorf("ApplyDelta: %v, want ErrInvalidDelta", err)
+			}
+		})
+	}
+}
+
+// A delta cut anywhere either fails or rebuilds the start of the file, never more
+func TestApplyTruncatedDelta(t *testing.T) {
+	base := randomBytes(5, 4*testBlockSize+300)
+	updated := join(base[testBlockSize:2*testBlockSize], randomBytes(6, 500), base[:testBlockSize], base[4*testBlockSize:])
+	_, delta := roundTrip(t, base, updated)
+	for cut := range len(delta) {
+		var rebuilt bytes.Buffer
+		_, err := ApplyDelta(&rebuilt, bytes.NewReader(base), int64(len(base)), testBlockSize, bytes.NewReader(delta[:cut]))
+		if !bytes.HasPrefix(updated, rebuilt.Bytes()) {
+			t.Fatalf("cut at %d: rebuilt bytes that aren't in the file", cut)
+		}
+		if err == nil && rebuilt.Len() == len(updated) {
+			t.Fatalf("cut at %d: rebuilt the whole file", cut)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidDelta) {
+			t.Fatalf("cut at %d: %v", cut, err)
+		}
+	}
+}
+
+func TestReadTruncatedSignature(t *testing.T) {
+	var signature bytes.Buffer
+	if err := WriteSignature(&signature, bytes.NewReader(randomBytes(7, 2*testBlockSize)), testBlockSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSignature(bytes.NewReader(signature.Bytes()[:signature.Len()-1])); !errors.Is(err, ErrInvalidDelta) {
+		t.Errorf("ReadSignature of a truncated signature: %v", err)
+	}
+}
+
+// Whatever comes from the network, applying it fails cleanly or stays within the base
+func FuzzApplyDelta(f *testing.F) {
+	base := randomBytes(8, 2*testBlockSize+10)
+	f.Add(join(copyOp(0, 3), literalOp(3, []byte("abc"))))
+	f.Add(copyOp(math.MaxUint64, math.MaxUint32))
+	f.Add(literalOp(math.MaxUint32, []byte("abc")))
+	f.Add([]byte("CD"))
+	f.Fuzz(func(t *testing.T, delta []byte) {
+		var rebuilt bytes.Buffer
+		written, err := ApplyDelta(&rebuilt, bytes.NewReader(base), int64(len(base)), testBlockSize, bytes.NewReader(delta))
+		if err != nil && !errors.Is(err, ErrInvalidDelta) {
+			t.Fatalf("ApplyDelta failed with %v, want ErrInvalidDelta", err)
+		}
+		if written != int64(rebuilt.Len()) {
+			t.Fatalf("ApplyDelta said it wrote %d bytes, it wrote %d", written, rebuilt.Len())
+		}
+	})
+}
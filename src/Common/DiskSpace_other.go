@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package common
+
+import "errors"
+
+func GetDiskSpace(path string) (free uint64, total uint64, err error) {
+	return 0, 0, errors.New("disk space is not available on this system")
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package common
+
+import "golang.org/x/sys/unix"
+
+// Space left for the server's user and the size of the disk holding path
+func GetDiskSpace(path string) (free uint64, total uint64, err error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), uint64(stat.Blocks) * uint64(stat.Bsize), nil
+}
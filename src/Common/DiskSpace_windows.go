@@ -0,0 +1,15 @@
+//go:build windows
+
+package common
+
+import "golang.org/x/sys/windows"
+
+// Space left for the server's user and the size of the disk holding path
+func GetDiskSpace(path string) (free uint64, total uint64, err error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = windows.GetDiskFreeSpaceEx(name, &free, &total, nil)
+	return free, total, err
+}
@@ -0,0 +1,256 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Binary frames travel on the TCP API next to the JSON lines:
+//
+//	0x00 marker | codec | uint32 big endian payload length | payload
+//
+// A JSON line can't start with the marker, so the first byte tells the two apart.
+// A stream is a run of binary frames ended by an empty one.
+const (
+	FrameMarker byte = 0x00
+	CodecNone   byte = 0
+	CodecGzip   byte = 1
+	CodecZstd   byte = 2
+)
+
+const frameHeaderSize = 6
+
+// Biggest payload of a binary frame, compressed or not
+const MaxFramePayload = 4 << 20
+
+// Biggest JSON line, the content of files goes in binary frames instead
+const MaxLineLength = 1 << 20
+
+// Size of the frames a stream is cut into
+const StreamChunkSize = 256 << 10
+
+var (
+	ErrFrameTooBig    = errors.New("frame too big")
+	ErrUnknownCodec   = errors.New("unknown frame codec")
+	ErrExpectedBinary = errors.New("expected a binary frame")
+)
+
+var codecNames = map[string]byte{"none": CodecNone, "gzip": CodecGzip, "zstd": CodecZstd}
+
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxFramePayload))
+
+func CodecByName(name string) (byte, bool) {
+	codec, exists := codecNames[name]
+	return codec, exists
+}
+
+func CodecName(codec byte) string {
+	for name, value := range codecNames {
+		if value == codec {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// Encodes data as a single binary frame. The data is sent as is when compressing doesn't make it smaller
+func EncodeFrame(codec byte, data []byte) []byte {
+	payload := data
+	if len(data) > 0 && codec != CodecNone {
+		compressed, err := compress(codec, data)
+		if err == nil && len(compressed) < len(data) {
+			payload = compressed
+		} else {
+			codec = CodecNone
+		}
+	} else {
+		codec = CodecNone
+	}
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	frame[0] = FrameMarker
+	frame[1] = codec
+	binary.BigEndian.PutUint32(frame[2:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func compress(codec byte, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case CodecGzip:
+		var out bytes.Buffer
+		writer := gzip.NewWriter(&out)
+		writer.Write(data)
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	}
+	return nil, ErrUnknownCodec
+}
+
+func decompress(codec byte, payload []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return payload, nil
+	case CodecZstd:
+		return zstdDecoder.DecodeAll(payload, nil)
+	case CodecGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		// The limit keeps a tiny frame from expanding into gigabytes
+		data, err := io.ReadAll(io.LimitReader(reader, MaxFramePayload+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > MaxFramePayload {
+			return nil, ErrFrameTooBig
+		}
+		return data, nil
+	}
+	return nil, ErrUnknownCodec
+}
+
+// Sends the content of r as a stream of binary frames, ended by an empty one
+func WriteStream(write func(frame []byte) error, codec byte, r io.Reader) error {
+	chunk := make([]byte, StreamChunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if writeErr := write(EncodeFrame(codec, chunk[:n])); writeErr != nil {
+				return writeErr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return write(EncodeFrame(CodecNone, nil))
+		}
+		if err != nil {
+			// The stream still has to be ended, or the other side would take the next frames as content
+			write(EncodeFrame(CodecNone, nil))
+			return err
+		}
+	}
+}
+
+// One frame read from the connection, Binary tells whether Data is a JSON line or a decompressed payload
+type Frame struct {
+	Binary bool
+	Data   []byte
+}
+
+type FrameReader struct {
+	reader *bufio.Reader
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{bufio.NewReader(r)}
+}
+
+func (f *FrameReader) ReadFrame() (Frame, error) {
+	first, err := f.reader.Peek(1)
+	if err != nil {
+		return Frame{}, err
+	}
+	if first[0] == FrameMarker {
+		data, err := f.readBinary()
+		return Frame{true, data}, err
+	}
+	line, err := f.readLine()
+	return Frame{false, line}, err
+}
+
+func (f *FrameReader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		part, err := f.reader.ReadSlice('\n')
+		line = append(line, part...)
+		if len(line) > MaxLineLength {
+			return nil, ErrFrameTooBig
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+}
+
+func (f *FrameReader) readBinary() ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(f.reader, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[2:])
+	if length > MaxFramePayload {
+		return nil, ErrFrameTooBig
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(f.reader, payload); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return payload, nil
+	}
+	return decompress(header[1], payload)
+}
+
+// Reader over the stream of binary frames coming next on the connection
+func (f *FrameReader) Stream() *FrameStream {
+	return &FrameStream{reader: f}
+}
+
+type FrameStream struct {
+	reader  *FrameReader
+	pending []byte
+	done    bool
+	err     error
+}
+
+func (s *FrameStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if s.err != nil {
+			return 0, s.err
+		}
+		frame, err := s.reader.ReadFrame()
+		if err == nil && !frame.Binary {
+			err = ErrExpectedBinary
+		}
+		// Only the empty frame ends the stream, a connection closed before it cut the content short
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			s.err = err
+			return 0, err
+		}
+		if len(frame.Data) == 0 {
+			s.done = true
+		}
+		s.pending = frame.Data
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Skips what the reader didn't consume, so the next frame on the connection is a command again
+func (s *FrameStream) Drain() error {
+	_, err := io.Copy(io.Discard, s)
+	return err
+}
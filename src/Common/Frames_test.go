@@ -0,0 +1,175 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func frameHeader(codec byte, length uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{FrameMarker, codec}, length)
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	compressible := bytes.Repeat([]byte("all work and no play "), 50000)
+	random := make([]byte, 100000)
+	rand.Read(random)
+	tests := []struct {
+		name string
+		data []byte
+		// Whether the frame should travel compressed when a codec is asked for
+		compressed bool
+	}{
+		{"empty", nil, false},
+		{"one byte", []byte("x"), false},
+		{"random", random, false},
+		{"compressible", compressible, true},
+		{"biggest payload", bytes.Repeat([]byte{'a'}, MaxFramePayload), true},
+	}
+	for _, codec := range []byte{CodecNone, CodecGzip, CodecZstd} {
+		for _, test := range tests {
+			t.Run(CodecName(codec)+"/"+test.name, func(t *testing.T) {
+				encoded := EncodeFrame(codec, test.data)
+				want := CodecNone
+				if test.compressed {
+					want = codec
+				}
+				if encoded[1] != want {
+					t.Errorf("sent with codec %s, want %s", CodecName(encoded[1]), CodecName(want))
+				}
+				if length := binary.BigEndian.Uint32(encoded[2:6]); int(length) != len(encoded)-frameHeaderSize || length > MaxFramePayload {
+					t.Errorf("header says %d bytes for a payload of %d", length, len(encoded)-frameHeaderSize)
+				}
+				frame, err := NewFrameReader(bytes.NewReader(encoded)).ReadFrame()
+				if err != nil {
+					t.Fatalf("ReadFrame: %v", err)
+				}
+				if !frame.Binary || !bytes.Equal(frame.Data, test.data) {
+					t.Errorf("read back %d bytes (binary %v), want %d", len(frame.Data), frame.Binary, len(test.data))
+				}
+			})
+		}
+	}
+}
+
+func TestFramesBetweenLines(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), StreamChunkSize/8+3)
+	var connection bytes.Buffer
+	connection.WriteString("{\"cmd\": \"first\"}\r\n")
+	err := WriteStream(func(frame []byte) error {
+		connection.Write(frame)
+		return nil
+	}, CodecZstd, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection.WriteString("{\"cmd\": \"last\"}\n")
+
+	reader := NewFrameReader(&connection)
+	if frame, err := reader.ReadFrame(); err != nil || frame.Binary || string(frame.Data) != `{"cmd": "first"}` {
+		t.Fatalf("first line: %q %v", frame.Data, err)
+	}
+	stream := reader.Stream()
+	received, err := io.ReadAll(stream)
+	if err != nil || !bytes.Equal(received, content) {
+		t.Fatalf("stream: %d bytes, %v, want %d bytes", len(received), err, len(content))
+	}
+	if frame, err := reader.ReadFrame(); err != nil || frame.Binary || string(frame.Data) != `{"cmd": "last"}` {
+		t.Fatalf("last line: %q %v", frame.Data, err)
+	}
+	if _, err := reader.ReadFrame(); err != io.EOF {
+		t.Errorf("after the last line: %v, want EOF", err)
+	}
+}
+
+func TestOversizedFrames(t *testing.T) {
+	var gzipBomb bytes.Buffer
+	writer := gzip.NewWriter(&gzipBomb)
+	writer.Write(make([]byte, MaxFramePayload+1))
+	writer.Close()
+	zstdBomb := zstdEncoder.EncodeAll(make([]byte, MaxFramePayload+1), nil)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"payload too long", append(frameHeader(CodecNone, MaxFramePayload+1), make([]byte, 16)...)},
+		{"biggest length", frameHeader(CodecNone, 0xffffffff)},
+		{"line too long", append(bytes.Repeat([]byte("a"), MaxLineLength+1), '\n')},
+		{"gzip expanding past the limit", append(frameHeader(CodecGzip, uint32(gzipBomb.Len())), gzipBomb.Bytes()...)},
+		{"zstd expanding past the limit", append(frameHeader(CodecZstd, uint32(len(zstdBomb))), zstdBomb...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame, err := NewFrameReader(bytes.NewReader(test.data)).ReadFrame()
+			if err == nil {
+				t.Fatalf("read a frame of %d bytes", len(frame.Data))
+			}
+			if len(frame.Data) > MaxFramePayload {
+				t.Errorf("returned %d bytes with the error", len(frame.Data))
+			}
+		})
+	}
+	// The length is checked before anything is allocated or read
+	if _, err := NewFrameReader(bytes.NewReader(frameHeader(CodecNone, MaxFramePayload+1))).ReadFrame(); !errors.Is(err, ErrFrameTooBig) {
+		t.Errorf("a frame announcing too much: %v, want ErrFrameTooBig", err)
+	}
+}
+
+func TestTruncatedFrames(t *testing.T) {
+	for _, codec := range []byte{CodecNone, CodecGzip, CodecZstd} {
+		encoded := EncodeFrame(codec, bytes.Repeat([]byte("truncated "), 100))
+		for cut := range len(encoded) {
+			_, err := NewFrameReader(bytes.NewReader(encoded[:cut])).ReadFrame()
+			if cut == 0 && err != io.EOF {
+				t.Errorf("%s, nothing sent: %v, want EOF", CodecName(codec), err)
+			}
+			if cut > 0 && err != io.ErrUnexpectedEOF {
+				t.Errorf("%s cut at %d: %v, want ErrUnexpectedEOF", CodecName(codec), cut, err)
+			}
+		}
+	}
+}
+
+func TestCorruptedFrames(t *testing.T) {
+	checksum := EncodeFrame(CodecGzip, bytes.Repeat([]byte("corrupted "), 100))
+	checksum[len(checksum)-5] ^= 0xff
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"unknown codec", append(frameHeader(7, 3), "abc"...)},
+		{"not gzip", append(frameHeader(CodecGzip, 3), "abc"...)},
+		{"not zstd", append(frameHeader(CodecZstd, 3), "abc"...)},
+		{"bad gzip checksum", checksum},
+	}
+	for _, test := range tests {
+		if _, err := NewFrameReader(bytes.NewReader(test.data)).ReadFrame(); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	// A stream cut before its empty frame is an error, not the end of the content
+	cut := append(EncodeFrame(CodecNone, []byte("part")), frameHeader(CodecNone, 10)...)
+	if _, err := io.ReadAll(NewFrameReader(bytes.NewReader(cut)).Stream()); err != io.ErrUnexpectedEOF {
+		t.Errorf("stream cut short: %v, want ErrUnexpectedEOF", err)
+	}
+	unended := EncodeFrame(CodecNone, []byte("part"))
+	if _, err := io.ReadAll(NewFrameReader(bytes.NewReader(unended)).Stream()); err != io.ErrUnexpectedEOF {
+		t.Errorf("stream without its empty frame: %v, want ErrUnexpectedEOF", err)
+	}
+	interrupted := append(EncodeFrame(CodecNone, []byte("part")), "{\"cmd\": \"next\"}\n"...)
+	stream := NewFrameReader(bytes.NewReader(interrupted)).Stream()
+	if _, err := io.ReadAll(stream); !errors.Is(err, ErrExpectedBinary) {
+		t.Errorf("a line in the middle of a stream: %v, want ErrExpectedBinary", err)
+	}
+	// Every read after the failure fails the same way
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, ErrExpectedBinary) {
+		t.Errorf("reading again after the failure: %v", err)
+	}
+}
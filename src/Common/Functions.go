@@ -11,6 +11,9 @@ import (
 
 const idFile = "./client_id.txt"
 
+// Where the web server listens, set when it starts. The links handed out to people point there
+var WebServerURL = "http://localhost:8080"
+
 func getHardwareInfo() string {
 	// grab MACs
 	macs := ""
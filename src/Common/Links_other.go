@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package common
+
+import "errors"
+
+var errLinksUnsupported = errors.New("hard links are not available on this system")
+
+func LinkCount(path string) (uint64, error) {
+	return 0, errLinksUnsupported
+}
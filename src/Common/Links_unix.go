@@ -0,0 +1,24 @@
+//go:build unix
+
+package common
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errLinksUnsupported = errors.New("hard links are not available on this system")
+
+// Number of hard links to the file at path
+func LinkCount(path string) (uint64, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, errLinksUnsupported
+	}
+	return uint64(stat.Nlink), nil
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package common
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Number of hard links to the file at path
+func LinkCount(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	var info windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(windows.Handle(file.Fd()), &info); err != nil {
+		return 0, err
+	}
+	return uint64(info.NumberOfLinks), nil
+}
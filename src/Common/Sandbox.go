@@ -0,0 +1,219 @@
+package common
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var ErrInvalidPath = errors.New("invalid path")
+
+// A folder that file operations can't get out of. Paths given by clients are relative to it: ".." and absolute
+// paths are refused, and os.Root refuses symlinks that lead outside of it
+type Sandbox struct {
+	Path string
+}
+
+func NewSandbox(folder string) Sandbox {
+	return Sandbox{Path: folder}
+}
+
+// Checks a path given by a client and returns it cleaned, "." being the root itself
+func CleanSandboxPath(name string) (string, error) {
+	// Windows clients send backslashes, and a backslash in a name would only be a trap on the other systems
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.ContainsRune(name, 0) || path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", ErrInvalidPath
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", ErrInvalidPath
+		}
+	}
+	return path.Clean("./" + name), nil
+}
+
+// The root is opened for each operation, so a folder deleted or created meanwhile is no problem
+func (s Sandbox) open() (*os.Root, error) {
+	if s.Path == "" {
+		return nil, ErrInvalidPath
+	}
+	if err := os.MkdirAll(s.Path, 0700); err != nil {
+		return nil, err
+	}
+	return os.OpenRoot(s.Path)
+}
+
+func (s Sandbox) OpenFile(name string, flag int, perm fs.FileMode) (*os.File, error) {
+	name, err := CleanSandboxPath(name)
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.OpenFile(name, flag, perm)
+}
+
+func (s Sandbox) Open(name string) (*os.File, error) {
+	return s.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (s Sandbox) ReadDir(name string) ([]os.DirEntry, error) {
+	folder, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer folder.Close()
+	return folder.ReadDir(-1)
+}
+
+func (s Sandbox) Stat(name string) (os.FileInfo, error) {
+	name, err := CleanSandboxPath(name)
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.Stat(name)
+}
+
+func (s Sandbox) Lstat(name string) (os.FileInfo, error) {
+	name, err := CleanSandboxPath(name)
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.Lstat(name)
+}
+
+func (s Sandbox) Mkdir(name string, perm fs.FileMode) error {
+	name, err := CleanSandboxPath(name)
+	if err != nil {
+		return err
+	}
+	root, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.Mkdir(name, perm)
+}
+
+func (s Sandbox) MkdirAll(name string, perm fs.FileMode) error {
+	name, err := CleanSandboxPath(name)
+	if err != nil {
+		return err
+	}
+	root, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.MkdirAll(name, perm)
+}
+
+func (s Sandbox) Remove(name string) error {
+	name, err := CleanSandboxPath(name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return ErrInvalidPath
+	}
+	root, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.Remove(name)
+}
+
+// Path on the real filesystem, for the tools that can't work through an os.Root (exec, a rename from another
+// folder). Every folder on the way is checked, so the result is only as safe as the folder is left untouched
+// until it is used
+func (s Sandbox) Resolve(name string) (string, error) {
+	name, err := CleanSandboxPath(name)
+	if err != nil {
+		return "", err
+	}
+	root, err := s.open()
+	if err != nil {
+		return "", err
+	}
+	defer root.Close()
+	folder, err := root.Open(path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	folder.Close()
+	// A symlink as the last element could still point anywhere
+	if info, err := root.Lstat(name); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		if _, err := root.Stat(name); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(s.Path, filepath.FromSlash(name)), nil
+}
+
+func (s Sandbox) RemoveAll(name string) error {
+	name, err := CleanSandboxPath(name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return ErrInvalidPath
+	}
+	root, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.RemoveAll(name)
+}
+
+func (s Sandbox) Rename(from, to string) error {
+	from, err := CleanSandboxPath(from)
+	if err != nil {
+		return err
+	}
+	to, err = CleanSandboxPath(to)
+	if err != nil {
+		return err
+	}
+	if from == "." || to == "." {
+		return ErrInvalidPath
+	}
+	root, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return root.Rename(from, to)
+}
+
+// Like fs.WalkDir, with the paths given to fn relative to the root
+func (s Sandbox) WalkDir(name string, fn fs.WalkDirFunc) error {
+	name, err := CleanSandboxPath(name)
+	if err != nil {
+		return err
+	}
+	root, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	return fs.WalkDir(root.FS(), name, fn)
+}
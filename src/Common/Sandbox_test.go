@@ -0,0 +1,198 @@
+package common
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Paths a client could send to get out of its folder
+var hostilePaths = []string{
+	"",
+	".",
+	"..",
+	"../",
+	"./..",
+	"a/../../b",
+	"a/b/../../..",
+	"inside/../../outside/secret.txt",
+	"/etc/passwd",
+	"//server/share/file",
+	"\\\\server\\share\\file",
+	"\\\\?\\C:\\Windows\\win.ini",
+	"C:\\Windows\\win.ini",
+	"C:/Windows/win.ini",
+	"C:secret.txt",
+	"..\\outside\\secret.txt",
+	"inside\\..\\..\\outside",
+	"inside.txt\x00.png",
+	"\x00",
+	"escape/secret.txt",
+	"escape",
+	"absolute",
+	"absolute/secret.txt",
+	"inside/escape/secret.txt",
+	"loop",
+	"loop/x",
+	"chain/secret.txt",
+	"inside.txt",
+	"inside/nested.txt",
+	"inside/./nested.txt",
+	"inside//nested.txt",
+	"...",
+	"a/.../b",
+	"%2e%2e/secret.txt",
+}
+
+func FuzzCleanSandboxPath(f *testing.F) {
+	for _, name := range hostilePaths {
+		f.Add(name)
+	}
+	root := filepath.Join(f.TempDir(), "root")
+	f.Fuzz(func(t *testing.T, name string) {
+		cleaned, err := CleanSandboxPath(name)
+		if err != nil {
+			if err != ErrInvalidPath {
+				t.Fatalf("CleanSandboxPath(%q) failed with %v, want ErrInvalidPath", name, err)
+			}
+			return
+		}
+		if cleaned == "" || strings.ContainsRune(cleaned, 0) || strings.Contains(cleaned, "\\") {
+			t.Fatalf("CleanSandboxPath(%q) = %q", name, cleaned)
+		}
+		if path.IsAbs(cleaned) || filepath.IsAbs(cleaned) || filepath.VolumeName(cleaned) != "" {
+			t.Fatalf("CleanSandboxPath(%q) = %q, an absolute path", name, cleaned)
+		}
+		if slices.Contains(strings.Split(cleaned, "/"), "..") {
+			t.Fatalf("CleanSandboxPath(%q) = %q, going up", name, cleaned)
+		}
+		if path.Clean(cleaned) != cleaned {
+			t.Fatalf("CleanSandboxPath(%q) = %q, not clean", name, cleaned)
+		}
+		if !within(root, filepath.Join(root, filepath.FromSlash(cleaned))) {
+			t.Fatalf("CleanSandboxPath(%q) = %q, outside of the root", name, cleaned)
+		}
+		// Cleaning is stable
+		if again, err := CleanSandboxPath(cleaned); err != nil || again != cleaned {
+			t.Fatalf("CleanSandboxPath(%q) = %q, %v after %q", cleaned, again, err, name)
+		}
+	})
+}
+
+func within(root, name string) bool {
+	relative, err := filepath.Rel(root, name)
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) && !filepath.IsAbs(relative)
+}
+
+// A sandbox with symlinks leading out of it, next to a folder it must never reach
+func hostileSandbox(tb testing.TB) (Sandbox, string) {
+	base := tb.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, folder := range []string{filepath.Join(root, "inside"), outside} {
+		if err := os.MkdirAll(folder, 0700); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(root, "inside.txt"):             "inside",
+		filepath.Join(root, "inside", "nested.txt"):   "nested",
+		filepath.Join(outside, "secret.txt"):          "secret",
+		filepath.Join(outside, "chain", "secret.txt"): "secret",
+	}
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(name), 0700)
+		if err := os.WriteFile(name, []byte(content), 0600); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(root, "escape"):           "../outside",
+		filepath.Join(root, "absolute"):         outside,
+		filepath.Join(root, "inside", "escape"): "../../outside",
+		filepath.Join(root, "loop"):             "loop",
+		filepath.Join(root, "chain"):            "inside/up",
+		filepath.Join(root, "inside", "up"):     "../../outside/chain",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, name); err != nil {
+			tb.Skip("symlinks are not available: " + err.Error())
+		}
+	}
+	return NewSandbox(root), outside
+}
+
+func outsideEntries(tb testing.TB, outside string) []string {
+	var entries []string
+	filepath.WalkDir(outside, func(name string, entry os.DirEntry, err error) error {
+		entries = append(entries, name)
+		return nil
+	})
+	return entries
+}
+
+func FuzzSandboxOpen(f *testing.F) {
+	for _, name := range hostilePaths {
+		f.Add(name)
+	}
+	sandbox, outside := hostileSandbox(f)
+	root, err := filepath.EvalSymlinks(sandbox.Path)
+	if err != nil {
+		f.Fatal(err)
+	}
+	var forbidden []os.FileInfo
+	for _, name := range outsideEntries(f, outside) {
+		info, err := os.Stat(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		forbidden = append(forbidden, info)
+	}
+	reaches_outside := func(info os.FileInfo) bool {
+		return slices.ContainsFunc(forbidden, func(outside os.FileInfo) bool { return os.SameFile(info, outside) })
+	}
+	before := outsideEntries(f, outside)
+
+	f.Fuzz(func(t *testing.T, name string) {
+		if file, err := sandbox.Open(name); err == nil {
+			info, statErr := file.Stat()
+			file.Close()
+			if statErr == nil && reaches_outside(info) {
+				t.Fatalf("Open(%q) reached %s outside of the sandbox", name, info.Name())
+			}
+		}
+		if info, err := sandbox.Stat(name); err == nil && reaches_outside(info) {
+			t.Fatalf("Stat(%q) reached %s outside of the sandbox", name, info.Name())
+		}
+		if resolved, err := sandbox.Resolve(name); err == nil {
+			if !within(sandbox.Path, resolved) {
+				t.Fatalf("Resolve(%q) = %q, outside of the sandbox", name, resolved)
+			}
+			if real, err := filepath.EvalSymlinks(resolved); err == nil && !within(root, real) {
+				t.Fatalf("Resolve(%q) = %q, leading to %q outside of the sandbox", name, resolved, real)
+			}
+		}
+
+		// Writing must not create anything outside either
+		if file, err := sandbox.OpenFile(path.Join(name, "created.txt"), os.O_CREATE|os.O_WRONLY, 0600); err == nil {
+			file.Close()
+		}
+		sandbox.MkdirAll(path.Join(name, "created"), 0700)
+		if after := outsideEntries(t, outside); !slices.Equal(before, after) {
+			t.Fatalf("writing under %q changed the folder outside of the sandbox: %v", name, after)
+		}
+	})
+}
+
+func TestSandboxWithoutPath(t *testing.T) {
+	sandbox := NewSandbox("")
+	if _, err := sandbox.Open("file.txt"); err != ErrInvalidPath {
+		t.Errorf("Open in a sandbox without path: %v, want ErrInvalidPath", err)
+	}
+	if err := sandbox.MkdirAll("folder", 0700); err != ErrInvalidPath {
+		t.Errorf("MkdirAll in a sandbox without path: %v, want ErrInvalidPath", err)
+	}
+}
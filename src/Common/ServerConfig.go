@@ -0,0 +1,83 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+const configFile = "res/config_files/server_config.json"
+
+// Port used by the TCP server when nothing else is configured
+const DefaultAPIPort = 5050
+
+type ServerConfig struct {
+	// Port the TCP server tries first, so firewalls and port forwards have something stable to target
+	API_Port int `json:"api_port"`
+	// If the preferred port is busy, fall back to the last used port and then to any free one
+	Allow_Dynamic_Port bool `json:"allow_dynamic_port"`
+	// Port the TCP server ended up on during the last run
+	Last_API_Port int `json:"last_api_port"`
+	// Deleted files stay in the trash this long before the janitor removes them
+	Trash_Retention_Days int `json:"trash_retention_days"`
+	// Previous versions kept for each overwritten file, 0 turns versioning off
+	Max_File_Versions int `json:"max_file_versions"`
+	// Previous versions older than this are removed by the janitor
+	Version_Retention_Days int `json:"version_retention_days"`
+	// Keeps the content of identical files once, in the blob store
+	Deduplicate_Files bool `json:"deduplicate_files"`
+}
+
+var Config = ServerConfig{
+	API_Port:               DefaultAPIPort,
+	Allow_Dynamic_Port:     true,
+	Trash_Retention_Days:   30,
+	Max_File_Versions:      5,
+	Version_Retention_Days: 90,
+	Deduplicate_Files:      true,
+}
+var configMutex sync.Mutex
+
+func LoadServerConfig() {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	file, err := os.ReadFile(configFile)
+	if err != nil {
+		err = os.MkdirAll("res/config_files", os.ModePerm)
+		if err != nil {
+			println("Could not create config_files directory: " + err.Error())
+		}
+		saveServerConfig()
+		return
+	}
+	if err := json.Unmarshal(file, &Config); err != nil {
+		println("Could not parse server config, using defaults: " + err.Error())
+	}
+	if Config.API_Port < 0 || Config.API_Port > 65535 {
+		println("Invalid api_port in server config, using the default one")
+		Config.API_Port = DefaultAPIPort
+	}
+}
+
+// Remembers the port the TCP server is listening on, so it can be reused on the next start
+func SetLastAPIPort(port int) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	if Config.Last_API_Port == port {
+		return
+	}
+	Config.Last_API_Port = port
+	saveServerConfig()
+}
+
+func saveServerConfig() {
+	data, err := json.MarshalIndent(Config, "", "  ")
+	if err != nil {
+		println("Could not marshal server config: " + err.Error())
+		return
+	}
+	err = os.WriteFile(configFile, data, 0644)
+	if err != nil {
+		println("Could not write server config to file: " + err.Error())
+	}
+}
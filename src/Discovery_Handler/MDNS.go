@@ -0,0 +1,403 @@
+package Discovery_Handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// DNS-SD service type the controllers advertise themselves under
+const ServiceType = "_homeserver._tcp"
+const domain = "local."
+const servicesEnumeration = "_services._dns-sd._udp." + domain
+
+// Records are announced with this TTL, goodbye packets use 0
+const recordTTL = 120
+
+// Standard mDNS group, used when the config doesn't say otherwise
+var DefaultGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+var wg sync.WaitGroup
+
+// Where the multicast traffic goes. The zero value means the standard mDNS group on the default interface,
+// tests can point it to the loopback interface and a private port instead
+type Config struct {
+	Interface *net.Interface
+	Group     *net.UDPAddr
+}
+
+// A controller, as seen on the network
+type Service struct {
+	Instance string            `json:"instance"`
+	Host     string            `json:"host"`
+	Port     int               `json:"port"`
+	Addrs    []net.IP          `json:"addresses"`
+	TXT      map[string]string `json:"txt"`
+}
+
+func (c Config) group() *net.UDPAddr {
+	if c.Group != nil {
+		return c.Group
+	}
+	return DefaultGroup
+}
+
+func serviceName() string {
+	return ServiceType + "." + domain
+}
+
+// Makes a string usable as a single DNS label
+func toLabel(s string) string {
+	s = strings.ReplaceAll(s, ".", "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
+
+// Starts answering mDNS queries for this controller until the context is cancelled.
+// The service is asked for on every answer, so the records always carry the live port
+func StartAdvertiser(ctx context.Context, config Config, service func() Service) error {
+	group := config.group()
+	conn, err := net.ListenMulticastUDP("udp4", config.Interface, group)
+	if err != nil {
+		return err
+	}
+	packetConn := ipv4.NewPacketConn(conn)
+	packetConn.SetMulticastLoopback(true)
+	packetConn.SetMulticastTTL(255)
+	if config.Interface != nil {
+		packetConn.SetMulticastInterface(config.Interface)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		// Tell the others to forget about us before leaving
+		if msg, err := buildResponse(service(), 0, 0); err == nil {
+			conn.WriteToUDP(msg, group)
+		}
+		conn.Close()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Unsolicited announcements, the TCP server may still be starting so they are delayed a bit
+		for _, delay := range []time.Duration{time.Second, 2 * time.Second} {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if msg, err := buildResponse(service(), 0, recordTTL); err == nil {
+				conn.WriteToUDP(msg, group)
+			}
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buffer := make([]byte, 9000)
+		for {
+			n, src, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			var parser dnsmessage.Parser
+			header, err := parser.Start(buffer[:n])
+			if err != nil || header.Response {
+				continue
+			}
+			current := service()
+			if !wantsService(&parser, current) {
+				continue
+			}
+			if src.Port != group.Port {
+				// Legacy one-shot query: the answer goes straight back to the asker, with its ID
+				msg, err := buildResponse(current, header.ID, 10)
+				if err == nil {
+					conn.WriteToUDP(msg, src)
+				}
+				continue
+			}
+			if msg, err := buildResponse(current, 0, recordTTL); err == nil {
+				conn.WriteToUDP(msg, group)
+			}
+		}
+	}()
+	return nil
+}
+
+func WaitForAdvertiser() {
+	wg.Wait()
+}
+
+// Checks if any of the questions is about this controller
+func wantsService(parser *dnsmessage.Parser, service Service) bool {
+	if service.Port == 0 {
+		// Nothing to advertise yet
+		return false
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return false
+	}
+	instance := instanceName(service)
+	for _, q := range questions {
+		name := q.Name.String()
+		switch {
+		case strings.EqualFold(name, serviceName()), strings.EqualFold(name, servicesEnumeration):
+			if q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL {
+				return true
+			}
+		case strings.EqualFold(name, instance):
+			if q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeTXT || q.Type == dnsmessage.TypeALL {
+				return true
+			}
+		case strings.EqualFold(name, service.Host):
+			if q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func instanceName(service Service) string {
+	return toLabel(service.Instance) + "." + serviceName()
+}
+
+func buildResponse(service Service, id uint16, ttl uint32) ([]byte, error) {
+	builder := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	builder.EnableCompression()
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	service_name, err := dnsmessage.NewName(serviceName())
+	if err != nil {
+		return nil, err
+	}
+	instance, err := dnsmessage.NewName(instanceName(service))
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(service.Host)
+	if err != nil {
+		return nil, err
+	}
+	enumeration, err := dnsmessage.NewName(servicesEnumeration)
+	if err != nil {
+		return nil, err
+	}
+
+	header := func(name dnsmessage.Name) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+	if err := builder.PTRResource(header(enumeration), dnsmessage.PTRResource{PTR: service_name}); err != nil {
+		return nil, err
+	}
+	if err := builder.PTRResource(header(service_name), dnsmessage.PTRResource{PTR: instance}); err != nil {
+		return nil, err
+	}
+	if err := builder.SRVResource(header(instance), dnsmessage.SRVResource{Target: host, Port: uint16(service.Port)}); err != nil {
+		return nil, err
+	}
+	var txt []string
+	for key, value := range service.TXT {
+		txt = append(txt, key+"="+value)
+	}
+	if len(txt) == 0 {
+		txt = []string{""}
+	}
+	if err := builder.TXTResource(header(instance), dnsmessage.TXTResource{TXT: txt}); err != nil {
+		return nil, err
+	}
+	for _, ip := range service.Addrs {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			continue
+		}
+		var a dnsmessage.AResource
+		copy(a.A[:], ip4)
+		if err := builder.AResource(header(host), a); err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
+
+// Asks the network for other controllers and collects the answers until the timeout runs out
+func Browse(ctx context.Context, config Config, timeout time.Duration) ([]Service, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	packetConn := ipv4.NewPacketConn(conn)
+	packetConn.SetMulticastLoopback(true)
+	if config.Interface != nil {
+		if err := packetConn.SetMulticastInterface(config.Interface); err != nil {
+			return nil, err
+		}
+	}
+
+	query, err := buildQuery()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(query, config.group()); err != nil {
+		return nil, fmt.Errorf("unable to send mDNS query: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	found := map[string]*Service{}
+	hosts := map[string][]net.IP{}
+	buffer := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			break
+		}
+		parseResponse(buffer[:n], found, hosts)
+	}
+
+	var results []Service
+	for _, service := range found {
+		if service.Port == 0 {
+			continue
+		}
+		service.Addrs = hosts[strings.ToLower(service.Host)]
+		results = append(results, *service)
+	}
+	return results, ctx.Err()
+}
+
+func buildQuery() ([]byte, error) {
+	name, err := dnsmessage.NewName(serviceName())
+	if err != nil {
+		return nil, err
+	}
+	builder := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{ID: 1})
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	return builder.Finish()
+}
+
+func parseResponse(msg []byte, found map[string]*Service, hosts map[string][]net.IP) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(msg)
+	if err != nil || !header.Response {
+		return
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return
+	}
+	get := func(name string) *Service {
+		key := strings.ToLower(name)
+		if found[key] == nil {
+			found[key] = &Service{Instance: strings.TrimSuffix(name, "."+serviceName()), TXT: map[string]string{}}
+		}
+		return found[key]
+	}
+	for {
+		resource, err := parser.Answer()
+		if err != nil {
+			break
+		}
+		name := resource.Header.Name.String()
+		switch body := resource.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if strings.EqualFold(name, serviceName()) {
+				get(body.PTR.String())
+			}
+		case *dnsmessage.SRVResource:
+			if strings.HasSuffix(strings.ToLower(name), serviceName()) {
+				service := get(name)
+				service.Host = body.Target.String()
+				service.Port = int(body.Port)
+			}
+		case *dnsmessage.TXTResource:
+			if strings.HasSuffix(strings.ToLower(name), serviceName()) {
+				service := get(name)
+				for _, entry := range body.TXT {
+					key, value, _ := strings.Cut(entry, "=")
+					if key != "" {
+						service.TXT[key] = value
+					}
+				}
+			}
+		case *dnsmessage.AResource:
+			key := strings.ToLower(name)
+			hosts[key] = append(hosts[key], net.IP(body.A[:]))
+		}
+	}
+}
+
+// Addresses other devices can reach this machine on
+func LocalAddresses(iface *net.Interface) []net.IP {
+	var addrs []net.Addr
+	var err error
+	if iface != nil {
+		addrs, err = iface.Addrs()
+	} else {
+		addrs, err = net.InterfaceAddrs()
+	}
+	if err != nil {
+		return nil
+	}
+	var result []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		if iface == nil && ipNet.IP.IsLoopback() {
+			continue
+		}
+		result = append(result, ipNet.IP.To4())
+	}
+	return result
+}
+
+// Host name used in the SRV record, unique per controller
+func HostName(uid string) string {
+	if len(uid) > 12 {
+		uid = uid[:12]
+	}
+	return "homeserver-" + uid + "." + domain
+}
+
+func TXTRecords(uid, serverName string, port, protocolVersion int) map[string]string {
+	return map[string]string{
+		"server_uid":       uid,
+		"server_name":      serverName,
+		"api_port":         strconv.Itoa(port),
+		"protocol_version": strconv.Itoa(protocolVersion),
+	}
+}
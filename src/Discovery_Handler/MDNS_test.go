@@ -0,0 +1,83 @@
+package Discovery_Handler
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// Loopback interface that can carry multicast, the test is skipped without one
+func loopbackConfig(t *testing.T) Config {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Skip("unable to list the interfaces: " + err.Error())
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 && iface.Flags&net.FlagUp != 0 {
+			// A private port keeps the test away from a real mDNS responder
+			return Config{Interface: &iface, Group: &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 35353}}
+		}
+	}
+	t.Skip("no loopback interface")
+	return Config{}
+}
+
+func TestAdvertiseAndBrowseOnLoopback(t *testing.T) {
+	config := loopbackConfig(t)
+	advertised := Service{
+		Instance: "Test controller abcdef12",
+		Host:     HostName("abcdef1234567890"),
+		Port:     5050,
+		Addrs:    []net.IP{net.IPv4(127, 0, 0, 1)},
+		TXT:      TXTRecords("abcdef1234567890", "Test controller", 5050, 16),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := StartAdvertiser(ctx, config, func() Service { return advertised }); err != nil {
+		cancel()
+		t.Skip("multicast is not available on loopback: " + err.Error())
+	}
+	defer WaitForAdvertiser()
+	defer cancel()
+
+	services, err := Browse(context.Background(), config, 1500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Browse: %v", err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("found %d services, want 1: %+v", len(services), services)
+	}
+	found := services[0]
+	if found.Instance != "Test controller abcdef12" || found.Port != 5050 || found.Host != advertised.Host {
+		t.Errorf("found %+v, want %+v", found, advertised)
+	}
+	if found.TXT["server_uid"] != "abcdef1234567890" || found.TXT["api_port"] != "5050" || found.TXT["protocol_version"] != "16" {
+		t.Errorf("TXT records are %v", found.TXT)
+	}
+	if len(found.Addrs) != 1 || !found.Addrs[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("addresses are %v, want 127.0.0.1", found.Addrs)
+	}
+}
+
+func TestBrowseWithoutControllers(t *testing.T) {
+	config := loopbackConfig(t)
+	config.Group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 35354}
+	services, err := Browse(context.Background(), config, 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Browse: %v", err)
+	}
+	if len(services) != 0 {
+		t.Errorf("found %+v on a group nobody advertises on", services)
+	}
+}
+
+func TestBrowseStopsWithContext(t *testing.T) {
+	config := loopbackConfig(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	Browse(ctx, config, 5*time.Second)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Browse took %s after its context ended", elapsed)
+	}
+}
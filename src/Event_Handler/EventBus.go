@@ -0,0 +1,144 @@
+package Event_Handler
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Topics published by the server
+const (
+	UserRequested  = "user.requested"
+	UserAccepted   = "user.accepted"
+	UserAdded      = "user.added"
+	ScriptFinished = "script.finished"
+	FileChanged    = "file.changed"
+	ServerStopping = "server.stopping"
+)
+
+// Default number of events a subscriber can fall behind before new ones get dropped
+const DefaultBufferSize = 64
+
+type Event struct {
+	Topic    string    `json:"topic"`
+	Sequence uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Data     any       `json:"data"`
+	// Only this user (and the admins) may see the event, empty means everyone
+	Username string `json:"-"`
+	// Only admins may see the event
+	Admin_only bool `json:"-"`
+}
+
+// A subscriber's view of the bus. Events are buffered, when the buffer is full new events are
+// dropped and counted, so a slow consumer never blocks the publishers
+type Subscription struct {
+	C       chan Event
+	mutex   sync.Mutex
+	topics  map[string]bool
+	dropped uint64
+}
+
+var subscribers = map[*Subscription]bool{}
+var busMutex sync.Mutex
+var sequence uint64
+
+func Subscribe(bufferSize int) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	subscription := &Subscription{
+		C:      make(chan Event, bufferSize),
+		topics: map[string]bool{},
+	}
+	busMutex.Lock()
+	subscribers[subscription] = true
+	busMutex.Unlock()
+	return subscription
+}
+
+// Removes the subscription from the bus. Already buffered events can still be read from C
+func Unsubscribe(subscription *Subscription) {
+	busMutex.Lock()
+	delete(subscribers, subscription)
+	busMutex.Unlock()
+}
+
+// Hands the event to every matching subscriber. Sequence numbers are given under the same lock,
+// so every subscriber sees the events in increasing order
+func Publish(event Event) {
+	busMutex.Lock()
+	defer busMutex.Unlock()
+	sequence++
+	event.Sequence = sequence
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for subscription := range subscribers {
+		if !subscription.Matches(event.Topic) {
+			continue
+		}
+		select {
+		case subscription.C <- event:
+		default:
+			subscription.mutex.Lock()
+			subscription.dropped++
+			subscription.mutex.Unlock()
+		}
+	}
+}
+
+// Topic filters are either exact ("script.finished"), a prefix ("user.*") or everything ("*")
+func (s *Subscription) AddTopics(topics ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, topic := range topics {
+		s.topics[topic] = true
+	}
+}
+
+// Removes the given filters, or all of them when called without arguments
+func (s *Subscription) RemoveTopics(topics ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(topics) == 0 {
+		s.topics = map[string]bool{}
+		return
+	}
+	for _, topic := range topics {
+		delete(s.topics, topic)
+	}
+}
+
+func (s *Subscription) Topics() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := []string{}
+	for topic := range s.topics {
+		result = append(result, topic)
+	}
+	return result
+}
+
+func (s *Subscription) Matches(topic string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for filter := range s.topics {
+		if filter == "*" || filter == topic {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(filter, "*"); ok && strings.HasPrefix(topic, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns how many events were dropped since the last call
+func (s *Subscription) TakeDropped() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dropped := s.dropped
+	s.dropped = 0
+	return dropped
+}
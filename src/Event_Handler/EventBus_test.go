@@ -0,0 +1,138 @@
+package Event_Handler
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestTopicFilters(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"script.finished", "script.finished", true},
+		{"script.finished", "script.started", false},
+		{"user.*", "user.added", true},
+		{"user.*", "user.", true},
+		{"user.*", "users.added", false},
+		{"user.*", "user", false},
+		{"*", "server.stopping", true},
+		{"user*", "users.added", true},
+		{"", "user.added", false},
+	}
+	for _, test := range tests {
+		subscription := &Subscription{topics: map[string]bool{}}
+		subscription.AddTopics(test.filter)
+		if subscription.Matches(test.topic) != test.match {
+			t.Errorf("%q matching %q: %v, want %v", test.filter, test.topic, !test.match, test.match)
+		}
+	}
+}
+
+func TestTopics(t *testing.T) {
+	subscription := Subscribe(1)
+	defer Unsubscribe(subscription)
+	subscription.AddTopics("user.*", "script.finished", "user.*")
+	topics := subscription.Topics()
+	slices.Sort(topics)
+	if !slices.Equal(topics, []string{"script.finished", "user.*"}) {
+		t.Errorf("topics %v", topics)
+	}
+	subscription.RemoveTopics("user.*", "unknown")
+	if topics := subscription.Topics(); !slices.Equal(topics, []string{"script.finished"}) {
+		t.Errorf("topics %v after removing user.*", topics)
+	}
+	subscription.AddTopics("file.changed")
+	subscription.RemoveTopics()
+	if topics := subscription.Topics(); len(topics) != 0 {
+		t.Errorf("topics %v after removing all of them", topics)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	matching := Subscribe(0)
+	defer Unsubscribe(matching)
+	matching.AddTopics("test.publish.*")
+	other := Subscribe(0)
+	defer Unsubscribe(other)
+	other.AddTopics("test.other")
+	if cap(matching.C) != DefaultBufferSize {
+		t.Errorf("buffer of %d events, want %d", cap(matching.C), DefaultBufferSize)
+	}
+
+	Publish(Event{Topic: "test.publish.one", Data: "first"})
+	Publish(Event{Topic: "test.publish.two", Data: "second"})
+	first, second := <-matching.C, <-matching.C
+	if first.Data != "first" || second.Data != "second" || second.Sequence <= first.Sequence {
+		t.Errorf("received %+v then %+v", first, second)
+	}
+	if first.Time.IsZero() {
+		t.Error("the event has no time")
+	}
+	if len(other.C) != 0 {
+		t.Errorf("the other subscriber received %+v", <-other.C)
+	}
+
+	// What is buffered stays readable, nothing new comes
+	Publish(Event{Topic: "test.publish.three"})
+	Unsubscribe(matching)
+	Publish(Event{Topic: "test.publish.four"})
+	if len(matching.C) != 1 || (<-matching.C).Topic != "test.publish.three" {
+		t.Error("unsubscribing lost the buffered event or let a new one in")
+	}
+}
+
+// A slow subscriber loses the new events and is told how many, the publishers never wait for it
+func TestSlowSubscriber(t *testing.T) {
+	subscription := Subscribe(2)
+	defer Unsubscribe(subscription)
+	subscription.AddTopics("test.slow")
+	for range 5 {
+		Publish(Event{Topic: "test.slow"})
+	}
+	first, second := <-subscription.C, <-subscription.C
+	if second.Sequence != first.Sequence+1 {
+		t.Errorf("kept events %d and %d, want the first two", first.Sequence, second.Sequence)
+	}
+	if dropped := subscription.TakeDropped(); dropped != 3 {
+		t.Errorf("%d events dropped, want 3", dropped)
+	}
+	if dropped := subscription.TakeDropped(); dropped != 0 {
+		t.Errorf("%d events dropped after the count was taken", dropped)
+	}
+}
+
+// However many publishers there are, every subscriber sees the sequence go up
+func TestConcurrentPublishers(t *testing.T) {
+	const publishers, events = 8, 100
+	subscriptions := make([]*Subscription, 3)
+	for i := range subscriptions {
+		subscriptions[i] = Subscribe(publishers * events)
+		subscriptions[i].AddTopics("test.concurrent")
+		defer Unsubscribe(subscriptions[i])
+	}
+	var wait sync.WaitGroup
+	for range publishers {
+		wait.Go(func() {
+			for range events {
+				Publish(Event{Topic: "test.concurrent"})
+			}
+		})
+	}
+	wait.Wait()
+	for i, subscription := range subscriptions {
+		if len(subscription.C) != publishers*events {
+			t.Fatalf("subscriber %d received %d events, want %d", i, len(subscription.C), publishers*events)
+		}
+		last := uint64(0)
+		for range publishers * events {
+			event := <-subscription.C
+			if event.Sequence <= last {
+				t.Fatalf("subscriber %d received %d after %d", i, event.Sequence, last)
+			}
+			last = event.Sequence
+		}
+	}
+}
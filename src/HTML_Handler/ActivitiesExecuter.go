@@ -1,6 +1,7 @@
 package HTML_Handler
 
 import (
+	"ServerController/src/Event_Handler"
 	"encoding/json"
 	"net/http"
 )
@@ -44,6 +45,10 @@ func handleShutdownActivity(w http.ResponseWriter, r *http.Request) {
 		w.Write(res)
 		return
 	}
+	Event_Handler.Publish(Event_Handler.Event{
+		Topic: Event_Handler.ServerStopping,
+		Data:  map[string]string{"reason": "shutdown"},
+	})
 	if webHosterRunning != nil {
 		webHosterRunning <- false
 	}
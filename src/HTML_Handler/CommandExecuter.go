@@ -1,8 +1,13 @@
 package HTML_Handler
 
 import (
+	"ServerController/src/API_Handler"
+	common "ServerController/src/Common"
+	"ServerController/src/Discovery_Handler"
 	"ServerController/src/User_Handler"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -27,6 +32,17 @@ func handleLoginCommand(w http.ResponseWriter, r *http.Request, parameters []str
 		return
 	}
 	if User_Handler.Authenticate_user(parameters[0], parameters[1]) {
+		// The username cookie only tells the page who is logged, the session token is what proves it
+		token, expires_at := User_Handler.Create_token(parameters[0])
+		http.SetCookie(w, &http.Cookie{
+			Name:     "SVC_session",
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   false,
+			SameSite: http.SameSiteStrictMode,
+			Expires:  expires_at,
+		})
 		http.SetCookie(w, &http.Cookie{
 			Name:     "SVC_username",
 			Value:    parameters[0],
@@ -54,6 +70,18 @@ func handleLoginCommand(w http.ResponseWriter, r *http.Request, parameters []str
 
 func handleLogOutCommand(w http.ResponseWriter, r *http.Request, parameters []string) {
 	w.Header().Set("Content-Type", "application/json")
+	if session, err := r.Cookie("SVC_session"); err == nil {
+		User_Handler.Revoke_token(session.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "SVC_session",
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  time.Unix(0, 0),
+	})
 	http.SetCookie(w, &http.Cookie{
 		Name:     "SVC_username",
 		Value:    "",
@@ -135,7 +163,7 @@ func handleWhoAmICommand(w http.ResponseWriter, r *http.Request, parameters []st
 }
 
 func handleAddUserCommand(w http.ResponseWriter, r *http.Request, parameters []string) {
-	_, err := r.Cookie("SVC_username")
+	cookie, err := r.Cookie("SVC_username")
 	if err != nil {
 		// Cookie doesn't exist - user is not logged in
 		w.WriteHeader(401) // Unauthorized
@@ -179,12 +207,150 @@ func handleAddUserCommand(w http.ResponseWriter, r *http.Request, parameters []s
 	}
 	w.WriteHeader(200)
 	var results commandResults
-	if User_Handler.Add_user(parameters[0], parameters[1], is_admin, admin_grade) {
+	if err := User_Handler.Add_user(parameters[0], parameters[1], is_admin, admin_grade, cookie.Value); err == nil {
 		results.Status = "success"
 		results.Message = "User added successfully"
-	} else {
+	} else if errors.Is(err, User_Handler.ErrUserExists) {
 		results.Status = "fail"
 		results.Message = "User already exists"
+	} else {
+		results.Status = "fail"
+		results.Message = err.Error()
+	}
+	res, _ := json.Marshal(results)
+	w.Write(res)
+}
+
+func handleDiscoverCommand(w http.ResponseWriter, r *http.Request, parameters []string) {
+	w.Header().Set("Content-Type", "application/json")
+	if !user_is_logged(r) {
+		w.WriteHeader(401)
+		res, _ := json.Marshal(commandResults{
+			Status:  "fail",
+			Message: "Not logged in",
+		})
+		w.Write(res)
+		return
+	}
+	timeout := 2
+	if len(parameters) > 0 {
+		parsed, err := strconv.Atoi(parameters[0])
+		if err != nil || parsed < 1 || parsed > 10 {
+			w.WriteHeader(400)
+			res, _ := json.Marshal(commandResults{
+				Status:  "fail",
+				Message: "The timeout must be a number of seconds between 1 and 10",
+			})
+			w.Write(res)
+			return
+		}
+		timeout = parsed
+	}
+	services, err := Discovery_Handler.Browse(r.Context(), Discovery_Handler.Config{}, time.Duration(timeout)*time.Second)
+	if err != nil && len(services) == 0 {
+		res, _ := json.Marshal(commandResults{
+			Status:  "fail",
+			Message: "Unable to search the network: " + err.Error(),
+		})
+		w.Write(res)
+		return
+	}
+	type discoverResult struct {
+		Status  string   `json:"status"`
+		Message []string `json:"message"`
+	}
+	var res discoverResult
+	res.Status = "success"
+	// Our own answers come back through the multicast loopback
+	own_uid := common.GetOrCreateID()
+	for _, service := range services {
+		if service.TXT["server_uid"] == own_uid {
+			continue
+		}
+		line := service.Instance + " : port " + strconv.Itoa(service.Port)
+		for _, addr := range service.Addrs {
+			line += " " + addr.String()
+		}
+		res.Message = append(res.Message, line)
+	}
+	if len(res.Message) == 0 {
+		res.Message = []string{"No other controllers found"}
+	}
+	data, _ := json.Marshal(res)
+	w.Write(data)
+}
+
+func handleListConnectionsCommand(w http.ResponseWriter, r *http.Request, parameters []string) {
+	w.Header().Set("Content-Type", "application/json")
+	if !user_is_admin(r) {
+		w.WriteHeader(401)
+		res, _ := json.Marshal(commandResults{
+			Status:  "fail",
+			Message: "Only admins can see the connections",
+		})
+		w.Write(res)
+		return
+	}
+	type connectionsResult struct {
+		Status  string   `json:"status"`
+		Message []string `json:"message"`
+	}
+	var res connectionsResult
+	res.Status = "success"
+	for _, connection := range API_Handler.List_connections() {
+		username := connection.Username
+		if username == "" {
+			username = "(not logged in)"
+		}
+		line := fmt.Sprintf("#%d %s %s %s, connected %s ago, %d B in / %d B out",
+			connection.ID, connection.Transport, connection.Remote_Address, username,
+			time.Since(connection.Connected_At).Round(time.Second), connection.Bytes_In, connection.Bytes_Out)
+		if connection.Client != "" {
+			line += ", client " + connection.Client
+		}
+		if connection.Last_Command != "" {
+			line += ", last command " + connection.Last_Command
+		}
+		res.Message = append(res.Message, line)
+	}
+	if len(res.Message) == 0 {
+		res.Message = []string{"No open connections"}
+	}
+	data, _ := json.Marshal(res)
+	w.Write(data)
+}
+
+func handleKickConnectionCommand(w http.ResponseWriter, r *http.Request, parameters []string) {
+	w.Header().Set("Content-Type", "application/json")
+	if !user_is_admin(r) {
+		w.WriteHeader(401)
+		res, _ := json.Marshal(commandResults{
+			Status:  "fail",
+			Message: "Only admins can close connections",
+		})
+		w.Write(res)
+		return
+	}
+	if len(parameters) != 1 {
+		w.WriteHeader(400)
+		res, _ := json.Marshal(commandResults{
+			Status:  "fail",
+			Message: "Invalid number of parameters : kick_connection [connection_id]",
+		})
+		w.Write(res)
+		return
+	}
+	id, err := strconv.ParseUint(parameters[0], 10, 64)
+	var results commandResults
+	if err != nil {
+		results.Status = "fail"
+		results.Message = "Invalid connection id"
+	} else if err := API_Handler.Kick_connection(id); err != nil {
+		results.Status = "fail"
+		results.Message = "Unknown connection"
+	} else {
+		results.Status = "success"
+		results.Message = "Connection closed"
 	}
 	res, _ := json.Marshal(results)
 	w.Write(res)
@@ -0,0 +1,267 @@
+package HTML_Handler
+
+import (
+	"ServerController/src/API_Handler"
+	"ServerController/src/User_Handler"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const restPrefix = "/api/v1"
+
+// Page size used when the client doesn't ask for one, and the biggest it may ask for
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+type restAuth int
+
+const (
+	restPublic restAuth = iota
+	restUser
+	restAdmin
+)
+
+type restParameter struct {
+	name        string
+	description string
+	kind        string // OpenAPI type: string, integer or boolean
+	required    bool
+}
+
+// One entry of the REST API. The same table registers the handlers and generates the OpenAPI document
+type restRoute struct {
+	method      string
+	path        string
+	summary     string
+	auth        restAuth
+	query       []restParameter
+	body        string // Description of the request body, empty if there is none
+	rawBody     bool   // The body is the raw file content instead of JSON
+	success     int
+	handler     func(http.ResponseWriter, *http.Request, *restSession)
+	paginated   bool
+	description string
+}
+
+// Who is calling, taken from the bearer token
+type restSession struct {
+	username string
+	is_admin bool
+}
+
+type restPage struct {
+	Items    any `json:"items"`
+	Page     int `json:"page"`
+	Per_Page int `json:"per_page"`
+	Total    int `json:"total"`
+}
+
+var restRoutes []restRoute
+
+var pathParameter = regexp.MustCompile(`\{(\w+)\}`)
+
+func registerRESTRoutes() {
+	for _, route := range restRoutes {
+		http.HandleFunc(route.method+" "+restPrefix+route.path, route.serve)
+	}
+}
+
+func (route restRoute) serve(w http.ResponseWriter, r *http.Request) {
+	wg.Add(1)
+	defer wg.Done()
+
+	w.Header().Set("Content-Type", "application/json")
+	var session *restSession
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		if username, valid := User_Handler.Token_user(strings.TrimSpace(token)); valid {
+			session = &restSession{username, User_Handler.LoadedUsers[username].Admin}
+		}
+	}
+	if route.auth != restPublic && session == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+Server_name+`"`)
+		writeRESTError(w, http.StatusUnauthorized, "Missing or invalid bearer token")
+		return
+	}
+	if route.auth == restAdmin && !session.is_admin {
+		writeRESTError(w, http.StatusForbidden, "Only admins have access to this functionality")
+		return
+	}
+	route.handler(w, r, session)
+}
+
+func writeREST(w http.ResponseWriter, status int, value any) {
+	w.WriteHeader(status)
+	if value == nil {
+		return
+	}
+	res, _ := json.Marshal(value)
+	w.Write(res)
+}
+
+func writeRESTError(w http.ResponseWriter, status int, message string) {
+	writeREST(w, status, commandResults{
+		Status:  "fail",
+		Message: message,
+	})
+}
+
+// Decodes the JSON body into value, answering with the right error when it can't
+func readRESTBody(w http.ResponseWriter, r *http.Request, value any) bool {
+	const maxBodySize = 10 * 1024 // 10KB limit, same as /api/command
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err := decoder.Decode(value); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeRESTError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		} else {
+			writeRESTError(w, http.StatusBadRequest, "Invalid JSON body: "+err.Error())
+		}
+		return false
+	}
+	return true
+}
+
+func readRawBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, bool) {
+	content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeRESTError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		} else {
+			writeRESTError(w, http.StatusBadRequest, "Error reading request body")
+		}
+		return nil, false
+	}
+	return content, true
+}
+
+// Cuts the requested page out of items, using the page and per_page query parameters
+func paginate[T any](w http.ResponseWriter, r *http.Request, items []T) (restPage, bool) {
+	page, per_page := 1, defaultPageSize
+	if value := r.URL.Query().Get("page"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			writeRESTError(w, http.StatusBadRequest, "page must be a positive number")
+			return restPage{}, false
+		}
+		page = parsed
+	}
+	if value := r.URL.Query().Get("per_page"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxPageSize {
+			writeRESTError(w, http.StatusBadRequest, "per_page must be between 1 and "+strconv.Itoa(maxPageSize))
+			return restPage{}, false
+		}
+		per_page = parsed
+	}
+	start := min((page-1)*per_page, len(items))
+	end := min(start+per_page, len(items))
+	return restPage{
+		Items:    items[start:end],
+		Page:     page,
+		Per_Page: per_page,
+		Total:    len(items),
+	}, true
+}
+
+var paginationParameters = []restParameter{
+	{"page", "Page number, starting at 1", "integer", false},
+	{"per_page", "Items per page, at most " + strconv.Itoa(maxPageSize), "integer", false},
+}
+
+// OpenAPI 3 description of every route in restRoutes
+func openAPIDocument() map[string]any {
+	paths := map[string]map[string]any{}
+	for _, route := range restRoutes {
+		full := restPrefix + route.path
+		if paths[full] == nil {
+			paths[full] = map[string]any{}
+		}
+
+		var parameters []map[string]any
+		for _, match := range pathParameter.FindAllStringSubmatch(route.path, -1) {
+			parameters = append(parameters, map[string]any{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]string{"type": "string"},
+			})
+		}
+		query := route.query
+		if route.paginated {
+			query = append(query, paginationParameters...)
+		}
+		for _, parameter := range query {
+			parameters = append(parameters, map[string]any{
+				"name":        parameter.name,
+				"in":          "query",
+				"description": parameter.description,
+				"required":    parameter.required,
+				"schema":      map[string]string{"type": parameter.kind},
+			})
+		}
+
+		responses := map[string]any{
+			strconv.Itoa(route.success): map[string]string{"description": http.StatusText(route.success)},
+			"400":                       map[string]string{"description": "Invalid request"},
+		}
+		operation := map[string]any{
+			"summary":     route.summary,
+			"operationId": strings.ToLower(route.method) + pathParameter.ReplaceAllString(strings.ReplaceAll(route.path, "/", "_"), "by_$1"),
+			"responses":   responses,
+		}
+		if route.description != "" {
+			operation["description"] = route.description
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if route.body != "" {
+			content_type := "application/json"
+			schema := map[string]string{"type": "object"}
+			if route.rawBody {
+				content_type = "application/octet-stream"
+				schema = map[string]string{"type": "string", "format": "binary"}
+			}
+			operation["requestBody"] = map[string]any{
+				"description": route.body,
+				"required":    true,
+				"content":     map[string]any{content_type: map[string]any{"schema": schema}},
+			}
+		}
+		if route.auth != restPublic {
+			operation["security"] = []map[string][]string{{"bearerAuth": {}}}
+			responses["401"] = map[string]string{"description": "Missing or invalid bearer token"}
+			responses["403"] = map[string]string{"description": "Not allowed for this user"}
+		}
+		if pathParameter.MatchString(route.path) {
+			responses["404"] = map[string]string{"description": "Not found"}
+		}
+		paths[full][strings.ToLower(route.method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   Server_name + " API",
+			"version": "v1 (TCP protocol " + strconv.Itoa(API_Handler.ProtocolVersion) + ")",
+		},
+		"components": map[string]any{
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"paths": paths,
+	}
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request, session *restSession) {
+	writeREST(w, http.StatusOK, openAPIDocument())
+}
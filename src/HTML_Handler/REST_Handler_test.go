@@ -0,0 +1,201 @@
+package HTML_Handler
+
+import (
+	"ServerController/src/User_Handler"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Every REST route on a fresh storage with root as the only, admin, user. Gives root's token
+func restServer(t *testing.T) (*http.ServeMux, string) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	os.MkdirAll("res/config_files", 0700)
+	users := User_Handler.LoadedUsers
+	t.Cleanup(func() { User_Handler.LoadedUsers = users })
+	User_Handler.LoadedUsers = map[string]User_Handler.User{"root": {Username: "root", Admin: true}}
+	mux := http.NewServeMux()
+	for _, route := range restRoutes {
+		mux.HandleFunc(route.method+" "+restPrefix+route.path, route.serve)
+	}
+	token, _ := User_Handler.Create_token("root")
+	return mux, token
+}
+
+func restRequest(t *testing.T, mux *http.ServeMux, method, path, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, restPrefix+path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func decodeREST(t *testing.T, w *httptest.ResponseRecorder, value any) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), value); err != nil {
+		t.Fatalf("answer %q: %v", w.Body.String(), err)
+	}
+}
+
+func TestRESTNeedsAToken(t *testing.T) {
+	mux, token := restServer(t)
+	for _, bearer := range []string{"", "forged", token + "x"} {
+		w := restRequest(t, mux, "GET", "/files", bearer, "")
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q: %d, want 401 with a challenge", bearer, w.Code)
+		}
+	}
+	if w := restRequest(t, mux, "GET", "/openapi.json", "", ""); w.Code != http.StatusOK {
+		t.Errorf("the public document: %d", w.Code)
+	}
+	if w := restRequest(t, mux, "GET", "/users", token, ""); w.Code != http.StatusOK {
+		t.Errorf("root listing the users: %d", w.Code)
+	}
+}
+
+func TestRESTUsersAndTokens(t *testing.T) {
+	mux, root := restServer(t)
+	if w := restRequest(t, mux, "POST", "/users", root, `{"username": "bob", "password": "secret"}`); w.Code != http.StatusCreated {
+		t.Fatalf("creating bob: %d %s", w.Code, w.Body)
+	}
+	if w := restRequest(t, mux, "POST", "/users", root, `{"username": "bob", "password": "other"}`); w.Code != http.StatusConflict {
+		t.Errorf("creating bob again: %d, want 409", w.Code)
+	}
+	if w := restRequest(t, mux, "POST", "/users", root, `{"username": "carol"`); w.Code != http.StatusBadRequest {
+		t.Errorf("broken JSON: %d, want 400", w.Code)
+	}
+
+	if w := restRequest(t, mux, "POST", "/auth/token", "", `{"username": "bob", "password": "wrong"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: %d, want 401", w.Code)
+	}
+	w := restRequest(t, mux, "POST", "/auth/token", "", `{"username": "bob", "password": "secret"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("bob's token: %d %s", w.Code, w.Body)
+	}
+	var created struct {
+		Token string `json:"token"`
+	}
+	decodeREST(t, w, &created)
+	bob := created.Token
+
+	steps := []struct {
+		method, path, token string
+		status              int
+	}{
+		{"GET", "/users/bob", bob, http.StatusOK},
+		{"GET", "/users/root", bob, http.StatusForbidden},
+		{"GET", "/users/bob", root, http.StatusOK},
+		{"GET", "/users/nobody", root, http.StatusNotFound},
+		{"GET", "/users", bob, http.StatusForbidden},
+		{"DELETE", "/users/root", bob, http.StatusForbidden},
+		{"DELETE", "/auth/token", bob, http.StatusNoContent},
+		// The revoked token is no good anymore
+		{"GET", "/users/bob", bob, http.StatusUnauthorized},
+		{"DELETE", "/users/bob", root, http.StatusNoContent},
+		{"GET", "/users/bob", root, http.StatusNotFound},
+	}
+	for _, step := range steps {
+		if w := restRequest(t, mux, step.method, step.path, step.token, ""); w.Code != step.status {
+			t.Errorf("%s %s: %d, want %d", step.method, step.path, w.Code, step.status)
+		}
+	}
+}
+
+func TestRESTFiles(t *testing.T) {
+	mux, root := restServer(t)
+	if w := restRequest(t, mux, "POST", "/files/folders", root, `{"path": "docs"}`); w.Code != http.StatusCreated {
+		t.Fatalf("creating docs: %d %s", w.Code, w.Body)
+	}
+	if w := restRequest(t, mux, "POST", "/files/folders", root, `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("a folder without a path: %d, want 400", w.Code)
+	}
+	if w := restRequest(t, mux, "PUT", "/files/content?path=docs/notes.txt", root, "some notes"); w.Code != http.StatusCreated {
+		t.Fatalf("uploading: %d %s", w.Code, w.Body)
+	}
+	if w := restRequest(t, mux, "PUT", "/files/content", root, "no path"); w.Code != http.StatusBadRequest {
+		t.Errorf("uploading without a path: %d, want 400", w.Code)
+	}
+	if content, err := os.ReadFile(User_Handler.User_folder("root") + "/docs/notes.txt"); err != nil || string(content) != "some notes" {
+		t.Errorf("uploaded %q, %v", content, err)
+	}
+
+	w := restRequest(t, mux, "GET", "/files?path=docs", root, "")
+	var listing struct {
+		Items []User_Handler.Folder_Entry `json:"items"`
+		Total int                         `json:"total"`
+	}
+	decodeREST(t, w, &listing)
+	if w.Code != http.StatusOK || listing.Total != 1 || listing.Items[0].Name != "notes.txt" {
+		t.Errorf("listing docs: %d %s", w.Code, w.Body)
+	}
+	if w := restRequest(t, mux, "GET", "/files?path=missing", root, ""); w.Code != http.StatusNotFound {
+		t.Errorf("listing a missing folder: %d, want 404", w.Code)
+	}
+}
+
+func TestRESTPagination(t *testing.T) {
+	mux, root := restServer(t)
+	for _, username := range []string{"bob", "carol"} {
+		if w := restRequest(t, mux, "POST", "/users", root, `{"username": "`+username+`", "password": "secret"}`); w.Code != http.StatusCreated {
+			t.Fatalf("creating %s: %d", username, w.Code)
+		}
+	}
+	tests := []struct {
+		query     string
+		usernames []string
+	}{
+		{"", []string{"bob", "carol", "root"}},
+		{"?per_page=2", []string{"bob", "carol"}},
+		{"?per_page=2&page=2", []string{"root"}},
+		{"?page=3&per_page=2", []string{}},
+	}
+	for _, test := range tests {
+		w := restRequest(t, mux, "GET", "/users"+test.query, root, "")
+		var page struct {
+			Items []struct {
+				Username string `json:"username"`
+			} `json:"items"`
+			Total int `json:"total"`
+		}
+		decodeREST(t, w, &page)
+		usernames := []string{}
+		for _, user := range page.Items {
+			usernames = append(usernames, user.Username)
+		}
+		if w.Code != http.StatusOK || page.Total != 3 || strings.Join(usernames, ",") != strings.Join(test.usernames, ",") {
+			t.Errorf("/users%s: %d %s, want %v", test.query, w.Code, w.Body, test.usernames)
+		}
+	}
+	for _, query := range []string{"?page=0", "?page=-1", "?page=one", "?per_page=0", "?per_page=501"} {
+		if w := restRequest(t, mux, "GET", "/users"+query, root, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("/users%s: %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestOpenAPIListsEveryRoute(t *testing.T) {
+	mux, _ := restServer(t)
+	var document struct {
+		Paths map[string]map[string]struct {
+			Security []map[string][]string `json:"security"`
+		} `json:"paths"`
+	}
+	decodeREST(t, restRequest(t, mux, "GET", "/openapi.json", "", ""), &document)
+	for _, route := range restRoutes {
+		operation, found := document.Paths[restPrefix+route.path][strings.ToLower(route.method)]
+		if !found {
+			t.Errorf("%s %s is missing", route.method, route.path)
+			continue
+		}
+		if secured := len(operation.Security) > 0; secured != (route.auth != restPublic) {
+			t.Errorf("%s %s: secured %v", route.method, route.path, secured)
+		}
+	}
+}
@@ -0,0 +1,974 @@
+package HTML_Handler
+
+import (
+	common "ServerController/src/Common"
+	"ServerController/src/Internal_Process_Handler"
+	"ServerController/src/User_Handler"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Biggest file accepted by PUT /files/content, and the biggest script
+const (
+	maxRESTUploadSize = 64 * 1024 * 1024
+	maxScriptSize     = 1024 * 1024
+)
+
+func init() {
+	restRoutes = []restRoute{
+		{method: "GET", path: "/openapi.json", summary: "This document", auth: restPublic, success: 200, handler: handleOpenAPI},
+
+		{method: "POST", path: "/auth/token", summary: "Exchange credentials for a bearer token", auth: restPublic, body: `{"username": string, "password": string}`, success: 201, handler: handleRESTCreateToken},
+		{method: "DELETE", path: "/auth/token", summary: "Revoke the bearer token used for this request", auth: restUser, success: 204, handler: handleRESTRevokeToken},
+
+		{method: "GET", path: "/users", summary: "List the users", auth: restAdmin, paginated: true, success: 200, handler: handleRESTListUsers},
+		{method: "POST", path: "/users", summary: "Create a user", auth: restAdmin, body: `{"username": string, "password": string, "admin": bool, "admin_grade": int}`, success: 201, handler: handleRESTCreateUser},
+		{method: "GET", path: "/users/{username}", summary: "Get a user, admins can see everyone", auth: restUser, success: 200, handler: handleRESTGetUser},
+		{method: "DELETE", path: "/users/{username}", summary: "Delete a user", auth: restAdmin, success: 204, handler: handleRESTDeleteUser},
+		{method: "PUT", path: "/users/{username}/password", summary: "Change a password, admins can change everyone's", auth: restUser, body: `{"password": string}`, success: 204, handler: handleRESTChangePassword},
+
+		{method: "GET", path: "/account-requests", summary: "List the pending account requests", auth: restAdmin, paginated: true, success: 200, handler: handleRESTListAccountRequests},
+		{method: "POST", path: "/account-requests", summary: "Ask for an account", auth: restPublic, body: `{"username": string, "password": string}`, success: 201, handler: handleRESTCreateAccountRequest},
+		{method: "POST", path: "/account-requests/{username}/accept", summary: "Accept an account request", auth: restAdmin, body: `{"admin": bool, "admin_grade": int}`, success: 201, handler: handleRESTAcceptAccountRequest},
+		{method: "DELETE", path: "/account-requests/{username}", summary: "Reject an account request", auth: restAdmin, success: 204, handler: handleRESTRejectAccountRequest},
+
+		{method: "GET", path: "/files", summary: "List a folder of the user's storage", auth: restUser, paginated: true, query: []restParameter{{"path", "Folder to list, relative to the user's storage", "string", false}, {"recursive", "List everything under the folder", "boolean", false}, {"sort", "name, size, modified or type, folders always come first", "string", false}, {"order", "asc or desc", "string", false}}, success: 200, handler: handleRESTListFiles},
+		{method: "GET", path: "/files/stat", summary: "Size, modification time and mode of a file or folder", auth: restUser, query: []restParameter{{"path", "Relative to the user's storage", "string", true}}, success: 200, handler: handleRESTStatFile},
+		{method: "DELETE", path: "/files", summary: "Move a file, or a folder with everything in it, to the trash", auth: restUser, query: []restParameter{{"path", "Relative to the user's storage", "string", true}}, success: 204, handler: handleRESTDeleteFile},
+		{method: "POST", path: "/files/move", summary: "Rename or move a file or folder, the destination must not exist", auth: restUser, body: `{"from": string, "to": string}`, success: 201, handler: handleRESTMoveFile},
+		{method: "POST", path: "/files/copy", summary: "Copy a file or folder, the destination must not exist", auth: restUser, body: `{"from": string, "to": string}`, success: 201, handler: handleRESTCopyFile},
+		{method: "POST", path: "/files/folders", summary: "Create a folder in the user's storage", auth: restUser, body: `{"path": string}`, success: 201, handler: handleRESTCreateFolder},
+		{method: "GET", path: "/files/content", summary: "Download a file of the user's storage", auth: restUser, query: []restParameter{{"path", "File to download, relative to the user's storage", "string", true}, {"inline", "Let the browser show the file instead of saving it", "boolean", false}}, success: 200, handler: handleRESTDownloadFile,
+			description: "Answers Range requests with 206 Partial Content, and conditional requests (ETag, Last-Modified) with 304 Not Modified"},
+		{method: "PUT", path: "/files/content", summary: "Upload a file to the user's storage", auth: restUser, query: []restParameter{{"path", "Destination of the file, relative to the user's storage", "string", true}}, body: "The file content", rawBody: true, success: 201, handler: handleRESTUploadFile},
+		{method: "GET", path: "/files/thumbnail", summary: "Thumbnail of a JPEG, PNG or GIF file of the user's storage", auth: restUser, query: []restParameter{{"path", "Image, relative to the user's storage", "string", true}, {"size", "Longest side: 128, 256 or 512 (default: 256)", "integer", false}}, success: 200, handler: handleRESTThumbnail,
+			description: "The ETag follows the content of the image, conditional requests are answered with 304 Not Modified"},
+		{method: "GET", path: "/files/versions", summary: "List the previous versions of an overwritten file, newest first", auth: restUser, query: []restParameter{{"path", "File, relative to the user's storage", "string", true}}, success: 200, handler: handleRESTListVersions},
+		{method: "POST", path: "/files/versions/{id}/restore", summary: "Bring a previous version back, the current content becomes a version", auth: restUser, query: []restParameter{{"path", "File, relative to the user's storage", "string", true}}, success: 201, handler: handleRESTRestoreVersion},
+		{method: "GET", path: "/files/usage", summary: "Space taken by the user's files, trash and versions", auth: restUser, success: 200, handler: handleRESTStorageUsage},
+
+		{method: "GET", path: "/trash", summary: "List the deleted files and folders, newest first", auth: restUser, paginated: true, success: 200, handler: handleRESTListTrash},
+		{method: "POST", path: "/trash/{id}/restore", summary: "Put a deleted file or folder back, nothing gets overwritten", auth: restUser, body: `{"to": string} (optional, default: where it was deleted from)`, success: 201, handler: handleRESTRestoreTrash},
+		{method: "DELETE", path: "/trash", summary: "Delete everything in the trash for good", auth: restUser, success: 204, handler: handleRESTEmptyTrash},
+		{method: "DELETE", path: "/history", summary: "Delete the trash entries and versions older than the given age for good", auth: restUser, query: []restParameter{{"older_than_days", "Age in days, 0 removes all of them", "integer", true}}, success: 200, handler: handleRESTPurgeHistory},
+
+		{method: "GET", path: "/shares", summary: "List what the user shares with the others", auth: restUser, paginated: true, success: 200, handler: handleRESTListShares},
+		{method: "GET", path: "/shares/incoming", summary: "List what the others share with the user, found under \"Shared with me\"", auth: restUser, paginated: true, success: 200, handler: handleRESTListIncomingShares},
+		{method: "POST", path: "/shares", summary: "Give another user read or read-write access to a file or folder, sharing it again changes the access", auth: restUser, body: `{"path": string, "username": string, "access": "read" | "read-write"}`, success: 201, handler: handleRESTCreateShare},
+		{method: "DELETE", path: "/shares/{id}", summary: "Stop a share, from its owner or from the user it was shared with", auth: restUser, success: 204, handler: handleRESTRevokeShare},
+
+		{method: "GET", path: "/share-links", summary: "List the user's public links", auth: restUser, paginated: true, query: []restParameter{{"all", "List the active links of every user (admins only)", "boolean", false}}, success: 200, handler: handleRESTListShareLinks},
+		{method: "POST", path: "/share-links", summary: "Make a public link to a file or folder, a folder is downloaded as a zip", auth: restUser, body: `{"path": string, "password": string, "expires_in": string, "max_downloads": int} (all but path optional, expires_in like "72h")`, success: 201, handler: handleRESTCreateShareLink,
+			description: "Anyone with the url can download without logging in, the password is asked through HTTP basic auth"},
+		{method: "DELETE", path: "/share-links/{id}", summary: "Disable a public link, admins can revoke any link", auth: restUser, success: 204, handler: handleRESTRevokeShareLink},
+
+		{method: "POST", path: "/uploads", summary: "Start a resumable upload, or get the unfinished one with the same path, size and hash", auth: restUser, body: `{"path": string, "size": int, "sha256": string, "base": string} (base optional, see the sync)`, success: 201, handler: handleRESTBeginUpload},
+		{method: "GET", path: "/uploads/{id}", summary: "Get the progress of an upload", auth: restUser, success: 200, handler: handleRESTGetUpload},
+		{method: "PUT", path: "/uploads/{id}", summary: "Add a chunk to an upload", auth: restUser, body: "The chunk, placed by the Content-Range header (bytes first-last/size)", rawBody: true, success: 200, handler: handleRESTUploadChunk,
+			description: "The chunk has to start where the upload stopped, otherwise the answer is 409 Conflict with the current offset"},
+		{method: "POST", path: "/uploads/{id}/commit", summary: "Check the hash of a complete upload and move the file in place, or to a conflict copy", auth: restUser, success: 201, handler: handleRESTCommitUpload},
+		{method: "DELETE", path: "/uploads/{id}", summary: "Cancel an upload", auth: restUser, success: 204, handler: handleRESTAbortUpload},
+
+		{method: "GET", path: "/sync/changes", summary: "Changes of the user's storage after a cursor, without since only the current cursor to start from", auth: restUser, query: []restParameter{{"since", "Cursor given by the previous call", "integer", false}}, success: 200, handler: handleRESTSyncChanges},
+		{method: "GET", path: "/search", summary: "Search the names, paths and text contents of the user's files and of the ones shared with them", auth: restUser, query: []restParameter{{"q", "Words and filters: name:, type:, path:, after:, before:, size>, size<", "string", true}, {"limit", "Most results to give (default: 100, at most 1000)", "integer", false}}, success: 200, handler: handleRESTSearchFiles},
+
+		{method: "GET", path: "/scripts", summary: "List the scripts, private ones are listed for admins only", auth: restUser, paginated: true, success: 200, handler: handleRESTListScripts},
+		{method: "POST", path: "/scripts", summary: "Upload a script", auth: restUser, body: `{"name": string, "public": bool, "content": string}`, success: 201, handler: handleRESTUploadScript},
+		{method: "POST", path: "/scripts/{name}/run", summary: "Start a script, the result is available as a job", auth: restUser, query: []restParameter{{"private", "Run the private script with this name (admins only)", "boolean", false}}, success: 202, handler: handleRESTRunScript},
+
+		{method: "GET", path: "/jobs", summary: "List the script runs, admins see everyone's", auth: restUser, paginated: true, success: 200, handler: handleRESTListJobs},
+		{method: "GET", path: "/jobs/{id}", summary: "Get a script run with its output", auth: restUser, success: 200, handler: handleRESTGetJob},
+
+		{method: "GET", path: "/storage/report", summary: "Space the users' files take as they see it, space really taken and what the deduplication saves", auth: restAdmin, success: 200, handler: handleRESTStorageReport},
+		{method: "POST", path: "/storage/gc", summary: "Delete the blobs no file uses anymore", auth: restAdmin, success: 200, handler: handleRESTCollectBlobs},
+		{method: "POST", path: "/storage/fsck", summary: "Hash every blob again and list the damaged ones", auth: restAdmin, success: 200, handler: handleRESTCheckBlobs},
+		{method: "POST", path: "/storage/scan", summary: "Deduplicate the files written before deduplicate_files was turned on", auth: restAdmin, success: 200, handler: handleRESTScanBlobs},
+
+		{method: "GET", path: "/system/status", summary: "Server usage and uptime", auth: restUser, success: 200, handler: handleRESTSystemStatus},
+		{method: "GET", path: "/system/details", summary: "Server name, id and TCP port", auth: restPublic, success: 200, handler: handleRESTSystemDetails},
+	}
+}
+
+// ===========================
+// Authentication
+// ===========================
+
+func handleRESTCreateToken(w http.ResponseWriter, r *http.Request, session *restSession) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if !readRESTBody(w, r, &body) {
+		return
+	}
+	if !User_Handler.Authenticate_user(body.Username, body.Password) {
+		writeRESTError(w, http.StatusUnauthorized, "Username or password invalid")
+		return
+	}
+	token, expires_at := User_Handler.Create_token(body.Username)
+	writeREST(w, http.StatusCreated, map[string]any{
+		"token":      token,
+		"token_type": "Bearer",
+		"expires_at": expires_at,
+	})
+}
+
+func handleRESTRevokeToken(w http.ResponseWriter, r *http.Request, session *restSession) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	User_Handler.Revoke_token(strings.TrimSpace(token))
+	writeREST(w, http.StatusNoContent, nil)
+}
+
+// ===========================
+// Users
+// ===========================
+
+type restUserDetails struct {
+	Username    string `json:"username"`
+	Admin       bool   `json:"admin"`
+	Admin_Grade uint8  `json:"admin_grade"`
+	CreatedAt   string `json:"created_at"`
+	LastLogin   string `json:"last_login"`
+}
+
+func toRESTUser(user User_Handler.User) restUserDetails {
+	return restUserDetails{user.Username, user.Admin, user.Admin_Grade, user.CreatedAt, user.LastLogin}
+}
+
+func handleRESTListUsers(w http.ResponseWriter, r *http.Request, session *restSession) {
+	usernames := User_Handler.List_users()
+	sort.Strings(usernames)
+	users := []restUserDetails{}
+	for _, username := range usernames {
+		users = append(users, toRESTUser(User_Handler.LoadedUsers[username]))
+	}
+	if page, ok := paginate(w, r, users); ok {
+		writeREST(w, http.StatusOK, page)
+	}
+}
+
+func handleRESTCreateUser(w http.ResponseWriter, r *http.Request, session *restSession) {
+	var body struct {
+		Username    string `json:"username"`
+		Password    string `json:"password"`
+		Admin       bool   `json:"admin"`
+		Admin_Grade *uint8 `json:"admin_grade"`
+	}
+	if !readRESTBody(w, r, &body) {
+		return
+	}
+	if body.Username == "" || body.Password == "" {
+		writeRESTError(w, http.StatusBadRequest, "username and password are required")
+		return
+	}
+	var grade uint8 = 1
+	if body.Admin_Grade != nil {
+		grade = *body.Admin_Grade
+	}
+	if err := User_Handler.Add_user(body.Username, body.Password, body.Admin, grade, session.username); errors.Is(err, User_Handler.ErrInvalidUsername) {
+		writeRESTError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
+		writeRESTError(w, http.StatusConflict, "User already exists")
+		return
+	}
+	w.Header().Set("Location", restPrefix+"/users/"+body.Username)
+	writeREST(w, http.StatusCreated, toRESTUser(User_Handler.LoadedUsers[body.Username]))
+}
+
+func handleRESTGetUser(w http.ResponseWriter, r *http.Request, session *restSession) {
+	username := r.PathValue("username")
+	if username != session.username && !session.is_admin {
+		writeRESTError(w, http.StatusForbidden, "You can only see your own account")
+		return
+	}
+	user, exists := User_Handler.LoadedUsers[username]
+	if !exists {
+		writeRESTError(w, http.StatusNotFound, "Unknown user")
+		return
+	}
+	writeREST(w, http.StatusOK, toRESTUser(user))
+}
+
+func handleRESTDeleteUser(w http.ResponseWriter, r *http.Request, session *restSession) {
+	username := r.PathValue("username")
+	if username == session.username {
+		writeRESTError(w, http.StatusConflict, "You can't delete your own account")
+		return
+	}
+	if !User_Handler.User_exists(username) {
+		writeRESTError(w, http.StatusNotFound, "Unknown user")
+		return
+	}
+	User_Handler.Remove_user(username)
+	writeREST(w, http.StatusNoContent, nil)
+}
+
+func handleRESTChangePassword(w http.ResponseWriter, r *http.Request, session *restSession) {
+	username := r.PathValue("username")
+	if username != session.username && !session.is_admin {
+		writeRESTError(w, http.StatusForbidden, "You can only change your own password")
+		return
+	}
+	var body struct {
+		Password string `json:"password"`
+	}
+	if !readRESTBody(w, r, &body) {
+		return
+	}
+	if body.Password == "" {
+		writeRESTError(w, http.StatusBadRequest, "password is required")
+		return
+	}
+	if !User_Handler.User_exists(username) {
+		writeRESTError(w, http.StatusNotFound, "Unknown user")
+		return
+	}
+	User_Handler.Change_password(username, body.Password)
+	writeREST(w, http.StatusNoContent, nil)
+}
+
+// ===========================
+// Account requests
+// ===========================
+
+func handleRESTListAccountRequests(w http.ResponseWriter, r *http.Request, session *restSession) {
+	type accountRequest struct {
+		Username   string `json:"username"`
+		Request_At string `json:"request_at"`
+	}
+	requests := []accountRequest{}
+	for _, request := range User_Handler.Loaded_Requests {
+		requests = append(requests, accountRequest{request.Username, request.Request_At})
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Request_At < requests[j].Request_At
+	})
+	if page, ok := paginate(w, r, requests); ok {
+		writeREST(w, http.StatusOK, page)
+	}
+}
+
+func handleRESTCreateAccountRequest(w http.ResponseWriter, r *http.Request, session *restSession) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if !readRESTBody(w, r, &body) {
+		return
+	}
+	if body.Username == "" || body.Password == "" {
+		writeRESTError(w, http.StatusBadRequest, "username and password are required")
+		return
+	}
+	result, message := User_Handler.Insert_account_request(body.Username, body.Password)
+	if !result {
+		writeRESTError(w, http.StatusConflict, message)
+		return
+	}
+	writeREST(w, http.StatusCreated, commandResults{Status: "success", Message: message})
+}
+
+func handleRESTAcceptAccountRequest(w http.ResponseWriter, r *http.Request, session *restSession) {
+	username := r.PathValue("username")
+	var body struct {
+		Admin       bool   `json:"admin"`
+		Admin_Grade *uint8 `json:"admin_grade"`
+	}
+	if !readRESTBody(w, r, &body) {
+		return
+	}
+	if !User_Handler.Request_exists(username) {
+		writeRESTError(w, http.StatusNotFound, "Unknown account request")
+		return
+	}
+	var grade uint8 = 5
+	if body.Admin_Grade != nil {
+		grade = *body.Admin_Grade
+	}
+	User_Handler.Accept_account_request(username, body.Admin, grade, session.username)
+	w.Header().Set("Location", restPrefix+"/users/"+username)
+	writeREST(w, http.StatusCreated, toRESTUser(User_Handler.LoadedUsers[username]))
+}
+
+func handleRESTRejectAccountRequest(w http.ResponseWriter, r *http.Request, session *restSession) {
+	if !User_Handler.Reject_account_request(r.PathValue("username")) {
+		writeRESTError(w, http.StatusNotFound, "Unknown account request")
+		return
+	}
+	writeREST(w, http.StatusNoContent, nil)
+}
+
+// ===========================
+// Files
+// ===========================
+
+// Answers with the error of a file operation, false when there was none
+func writeRESTFileError(w http.ResponseWriter, err error, fallback string) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, common.ErrInvalidPath):
+		writeRESTError(w, http.StatusBadRequest, "Invalid path")
+	case errors.Is(err, User_Handler.ErrInvalidMove), errors.Is(err, User_Handler.ErrInvalidSort), errors.Is(err, User_Handler.ErrInvalidShare),
+		errors.Is(err, User_Handler.ErrInvalidShareLink), errors.Is(err, User_Handler.ErrInvalidThumbnailSize):
+		writeRESTError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, User_Handler.ErrReadOnly), errors.Is(err, User_Handler.ErrSharedFolder):
+		writeRESTError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, User_Handler.ErrUnknownPath):
+		writeRESTError(w, http.StatusNotFound, "Unknown path")
+	case errors.Is(err, User_Handler.ErrUnknownShare):
+		writeRESTError(w, http.StatusNotFound, "Unknown share")
+	case errors.Is(err, User_Handler.ErrUnknownShareLink):
+		writeRESTError(w, http.StatusNotFound, "Unknown share link")
+	case errors.Is(err, User_Handler.ErrUnknownTrashEntry):
+		writeRESTError(w, http.StatusNotFound, "Unknown trash entry")
+	case errors.Is(err, User_Handler.ErrUnknownVersion):
+		writeRESTError(w, http.StatusNotFound, "Unknown version")
+	case errors.Is(err, User_Handler.ErrPathExists):
+		writeRESTError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, User_Handler.ErrNotAnImage), errors.Is(err, User_Handler.ErrImageTooBig):
+		writeRESTError(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		writeRESTError(w, http.StatusInternalServerError, fallback)
+	}
+	return true
+}
+
+func handleRESTListFiles(w http.ResponseWriter, r *http.Request, session *restSession) {
+	query := r.URL.Query()
+	var entries []User_Handler.Folder_Entry
+	var err error
+	if query.Get("recursive") == "true" {
+		entries, err = User_Handler.List_user_folder_recursive(session.username, query.Get("path"))
+	} else {
+		entries, err = User_Handler.List_user_folder(session.username, query.Get("path"))
+	}
+	if err == nil {
+		err = User_Handler.Sort_folder_entries(entries, query.Get("sort"), query.Get("order") == "desc")
+	}
+	if writeRESTFileError(w, err, "An error occurred while trying to read folder content") {
+		return
+	}
+	if page, ok := paginate(w, r, entries); ok {
+		writeREST(w, http.StatusOK, page)
+	}
+}
+
+func handleRESTStatFile(w http.ResponseWriter, r *http.Request, session *restSession) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeRESTError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	entry, err := User_Handler.Stat_user_path(session.username, path)
+	if writeRESTFileError(w, err, "Unable to read the path") {
+		return
+	}
+	writeREST(w, http.StatusOK, entry)
+}
+
+func handleRESTDeleteFile(w http.ResponseWriter, r *http.Request, session *restSession) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeRESTError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	if writeRESTFileError(w, User_Handler.Delete_user_path(session.username, path), "Unable to delete the path") {
+		return
+	}
+	writeREST(w, http.StatusNoContent, nil)
+}
+
+func handleRESTMoveFile(w http.ResponseWriter, r *http.Request, session *restSession) {
+	var body struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if !readRESTBody(w, r, &body) {
+		return
+	}
+	if body.From == "" || body.To == "" {
+		writeRESTError(w, http.StatusBadRequest, "from and to are required")
+		return
+	}
+	if writeRESTFileError(w, User_Handler.Move_user_path(session.username, body.From, body.To), "Unable to move the path") {
+		return
+	}
+	writeREST(w, http.StatusCreated, commandResults{Status: "success", Message: "Moved successfully"})
+}
+
+func handleRESTCopyFile(w http.ResponseWriter, r *http.Request, session *restSession) {
+	var body struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if !readRESTBody(w, r, &body) {
+		return
+	}
+	if body.From == "" || body.To == "" {
+		writeRESTError(w, http.StatusBadRequest, "from and to are required")
+		return
+	}
+	if writeRESTFileError(w, User_Handler.Copy_user_path(session.username, body.From, body.To), "Unable to copy the path") {
+		return
+	}
+	writeREST(w, http.StatusCreated, commandResults{Status: "success", Message: "Copied successfully"})
+}
+
+func handleRESTCreateFolder(w http.ResponseWriter, r *http.Request, session *restSession) {
+	var body struct {
+		Path string `json:"path"`
+	}
+	if !readRESTBody(w, r, &body) {
+		return
+	}
+	if body.Path == "" {
+		writeRESTError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	if writeRESTFileError(w, User_Handler.Create_user_folder(session.username, body.Path), "Unable to create folder") {
+		return
+	}
+	writeREST(w, http.StatusCreated, commandResults{Status: "success", Message: "Folder created successfully"})
+}
+
+func handleRESTListVersions(w http.ResponseWriter, r *http.Request, session *restSession) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeRESTError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	versions, err := User_Handler.List_file_versions(session.username, path)
+	if writeRESTFileError(w, err, "Unable to list the versions") {
+		return
+	}
+	writeREST(w, http.StatusOK, versions)
+}
+
+func handleRESTRestoreVersion(w http.ResponseWriter, r *http.Request, session *restSession) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeRESTError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	err := User_Handler.Restore_file_version(session.username, path, r.PathValue("id"))
+	if writeRESTFileError(w, err, "Unable to restore the version") {
+		return
+	}
+	writeREST(w, http.StatusCreated, commandResults{Status: "success", Message: "Version restored"})
+}
+
+func handleRESTStorageUsage(w http.ResponseWriter, r *http.Request, session *restSession) {
+	writeREST(w, http.StatusOK, User_Handler.Get_storage_usage(session.username))
+}
+
+func handleRESTListTrash(w http.ResponseWriter, r *http.Request, session *restSession) {
+	if page, ok := paginate(w, r, User_Handler.List_trash(session.username)); ok {
+		writeREST(w, http.StatusOK, page)
+	}
+}
+
+func handleRESTRestoreTrash(w http.ResponseWriter, r *http.Request, session *restSession) {
+	var body struct {
+		To string `json:"to"`
+	}
+	// The body is optional
+	if r.ContentLength != 0 && !readRESTBody(w, r, &body) {
+		return
+	}
+	restored, err := User_Handler.Restore_from_trash(session.username, r.PathValue("id"), body.To)
+	if writeRESTFileError(w, err, "Unable to restore from the trash") {
+		return
+	}
+	writeREST(w, http.StatusCreated, commandResults{Status: "success", Message: "Restored to " + restored})
+}
+
+func handleRESTEmptyTrash(w http.ResponseWriter, r *http.Request, session *restSession) {
+	if writeRESTFileError(w, User_Handler.Empty_trash(session.username), "Unable to empty the trash") {
+		return
+	}
+	writeREST(w, http.StatusNoContent, nil)
+}
+
+func handleRESTPurgeHistory(w http.ResponseWriter, r *http.Request, session *restSession) {
+	days, err := strconv.Atoi(r.URL.Query().Get("older_than_days"))
+	if err != nil || days < 0 {
+		writeRESTError(w, http.StatusBadRequest, "older_than_days must be a positive number or 0")
+		return
+	}
+	removed := User_Handler.Purge_history(session.username, time.Duration(days)*24*time.Hour)
+	writeREST(w, http.StatusOK, commandResults{Status: "success", Message: strconv.Itoa(removed) + " trash entries and versions removed"})
+}
+
+func handleRESTUploadFile(w http.ResponseWriter, r *http.Request, session *restSession) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeRESTError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	// A big file on a slow link takes longer than the web server's timeouts, the answer comes after it
+	controller := http.NewResponseController(w)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+	content, ok := readRawBody(w, r, maxRESTUploadSize)
+	if !ok {
+		return
+	}
+	if writeRESTFileError(w, User_Handler.Write_user_file(session.username, path, content), "Unable to upload file") {
+		return
+	}
+	writeREST(w, http.StatusCreated, commandResults{Status: "success", Message: "File uploaded successfully"})
+}
+
+// http.ServeContent handles Range, If-Range, If-None-Match and If-Modified-Since, and guesses the Content-Type
+// from the extension or the first bytes
+func handleRESTDownloadFile(w http.ResponseWriter, r *http.Request, session *restSession) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeRESTError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	file, info, err := User_Handler.Open_user_file(session.username, path)
+	if errors.Is(err, common.ErrInvalidPath) {
+		writeRESTError(w, http.StatusBadRequest, "Invalid path")
+		return
+	}
+	if errors.Is(err, User_Handler.ErrUnknownPath) || errors.Is(err, User_Handler.ErrNotAFile) {
+		writeRESTError(w, http.StatusNotFound, "Unknown file")
+		return
+	}
+	if err != nil {
+		writeRESTError(w, http.StatusInternalServerError, "Unable to read file")
+		return
+	}
+	defer file.Close()
+
+	disposition := "attachment"
+	if r.URL.Query().Get("inline") == "true" {
+		disposition = "inline"
+		// A file shown by the browser must not run scripts in the panel's origin
+		w.Header().Set("Content-Security-Policy", "sandbox")
+	}
+	w.Header().Del("Content-Type")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": info.Name()}))
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	// Big files take longer than the web server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+func handleRESTThumbnail(w http.ResponseWriter, r *http.Request, session *restSession) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeRESTError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	size := User_Handler.Thumbnail_Default_Size
+	if r.URL.Query().Has("size") {
+		var err error
+		if size, err = strconv.Atoi(r.URL.Query().Get("size")); err != nil {
+			writeRESTError(w, http.StatusBadRequest, User_Handler.ErrInvalidThumbnailSize.Error())
+			return
+		}
+	}
+	thumbnail, file, err := User_Handler.Open_thumbnail(session.username, path, size)
+	if writeRESTFileError(w, err, "Unable to make the thumbnail") {
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", thumbnail.Mime)
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, thumbnail.Hash, thumbnail.Size))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	// A thumbnail made on the spot can take longer than the web server's write timeout on a slow link
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	http.ServeContent(w, r, "", time.Time{}, file)
+}
+
+// ===========================
+// Sharing
+// ===========================
+
+func handleRESTListShares(w http.ResponseWriter, r *http.Request, session *restSession) {
+	if page, ok := paginate(w, r, User_Handler.List_shares(session.username)); ok {
+		writeREST(w, http.StatusOK, page)
+	}
+}
+
+func handleRESTListIncomingShares(w http.ResponseWriter, r *http.Request, session *restSession) {
+	if page, ok := paginate(w, r, User_Handler.List_incoming_shares(session.username)); ok {
+		writeREST(w, http.StatusOK, page)
+	}
+}
+
+func handleRESTCreateShare(w http.ResponseWriter, r *http.Request, session *restSession) {
+	var body struct {
+		Path     string `json:"path"`
+		Username string `json:"username"`
+		Access   string `json:"access"`
+	}
+	if !readRESTBody(w, r, &body) {
+		return
+	}
+	share, err := User_Handler.Share_path(session.username, body.Path, body.Username, body.Access)
+	if writeRESTFileError(w, err, "Unable to share the path") {
+		return
+	}
+	writeREST(w, http.StatusCreated, share)
+}
+
+func handleRESTRevokeShare(w http.ResponseWriter, r *http.Request, session *restSession) {
+	if writeRESTFileError(w, User_Handler.Revoke_share(session.username, r.PathValue("id")), "Unable to revoke the share") {
+		return
+	}
+	writeREST(w, http.StatusNoContent, nil)
+}
+
+func handleRESTListShareLinks(w http.ResponseWriter, r *http.Request, session *restSession) {
+	links := User_Handler.List_share_links(session.username)
+	if r.URL.Query().Get("all") == "true" {
+		if !session.is_admin {
+			writeRESTError(w, http.StatusForbidden, "You need to be an admin to see every link")
+			return
+		}
+		links = User_Handler.List_active_share_links()
+	}
+	if page, ok := paginate(w, r, links); ok {
+		writeREST(w, http.StatusOK, page)
+	}
+}
+
+func handleRESTCreateShareLink(w http.ResponseWriter, r *http.Request, session *restSession) {
+	var body struct {
+		Path          string `json:"path"`
+		Password      string `json:"password"`
+		Expires_In    string `json:"expires_in"`
+		Max_Downloads int    `json:"max_downloads"`
+	}
+	if !readRESTBody(w, r, &body) {
+		return
+	}
+	var expires_in time.Duration
+	if body.Expires_In != "" {
+		var err error
+		if expires_in, err = time.ParseDuration(body.Expires_In); err != nil {
+			writeRESTError(w, http.StatusBadRequest, "expires_in must be a duration like 72h")
+			return
+		}
+	}
+	link, err := User_Handler.Create_share_link(session.username, body.Path, body.Password, expires_in, body.Max_Downloads)
+	if writeRESTFileError(w, err, "Unable to create the link") {
+		return
+	}
+	writeREST(w, http.StatusCreated, link)
+}
+
+func handleRESTRevokeShareLink(w http.ResponseWriter, r *http.Request, session *restSession) {
+	err := User_Handler.Revoke_share_link(session.username, session.is_admin, r.PathValue("id"))
+	if writeRESTFileError(w, err, "Unable to revoke the link") {
+		return
+	}
+	writeREST(w, http.StatusNoContent, nil)
+}
+
+// ===========================
+// Sync
+// ===========================
+
+func handleRESTSyncChanges(w http.ResponseWriter, r *http.Request, session *restSession) {
+	var since *uint64
+	if r.URL.Query().Has("since") {
+		cursor, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			writeRESTError(w, http.StatusBadRequest, "since must be a cursor given by a previous call")
+			return
+		}
+		since = &cursor
+	}
+	writeREST(w, http.StatusOK, User_Handler.Sync_changes(session.username, since))
+}
+
+func handleRESTSearchFiles(w http.ResponseWriter, r *http.Request, session *restSession) {
+	limit := User_Handler.Search_Default_Limit
+	if r.URL.Query().Has("limit") {
+		var err error
+		if limit, err = strconv.Atoi(r.URL.Query().Get("limit")); err != nil || limit < 1 || limit > User_Handler.Search_Max_Limit {
+			writeRESTError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(User_Handler.Search_Max_Limit))
+			return
+		}
+	}
+	results, err := User_Handler.Search_files(session.username, r.URL.Query().Get("q"), limit)
+	if err != nil {
+		writeRESTError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeREST(w, http.StatusOK, results)
+}
+
+// ===========================
+// Blob store
+// ===========================
+
+func handleRESTStorageReport(w http.ResponseWriter, r *http.Request, session *restSession) {
+	writeREST(w, http.StatusOK, User_Handler.Get_storage_report())
+}
+
+func handleRESTCollectBlobs(w http.ResponseWriter, r *http.Request, session *restSession) {
+	writeREST(w, http.StatusOK, User_Handler.Collect_blobs())
+}
+
+func handleRESTCheckBlobs(w http.ResponseWriter, r *http.Request, session *restSession) {
+	writeREST(w, http.StatusOK, User_Handler.Check_blobs())
+}
+
+func handleRESTScanBlobs(w http.ResponseWriter, r *http.Request, session *restSession) {
+	writeREST(w, http.StatusOK, User_Handler.Scan_blobs())
+}
+
+// ===========================
+// Resumable uploads
+// ===========================
+
+type restUploadProgress struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+func writeRESTUploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, User_Handler.ErrUnknownUpload):
+		writeRESTError(w, http.StatusNotFound, "Unknown upload")
+	case errors.Is(err, User_Handler.ErrUnknownPath):
+		writeRESTError(w, http.StatusNotFound, "Unknown path")
+	case errors.Is(err, User_Handler.ErrReadOnly), errors.Is(err, User_Handler.ErrSharedFolder):
+		writeRESTError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, User_Handler.ErrInvalidHash), errors.Is(err, User_Handler.ErrUploadTooBig), errors.Is(err, common.ErrInvalidPath):
+		writeRESTError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, User_Handler.ErrUploadIncomplete), errors.Is(err, User_Handler.ErrHashMismatch):
+		writeRESTError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, User_Handler.ErrNotEnoughSpace):
+		writeRESTError(w, http.StatusInsufficientStorage, err.Error())
+	default:
+		writeRESTError(w, http.StatusInternalServerError, "Unable to store the upload")
+	}
+}
+
+func handleRESTBeginUpload(w http.ResponseWriter, r *http.Request, session *restSession) {
+	var body struct {
+		Path   string `json:"path"`
+		Size   int64  `json:"size"`
+		Sha256 string `json:"sha256"`
+		Base   string `json:"base"`
+	}
+	if !readRESTBody(w, r, &body) {
+		return
+	}
+	if body.Path == "" {
+		writeRESTError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+	upload, err := User_Handler.Begin_upload(session.username, body.Path, body.Size, body.Sha256, body.Base)
+	if err != nil {
+		writeRESTUploadError(w, err)
+		return
+	}
+	writeREST(w, http.StatusCreated, restUploadProgress{upload.ID, upload.Received, upload.Size})
+}
+
+func handleRESTGetUpload(w http.ResponseWriter, r *http.Request, session *restSession) {
+	upload, err := User_Handler.Get_upload(session.username, r.PathValue("id"))
+	if err != nil {
+		writeRESTUploadError(w, err)
+		return
+	}
+	writeREST(w, http.StatusOK, restUploadProgress{upload.ID, upload.Received, upload.Size})
+}
+
+// Reads "bytes first-last/size", the size may be * when unknown
+func parseContentRange(header string) (int64, int64, bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	span, _, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, false
+	}
+	first_text, last_text, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, false
+	}
+	first, err := strconv.ParseInt(first_text, 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, false
+	}
+	last, err := strconv.ParseInt(last_text, 10, 64)
+	if err != nil || last < first {
+		return 0, 0, false
+	}
+	return first, last, true
+}
+
+func handleRESTUploadChunk(w http.ResponseWriter, r *http.Request, session *restSession) {
+	// A big chunk on a slow link takes longer than the web server's timeouts, the answer comes after it
+	controller := http.NewResponseController(w)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+	first, last, ok := parseContentRange(r.Header.Get("Content-Range"))
+	if !ok {
+		writeRESTError(w, http.StatusBadRequest, "A Content-Range header (bytes first-last/size) is required")
+		return
+	}
+	if last-first+1 > maxRESTUploadSize {
+		writeRESTError(w, http.StatusRequestEntityTooLarge, "Chunks are limited to 64MB")
+		return
+	}
+	upload, err := User_Handler.Write_upload_chunk(session.username, r.PathValue("id"), first, io.LimitReader(r.Body, last-first+1))
+	if errors.Is(err, User_Handler.ErrUploadOffset) {
+		writeREST(w, http.StatusConflict, struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+			restUploadProgress
+		}{"fail", err.Error(), restUploadProgress{upload.ID, upload.Received, upload.Size}})
+		return
+	}
+	if err != nil {
+		writeRESTUploadError(w, err)
+		return
+	}
+	writeREST(w, http.StatusOK, restUploadProgress{upload.ID, upload.Received, upload.Size})
+}
+
+func handleRESTCommitUpload(w http.ResponseWriter, r *http.Request, session *restSession) {
+	result, err := User_Handler.Commit_upload(session.username, r.PathValue("id"))
+	if err != nil {
+		writeRESTUploadError(w, err)
+		return
+	}
+	writeREST(w, http.StatusCreated, result)
+}
+
+func handleRESTAbortUpload(w http.ResponseWriter, r *http.Request, session *restSession) {
+	if err := User_Handler.Abort_upload(session.username, r.PathValue("id")); err != nil {
+		writeRESTUploadError(w, err)
+		return
+	}
+	writeREST(w, http.StatusNoContent, nil)
+}
+
+// ===========================
+// Scripts and jobs
+// ===========================
+
+func handleRESTListScripts(w http.ResponseWriter, r *http.Request, session *restSession) {
+	type script struct {
+		Name    string `json:"name"`
+		Private bool   `json:"private"`
+	}
+	scripts := []script{}
+	for _, name := range Internal_Process_Handler.List_scripts(false) {
+		scripts = append(scripts, script{name, false})
+	}
+	if session.is_admin {
+		for _, name := range Internal_Process_Handler.List_scripts(true) {
+			scripts = append(scripts, script{name, true})
+		}
+	}
+	if page, ok := paginate(w, r, scripts); ok {
+		writeREST(w, http.StatusOK, page)
+	}
+}
+
+func handleRESTUploadScript(w http.ResponseWriter, r *http.Request, session *restSession) {
+	var body struct {
+		Name    string `json:"name"`
+		Public  bool   `json:"public"`
+		Content string `json:"content"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxScriptSize)
+	if !readRESTBody(w, r, &body) {
+		return
+	}
+	if body.Name == "" {
+		writeRESTError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	err := Internal_Process_Handler.Save_script(!body.Public, body.Name, []byte(body.Content))
+	if errors.Is(err, common.ErrInvalidPath) {
+		writeRESTError(w, http.StatusBadRequest, "Invalid script name")
+		return
+	}
+	if errors.Is(err, Internal_Process_Handler.ErrScriptExists) {
+		writeRESTError(w, http.StatusConflict, "Script already exists under this name")
+		return
+	}
+	if err != nil {
+		writeRESTError(w, http.StatusInternalServerError, "Unable to upload script")
+		return
+	}
+	writeREST(w, http.StatusCreated, commandResults{Status: "success", Message: "Script uploaded successfully"})
+}
+
+func handleRESTRunScript(w http.ResponseWriter, r *http.Request, session *restSession) {
+	name := r.PathValue("name")
+	private := r.URL.Query().Get("private") == "true"
+	if private && !session.is_admin {
+		writeRESTError(w, http.StatusForbidden, "Only admins can run private scripts")
+		return
+	}
+	found := false
+	for _, script := range Internal_Process_Handler.List_scripts(private) {
+		if script == name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		writeRESTError(w, http.StatusNotFound, "Unknown script")
+		return
+	}
+	job := Internal_Process_Handler.Start_job(session.username, name, private)
+	w.Header().Set("Location", restPrefix+"/jobs/"+job.ID)
+	writeREST(w, http.StatusAccepted, job.Snapshot())
+}
+
+func handleRESTListJobs(w http.ResponseWriter, r *http.Request, session *restSession) {
+	owner := session.username
+	if session.is_admin {
+		owner = ""
+	}
+	if page, ok := paginate(w, r, Internal_Process_Handler.List_jobs(owner)); ok {
+		writeREST(w, http.StatusOK, page)
+	}
+}
+
+func handleRESTGetJob(w http.ResponseWriter, r *http.Request, session *restSession) {
+	job, exists := Internal_Process_Handler.Get_job(r.PathValue("id"))
+	if !exists || (job.Owner != session.username && !session.is_admin) {
+		writeRESTError(w, http.StatusNotFound, "Unknown job")
+		return
+	}
+	writeREST(w, http.StatusOK, job)
+}
+
+// ===========================
+// System
+// ===========================
+
+func handleRESTSystemStatus(w http.ResponseWriter, r *http.Request, session *restSession) {
+	writeREST(w, http.StatusOK, serverStatus(session.username))
+}
+
+func handleRESTSystemDetails(w http.ResponseWriter, r *http.Request, session *restSession) {
+	writeREST(w, http.StatusOK, serverDetails())
+}
@@ -0,0 +1,247 @@
+package HTML_Handler
+
+import (
+	"ServerController/src/User_Handler"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Downloads through the links made with create_share_link, open to anyone who has the link. A file is sent as it
+// is, a folder as a zip. The password, when there is one, comes through HTTP basic auth so browsers ask for it
+func handleShareLink(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.PathValue("token")
+	_, password, _ := r.BasicAuth()
+	link, err := User_Handler.Open_share_link(token, password)
+	switch {
+	case errors.Is(err, User_Handler.ErrUnknownShareLink):
+		http.Error(w, "Unknown link", http.StatusNotFound)
+		return
+	case errors.Is(err, User_Handler.ErrShareLinkExpired):
+		http.Error(w, "This link has expired", http.StatusGone)
+		return
+	case errors.Is(err, User_Handler.ErrWrongPassword):
+		if password != "" {
+			// Slows down the guessing
+			time.Sleep(time.Second)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="Shared file", charset="UTF-8"`)
+		http.Error(w, "This link needs a password", http.StatusUnauthorized)
+		return
+	case err != nil:
+		http.Error(w, "Unable to open the link", http.StatusInternalServerError)
+		return
+	}
+
+	sandbox := User_Handler.User_sandbox(link.Owner)
+	info, err := sandbox.Stat(link.Path)
+	if err != nil {
+		http.Error(w, "The shared file doesn't exist anymore", http.StatusNotFound)
+		return
+	}
+	info = User_Handler.Own_file_info(sandbox, link.Path, info)
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	// Big files and folders take longer than the web server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	// Resuming a download doesn't count as another one. A folder is zipped again each time, so every GET counts
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+	client := share_link_client(token, r)
+	resumed := r.Method == http.MethodGet && !info.IsDir() && resumes_download(r, etag, info.Size(), download_progress(client))
+	if !resumed && link.Used_up() {
+		http.Error(w, "This link has expired", http.StatusGone)
+		return
+	}
+	if r.Method == http.MethodGet && !resumed {
+		if err := User_Handler.Count_share_link_download(token); err != nil {
+			http.Error(w, "This link has expired", http.StatusGone)
+			return
+		}
+	}
+	if info.IsDir() {
+		serveShareLinkFolder(w, r, link)
+		return
+	}
+	file, err := sandbox.Open(link.Path)
+	if err != nil {
+		http.Error(w, "Unable to read the file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+	w.Header().Set("ETag", etag)
+	if r.Method == http.MethodHead {
+		http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+		return
+	}
+	counter := &counting_writer{ResponseWriter: w}
+	http.ServeContent(counter, r, info.Name(), info.ModTime(), file)
+	start := int64(0)
+	if counter.status == http.StatusPartialContent {
+		start, _ = range_start(r)
+	}
+	if counter.status == http.StatusOK || counter.status == http.StatusPartialContent {
+		set_download_progress(client, start+counter.written, info.Size())
+	}
+}
+
+// Where each client's download of a link stopped, by token and client address. Only a request going on from there
+// is a resumed download, anything else counts as another one
+type download_progress_entry struct {
+	next       int64
+	updated_at time.Time
+}
+
+// A download left alone longer than this counts again when it is resumed
+const shareLinkResumeWindow = time.Hour
+
+var downloadProgress = map[string]download_progress_entry{}
+var downloadProgressMutex sync.Mutex
+
+func share_link_client(token string, r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return token + " " + host
+}
+
+// Offset the client's last download of the link stopped at, 0 when there is nothing to resume
+func download_progress(client string) int64 {
+	downloadProgressMutex.Lock()
+	defer downloadProgressMutex.Unlock()
+	progress, found := downloadProgress[client]
+	if !found || time.Since(progress.updated_at) > shareLinkResumeWindow {
+		return 0
+	}
+	return progress.next
+}
+
+// A finished download leaves nothing to resume
+func set_download_progress(client string, next, size int64) {
+	downloadProgressMutex.Lock()
+	defer downloadProgressMutex.Unlock()
+	for key, progress := range downloadProgress {
+		if time.Since(progress.updated_at) > shareLinkResumeWindow {
+			delete(downloadProgress, key)
+		}
+	}
+	if next <= 0 || next >= size {
+		delete(downloadProgress, client)
+		return
+	}
+	downloadProgress[client] = download_progress_entry{next, time.Now()}
+}
+
+// Counts what was sent, so a download cut short is resumed from where it really stopped
+type counting_writer struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *counting_writer) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *counting_writer) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *counting_writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Start of a single range, false for anything else. Suffix ranges and several ranges can fetch the file piece by
+// piece from anywhere
+func range_start(r *http.Request) (int64, bool) {
+	spec, found := strings.CutPrefix(r.Header.Get("Range"), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, false
+	}
+	first, _, found := strings.Cut(strings.TrimSpace(spec), "-")
+	start, err := strconv.ParseInt(first, 10, 64)
+	return start, found && err == nil
+}
+
+// Only a single range starting exactly where the client's previous download of the link stopped is taken as
+// resuming. Starting anywhere else would let a client fetch the file again and again without it being counted, and
+// a stale If-Range gets the whole file anyway
+func resumes_download(r *http.Request, etag string, size, next int64) bool {
+	if if_range := r.Header.Get("If-Range"); if_range != "" && if_range != etag {
+		return false
+	}
+	start, single := range_start(r)
+	return single && next > 0 && start == next && start < size
+}
+
+// The zip is written while the folder is walked, so an error halfway can only cut the download short
+func serveShareLinkFolder(w http.ResponseWriter, r *http.Request, link User_Handler.Share_Link) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(link.Path) + ".zip"}))
+	if r.Method == http.MethodHead {
+		return
+	}
+	sandbox := User_Handler.User_sandbox(link.Owner)
+	archive := zip.NewWriter(w)
+	err := sandbox.WalkDir(link.Path, func(entry_path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil || entry_path == link.Path || !(info.IsDir() || info.Mode().IsRegular()) {
+			// Symlinks and devices are left out
+			return err
+		}
+		header, err := zip.FileInfoHeader(User_Handler.Own_file_info(sandbox, entry_path, info))
+		if err != nil {
+			return err
+		}
+		header.Name = strings.TrimPrefix(entry_path, link.Path+"/")
+		if info.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+		writer, err := archive.CreateHeader(header)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		file, err := sandbox.Open(entry_path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(writer, file)
+		return err
+	})
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		println("Share link " + link.ID + " download stopped: " + err.Error())
+	}
+}
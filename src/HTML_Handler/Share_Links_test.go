@@ -0,0 +1,115 @@
+package HTML_Handler
+
+import (
+	"ServerController/src/User_Handler"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// A file of alice's storage behind a link
+func sharedFile(t *testing.T, content string, max_downloads int) User_Handler.Share_Link {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	os.MkdirAll("res/config_files", 0700)
+	os.MkdirAll("users_data/alice/folder", 0700)
+	if err := os.WriteFile("users_data/alice/file.bin", []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile("users_data/alice/folder/inside.txt", []byte("inside"), 0600)
+	link, err := User_Handler.Create_share_link("alice", "file.bin", "", 0, max_downloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+// The link as it is now, the other tests' links are loaded too
+func currentShareLink(t *testing.T, id string) User_Handler.Share_Link {
+	t.Helper()
+	for _, link := range User_Handler.List_share_links("alice") {
+		if link.ID == id {
+			return link
+		}
+	}
+	t.Fatalf("link %s is gone", id)
+	return User_Handler.Share_Link{}
+}
+
+func getShareLink(t *testing.T, token, client, ranges string) *httptest.ResponseRecorder {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/s/{token}", handleShareLink)
+	r := httptest.NewRequest(http.MethodGet, "/s/"+token, nil)
+	r.RemoteAddr = client + ":4000"
+	if ranges != "" {
+		r.Header.Set("Range", ranges)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestShareLinkRangesCantSkipTheCount(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	token := path.Base(sharedFile(t, content, 1).URL)
+	steps := []struct {
+		client, ranges string
+		status         int
+		body           string
+	}{
+		// The only download allowed, taken one byte at first
+		{"192.0.2.1", "bytes=0-0", http.StatusPartialContent, "0"},
+		// Going on from there is the same download
+		{"192.0.2.1", "bytes=1-", http.StatusPartialContent, content[1:]},
+		// Asking again for what was already sent is another one
+		{"192.0.2.1", "bytes=1-", http.StatusGone, ""},
+		{"192.0.2.1", "bytes=-999", http.StatusGone, ""},
+		{"192.0.2.1", "bytes=1-1,2-", http.StatusGone, ""},
+		{"192.0.2.2", "bytes=1-", http.StatusGone, ""},
+		{"192.0.2.2", "", http.StatusGone, ""},
+	}
+	for i, step := range steps {
+		w := getShareLink(t, token, step.client, step.ranges)
+		if w.Code != step.status {
+			t.Fatalf("step %d (%s %q): status %d, want %d", i, step.client, step.ranges, w.Code, step.status)
+		}
+		if step.body != "" && w.Body.String() != step.body {
+			t.Fatalf("step %d: got %d bytes, want %d", i, w.Body.Len(), len(step.body))
+		}
+	}
+}
+
+func TestShareLinkResumes(t *testing.T) {
+	content := strings.Repeat("abcdefghij", 100)
+	link := sharedFile(t, content, 2)
+	token := path.Base(link.URL)
+	for i, ranges := range []string{"bytes=0-99", "bytes=100-499", "bytes=500-"} {
+		if w := getShareLink(t, token, "192.0.2.1", ranges); w.Code != http.StatusPartialContent {
+			t.Fatalf("part %d: status %d", i, w.Code)
+		}
+	}
+	// Another client starting in the middle doesn't resume anything
+	getShareLink(t, token, "192.0.2.2", "bytes=500-")
+	if downloads := currentShareLink(t, link.ID).Downloads; downloads != 2 {
+		t.Errorf("%d downloads counted, want 2", downloads)
+	}
+}
+
+func TestShareLinkFolderCountsEveryGet(t *testing.T) {
+	sharedFile(t, "content", 0)
+	link, err := User_Handler.Create_share_link("alice", "folder", "", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := path.Base(link.URL)
+	if w := getShareLink(t, token, "192.0.2.1", ""); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if w := getShareLink(t, token, "192.0.2.1", "bytes=100-"); w.Code != http.StatusGone {
+		t.Errorf("a range of a folder wasn't counted: status %d", w.Code)
+	}
+}
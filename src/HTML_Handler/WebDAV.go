@@ -0,0 +1,71 @@
+package HTML_Handler
+
+import (
+	"ServerController/src/User_Handler"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// Where the users mount their storage as a network drive
+const davPrefix = "/dav"
+
+// One handler per user, each with its own locks since the same path means a different file for each of them
+var davHandlers = map[string]*webdav.Handler{}
+var davMutex sync.Mutex
+
+func davHandler(username string) *webdav.Handler {
+	davMutex.Lock()
+	defer davMutex.Unlock()
+	handler, exists := davHandlers[username]
+	if !exists {
+		handler = &webdav.Handler{
+			Prefix:     davPrefix,
+			FileSystem: User_Handler.User_webdav_storage(username),
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, webdav.ErrLocked) {
+					println("WebDAV " + r.Method + " " + r.URL.Path + " failed: " + err.Error())
+				}
+			},
+		}
+		davHandlers[username] = handler
+	}
+	return handler
+}
+
+// Desktop file managers only speak basic auth, asked again with every request
+func handleWebDAV(w http.ResponseWriter, r *http.Request) {
+	username, password, given := r.BasicAuth()
+	if !given || !User_Handler.Authenticate_user(username, password) {
+		if given {
+			// Slows down the guessing
+			time.Sleep(time.Second)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+Server_name+`", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// Listing the whole storage in one answer is refused (RFC 4918 9.1), and a missing depth means the folder
+	// and its content instead of everything under it
+	if r.Method == "PROPFIND" {
+		switch r.Header.Get("Depth") {
+		case "":
+			r.Header.Set("Depth", "1")
+		case "infinity":
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?><D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`))
+			return
+		}
+	}
+	// Big files take longer than the web server's timeouts
+	controller := http.NewResponseController(w)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+	davHandler(username).ServeHTTP(w, r)
+}
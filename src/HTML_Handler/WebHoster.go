@@ -3,6 +3,8 @@ package HTML_Handler
 import (
 	"ServerController/src/API_Handler"
 	common "ServerController/src/Common"
+	"ServerController/src/Discovery_Handler"
+	"ServerController/src/User_Handler"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -36,11 +38,14 @@ var activitiesMap = map[string]func(http.ResponseWriter, *http.Request){
 }
 
 var commandsMap = map[string]command{
-	"login":           {"Let the user login based on credentials, and gives permisions based on user details, determined by the admin { login [username] [password] }", handleLoginCommand, true},
-	"logout":          {"Logs out the user, giving him access to switch to other accounts", handleLogOutCommand, false},
-	"whoami":          {"Specify the account you are connected", handleWhoAmICommand, false},
-	"change_password": {"Changes the password of the user that you are logged in as { change_password [new_password]}", handleChangePassword, false},
-	"add_user":        {"Creates a new user { add_user [username] [password] [is_admin](optional, default false) [admin_grade](optional, default 1)}", handleAddUserCommand, false},
+	"login":            {"Let the user login based on credentials, and gives permisions based on user details, determined by the admin { login [username] [password] }", handleLoginCommand, true},
+	"logout":           {"Logs out the user, giving him access to switch to other accounts", handleLogOutCommand, false},
+	"whoami":           {"Specify the account you are connected", handleWhoAmICommand, false},
+	"change_password":  {"Changes the password of the user that you are logged in as { change_password [new_password]}", handleChangePassword, false},
+	"add_user":         {"Creates a new user { add_user [username] [password] [is_admin](optional, default false) [admin_grade](optional, default 1)}", handleAddUserCommand, false},
+	"discover":         {"Lists the other controllers found on the local network { discover [timeout_seconds](optional, default 2) }", handleDiscoverCommand, false},
+	"list_connections": {"Lists the live TCP API connections (admins only)", handleListConnectionsCommand, false},
+	"kick_connection":  {"Closes a TCP API connection (admins only) { kick_connection [connection_id] }", handleKickConnectionCommand, false},
 }
 
 func init() {
@@ -58,6 +63,20 @@ func user_is_logged(r *http.Request) bool {
 	return true
 }
 
+// The user of the session token given at login. Unlike the username cookie it can't be made up by the client
+func session_user(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie("SVC_session")
+	if err != nil {
+		return "", false
+	}
+	return User_Handler.Token_user(cookie.Value)
+}
+
+func user_is_admin(r *http.Request) bool {
+	username, logged := session_user(r)
+	return logged && User_Handler.LoadedUsers[username].Admin
+}
+
 func GetFileContentsAsString(filePath string) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -194,31 +213,50 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	jsonResponse, _ := json.Marshal(serverStatus(cookie.Value))
+	w.Write(jsonResponse)
+}
+
+func serverStatus(username string) map[string]interface{} {
 	// Your JS expects these fields:
 	_, totalMemory, _ := common.GetMemoryUsage()
-	response := map[string]interface{}{
+	return map[string]interface{}{
 		"status":      "success",
-		"username":    cookie.Value,
-		"port":        "5050",
+		"username":    username,
+		"port":        API_Handler.GetServerPort(),
 		"startTime":   API_Handler.StartTime,
 		"cpu":         common.GetCPUUsage(),
 		"memory":      totalMemory,
 		"connections": API_Handler.GetNumberOfConnections(),
 	}
+}
 
-	jsonResponse, _ := json.Marshal(response)
+func handServerDetails(w http.ResponseWriter, r *http.Request) {
+	jsonResponse, _ := json.Marshal(serverDetails())
 	w.Write(jsonResponse)
 }
 
-func handServerDetails(w http.ResponseWriter, r *http.Request) {
-	response := map[string]interface{}{
+func serverDetails() map[string]interface{} {
+	return map[string]interface{}{
 		"status":      "success",
 		"server_name": Server_name,
 		"server_uid":  common.GetOrCreateID(),
 		"port":        API_Handler.GetServerPort(),
+		"protocol":    API_Handler.ProtocolVersion,
+	}
+}
+
+// The same details as handServerDetails, in the shape advertised over mDNS
+func DiscoveryService() Discovery_Handler.Service {
+	uid := common.GetOrCreateID()
+	port := API_Handler.GetServerPort()
+	return Discovery_Handler.Service{
+		Instance: Server_name + " " + uid[:min(8, len(uid))],
+		Host:     Discovery_Handler.HostName(uid),
+		Port:     port,
+		Addrs:    Discovery_Handler.LocalAddresses(nil),
+		TXT:      Discovery_Handler.TXTRecords(uid, Server_name, port, API_Handler.ProtocolVersion),
 	}
-	jsonResponse, _ := json.Marshal(response)
-	w.Write(jsonResponse)
 }
 
 func StartWebHoster(serverRunning chan<- bool) {
@@ -230,12 +268,18 @@ func StartWebHoster(serverRunning chan<- bool) {
 	http.HandleFunc("/api/command", handleCommands)
 	http.HandleFunc("/api/activities", handleActivities)
 	http.HandleFunc("/api/status", handleStatus)
+	http.HandleFunc("/api/ws", handleWebSocketGateway)
+	http.HandleFunc("/s/{token}", handleShareLink)
+	http.HandleFunc(davPrefix, handleWebDAV)
+	http.HandleFunc(davPrefix+"/", handleWebDAV)
 	http.HandleFunc("/WebServerController/details", handServerDetails)
+	registerRESTRoutes()
 
 	ipAddress := common.GetOutboundIP()
 	port := "8080"
 	addr := ipAddress.String() + ":" + port
-	fmt.Println("Web server starting at: http://" + addr)
+	common.WebServerURL = "http://" + addr
+	fmt.Println("Web server starting at: " + common.WebServerURL)
 	server = &http.Server{
 		Addr:         addr,
 		ReadTimeout:  15 * time.Second,
@@ -0,0 +1,276 @@
+package HTML_Handler
+
+import (
+	"ServerController/src/API_Handler"
+	common "ServerController/src/Common"
+	"ServerController/src/User_Handler"
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Magic value from RFC 6455, used to compute Sec-WebSocket-Accept
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Biggest message accepted from the browser
+const maxWebSocketMessage = 16 * 1024 * 1024
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Makes a WebSocket look like the raw TCP connection the API handler expects:
+// every incoming message becomes one line, every written line becomes one text message
+type websocketConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	pending    []byte
+	writeMutex sync.Mutex
+	closed     bool
+}
+
+// Upgrades the request to a WebSocket carrying the TCP API frames. The session is already logged in as the user of
+// the login's session token
+func handleWebSocketGateway(w http.ResponseWriter, r *http.Request) {
+	username, logged := session_user(r)
+	if !logged {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || !headerContains(r.Header, "Connection", "upgrade") {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	// The cookie would be sent by any page, so only our own page may open the socket
+	if origin := r.Header.Get("Origin"); origin != "" {
+		parsed, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(parsed.Host, r.Host) {
+			http.Error(w, "Cross origin WebSocket requests are not allowed", http.StatusForbidden)
+			return
+		}
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSockets are not supported by this server", http.StatusInternalServerError)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	// The HTTP server timeouts don't apply to a long lived socket
+	conn.SetDeadline(time.Time{})
+
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+	if err := buffered.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	user := User_Handler.LoadedUsers[username]
+	ws := &websocketConn{Conn: conn, reader: buffered.Reader}
+	API_Handler.ServeConnection(ws, user.Username, user.Admin)
+}
+
+func headerContains(header http.Header, name, value string) bool {
+	for _, field := range header.Values(name) {
+		for _, part := range strings.Split(field, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ws *websocketConn) Read(p []byte) (int, error) {
+	for len(ws.pending) == 0 {
+		binary, message, err := ws.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		// Binary messages carry binary frames of the TCP API, which have no line ending
+		if binary {
+			ws.pending = message
+		} else {
+			ws.pending = append(message, '\n')
+		}
+	}
+	n := copy(p, ws.pending)
+	ws.pending = ws.pending[n:]
+	return n, nil
+}
+
+// Reads a whole data message, answering the control frames found on the way
+func (ws *websocketConn) readMessage() (bool, []byte, error) {
+	var message []byte
+	binary, started := false, false
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return false, nil, err
+		}
+		// Control frames may come between the fragments of a message, but can't be fragmented themselves
+		if opcode >= opClose && (!fin || len(payload) > 125) {
+			ws.writeFrame(opClose, closePayload(1002, "Invalid control frame"))
+			return false, nil, errors.New("invalid websocket control frame")
+		}
+		switch opcode {
+		case opPing:
+			ws.writeFrame(opPong, payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			ws.writeFrame(opClose, nil)
+			return false, nil, io.EOF
+		case opText, opBinary, opContinuation:
+			// Only a continuation goes on with a message, and only a started message goes on
+			if (opcode == opContinuation) != started {
+				ws.writeFrame(opClose, closePayload(1002, "Unexpected fragment"))
+				return false, nil, errors.New("websocket fragments out of order")
+			}
+			started = true
+			if opcode == opBinary {
+				binary = true
+			}
+			message = append(message, payload...)
+			if len(message) > maxWebSocketMessage {
+				ws.writeFrame(opClose, closePayload(1009, "Message too big"))
+				return false, nil, errors.New("websocket message too big")
+			}
+			if fin {
+				return binary, message, nil
+			}
+		default:
+			ws.writeFrame(opClose, closePayload(1002, "Unknown opcode"))
+			return false, nil, errors.New("unknown websocket opcode")
+		}
+	}
+}
+
+func (ws *websocketConn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	if header[0]&0x70 != 0 {
+		// No extension is ever agreed on
+		return false, 0, nil, errors.New("reserved websocket bits set")
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if !masked {
+		// Browsers must mask everything they send
+		return false, 0, nil, errors.New("unmasked websocket frame from client")
+	}
+	if length > maxWebSocketMessage {
+		return false, 0, nil, errors.New("websocket frame too big")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// Every write from the API handler is a single frame ending with a new line, sent as one text message.
+// Binary frames go as they are in a binary message
+func (ws *websocketConn) Write(p []byte) (int, error) {
+	if len(p) > 0 && p[0] == common.FrameMarker {
+		if err := ws.writeFrame(opBinary, p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if err := ws.writeFrame(opText, []byte(strings.TrimSuffix(string(p), "\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ws *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	if ws.closed {
+		return net.ErrClosed
+	}
+	if opcode == opClose {
+		ws.closed = true
+	}
+	frame := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+	frame = append(frame, payload...)
+	_, err := ws.Conn.Write(frame)
+	return err
+}
+
+func (ws *websocketConn) Close() error {
+	ws.writeFrame(opClose, closePayload(1000, ""))
+	return ws.Conn.Close()
+}
+
+func closePayload(code uint16, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, code), reason...)
+}
@@ -0,0 +1,286 @@
+package HTML_Handler
+
+import (
+	"ServerController/src/User_Handler"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// What the gateway writes is kept, what it reads comes from the frames the test prepared
+type recordedConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordedConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func testWebsocket(frames ...[]byte) (*websocketConn, *recordedConn) {
+	conn := &recordedConn{}
+	return &websocketConn{Conn: conn, reader: bufio.NewReader(bytes.NewReader(bytes.Join(frames, nil)))}, conn
+}
+
+// A frame as a browser sends it, masked and with the shortest length encoding
+func clientFrame(fin bool, opcode byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(len(payload)))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(len(payload)))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+	return frame
+}
+
+type serverFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// A frame sent by the gateway, which must never be masked
+func readServerFrame(t *testing.T, reader io.Reader) serverFrame {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatal("the server masked a frame")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		io.ReadFull(reader, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+		if length < 126 {
+			t.Errorf("a 16 bit length of %d", length)
+		}
+	case 127:
+		var extended [8]byte
+		io.ReadFull(reader, extended[:])
+		length = binary.BigEndian.Uint64(extended[:])
+		if length <= 0xFFFF {
+			t.Errorf("a 64 bit length of %d", length)
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatalf("frame cut short: %v", err)
+	}
+	return serverFrame{header[0]&0x80 != 0, header[0] & 0x0F, payload}
+}
+
+func serverFrames(t *testing.T, data []byte) []serverFrame {
+	t.Helper()
+	var frames []serverFrame
+	reader := bytes.NewReader(data)
+	for reader.Len() > 0 {
+		frames = append(frames, readServerFrame(t, reader))
+	}
+	return frames
+}
+
+func TestWebsocketLengths(t *testing.T) {
+	for _, length := range []int{0, 1, 125, 126, 127, 0xFFFF, 0x10000, 100000} {
+		message := bytes.Repeat([]byte{'x'}, length)
+		ws, conn := testWebsocket(clientFrame(true, opText, message))
+		received, err := io.ReadAll(io.LimitReader(ws, int64(length+1)))
+		if err != nil || !bytes.Equal(received, append(message, '\n')) {
+			t.Errorf("message of %d bytes read as %d bytes, %v", length, len(received), err)
+		}
+		// Written back, the line ending is left out
+		ws.Write(append(message, '\n'))
+		frames := serverFrames(t, conn.written.Bytes())
+		if len(frames) != 1 || !frames[0].fin || frames[0].opcode != opText || !bytes.Equal(frames[0].payload, message) {
+			t.Errorf("message of %d bytes written as %d frames", length, len(frames))
+		}
+	}
+}
+
+func TestWebsocketMasking(t *testing.T) {
+	frame := clientFrame(true, opText, []byte(`{"cmd":"describe"}`))
+	if frame[6] == '{' {
+		t.Fatal("the test frame isn't masked")
+	}
+	ws, _ := testWebsocket(frame)
+	line, err := bufio.NewReader(ws).ReadString('\n')
+	if err != nil || line != "{\"cmd\":\"describe\"}\n" {
+		t.Errorf("unmasked to %q, %v", line, err)
+	}
+
+	// Browsers must mask, an unmasked frame ends the connection
+	unmasked := []byte{0x80 | opText, 2, 'h', 'i'}
+	ws, _ = testWebsocket(unmasked)
+	if _, err := ws.Read(make([]byte, 10)); err == nil {
+		t.Error("an unmasked frame was accepted")
+	}
+}
+
+func TestWebsocketFragmentation(t *testing.T) {
+	ws, conn := testWebsocket(
+		clientFrame(false, opText, []byte("hel")),
+		clientFrame(true, opPing, []byte("are you there")),
+		clientFrame(false, opContinuation, []byte("lo ")),
+		clientFrame(true, opPong, nil),
+		clientFrame(true, opContinuation, []byte("world")),
+		clientFrame(false, opBinary, []byte{0, 1}),
+		clientFrame(true, opContinuation, []byte{2, 3}),
+	)
+	received := make([]byte, 100)
+	n, err := io.ReadAtLeast(ws, received, len("hello world\n")+4)
+	if err != nil || string(received[:n]) != "hello world\n\x00\x01\x02\x03" {
+		t.Errorf("read %q, %v", received[:n], err)
+	}
+	// The ping in the middle of the message was answered with the same payload
+	frames := serverFrames(t, conn.written.Bytes())
+	if len(frames) != 1 || frames[0].opcode != opPong || string(frames[0].payload) != "are you there" {
+		t.Errorf("answered the ping with %+v", frames)
+	}
+}
+
+func TestWebsocketClose(t *testing.T) {
+	ws, conn := testWebsocket(clientFrame(true, opClose, closePayload(1000, "bye")), clientFrame(true, opText, []byte("late")))
+	if _, err := ws.Read(make([]byte, 10)); err != io.EOF {
+		t.Errorf("read %v after a close, want EOF", err)
+	}
+	frames := serverFrames(t, conn.written.Bytes())
+	if len(frames) != 1 || frames[0].opcode != opClose {
+		t.Errorf("answered the close with %+v", frames)
+	}
+	// Nothing goes out after the close frame
+	if _, err := ws.Write([]byte("too late\n")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("writing after the close: %v", err)
+	}
+}
+
+func TestWebsocketProtocolErrors(t *testing.T) {
+	tooBig := bytes.Repeat([]byte{'x'}, maxWebSocketMessage/2+1)
+	tests := []struct {
+		name   string
+		frames [][]byte
+		status uint16 // Of the close frame sent back, 0 when the connection is just dropped
+	}{
+		{"fragmented ping", [][]byte{clientFrame(false, opPing, nil)}, 1002},
+		{"ping over 125 bytes", [][]byte{clientFrame(true, opPing, bytes.Repeat([]byte{'x'}, 126))}, 1002},
+		{"continuation first", [][]byte{clientFrame(true, opContinuation, []byte("x"))}, 1002},
+		{"new message in the middle of one", [][]byte{clientFrame(false, opText, []byte("a")), clientFrame(true, opText, []byte("b"))}, 1002},
+		{"unknown opcode", [][]byte{clientFrame(true, 0x3, nil)}, 1002},
+		{"reserved bit", [][]byte{append([]byte{0x80 | 0x40 | opText}, clientFrame(true, opText, nil)[1:]...)}, 0},
+		{"frame over the limit", [][]byte{clientFrame(true, opText, make([]byte, maxWebSocketMessage+1))}, 0},
+		{"message over the limit", [][]byte{clientFrame(false, opText, tooBig), clientFrame(true, opContinuation, tooBig)}, 1009},
+		{"cut short", [][]byte{clientFrame(true, opText, []byte("hello"))[:8]}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ws, conn := testWebsocket(test.frames...)
+			if _, err := ws.Read(make([]byte, 10)); err == nil || err == io.EOF {
+				t.Fatalf("read ended with %v, want an error", err)
+			}
+			frames := serverFrames(t, conn.written.Bytes())
+			if test.status == 0 {
+				if len(frames) != 0 {
+					t.Errorf("sent %+v", frames)
+				}
+				return
+			}
+			if len(frames) != 1 || frames[0].opcode != opClose || binary.BigEndian.Uint16(frames[0].payload) != test.status {
+				t.Errorf("sent %+v, want a close with status %d", frames, test.status)
+			}
+		})
+	}
+}
+
+// Binary frames of the TCP API go in binary messages, the lines in text messages
+func TestWebsocketWritesBinaryFrames(t *testing.T) {
+	ws, conn := testWebsocket()
+	ws.Write([]byte{0, 0, 0, 0, 0, 1, 'x'})
+	ws.Write([]byte("{\"status\":\"success\"}\n"))
+	frames := serverFrames(t, conn.written.Bytes())
+	if len(frames) != 2 || frames[0].opcode != opBinary || frames[1].opcode != opText || string(frames[1].payload) != `{"status":"success"}` {
+		t.Errorf("wrote %+v", frames)
+	}
+}
+
+func upgradeRequest(t *testing.T, address string, cookies ...*http.Cookie) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	request, _ := http.NewRequest(http.MethodGet, "http://"+address+"/api/ws", nil)
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for _, cookie := range cookies {
+		request.AddCookie(cookie)
+	}
+	request.Write(conn)
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, response
+}
+
+// The display cookie can be set to anything by the browser, only the login's session token opens the socket
+func TestWebsocketGatewayNeedsTheSessionToken(t *testing.T) {
+	t.Chdir(t.TempDir())
+	users := User_Handler.LoadedUsers
+	t.Cleanup(func() { User_Handler.LoadedUsers = users })
+	User_Handler.LoadedUsers = map[string]User_Handler.User{"root": {Username: "root", Admin: true}}
+	server := httptest.NewServer(http.HandlerFunc(handleWebSocketGateway))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	forged := []*http.Cookie{{Name: "SVC_username", Value: "root"}, {Name: "SVC_session", Value: "root"}}
+	if _, _, response := upgradeRequest(t, address, forged...); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("forged cookies: status %d, want 401", response.StatusCode)
+	}
+
+	token, _ := User_Handler.Create_token("root")
+	conn, reader, response := upgradeRequest(t, address, &http.Cookie{Name: "SVC_session", Value: token})
+	if response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("session token: status %d, accept %q", response.StatusCode, response.Header.Get("Sec-WebSocket-Accept"))
+	}
+	// The socket is logged in as the token's user, an admin
+	conn.Write(clientFrame(true, opText, []byte(`{"cmd":"list_account_requests","args":[]}`)))
+	frame := readServerFrame(t, reader)
+	var result struct{ Status string }
+	json.Unmarshal(frame.payload, &result)
+	if frame.opcode != opText || result.Status != "success" {
+		t.Errorf("list_account_requests as root answered %s", frame.payload)
+	}
+
+	User_Handler.Revoke_token(token)
+	if _, _, response := upgradeRequest(t, address, &http.Cookie{Name: "SVC_session", Value: token}); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d, want 401", response.StatusCode)
+	}
+}
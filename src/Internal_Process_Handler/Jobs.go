@@ -0,0 +1,133 @@
+package Internal_Process_Handler
+
+import (
+	"ServerController/src/Event_Handler"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	JobRunning  = "running"
+	JobFinished = "finished"
+	JobFailed   = "failed"
+)
+
+// Finished jobs are forgotten after this long
+const jobRetention = 24 * time.Hour
+
+// A script run, started by a user and kept around so its output can be fetched later
+type Job struct {
+	ID          string    `json:"id"`
+	Owner       string    `json:"owner"`
+	Script      string    `json:"script"`
+	Private     bool      `json:"private"`
+	Status      string    `json:"status"`
+	Output      string    `json:"output"`
+	Error       string    `json:"error,omitempty"`
+	Started_At  time.Time `json:"started_at"`
+	Finished_At time.Time `json:"finished_at,omitzero"`
+
+	done chan struct{}
+}
+
+var jobs = map[string]*Job{}
+var jobsMutex sync.Mutex
+
+func newJobID() string {
+	bytes := make([]byte, 8)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// Runs the script in the background and returns right away
+func Start_job(owner, script string, private bool) *Job {
+	job := &Job{
+		ID:         newJobID(),
+		Owner:      owner,
+		Script:     script,
+		Private:    private,
+		Status:     JobRunning,
+		Started_At: time.Now(),
+		done:       make(chan struct{}),
+	}
+	jobsMutex.Lock()
+	cleanupJobs()
+	jobs[job.ID] = job
+	jobsMutex.Unlock()
+
+	go func() {
+		output := ""
+		path, err := Script_path(private, script)
+		if err == nil {
+			output, err = RunScript([]string{path})
+		}
+		jobsMutex.Lock()
+		job.Output = output
+		job.Status = JobFinished
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+		}
+		job.Finished_At = time.Now()
+		jobsMutex.Unlock()
+		close(job.done)
+
+		Event_Handler.Publish(Event_Handler.Event{
+			Topic:    Event_Handler.ScriptFinished,
+			Data:     map[string]string{"job": job.ID, "script": script, "error": job.Error},
+			Username: owner,
+		})
+	}()
+	return job
+}
+
+// Blocks until the job is done and returns a copy of its final state
+func (job *Job) Wait() Job {
+	<-job.done
+	return job.Snapshot()
+}
+
+// Copy of the job that is safe to read while it's still running
+func (job *Job) Snapshot() Job {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	return *job
+}
+
+func Get_job(id string) (Job, bool) {
+	jobsMutex.Lock()
+	job, exists := jobs[id]
+	jobsMutex.Unlock()
+	if !exists {
+		return Job{}, false
+	}
+	return job.Snapshot(), true
+}
+
+// Lists the jobs of the given user, or everyone's when the owner is empty. Newest first
+func List_jobs(owner string) []Job {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	result := []Job{}
+	for _, job := range jobs {
+		if owner == "" || job.Owner == owner {
+			result = append(result, *job)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Started_At.After(result[j].Started_At)
+	})
+	return result
+}
+
+// Must be called with jobsMutex held
+func cleanupJobs() {
+	for id, job := range jobs {
+		if job.Status != JobRunning && time.Since(job.Finished_At) > jobRetention {
+			delete(jobs, id)
+		}
+	}
+}
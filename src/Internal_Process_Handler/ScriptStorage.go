@@ -0,0 +1,81 @@
+package Internal_Process_Handler
+
+import (
+	common "ServerController/src/Common"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+var ErrScriptExists = errors.New("script already exists")
+var ErrUnknownScript = errors.New("unknown script")
+
+// Folder the script lives in, private scripts are reserved to the admins
+func Scripts_folder(private bool) string {
+	if private {
+		return "scripts/private/"
+	}
+	return "scripts/public/"
+}
+
+// Script names are file names in their folder, nothing else is reachable through them
+func scripts_sandbox(private bool, name string) (common.Sandbox, error) {
+	cleaned, err := common.CleanSandboxPath(name)
+	if err != nil || cleaned == "." || strings.Contains(cleaned, "/") {
+		return common.Sandbox{}, common.ErrInvalidPath
+	}
+	return common.NewSandbox(Scripts_folder(private)), nil
+}
+
+// Path of the script to run, only when it is a file of the scripts folder
+func Script_path(private bool, name string) (string, error) {
+	sandbox, err := scripts_sandbox(private, name)
+	if err != nil {
+		return "", err
+	}
+	info, err := sandbox.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", ErrUnknownScript
+	}
+	return sandbox.Resolve(name)
+}
+
+func List_scripts(private bool) []string {
+	var result []string
+	entries, err := os.ReadDir(Scripts_folder(private))
+	if err != nil {
+		return result
+	}
+	for i := 0; i < len(entries); i++ {
+		result = append(result, entries[i].Name())
+	}
+	return result
+}
+
+func Save_script(private bool, name string, content []byte) error {
+	return Save_script_from(private, name, bytes.NewReader(content))
+}
+
+func Save_script_from(private bool, name string, content io.Reader) error {
+	sandbox, err := scripts_sandbox(private, name)
+	if err != nil {
+		return err
+	}
+	file, err := sandbox.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0700)
+	if errors.Is(err, os.ErrExist) {
+		return ErrScriptExists
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		sandbox.Remove(name)
+	}
+	return err
+}
@@ -2,19 +2,44 @@ package main
 
 import (
 	"ServerController/src/API_Handler"
+	common "ServerController/src/Common"
+	"ServerController/src/Discovery_Handler"
 	"ServerController/src/HTML_Handler"
 	"ServerController/src/User_Handler"
 	"context"
+	"fmt"
+	"os"
+	"sync"
 )
 
 var serverRunning = make(chan bool)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sync" {
+		if err := runSyncMode(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "ServerController: sync:", err)
+			os.Exit(1)
+		}
+		return
+	}
 	ctx, cancel := context.WithCancel(context.Background())
+	common.LoadServerConfig()
 	User_Handler.Load_users()
 	User_Handler.Load_requests()
+	User_Handler.Load_uploads()
+	User_Handler.Load_shares()
+	User_Handler.Load_share_links()
+	User_Handler.Load_blob_metadata()
+	// The background workers write to disk until ctx is done, so main waits for them before returning
+	var workers sync.WaitGroup
+	workers.Go(func() { User_Handler.Start_janitor(ctx) })
+	workers.Go(func() { User_Handler.Start_indexer(ctx) })
+	workers.Go(func() { User_Handler.Start_thumbnailer(ctx) })
 	go HTML_Handler.StartWebHoster(serverRunning)
 	go API_Handler.StartAPIHoster(ctx, serverRunning)
+	if err := Discovery_Handler.StartAdvertiser(ctx, Discovery_Handler.Config{}, HTML_Handler.DiscoveryService); err != nil {
+		println("Unable to advertise the server on the local network: " + err.Error())
+	}
 	for isRunning := range serverRunning {
 		if !isRunning {
 			break
@@ -27,4 +52,6 @@ func main() {
 	API_Handler.StopAPIHoster()
 	HTML_Handler.WaitForWebHoster()
 	API_Handler.WaitForAPIHoster()
+	Discovery_Handler.WaitForAdvertiser()
+	workers.Wait()
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"ServerController/src/client"
+	"ServerController/src/client/foldersync"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// ServerController sync LOCAL runs the binary as a sync client of another server instead of as a server: the local
+// folder and a folder of the user's storage are kept the same, both ways, like hsctl sync
+func runSyncMode(args []string) error {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: ServerController sync LOCAL (--web URL | --address HOST:PORT) --user NAME [--password P] [--remote PATH] [--interval DURATION] [--once]")
+		flags.PrintDefaults()
+	}
+	web := flags.String("web", "", "web panel address, the TCP port is discovered from it")
+	address := flags.String("address", "", "TCP API address (host:port)")
+	username := flags.String("user", "", "username")
+	password := flags.String("password", "", "password (default: $HSC_PASSWORD or asked)")
+	remote := flags.String("remote", "", "folder of your storage to sync with (default: all of it)")
+	interval := flags.Duration("interval", 5*time.Second, "how often the local folder is checked when it can't be watched")
+	once := flags.Bool("once", false, "sync once and stop")
+	// The folder may come before the flags or after them
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(positional) != 1 {
+		flags.Usage()
+		return errors.New("give one local folder")
+	}
+	local := positional[0]
+	if (*web == "") == (*address == "") {
+		return errors.New("give either --web or --address")
+	}
+	if *username == "" {
+		return errors.New("--user is required")
+	}
+	if *password == "" {
+		*password = os.Getenv("HSC_PASSWORD")
+	}
+	if *password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	options := client.Options{Client_Name: "ServerController sync"}
+	var c *client.Client
+	var err error
+	if *web != "" {
+		c, err = client.DialWebServer(ctx, *web, options)
+	} else {
+		c, err = client.Dial(ctx, *address, options)
+	}
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Login(ctx, *username, *password); err != nil {
+		return err
+	}
+	s, err := foldersync.New(c, local, *remote)
+	if err != nil {
+		return err
+	}
+	s.Name = "ServerController"
+	if *once {
+		return s.Cycle(ctx)
+	}
+	return s.Run(ctx, *interval)
+}
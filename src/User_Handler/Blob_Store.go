@@ -0,0 +1,510 @@
+package User_Handler
+
+import (
+	common "ServerController/src/Common"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identical files are kept once: the content lives in the blob store under its SHA-256, and every copy in the users'
+// storage, trash and versions is a hard link to it. The link count is the reference count. The copies share the
+// inode, so each copy's own modification time and permissions are kept in the blob metadata. Where hard links
+// aren't available the files are kept as they are, and the storage report tells deduplication is inactive
+const Blobs_folder = "users_blobs/"
+
+// By the real path of the copies, an entry only counts while the file there is linked to the blob it names
+const blobMetadataFile = "res/config_files/blob_metadata.json"
+
+// Temporary links older than this were left by a crash
+const blobTemporaryLifetime = time.Hour
+
+var blobsMutex sync.Mutex
+
+// The first failed link is told, the others would only repeat it
+var blobLinkFailed bool
+
+type blob_metadata struct {
+	Hash     string      `json:"hash"`
+	Modified time.Time   `json:"modified"`
+	Mode     fs.FileMode `json:"mode"`
+}
+
+var blobMetadata = map[string]blob_metadata{}
+var blobMetadataMutex sync.RWMutex
+
+// What a copy looks like to its owner, the inode holding the time and permissions of whichever copy came first
+type own_file_info struct {
+	fs.FileInfo
+	metadata blob_metadata
+}
+
+func (info own_file_info) ModTime() time.Time {
+	return info.metadata.Modified
+}
+
+func (info own_file_info) Mode() fs.FileMode {
+	return info.FileInfo.Mode()&^fs.ModePerm | info.metadata.Mode.Perm()
+}
+
+type Blob_GC_Result struct {
+	Removed int   `json:"removed"`
+	Freed   int64 `json:"freed"`
+}
+
+type Blob_Damage struct {
+	Hash       string `json:"hash"`
+	Actual     string `json:"actual"` // Hash of what the blob holds now
+	Size       int64  `json:"size"`
+	References uint64 `json:"references"`
+}
+
+type Fsck_Result struct {
+	Checked   int           `json:"checked"`
+	Corrupted []Blob_Damage `json:"corrupted"`
+}
+
+// Logical is what the users see (and what their own usage tells), Real what the disk holds
+type Storage_Report struct {
+	Deduplication string `json:"deduplication"` // "active", "off", or why it can't work
+	Logical       int64  `json:"logical"`
+	Real          int64  `json:"real"`
+	Saved         int64  `json:"saved"`
+	Blobs         int    `json:"blobs"`
+	References    uint64 `json:"references"`
+	Unreferenced  int    `json:"unreferenced"`
+}
+
+type Blob_Scan_Result struct {
+	Scanned      int   `json:"scanned"`
+	Deduplicated int   `json:"deduplicated"`
+	Saved        int64 `json:"saved"`
+}
+
+func Load_blob_metadata() {
+	blobMetadataMutex.Lock()
+	defer blobMetadataMutex.Unlock()
+	file, err := os.ReadFile(blobMetadataFile)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(file, &blobMetadata); err != nil || blobMetadata == nil {
+		println("Could not parse the blob metadata, the deduplicated files show the time of their first copy")
+		blobMetadata = map[string]blob_metadata{}
+	}
+}
+
+// Must be called with blobMetadataMutex held
+func save_blob_metadata() {
+	data, err := json.MarshalIndent(blobMetadata, "", "  ")
+	if err != nil {
+		println("Could not marshal blob metadata: " + err.Error())
+		return
+	}
+	if err := os.WriteFile(blobMetadataFile, data, 0600); err != nil {
+		println("Could not write blob metadata to file: " + err.Error())
+	}
+}
+
+func metadata_key(real string) string {
+	return filepath.ToSlash(filepath.Clean(real))
+}
+
+// The info of a file of the sandbox with its own modification time and permissions, when it is linked to a blob
+func Own_file_info(sandbox common.Sandbox, name string, info fs.FileInfo) fs.FileInfo {
+	name, err := common.CleanSandboxPath(name)
+	if err != nil {
+		return info
+	}
+	return own_info(filepath.Join(sandbox.Path, filepath.FromSlash(name)), info)
+}
+
+func own_info(real string, info fs.FileInfo) fs.FileInfo {
+	if info == nil || !info.Mode().IsRegular() {
+		return info
+	}
+	blobMetadataMutex.RLock()
+	metadata, found := blobMetadata[metadata_key(real)]
+	blobMetadataMutex.RUnlock()
+	if !found {
+		return info
+	}
+	if blob, err := os.Stat(blob_path(metadata.Hash)); err != nil || !os.SameFile(info, blob) {
+		// Written again or deleted since
+		return info
+	}
+	return own_file_info{info, metadata}
+}
+
+// Nil forgets the entry
+func set_blob_metadata(real string, metadata *blob_metadata) {
+	blobMetadataMutex.Lock()
+	defer blobMetadataMutex.Unlock()
+	key := metadata_key(real)
+	if _, found := blobMetadata[key]; !found && metadata == nil {
+		return
+	}
+	if metadata == nil {
+		delete(blobMetadata, key)
+	} else {
+		blobMetadata[key] = *metadata
+	}
+	save_blob_metadata()
+}
+
+// Follows a file or a folder renamed on the disk, from and to are real paths
+func move_blob_metadata(from, to string) {
+	blobMetadataMutex.Lock()
+	defer blobMetadataMutex.Unlock()
+	from, to = metadata_key(from), metadata_key(to)
+	moved := map[string]blob_metadata{}
+	for key, metadata := range blobMetadata {
+		if key == from || strings.HasPrefix(key, from+"/") {
+			moved[to+strings.TrimPrefix(key, from)] = metadata
+			delete(blobMetadata, key)
+		}
+	}
+	if len(moved) == 0 {
+		return
+	}
+	maps.Copy(blobMetadata, moved)
+	save_blob_metadata()
+}
+
+// Same within a sandbox, from and to are paths of it
+func move_sandbox_metadata(sandbox common.Sandbox, from, to string) {
+	from, err := common.CleanSandboxPath(from)
+	if err != nil {
+		return
+	}
+	to, err = common.CleanSandboxPath(to)
+	if err != nil {
+		return
+	}
+	move_blob_metadata(filepath.Join(sandbox.Path, filepath.FromSlash(from)), filepath.Join(sandbox.Path, filepath.FromSlash(to)))
+}
+
+// Forgets the entries of the files deleted, written again or gone out of the blob store
+func prune_blob_metadata() {
+	blobMetadataMutex.Lock()
+	defer blobMetadataMutex.Unlock()
+	changed := false
+	for key, metadata := range blobMetadata {
+		info, err := os.Lstat(filepath.FromSlash(key))
+		blob, blobErr := os.Stat(blob_path(metadata.Hash))
+		if err != nil || blobErr != nil || !os.SameFile(info, blob) {
+			delete(blobMetadata, key)
+			changed = true
+		}
+	}
+	if changed {
+		save_blob_metadata()
+	}
+}
+
+// Must be called with blobsMutex held
+func blob_link_failed(err error) {
+	if !blobLinkFailed {
+		blobLinkFailed = true
+		println("Deduplication is inactive, the blob store can't link files: " + err.Error())
+	}
+}
+
+// Deduplication needs hard links between the blob store and the users' storage
+func check_blob_links() error {
+	for _, folder := range []string{Blobs_folder, User_folder("")} {
+		if err := os.MkdirAll(folder, 0700); err != nil {
+			return err
+		}
+	}
+	probe := Blobs_folder + "probe." + history_id()
+	if err := os.WriteFile(probe, nil, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(probe)
+	link := User_folder("") + ".blob_probe." + history_id()
+	if err := os.Link(probe, link); err != nil {
+		return err
+	}
+	return os.Remove(link)
+}
+
+func blob_path(hash string) string {
+	return Blobs_folder + hash[:2] + "/" + hash
+}
+
+// Blobs are named by their hash, anything else in the store is a temporary link
+func is_blob_name(name string) bool {
+	decoded, err := hex.DecodeString(name)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+func hash_file(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Replaces the file at path of the owner's storage by a link to the blob of its content, the file becoming the
+// blob when its content is new. True when an existing blob was used
+func store_blob(username, path, hash string) bool {
+	if !common.Config.Deduplicate_Files || !is_blob_name(hash) {
+		return false
+	}
+	real, err := User_sandbox(username).Resolve(path)
+	if err != nil {
+		return false
+	}
+	info, err := os.Lstat(real)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+
+	blobsMutex.Lock()
+	defer blobsMutex.Unlock()
+	blob := blob_path(hash)
+	if err := os.MkdirAll(filepath.Dir(blob), 0700); err != nil {
+		return false
+	}
+	existing, err := os.Lstat(blob)
+	if errors.Is(err, os.ErrNotExist) {
+		// The file becomes the blob, its time and permissions are the inode's
+		if err := os.Link(real, blob); err != nil {
+			blob_link_failed(err)
+		}
+		set_blob_metadata(real, nil)
+		return false
+	}
+	if err != nil || os.SameFile(existing, info) || existing.Size() != info.Size() {
+		return false
+	}
+	// Linked next to the blob first, so the file is replaced in one step
+	temporary := blob + "." + history_id()
+	if err := os.Link(blob, temporary); err != nil {
+		blob_link_failed(err)
+		return false
+	}
+	set_blob_metadata(real, &blob_metadata{hash, info.ModTime(), info.Mode().Perm()})
+	if os.Rename(temporary, real) != nil {
+		os.Remove(temporary)
+		set_blob_metadata(real, nil)
+		return false
+	}
+	return true
+}
+
+// Hashes a file of the owner's storage and stores it in the blob store
+func dedupe_path(username, path string) bool {
+	if !common.Config.Deduplicate_Files {
+		return false
+	}
+	real, err := User_sandbox(username).Resolve(path)
+	if err != nil {
+		return false
+	}
+	hash, err := hash_file(real)
+	if err != nil {
+		return false
+	}
+	return store_blob(username, path, hash)
+}
+
+// Removes the file about to be rewritten, so a blob shared with other files is never truncated
+func unlink_previous(username, path string) error {
+	sandbox := User_sandbox(username)
+	info, err := sandbox.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	return sandbox.Remove(path)
+}
+
+// Gives a linked file its own copy of the content, before it is changed in place
+func detach_blob(username, path string) error {
+	real, err := User_sandbox(username).Resolve(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(real)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	if links, err := common.LinkCount(real); err != nil || links < 2 {
+		return nil
+	}
+	info = own_info(real, info)
+	source, err := os.Open(real)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	if err := os.MkdirAll(Blobs_folder, 0700); err != nil {
+		return err
+	}
+	temporary := Blobs_folder + "detach." + history_id()
+	copy, err := os.OpenFile(temporary, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(copy, source)
+	if closeErr := copy.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		os.Chtimes(temporary, info.ModTime(), info.ModTime())
+		err = os.Rename(temporary, real)
+	}
+	if err != nil {
+		os.Remove(temporary)
+	}
+	return err
+}
+
+// Calls fn for each blob with its hash and its real path
+func walkBlobs(fn func(hash, path string, info fs.FileInfo)) {
+	filepath.WalkDir(Blobs_folder, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err == nil && info.Mode().IsRegular() {
+			fn(entry.Name(), path, info)
+		}
+		return nil
+	})
+}
+
+// Deletes the blobs nothing links to anymore, and the temporary links left by a crash
+func Collect_blobs() Blob_GC_Result {
+	blobsMutex.Lock()
+	defer blobsMutex.Unlock()
+	defer prune_blob_metadata()
+	var result Blob_GC_Result
+	walkBlobs(func(hash, path string, info fs.FileInfo) {
+		if !is_blob_name(hash) {
+			if time.Since(info.ModTime()) > blobTemporaryLifetime && os.Remove(path) == nil {
+				result.Removed++
+			}
+			return
+		}
+		links, err := common.LinkCount(path)
+		if err == nil && links == 1 && os.Remove(path) == nil {
+			result.Removed++
+			result.Freed += info.Size()
+		}
+	})
+	return result
+}
+
+// Hashes every blob again, a damaged blob means every file linked to it is damaged
+func Check_blobs() Fsck_Result {
+	result := Fsck_Result{Corrupted: []Blob_Damage{}}
+	walkBlobs(func(hash, path string, info fs.FileInfo) {
+		if !is_blob_name(hash) {
+			return
+		}
+		result.Checked++
+		actual, err := hash_file(path)
+		if err != nil {
+			actual = "unreadable: " + err.Error()
+		}
+		if actual != hash {
+			links, _ := common.LinkCount(path)
+			result.Corrupted = append(result.Corrupted, Blob_Damage{hash, actual, info.Size(), max(links, 1) - 1})
+		}
+	})
+	return result
+}
+
+func Get_storage_report() Storage_Report {
+	report := Storage_Report{Deduplication: "active"}
+	if !common.Config.Deduplicate_Files {
+		report.Deduplication = "off"
+	} else if err := check_blob_links(); err != nil {
+		report.Deduplication = "inactive, hard links don't work here: " + err.Error()
+	}
+	for _, folder := range []string{User_folder(""), Trash_folder, Versions_folder} {
+		report.Logical += pathSize(folder)
+	}
+	var unreferenced int64
+	walkBlobs(func(hash, path string, info fs.FileInfo) {
+		if !is_blob_name(hash) {
+			unreferenced += info.Size()
+			return
+		}
+		links, err := common.LinkCount(path)
+		if err != nil {
+			return
+		}
+		report.Blobs++
+		report.References += links - 1
+		switch {
+		case links == 1:
+			report.Unreferenced++
+			unreferenced += info.Size()
+		case links > 2:
+			report.Saved += int64(links-2) * info.Size()
+		}
+	})
+	report.Real = report.Logical - report.Saved + unreferenced
+	return report
+}
+
+// Puts the files written before deduplication was turned on in the blob store
+func Scan_blobs() Blob_Scan_Result {
+	var result Blob_Scan_Result
+	if !common.Config.Deduplicate_Files {
+		return result
+	}
+	users, _ := os.ReadDir(User_folder(""))
+	for _, user := range users {
+		if !user.IsDir() {
+			continue
+		}
+		sandbox := User_sandbox(user.Name())
+		sandbox.WalkDir(".", func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || !entry.Type().IsRegular() {
+				return nil
+			}
+			real, err := sandbox.Resolve(path)
+			if err != nil {
+				return nil
+			}
+			if links, err := common.LinkCount(real); err != nil || links > 1 {
+				return nil
+			}
+			result.Scanned++
+			if dedupe_path(user.Name(), path) {
+				result.Deduplicated++
+				if info, err := entry.Info(); err == nil {
+					result.Saved += info.Size()
+				}
+			}
+			return nil
+		})
+	}
+	return result
+}
+
+func runBlobCollector() {
+	if result := Collect_blobs(); result.Removed > 0 {
+		fmt.Printf("Janitor removed %d unused blobs, %d bytes freed\n", result.Removed, result.Freed)
+	}
+}
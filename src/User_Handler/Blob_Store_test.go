@@ -0,0 +1,97 @@
+package User_Handler
+
+import (
+	common "ServerController/src/Common"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeUserFile(t *testing.T, username, name, content string, mode fs.FileMode, modified time.Time) string {
+	t.Helper()
+	sandbox := User_sandbox(username)
+	if err := sandbox.MkdirAll(".", 0700); err != nil {
+		t.Fatal(err)
+	}
+	real, err := sandbox.Resolve(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(real, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(real, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(hash[:])
+}
+
+func TestDeduplicatedCopiesKeepTheirOwnMetadata(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll("res/config_files", 0700)
+	common.Config.Deduplicate_Files = true
+	blobMetadata = map[string]blob_metadata{}
+	if err := check_blob_links(); err != nil {
+		t.Skip("hard links are not available: " + err.Error())
+	}
+
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	hash := writeUserFile(t, "alice", "photo.jpg", "the same photo", 0600, first)
+	store_blob("alice", "photo.jpg", hash)
+	writeUserFile(t, "bob", "photo.jpg", "the same photo", 0640, second)
+	if !store_blob("bob", "photo.jpg", hash) {
+		t.Fatal("the second copy wasn't linked to the blob")
+	}
+
+	check := func(username, name string, modified time.Time, mode fs.FileMode) {
+		t.Helper()
+		entry, err := Stat_user_path(username, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !entry.Modified.Equal(modified) || entry.Mode != mode.String() {
+			t.Errorf("%s's %s: modified %v, mode %s, want %v, %s", username, name, entry.Modified, entry.Mode, modified, mode)
+		}
+	}
+	check("alice", "photo.jpg", first, 0600)
+	check("bob", "photo.jpg", second, 0640)
+
+	if err := Move_user_path("bob", "photo.jpg", "holidays.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	check("bob", "holidays.jpg", second, 0640)
+	entry, err := Move_to_trash("bob", "holidays.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Restore_from_trash("bob", entry.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	check("bob", "holidays.jpg", second, 0640)
+	check("alice", "photo.jpg", first, 0600)
+
+	// Written again, the copy has its own inode and the entry no longer counts
+	if err := unlink_previous("bob", "holidays.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	third := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeUserFile(t, "bob", "holidays.jpg", "another photo", 0600, third)
+	check("bob", "holidays.jpg", third, 0600)
+	Collect_blobs()
+	if len(blobMetadata) != 0 {
+		t.Errorf("the stale entries were kept: %v", blobMetadata)
+	}
+
+	if report := Get_storage_report(); report.Deduplication != "active" {
+		t.Errorf("deduplication is %q, want active", report.Deduplication)
+	}
+	common.Config.Deduplicate_Files = false
+	if report := Get_storage_report(); report.Deduplication != "off" {
+		t.Errorf("deduplication is %q, want off", report.Deduplication)
+	}
+}
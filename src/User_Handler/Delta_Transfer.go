@@ -0,0 +1,119 @@
+package User_Handler
+
+import (
+	common "ServerController/src/Common"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Deltas are rebuilt next to the uploads, a file left by a crash is removed by Load_uploads
+const deltaStagingPrefix = "delta."
+
+// Stops the rebuilt file at the announced size, a delta can copy the same blocks over and over
+type delta_output struct {
+	writer    io.Writer
+	remaining int64
+}
+
+func (o *delta_output) Write(p []byte) (int, error) {
+	if int64(len(p)) > o.remaining {
+		n, _ := o.writer.Write(p[:o.remaining])
+		o.remaining -= int64(n)
+		return n, ErrUploadTooBig
+	}
+	n, err := o.writer.Write(p)
+	o.remaining -= int64(n)
+	return n, err
+}
+
+// Signature of a file the user can read, the blocks come from the returned reader which the caller closes.
+// A block size of 0 picks one from the size of the file
+func Open_file_signature(username, path string, block_size int) (common.FileSignature, io.ReadCloser, error) {
+	file, info, err := Open_user_file(username, path)
+	if err != nil {
+		return common.FileSignature{}, nil, err
+	}
+	if block_size == 0 {
+		block_size = common.DeltaBlockSize(info.Size())
+	}
+	if !common.ValidDeltaBlockSize(block_size) {
+		file.Close()
+		return common.FileSignature{}, nil, common.ErrInvalidBlockSize
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		defer file.Close()
+		writer.CloseWithError(common.WriteSignature(writer, file, block_size))
+	}()
+	return common.FileSignature{Size: info.Size(), Block_Size: block_size}, reader, nil
+}
+
+// Rebuilds a file from its current content and a delta made against its signature. The result has to match size
+// and hash before it replaces the file, the previous content becoming a version
+func Apply_file_delta(username, path string, block_size int, size int64, hash string, delta io.Reader) error {
+	hash = strings.ToLower(hash)
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+		return ErrInvalidHash
+	}
+	if size < 0 {
+		return ErrUploadTooBig
+	}
+	if !common.ValidDeltaBlockSize(block_size) {
+		return common.ErrInvalidBlockSize
+	}
+	path, err := common.CleanSandboxPath(path)
+	if err != nil || path == "." {
+		return common.ErrInvalidPath
+	}
+	target, err := resolve_path(username, path, true)
+	if err != nil {
+		return err
+	}
+	base, err := target.sandbox().Open(target.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrUnknownPath
+	}
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	base_info, err := base.Stat()
+	if err != nil {
+		return err
+	}
+	if !base_info.Mode().IsRegular() {
+		return ErrNotAFile
+	}
+
+	if err := os.MkdirAll(Upload_staging_folder, 0700); err != nil {
+		return err
+	}
+	staged := staging_path(deltaStagingPrefix+history_id(), ".part")
+	file, err := os.OpenFile(staged, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	written, err := common.ApplyDelta(&delta_output{io.MultiWriter(file, hasher), size}, base, base_info.Size(), block_size, delta)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && written != size {
+		err = ErrUploadIncomplete
+	}
+	// The base changing while the delta was made shows here too
+	if err == nil && hex.EncodeToString(hasher.Sum(nil)) != hash {
+		err = ErrHashMismatch
+	}
+	if err == nil {
+		err = place_staged_file(target, staged, hash)
+	}
+	if err != nil {
+		os.Remove(staged)
+	}
+	return err
+}
@@ -0,0 +1,287 @@
+package User_Handler
+
+import (
+	common "ServerController/src/Common"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrPathExists = errors.New("path already exists")
+var ErrInvalidSort = errors.New("unknown sort key")
+var ErrInvalidMove = errors.New("a path can't be moved or copied onto itself or inside itself")
+
+func folder_entry(name, entry_path string, info fs.FileInfo) Folder_Entry {
+	return Folder_Entry{
+		Name:     name,
+		Path:     entry_path,
+		Type:     info.Mode().Type().String(),
+		Size:     info.Size(),
+		Modified: info.ModTime(),
+		Mode:     info.Mode().String(),
+	}
+}
+
+func Stat_user_path(username, name string) (Folder_Entry, error) {
+	cleaned, err := common.CleanSandboxPath(name)
+	if err != nil {
+		return Folder_Entry{}, err
+	}
+	if _, found, err := shared_entries(username, cleaned); found {
+		if err != nil {
+			return Folder_Entry{}, err
+		}
+		entry := virtual_entry(path.Base(cleaned), time.Time{})
+		entry.Path = cleaned
+		return entry, nil
+	}
+	resolved, err := resolve_path(username, cleaned, false)
+	if err != nil {
+		return Folder_Entry{}, err
+	}
+	info, err := resolved.sandbox().Lstat(resolved.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Folder_Entry{}, ErrUnknownPath
+	}
+	if err != nil {
+		return Folder_Entry{}, err
+	}
+	info = Own_file_info(resolved.sandbox(), resolved.path, info)
+	if cleaned == "." {
+		return folder_entry(info.Name(), cleaned, info), nil
+	}
+	// The name the user sees, a shared folder can be renamed in "Shared with me"
+	return folder_entry(path.Base(cleaned), cleaned, info), nil
+}
+
+// Every file and folder under path, with their path as the user sees it. The listing of the root doesn't go into
+// "Shared with me", a listing of it or in it does
+func List_user_folder_recursive(username, path string) ([]Folder_Entry, error) {
+	path, err := common.CleanSandboxPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if entries, found, err := shared_entries(username, path); found {
+		if err != nil {
+			return nil, err
+		}
+		results := []Folder_Entry{}
+		for _, entry := range entries {
+			entry.Path = path + "/" + entry.Name
+			content, err := List_user_folder_recursive(username, entry.Path)
+			if err != nil {
+				continue
+			}
+			results = append(append(results, entry), content...)
+		}
+		return results, nil
+	}
+	resolved, err := resolve_path(username, path, false)
+	if err != nil {
+		return nil, err
+	}
+	results := []Folder_Entry{}
+	err = resolved.sandbox().WalkDir(resolved.path, func(entry_path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if resolved.share == nil && entry_path == Shared_folder {
+			// Hidden by the virtual one
+			return fs.SkipDir
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			// Deleted while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry_path != resolved.path {
+			results = append(results, folder_entry(entry.Name(), resolved.view(entry_path), Own_file_info(resolved.sandbox(), entry_path, info)))
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrUnknownPath
+	}
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Sorts by name, size, modified or type (the extension), folders always come first
+func Sort_folder_entries(entries []Folder_Entry, by string, descending bool) error {
+	var less func(a, b Folder_Entry) bool
+	switch by {
+	case "", "name":
+		less = func(a, b Folder_Entry) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) }
+	case "size":
+		less = func(a, b Folder_Entry) bool { return a.Size < b.Size }
+	case "modified":
+		less = func(a, b Folder_Entry) bool { return a.Modified.Before(b.Modified) }
+	case "type":
+		less = func(a, b Folder_Entry) bool {
+			return strings.ToLower(path.Ext(a.Name)) < strings.ToLower(path.Ext(b.Name))
+		}
+	default:
+		return ErrInvalidSort
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Is_folder() != b.Is_folder() {
+			return a.Is_folder()
+		}
+		if descending {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+	return nil
+}
+
+func (entry Folder_Entry) Is_folder() bool {
+	return strings.HasPrefix(entry.Type, "d")
+}
+
+// Moves a file, or a folder with everything in it, to the trash of its owner
+func Delete_user_path(username, path string) error {
+	resolved, err := resolve_path(username, path, true)
+	if err != nil {
+		return err
+	}
+	if resolved.is_share_root() {
+		return ErrSharedFolder
+	}
+	_, err = Move_to_trash(resolved.owner, resolved.path)
+	return err
+}
+
+// Renames or moves a file or folder, nothing gets overwritten. Between two users' storages it is a copy followed
+// by a delete
+func Move_user_path(username, from, to string) error {
+	source, destination, err := checkTransfer(username, from, to, true)
+	if err != nil {
+		return err
+	}
+	if source.is_share_root() {
+		return ErrSharedFolder
+	}
+	if source.owner != destination.owner {
+		if err := copy_path(source, destination); err != nil {
+			return err
+		}
+		if err := source.sandbox().RemoveAll(source.path); err != nil {
+			return err
+		}
+		publishFileChange(source.owner, source.path, "deleted")
+		return nil
+	}
+	if err := source.sandbox().Rename(source.path, destination.path); err != nil {
+		return err
+	}
+	move_sandbox_metadata(source.sandbox(), source.path, destination.path)
+	move_shares(source.owner, source.path, destination.path)
+	move_share_links(source.owner, source.path, destination.path)
+	publishFileChange(source.owner, source.path, "deleted")
+	publishFileChange(destination.owner, destination.path, "created")
+	return nil
+}
+
+// Copies a file, or a folder with everything in it, nothing gets overwritten
+func Copy_user_path(username, from, to string) error {
+	source, destination, err := checkTransfer(username, from, to, false)
+	if err != nil {
+		return err
+	}
+	return copy_path(source, destination)
+}
+
+func copy_path(source, destination user_path) error {
+	from, to := source.sandbox(), destination.sandbox()
+	err := from.WalkDir(source.path, func(entry_path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := destination.path + strings.TrimPrefix(entry_path, source.path)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.IsDir():
+			return to.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode().IsRegular():
+			hash, err := copyUserFile(from, to, entry_path, target, info.Mode().Perm())
+			if err == nil {
+				store_blob(destination.owner, target, hash)
+			}
+			return err
+		}
+		// Symlinks and devices are left out
+		return nil
+	})
+	if err != nil {
+		// A half made copy is of no use
+		to.RemoveAll(destination.path)
+		return err
+	}
+	publishFileChange(destination.owner, destination.path, "created")
+	return nil
+}
+
+// Gives the hash of what was copied, for the blob store
+func copyUserFile(from_sandbox, to_sandbox common.Sandbox, from, to string, perm fs.FileMode) (string, error) {
+	source, err := from_sandbox.Open(from)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+	destination, err := to_sandbox.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return "", err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(destination, hasher), source)
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), err
+}
+
+// The source has to exist, the destination must not, and a folder can't go inside itself.
+// Writing is needed at the destination, and at the source too for a move
+func checkTransfer(username, from, to string, moving bool) (user_path, user_path, error) {
+	source, err := resolve_path(username, from, moving)
+	if err != nil {
+		return user_path{}, user_path{}, err
+	}
+	destination, err := resolve_path(username, to, true)
+	if err != nil {
+		return user_path{}, user_path{}, err
+	}
+	same := source.owner == destination.owner
+	if source.path == "." || destination.path == "." || destination.is_share_root() ||
+		(same && (destination.path == source.path || strings.HasPrefix(destination.path, source.path+"/"))) {
+		return user_path{}, user_path{}, ErrInvalidMove
+	}
+	if _, err := source.sandbox().Lstat(source.path); errors.Is(err, os.ErrNotExist) {
+		return user_path{}, user_path{}, ErrUnknownPath
+	} else if err != nil {
+		return user_path{}, user_path{}, err
+	}
+	if _, err := destination.sandbox().Lstat(destination.path); err == nil {
+		return user_path{}, user_path{}, ErrPathExists
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return user_path{}, user_path{}, err
+	}
+	return source, destination, destination.sandbox().MkdirAll(path.Dir(destination.path), 0700)
+}
@@ -1,6 +1,7 @@
 package User_Handler
 
 import (
+	"ServerController/src/Event_Handler"
 	"encoding/json"
 	"os"
 	"time"
@@ -27,6 +28,12 @@ func Load_requests() {
 		// Parse JSON and load users
 		_ = json.Unmarshal(file, &Loaded_Requests)
 	}
+	for username := range Loaded_Requests {
+		if !Valid_username(username) {
+			println("Ignoring the account request with an invalid name: " + username)
+			delete(Loaded_Requests, username)
+		}
+	}
 
 }
 
@@ -49,6 +56,9 @@ func Request_exists(username string) bool {
 }
 
 func Insert_account_request(username string, password string) (bool, string) {
+	if !Valid_username(username) {
+		return false, "Invalid username"
+	}
 	if User_exists(username) {
 		return false, "Username already exists"
 	}
@@ -63,10 +73,16 @@ func Insert_account_request(username string, password string) (bool, string) {
 		Request_At: time.Now().Format(time.RFC3339),
 	}
 	save_requests()
+	Event_Handler.Publish(Event_Handler.Event{
+		Topic:      Event_Handler.UserRequested,
+		Data:       map[string]string{"username": username},
+		Admin_only: true,
+	})
 	return true, "Request placed successfully"
 }
 
-func Accept_account_request(username string, admin bool, grade uint8) {
+// accepted_by is the admin who accepted it, for the event
+func Accept_account_request(username string, admin bool, grade uint8, accepted_by string) {
 	request := Loaded_Requests[username]
 	LoadedUsers[username] = User{
 		Username:    username,
@@ -80,4 +96,18 @@ func Accept_account_request(username string, admin bool, grade uint8) {
 	delete(Loaded_Requests, username)
 	Save_users()
 	save_requests()
+	Event_Handler.Publish(Event_Handler.Event{
+		Topic:      Event_Handler.UserAccepted,
+		Data:       map[string]string{"username": username, "accepted_by": accepted_by},
+		Admin_only: true,
+	})
+}
+
+func Reject_account_request(username string) bool {
+	if !Request_exists(username) {
+		return false
+	}
+	delete(Loaded_Requests, username)
+	save_requests()
+	return true
 }
@@ -0,0 +1,356 @@
+package User_Handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The files of each user are indexed for search_files: an inverted index from the terms of the names, paths and
+// text contents to the files holding them, one .json file per user. The index follows the changes of the storage,
+// and the whole storage is checked again every hour for what changed behind the server's back
+const Index_folder = "users_index/"
+
+// Bumped when the format changes, an index of another version is built again
+const searchIndexVersion = 1
+
+const searchRescanInterval = time.Hour
+
+// Most of a text file read for its terms, and biggest PDF read at all
+const searchTextLimit = 1 << 20
+const searchPDFLimit = 32 << 20
+
+// Terms kept per file, a huge text file doesn't fill the index on its own
+const searchMaxTerms = 20000
+
+const (
+	searchMinTermLength = 2
+	searchMaxTermLength = 40
+)
+
+// Extensions the system doesn't always know
+var searchMimeTypes = map[string]string{
+	".txt":      "text/plain",
+	".log":      "text/plain",
+	".md":       "text/markdown",
+	".markdown": "text/markdown",
+	".csv":      "text/csv",
+}
+
+type search_document struct {
+	Path     string    `json:"path"` // In the owner's storage
+	Folder   bool      `json:"folder,omitempty"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Mime     string    `json:"mime,omitempty"`
+	Terms    []string  `json:"terms,omitempty"` // To take the document out of the postings again
+}
+
+type search_index struct {
+	Version   int                         `json:"version"`
+	Next      uint32                      `json:"next"`
+	Documents map[uint32]*search_document `json:"documents"`
+	Postings  map[string][]uint32         `json:"postings"` // Term to the sorted documents holding it
+
+	paths map[string]uint32
+	dirty bool
+}
+
+// A path of the owner's storage to index again, what is under it included
+type index_job struct {
+	owner string
+	path  string
+}
+
+var searchIndexes = map[string]*search_index{}
+var searchMutex sync.Mutex
+
+var indexQueue = make(chan index_job, 1024)
+
+// Owners whose changes didn't fit in the queue, their whole storage is checked instead
+var indexOverflow = map[string]bool{}
+var indexOverflowMutex sync.Mutex
+
+func index_file(owner string) string {
+	return Index_folder + owner + ".json"
+}
+
+func new_search_index() *search_index {
+	return &search_index{Version: searchIndexVersion, Documents: map[uint32]*search_document{}, Postings: map[string][]uint32{}, paths: map[string]uint32{}}
+}
+
+// Must be called with searchMutex held
+func load_search_index(owner string) *search_index {
+	if loaded, exists := searchIndexes[owner]; exists {
+		return loaded
+	}
+	loaded := new_search_index()
+	if data, err := os.ReadFile(index_file(owner)); err == nil {
+		read := new_search_index()
+		if json.Unmarshal(data, read) == nil && read.Version == searchIndexVersion && read.Documents != nil && read.Postings != nil {
+			loaded = read
+			for id, document := range loaded.Documents {
+				loaded.paths[document.Path] = id
+			}
+		}
+	}
+	searchIndexes[owner] = loaded
+	return loaded
+}
+
+// Must be called with searchMutex held
+func save_search_index(owner string, index *search_index) {
+	if !index.dirty {
+		return
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		println("Could not marshal the search index of " + owner + ": " + err.Error())
+		return
+	}
+	if err := os.MkdirAll(Index_folder, 0700); err != nil {
+		return
+	}
+	temporary := index_file(owner) + ".tmp"
+	if err := os.WriteFile(temporary, data, 0600); err != nil {
+		println("Could not write the search index of " + owner + ": " + err.Error())
+		return
+	}
+	if err := os.Rename(temporary, index_file(owner)); err != nil {
+		os.Remove(temporary)
+		return
+	}
+	index.dirty = false
+}
+
+func save_search_indexes() {
+	searchMutex.Lock()
+	defer searchMutex.Unlock()
+	for owner, index := range searchIndexes {
+		save_search_index(owner, index)
+	}
+}
+
+func (index *search_index) remove(id uint32) {
+	document := index.Documents[id]
+	for _, term := range document.Terms {
+		postings := index.Postings[term]
+		if i, found := slices.BinarySearch(postings, id); found {
+			postings = slices.Delete(postings, i, i+1)
+		}
+		if len(postings) == 0 {
+			delete(index.Postings, term)
+		} else {
+			index.Postings[term] = postings
+		}
+	}
+	delete(index.paths, document.Path)
+	delete(index.Documents, id)
+	index.dirty = true
+}
+
+func (index *search_index) put(document *search_document) {
+	if id, exists := index.paths[document.Path]; exists {
+		index.remove(id)
+	}
+	index.Next++
+	id := index.Next
+	index.Documents[id] = document
+	index.paths[document.Path] = id
+	// Ids only go up, so appending keeps the postings sorted
+	for _, term := range document.Terms {
+		index.Postings[term] = append(index.Postings[term], id)
+	}
+	index.dirty = true
+}
+
+// Lowercased words of text, each once
+func search_terms(text string, limit int) []string {
+	seen := map[string]bool{}
+	terms := []string{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		length := utf8.RuneCountInString(word)
+		if length < searchMinTermLength || length > searchMaxTermLength || seen[word] {
+			continue
+		}
+		if len(terms) == limit {
+			break
+		}
+		seen[word] = true
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+// Type of the file from its extension, or from its first bytes when the extension says nothing
+func detect_mime(file *os.File, name string) string {
+	extension := strings.ToLower(path.Ext(name))
+	detected := searchMimeTypes[extension]
+	if detected == "" {
+		detected = mime.TypeByExtension(extension)
+	}
+	if detected == "" {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(file, head)
+		detected = http.DetectContentType(head[:n])
+	}
+	if media_type, _, err := mime.ParseMediaType(detected); err == nil {
+		return media_type
+	}
+	return detected
+}
+
+// Text of the files search_files looks into: plain text, markdown and the text of PDFs
+func document_text(file *os.File, media_type string) string {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return ""
+	}
+	switch {
+	case media_type == "application/pdf":
+		data, err := io.ReadAll(io.LimitReader(file, searchPDFLimit))
+		if err != nil {
+			return ""
+		}
+		return pdf_text(data)
+	case strings.HasPrefix(media_type, "text/"):
+		data, err := io.ReadAll(io.LimitReader(file, searchTextLimit))
+		if err != nil || !utf8.Valid(data[:max(len(data)-utf8.UTFMax, 0)]) {
+			return ""
+		}
+		return string(data)
+	}
+	return ""
+}
+
+func build_document(owner, document_path string, info fs.FileInfo) *search_document {
+	document := &search_document{Path: document_path, Folder: info.IsDir(), Modified: info.ModTime()}
+	name_terms := path.Base(document_path) + " " + document_path
+	if document.Folder {
+		document.Terms = search_terms(name_terms, searchMaxTerms)
+		return document
+	}
+	document.Size = info.Size()
+	text := ""
+	if file, err := User_sandbox(owner).Open(document_path); err == nil {
+		document.Mime = detect_mime(file, document_path)
+		text = document_text(file, document.Mime)
+		file.Close()
+	}
+	document.Terms = search_terms(name_terms+" "+text, searchMaxTerms)
+	return document
+}
+
+// Brings the index of what is under root up to date: new and changed files are indexed, the ones gone are dropped
+func reindex(owner, root string) {
+	seen := map[string]bool{}
+	User_sandbox(owner).WalkDir(root, func(entry_path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry_path == "." {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || !(info.IsDir() || info.Mode().IsRegular()) {
+			return nil
+		}
+		info = Own_file_info(User_sandbox(owner), entry_path, info)
+		seen[entry_path] = true
+		searchMutex.Lock()
+		index := load_search_index(owner)
+		id, exists := index.paths[entry_path]
+		unchanged := exists && index.Documents[id].Folder == info.IsDir() && index.Documents[id].Size == info.Size() && index.Documents[id].Modified.Equal(info.ModTime())
+		searchMutex.Unlock()
+		if unchanged {
+			return nil
+		}
+		// The content is read without holding the index
+		document := build_document(owner, entry_path, info)
+		searchMutex.Lock()
+		load_search_index(owner).put(document)
+		searchMutex.Unlock()
+		return nil
+	})
+
+	searchMutex.Lock()
+	defer searchMutex.Unlock()
+	index := load_search_index(owner)
+	for document_path, id := range index.paths {
+		under := root == "." || document_path == root || strings.HasPrefix(document_path, root+"/")
+		if under && !seen[document_path] {
+			index.remove(id)
+		}
+	}
+}
+
+// Called for every change of a path of the owner's storage
+func index_change(owner, changed_path string) {
+	if is_shared_view(changed_path) {
+		return
+	}
+	select {
+	case indexQueue <- index_job{owner, changed_path}:
+	default:
+		indexOverflowMutex.Lock()
+		indexOverflow[owner] = true
+		indexOverflowMutex.Unlock()
+	}
+}
+
+func rescan_indexes() {
+	users, _ := os.ReadDir(User_folder(""))
+	for _, user := range users {
+		if user.IsDir() {
+			reindex(user.Name(), ".")
+		}
+	}
+}
+
+// Indexes the changes as they come, and the whole storage at start and every hour. The indexes are written to disk
+// once the changes calm down
+func Start_indexer(ctx context.Context) {
+	rescan_indexes()
+	save_search_indexes()
+	ticker := time.NewTicker(searchRescanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			save_search_indexes()
+			return
+		case <-ticker.C:
+			rescan_indexes()
+		case job := <-indexQueue:
+			reindex(job.owner, job.path)
+			for len(indexQueue) > 0 {
+				job = <-indexQueue
+				reindex(job.owner, job.path)
+			}
+		}
+		indexOverflowMutex.Lock()
+		overflow := indexOverflow
+		indexOverflow = map[string]bool{}
+		indexOverflowMutex.Unlock()
+		for owner := range overflow {
+			reindex(owner, ".")
+		}
+		save_search_indexes()
+	}
+}
+
+func remove_user_index(username string) {
+	searchMutex.Lock()
+	defer searchMutex.Unlock()
+	delete(searchIndexes, username)
+	os.Remove(index_file(username))
+}
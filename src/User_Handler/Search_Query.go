@@ -0,0 +1,302 @@
+package User_Handler
+
+import (
+	"errors"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Results given by search_files when the client doesn't ask for a number, and the most it may ask for
+const (
+	Search_Default_Limit = 100
+	Search_Max_Limit     = 1000
+)
+
+var ErrInvalidQuery = errors.New("invalid query: use words, name:, type:, path:, after:, before: and size>, size< (like size>10MB)")
+
+type Search_Result struct {
+	Path     string    `json:"path"` // As the user sees it
+	Name     string    `json:"name"`
+	Type     string    `json:"type"` // file or folder
+	Mime     string    `json:"mime,omitempty"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+type Search_Results struct {
+	Total   int             `json:"total"` // Matches found, more than the results when the limit cut them
+	Results []Search_Result `json:"results"`
+}
+
+type size_filter struct {
+	operator string
+	size     int64
+}
+
+// Every criterion has to match
+type search_query struct {
+	terms    []string // Whole words, or prefixes when they end with a *
+	names    []string
+	types    []string
+	paths    []string
+	after    time.Time
+	before   time.Time
+	sizes    []size_filter
+	criteria int
+}
+
+var searchSizeUnits = map[string]int64{"": 1, "b": 1, "k": 1 << 10, "kb": 1 << 10, "m": 1 << 20, "mb": 1 << 20, "g": 1 << 30, "gb": 1 << 30, "t": 1 << 40, "tb": 1 << 40}
+
+// Splits at the spaces, except between double quotes: name:"holiday photos"
+func split_query(query string) []string {
+	var tokens []string
+	var token strings.Builder
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+		default:
+			token.WriteRune(r)
+		}
+	}
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+	return tokens
+}
+
+func parse_size(value string) (int64, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	number := strings.TrimRightFunc(value, func(r rune) bool { return r >= 'a' && r <= 'z' })
+	unit, known := searchSizeUnits[value[len(number):]]
+	size, err := strconv.ParseFloat(number, 64)
+	if !known || err != nil || size < 0 {
+		return 0, false
+	}
+	return int64(size * float64(unit)), true
+}
+
+func parse_date(value string) (time.Time, bool) {
+	if date, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return date, true
+	}
+	date, err := time.Parse(time.RFC3339, value)
+	return date, err == nil
+}
+
+func parse_search_query(query string) (search_query, error) {
+	var parsed search_query
+	for _, token := range split_query(query) {
+		lowered := strings.ToLower(token)
+		if rest, is_size := strings.CutPrefix(lowered, "size"); is_size && rest != "" && strings.ContainsRune("<>=", rune(rest[0])) {
+			operator := rest[:1]
+			if len(rest) > 1 && rest[1] == '=' {
+				operator = rest[:2]
+			}
+			size, valid := parse_size(rest[len(operator):])
+			if !valid {
+				return parsed, ErrInvalidQuery
+			}
+			parsed.sizes = append(parsed.sizes, size_filter{operator, size})
+			parsed.criteria++
+			continue
+		}
+		filter, value, has_filter := strings.Cut(token, ":")
+		valid := value != ""
+		switch strings.ToLower(filter) {
+		case "name":
+			parsed.names = append(parsed.names, strings.ToLower(value))
+		case "type":
+			parsed.types = append(parsed.types, strings.TrimPrefix(strings.ToLower(value), "."))
+		case "path":
+			cleaned := strings.Trim(path.Clean("/"+value), "/")
+			parsed.paths = append(parsed.paths, cleaned)
+		case "after":
+			parsed.after, valid = parse_date(value)
+		case "before":
+			parsed.before, valid = parse_date(value)
+		default:
+			has_filter = false
+		}
+		if has_filter {
+			if !valid {
+				return parsed, ErrInvalidQuery
+			}
+			parsed.criteria++
+			continue
+		}
+		prefix := strings.HasSuffix(token, "*")
+		terms := search_terms(token, -1)
+		for i, term := range terms {
+			if prefix && i == len(terms)-1 {
+				term += "*"
+			}
+			parsed.terms = append(parsed.terms, term)
+			parsed.criteria++
+		}
+	}
+	if parsed.criteria == 0 {
+		return parsed, ErrInvalidQuery
+	}
+	return parsed, nil
+}
+
+// Documents holding every term, nil when there is no term to look for
+func (index *search_index) candidates(terms []string) []uint32 {
+	var found []uint32
+	for i, term := range terms {
+		var postings []uint32
+		if prefix, is_prefix := strings.CutSuffix(term, "*"); is_prefix {
+			for indexed, ids := range index.Postings {
+				if strings.HasPrefix(indexed, prefix) {
+					postings = append(postings, ids...)
+				}
+			}
+			slices.Sort(postings)
+			postings = slices.Compact(postings)
+		} else {
+			postings = index.Postings[term]
+		}
+		if i == 0 {
+			found = slices.Clone(postings)
+			continue
+		}
+		found = slices.DeleteFunc(found, func(id uint32) bool {
+			_, holds := slices.BinarySearch(postings, id)
+			return !holds
+		})
+	}
+	return found
+}
+
+func (query search_query) matches(document *search_document, view string) bool {
+	name := strings.ToLower(path.Base(document.Path))
+	for _, pattern := range query.names {
+		if strings.ContainsAny(pattern, "*?[") {
+			if matched, _ := path.Match(pattern, name); !matched {
+				return false
+			}
+		} else if !strings.Contains(name, pattern) {
+			return false
+		}
+	}
+	for _, wanted := range query.types {
+		if !matches_type(document, wanted) {
+			return false
+		}
+	}
+	for _, prefix := range query.paths {
+		if prefix != "" && view != prefix && !strings.HasPrefix(view, prefix+"/") {
+			return false
+		}
+	}
+	if !query.after.IsZero() && document.Modified.Before(query.after) {
+		return false
+	}
+	if !query.before.IsZero() && !document.Modified.Before(query.before) {
+		return false
+	}
+	for _, filter := range query.sizes {
+		if document.Folder {
+			return false
+		}
+		size := document.Size
+		if !(filter.operator == ">" && size > filter.size || filter.operator == ">=" && size >= filter.size ||
+			filter.operator == "<" && size < filter.size || filter.operator == "<=" && size <= filter.size ||
+			filter.operator == "=" && size == filter.size) {
+			return false
+		}
+	}
+	return true
+}
+
+// type:folder, type:file, a MIME type (image/png), its first half (image) or second half (pdf), or an extension (md)
+func matches_type(document *search_document, wanted string) bool {
+	if wanted == "folder" || wanted == "file" {
+		return document.Folder == (wanted == "folder")
+	}
+	if document.Folder {
+		return false
+	}
+	if strings.Contains(wanted, "/") {
+		return strings.HasPrefix(document.Mime, wanted)
+	}
+	major, minor, _ := strings.Cut(document.Mime, "/")
+	return wanted == major || wanted == minor || wanted == strings.TrimPrefix(strings.ToLower(path.Ext(document.Path)), ".")
+}
+
+// Where a search looks: the user's own storage, or what one share gives access to
+type search_scope struct {
+	owner string
+	share *Share
+}
+
+func (scope search_scope) view(owner_path string) string {
+	return user_path{owner: scope.owner, share: scope.share}.view(owner_path)
+}
+
+func (scope search_scope) contains(owner_path string) bool {
+	return scope.share == nil || owner_path == scope.share.Path || strings.HasPrefix(owner_path, scope.share.Path+"/")
+}
+
+// Looks through the user's files and the ones shared with them, the last modified first
+func Search_files(username, query string, limit int) (Search_Results, error) {
+	results := Search_Results{Results: []Search_Result{}}
+	parsed, err := parse_search_query(query)
+	if err != nil {
+		return results, err
+	}
+	scopes := []search_scope{{owner: username}}
+	for _, share := range List_incoming_shares(username) {
+		scopes = append(scopes, search_scope{share.Owner, &share})
+	}
+
+	searchMutex.Lock()
+	for _, scope := range scopes {
+		index := load_search_index(scope.owner)
+		consider := func(document *search_document) {
+			if !scope.contains(document.Path) {
+				return
+			}
+			view := scope.view(document.Path)
+			if !parsed.matches(document, view) {
+				return
+			}
+			result := Search_Result{view, path.Base(view), "file", document.Mime, document.Size, document.Modified}
+			if document.Folder {
+				result.Type = "folder"
+			}
+			results.Results = append(results.Results, result)
+		}
+		if len(parsed.terms) > 0 {
+			for _, id := range index.candidates(parsed.terms) {
+				consider(index.Documents[id])
+			}
+		} else {
+			for _, document := range index.Documents {
+				consider(document)
+			}
+		}
+	}
+	searchMutex.Unlock()
+
+	sort.Slice(results.Results, func(i, j int) bool {
+		if !results.Results[i].Modified.Equal(results.Results[j].Modified) {
+			return results.Results[i].Modified.After(results.Results[j].Modified)
+		}
+		return results.Results[i].Path < results.Results[j].Path
+	})
+	results.Total = len(results.Results)
+	results.Results = results.Results[:min(len(results.Results), limit)]
+	return results, nil
+}
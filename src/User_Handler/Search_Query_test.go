@@ -0,0 +1,131 @@
+package User_Handler
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		query  string
+		parsed search_query
+	}{
+		{"report", search_query{terms: []string{"report"}, criteria: 1}},
+		{"Annual REPORT", search_query{terms: []string{"annual", "report"}, criteria: 2}},
+		{"rep*", search_query{terms: []string{"rep*"}, criteria: 1}},
+		// Quotes keep the spaces in a value, a quoted term is its words
+		{`name:"holiday photos"`, search_query{names: []string{"holiday photos"}, criteria: 1}},
+		{`"annual report" name:2024`, search_query{terms: []string{"annual", "report"}, names: []string{"2024"}, criteria: 3}},
+		{`name:"*.JPG"`, search_query{names: []string{"*.jpg"}, criteria: 1}},
+		{"type:.PDF type:image", search_query{types: []string{"pdf", "image"}, criteria: 2}},
+		{"path:docs/../work/", search_query{paths: []string{"work"}, criteria: 1}},
+		{"after:2024-03-01", search_query{after: time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local), criteria: 1}},
+		{"before:2024-03-01T10:00:00Z", search_query{before: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), criteria: 1}},
+		{"size>10MB", search_query{sizes: []size_filter{{">", 10 << 20}}, criteria: 1}},
+		{"SIZE>=1.5k size<2g", search_query{sizes: []size_filter{{">=", 1536}, {"<", 2 << 30}}, criteria: 2}},
+		{"size=0", search_query{sizes: []size_filter{{"=", 0}}, criteria: 1}},
+		// An unknown prefix is no filter, its words are looked for
+		{"author:alice", search_query{terms: []string{"author", "alice"}, criteria: 2}},
+		{"size", search_query{terms: []string{"size"}, criteria: 1}},
+		{"sizes:big", search_query{terms: []string{"sizes", "big"}, criteria: 2}},
+	}
+	for _, test := range tests {
+		parsed, err := parse_search_query(test.query)
+		if err != nil {
+			t.Errorf("parse_search_query(%q): %v", test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed, test.parsed) {
+			t.Errorf("parse_search_query(%q) = %+v, want %+v", test.query, parsed, test.parsed)
+		}
+	}
+}
+
+func TestParseInvalidSearchQuery(t *testing.T) {
+	queries := []string{
+		"",
+		"   ",
+		// Nothing long enough to be a term
+		"a",
+		`""`,
+		"name:",
+		"type:",
+		"after:",
+		"after:2024-13-01",
+		"after:2024-02-30",
+		"after:yesterday",
+		"before:01/03/2024",
+		"before:2024-03-01T25:00:00Z",
+		"size>",
+		"size>MB",
+		"size>10XB",
+		"size>-1",
+		"size>ten",
+		"size<1e",
+		"size=>5",
+		"report size>big",
+	}
+	for _, query := range queries {
+		if parsed, err := parse_search_query(query); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("parse_search_query(%q) = %+v, %v, want ErrInvalidQuery", query, parsed, err)
+		}
+	}
+}
+
+func searchPaths(t *testing.T, username, query string) map[string]bool {
+	t.Helper()
+	results, err := Search_files(username, query, Search_Max_Limit)
+	if err != nil {
+		t.Fatalf("Search_files(%s, %q): %v", username, query, err)
+	}
+	paths := map[string]bool{}
+	for _, result := range results.Results {
+		paths[result.Path] = true
+	}
+	return paths
+}
+
+// Whatever the query, the results only hold the caller's files and what is shared with them, as they see it
+func TestSearchStaysInReach(t *testing.T) {
+	testUsers(t, "alice", "bob", "carol")
+	indexes := searchIndexes
+	t.Cleanup(func() { searchIndexes = indexes })
+	searchIndexes = map[string]*search_index{}
+	writeTestFile(t, "alice", "docs/report.txt", "quarterly numbers")
+	writeTestFile(t, "alice", "private/report.txt", "quarterly secrets")
+	writeTestFile(t, "bob", "report.txt", "quarterly plans")
+	share, err := Share_path("alice", "docs", "bob", Share_Read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"alice", "bob", "carol"} {
+		reindex(username, ".")
+	}
+
+	reachable := map[string]bool{"report.txt": true, "Shared with me/alice/docs/report.txt": true}
+	for _, query := range []string{"report", "quarterly", "rep*", "name:report", "type:txt", "path:private", "path:docs", "size>1"} {
+		for found := range searchPaths(t, "bob", query) {
+			if !reachable[found] {
+				t.Errorf("bob searching %q found %s", query, found)
+			}
+		}
+		if found := searchPaths(t, "carol", query); len(found) > 0 {
+			t.Errorf("carol searching %q found %v", query, found)
+		}
+	}
+	if found := searchPaths(t, "bob", "quarterly"); len(found) != 2 {
+		t.Errorf("bob searching quarterly found %v, want his report and the shared one", found)
+	}
+	if found := searchPaths(t, "alice", "secrets"); !found["private/report.txt"] {
+		t.Errorf("alice doesn't find her own private file: %v", found)
+	}
+
+	if err := Revoke_share("alice", share.ID); err != nil {
+		t.Fatal(err)
+	}
+	if found := searchPaths(t, "bob", "quarterly"); len(found) != 1 || !found["report.txt"] {
+		t.Errorf("after the revocation bob searching quarterly found %v", found)
+	}
+}
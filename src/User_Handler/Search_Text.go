@@ -0,0 +1,192 @@
+package User_Handler
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Longest look back from a stream for its dictionary
+const pdfDictionaryLookBack = 1024
+
+// Move in a TJ array, in thousandths of the font size, from which it is taken as a space
+const pdfWordSpacing = 200
+
+// Text of a PDF, good enough for searching: the strings drawn between BT and ET in each content stream, compressed
+// with FlateDecode or not compressed. Text drawn with fonts that need their own encoding table comes out as noise
+func pdf_text(data []byte) string {
+	var text strings.Builder
+	for position := 0; text.Len() < searchTextLimit; {
+		start := bytes.Index(data[position:], []byte("stream"))
+		if start < 0 {
+			break
+		}
+		start += position
+		position = start + len("stream")
+		// "endstream" holds "stream" too
+		if start >= 3 && string(data[start-3:start]) == "end" {
+			continue
+		}
+		content := data[position:]
+		if bytes.HasPrefix(content, []byte("\r\n")) {
+			content = content[2:]
+		} else if bytes.HasPrefix(content, []byte("\n")) {
+			content = content[1:]
+		}
+		end := bytes.Index(content, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		content = content[:end]
+		position += end
+
+		dictionary := data[max(start-pdfDictionaryLookBack, 0):start]
+		if object := bytes.LastIndex(dictionary, []byte("obj")); object >= 0 {
+			dictionary = dictionary[object:]
+		}
+		if bytes.Contains(dictionary, []byte("/FlateDecode")) {
+			reader, err := zlib.NewReader(bytes.NewReader(content))
+			if err != nil {
+				continue
+			}
+			// A damaged stream still gives what came before the damage
+			content, _ = io.ReadAll(io.LimitReader(reader, searchPDFLimit))
+		} else if bytes.Contains(dictionary, []byte("/Filter")) {
+			// Images and the other filters hold no text
+			continue
+		}
+		pdf_content_text(content, &text)
+	}
+	return text.String()
+}
+
+// Strings of the text objects of a content stream
+func pdf_content_text(content []byte, text *strings.Builder) {
+	in_text := false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case c == '(':
+			var literal []byte
+			literal, i = pdf_literal_string(content, i+1)
+			if in_text {
+				text.Write(printable(literal))
+			}
+		case c == '<' && i+1 < len(content) && content[i+1] != '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end < 0 {
+				return
+			}
+			if in_text {
+				digits := bytes.Map(func(r rune) rune {
+					if strings.ContainsRune(" \t\r\n", r) {
+						return -1
+					}
+					return r
+				}, content[i+1:i+end])
+				if len(digits)%2 == 1 {
+					digits = append(digits, '0')
+				}
+				if decoded, err := hex.DecodeString(string(digits)); err == nil {
+					text.Write(printable(decoded))
+				}
+			}
+			i += end
+		case c == '-' && in_text:
+			// In a TJ array, a big move to the right is how most PDFs put a space between words
+			start := i + 1
+			for i+1 < len(content) && (content[i+1] >= '0' && content[i+1] <= '9' || content[i+1] == '.') {
+				i++
+			}
+			if move, err := strconv.ParseFloat(string(content[start:i+1]), 64); err == nil && move >= pdfWordSpacing {
+				text.WriteByte(' ')
+			}
+		case c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '\'' || c == '"' || c == '*':
+			start := i
+			for i+1 < len(content) && (content[i+1] >= 'A' && content[i+1] <= 'Z' || content[i+1] >= 'a' && content[i+1] <= 'z' || content[i+1] == '*') {
+				i++
+			}
+			switch string(content[start : i+1]) {
+			case "BT":
+				in_text = true
+			case "ET":
+				in_text = false
+				text.WriteByte('\n')
+			case "Tj", "TJ", "'", "\"", "T*", "Td", "TD", "Tm":
+				// The spaces between words are often only moves, each string is kept apart
+				if in_text {
+					text.WriteByte(' ')
+				}
+			}
+		}
+	}
+}
+
+// Reads a literal string up to its closing parenthesis, gives it with the position of that parenthesis
+func pdf_literal_string(content []byte, i int) ([]byte, int) {
+	var literal []byte
+	depth := 1
+	for ; i < len(content); i++ {
+		c := content[i]
+		switch c {
+		case '\\':
+			if i+1 >= len(content) {
+				return literal, i
+			}
+			i++
+			switch escaped := content[i]; escaped {
+			case 'n', 'r', 't', 'b', 'f':
+				literal = append(literal, ' ')
+			case '\r', '\n':
+				// A line continuation
+			default:
+				if escaped >= '0' && escaped <= '7' {
+					value := 0
+					for digits := 0; digits < 3 && i < len(content) && content[i] >= '0' && content[i] <= '7'; digits++ {
+						value = value*8 + int(content[i]-'0')
+						i++
+					}
+					i--
+					literal = append(literal, byte(value))
+				} else {
+					literal = append(literal, escaped)
+				}
+			}
+		case '(':
+			depth++
+			literal = append(literal, c)
+		case ')':
+			depth--
+			if depth == 0 {
+				return literal, i
+			}
+			literal = append(literal, c)
+		default:
+			literal = append(literal, c)
+		}
+	}
+	return literal, i
+}
+
+// Keeps the bytes that can be text, the strings of most PDFs are in a single byte encoding close to Latin-1
+func printable(data []byte) []byte {
+	var kept []byte
+	for _, c := range data {
+		switch {
+		case c >= 0x20 && c < 0x7f:
+			kept = append(kept, c)
+		case c >= 0xc0:
+			kept = append(kept, string(rune(c))...)
+		default:
+			kept = append(kept, ' ')
+		}
+	}
+	return kept
+}
@@ -0,0 +1,262 @@
+package User_Handler
+
+import (
+	common "ServerController/src/Common"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const shareLinksFile = "res/config_files/share_links.json"
+
+var ErrUnknownShareLink = errors.New("unknown share link")
+var ErrShareLinkExpired = errors.New("this link has expired or reached its download limit")
+var ErrWrongPassword = errors.New("wrong password")
+var ErrInvalidShareLink = errors.New("the expiry and the download limit can't be negative")
+
+// A link that gives a file, or a folder, of a user's storage to anyone who has it
+type Share_Link struct {
+	ID            string    `json:"id"`
+	Owner         string    `json:"owner"`
+	Path          string    `json:"path"`
+	URL           string    `json:"url,omitempty"` // Filled when handed out, the server address can change
+	Has_Password  bool      `json:"has_password"`
+	Expires_At    time.Time `json:"expires_at,omitzero"`
+	Max_Downloads int       `json:"max_downloads"` // 0 for no limit
+	Downloads     int       `json:"downloads"`
+	Created_At    time.Time `json:"created_at"`
+}
+
+// The token is the secret part of the URL, the ID only names the link for its owner and the admins
+type share_link struct {
+	Share_Link
+	Token    string `json:"token"`
+	Password string `json:"password,omitempty"`
+	Salt     string `json:"salt,omitempty"`
+}
+
+var loadedShareLinks = map[string]*share_link{}
+var shareLinksMutex sync.Mutex
+
+func Load_share_links() {
+	shareLinksMutex.Lock()
+	defer shareLinksMutex.Unlock()
+	file, err := os.ReadFile(shareLinksFile)
+	if err != nil {
+		return
+	}
+	var links []*share_link
+	if err := json.Unmarshal(file, &links); err != nil {
+		println("Could not parse the share links, starting without any")
+		return
+	}
+	for _, link := range links {
+		loadedShareLinks[link.Token] = link
+	}
+}
+
+// Must be called with shareLinksMutex held
+func save_share_links() {
+	links := make([]*share_link, 0, len(loadedShareLinks))
+	for _, link := range loadedShareLinks {
+		links = append(links, link)
+	}
+	data, err := json.MarshalIndent(links, "", "  ")
+	if err != nil {
+		println("Could not marshal share links data: " + err.Error())
+		return
+	}
+	if err := os.WriteFile(shareLinksFile, data, 0600); err != nil {
+		println("Could not write share links data to file: " + err.Error())
+	}
+}
+
+func (link *share_link) active(now time.Time) bool {
+	return !link.expired(now) && !link.Used_up()
+}
+
+func (link *share_link) expired(now time.Time) bool {
+	return !link.Expires_At.IsZero() && !now.Before(link.Expires_At)
+}
+
+// Every download allowed was taken, what is left is resuming them
+func (link Share_Link) Used_up() bool {
+	return link.Max_Downloads != 0 && link.Downloads >= link.Max_Downloads
+}
+
+func (link *share_link) public() Share_Link {
+	public := link.Share_Link
+	public.URL = common.WebServerURL + "/s/" + link.Token
+	return public
+}
+
+// Creates a link to a path of the owner's storage. An empty password, a zero expires_in and a zero max_downloads
+// mean no password, no expiry and no download limit
+func Create_share_link(owner, path, password string, expires_in time.Duration, max_downloads int) (Share_Link, error) {
+	if expires_in < 0 || max_downloads < 0 {
+		return Share_Link{}, ErrInvalidShareLink
+	}
+	// What the others share can't be passed on to everyone
+	path, err := common.CleanSandboxPath(path)
+	if err != nil || path == "." || is_shared_view(path) {
+		return Share_Link{}, common.ErrInvalidPath
+	}
+	if _, err := User_sandbox(owner).Lstat(path); errors.Is(err, os.ErrNotExist) {
+		return Share_Link{}, ErrUnknownPath
+	} else if err != nil {
+		return Share_Link{}, err
+	}
+
+	token := make([]byte, 32)
+	rand.Read(token)
+	now := time.Now()
+	link := &share_link{
+		Share_Link: Share_Link{
+			ID:            history_id(),
+			Owner:         owner,
+			Path:          path,
+			Has_Password:  password != "",
+			Max_Downloads: max_downloads,
+			Created_At:    now,
+		},
+		Token: base64.RawURLEncoding.EncodeToString(token),
+	}
+	if expires_in > 0 {
+		link.Expires_At = now.Add(expires_in)
+	}
+	if password != "" {
+		link.Salt = generateSalt()
+		link.Password = hashPassword(password, link.Salt)
+	}
+	shareLinksMutex.Lock()
+	defer shareLinksMutex.Unlock()
+	loadedShareLinks[link.Token] = link
+	save_share_links()
+	return link.public(), nil
+}
+
+func filterShareLinks(keep func(*share_link) bool) []Share_Link {
+	shareLinksMutex.Lock()
+	defer shareLinksMutex.Unlock()
+	results := []Share_Link{}
+	for _, link := range loadedShareLinks {
+		if keep(link) {
+			results = append(results, link.public())
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Created_At.Before(results[j].Created_At) })
+	return results
+}
+
+// The links of a user, the used up ones included until the janitor removes them
+func List_share_links(owner string) []Share_Link {
+	return filterShareLinks(func(link *share_link) bool { return link.Owner == owner })
+}
+
+// Every link that can still be used, for the admins
+func List_active_share_links() []Share_Link {
+	now := time.Now()
+	return filterShareLinks(func(link *share_link) bool { return link.active(now) })
+}
+
+// Owners revoke their links, admins any link
+func Revoke_share_link(username string, is_admin bool, id string) error {
+	shareLinksMutex.Lock()
+	defer shareLinksMutex.Unlock()
+	for token, link := range loadedShareLinks {
+		if link.ID == id && (link.Owner == username || is_admin) {
+			delete(loadedShareLinks, token)
+			save_share_links()
+			return nil
+		}
+	}
+	return ErrUnknownShareLink
+}
+
+// Checks a link and its password before anything is sent. A used up link still opens so the last downloads can be
+// resumed, Count_share_link_download refuses new ones
+func Open_share_link(token, password string) (Share_Link, error) {
+	shareLinksMutex.Lock()
+	defer shareLinksMutex.Unlock()
+	link, exists := loadedShareLinks[token]
+	if !exists {
+		return Share_Link{}, ErrUnknownShareLink
+	}
+	if link.expired(time.Now()) {
+		return Share_Link{}, ErrShareLinkExpired
+	}
+	if link.Password != "" &&
+		subtle.ConstantTimeCompare([]byte(hashPassword(password, link.Salt)), []byte(link.Password)) != 1 {
+		return Share_Link{}, ErrWrongPassword
+	}
+	return link.Share_Link, nil
+}
+
+// Takes one download from the link, refused once the limit is reached
+func Count_share_link_download(token string) error {
+	shareLinksMutex.Lock()
+	defer shareLinksMutex.Unlock()
+	link, exists := loadedShareLinks[token]
+	if !exists {
+		return ErrUnknownShareLink
+	}
+	if !link.active(time.Now()) {
+		return ErrShareLinkExpired
+	}
+	link.Downloads++
+	save_share_links()
+	return nil
+}
+
+// Links follow their path when it is moved in the owner's storage
+func move_share_links(owner, from, to string) {
+	shareLinksMutex.Lock()
+	defer shareLinksMutex.Unlock()
+	changed := false
+	for _, link := range loadedShareLinks {
+		if link.Owner == owner && (link.Path == from || strings.HasPrefix(link.Path, from+"/")) {
+			link.Path = to + strings.TrimPrefix(link.Path, from)
+			changed = true
+		}
+	}
+	if changed {
+		save_share_links()
+	}
+}
+
+func remove_user_share_links(username string) {
+	shareLinksMutex.Lock()
+	defer shareLinksMutex.Unlock()
+	for token, link := range loadedShareLinks {
+		if link.Owner == username {
+			delete(loadedShareLinks, token)
+		}
+	}
+	save_share_links()
+}
+
+// Drops the expired and used up links, for the janitor
+func purgeShareLinks() {
+	shareLinksMutex.Lock()
+	defer shareLinksMutex.Unlock()
+	now := time.Now()
+	removed := 0
+	for token, link := range loadedShareLinks {
+		if !link.active(now) {
+			delete(loadedShareLinks, token)
+			removed++
+		}
+	}
+	if removed > 0 {
+		save_share_links()
+		fmt.Printf("Janitor removed %d expired share links\n", removed)
+	}
+}
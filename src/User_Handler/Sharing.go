@@ -0,0 +1,310 @@
+package User_Handler
+
+import (
+	common "ServerController/src/Common"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Virtual folder at the root of every storage, holding a folder per user who shares something with its owner:
+// "Shared with me/<owner>/<share name>/..." leads into the owner's storage
+const Shared_folder = "Shared with me"
+
+const (
+	Share_Read       = "read"
+	Share_Read_Write = "read-write"
+)
+
+const sharesFile = "res/config_files/shares.json"
+
+var ErrUnknownShare = errors.New("unknown share")
+var ErrInvalidShare = errors.New("a path can only be shared with another existing user, with read or read-write access")
+var ErrReadOnly = errors.New("this share is read only")
+var ErrSharedFolder = errors.New("the shared folders can't be changed, only their content")
+
+type Share struct {
+	ID         string    `json:"id"`
+	Owner      string    `json:"owner"`
+	Recipient  string    `json:"recipient"`
+	Path       string    `json:"path"` // In the owner's storage
+	Name       string    `json:"name"` // Folder under "Shared with me/<owner>" for the recipient
+	Access     string    `json:"access"`
+	Created_At time.Time `json:"created_at"`
+}
+
+var loadedShares = map[string]Share{}
+var sharesMutex sync.RWMutex
+
+func Load_shares() {
+	sharesMutex.Lock()
+	defer sharesMutex.Unlock()
+	file, err := os.ReadFile(sharesFile)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(file, &loadedShares); err != nil || loadedShares == nil {
+		println("Could not parse the shares, starting without any")
+		loadedShares = map[string]Share{}
+	}
+}
+
+// Must be called with sharesMutex held
+func save_shares() {
+	data, err := json.MarshalIndent(loadedShares, "", "  ")
+	if err != nil {
+		println("Could not marshal shares data: " + err.Error())
+		return
+	}
+	if err := os.WriteFile(sharesFile, data, 0600); err != nil {
+		println("Could not write shares data to file: " + err.Error())
+	}
+}
+
+func sortShares(shares []Share) []Share {
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created_At.Before(shares[j].Created_At) })
+	return shares
+}
+
+func filterShares(keep func(Share) bool) []Share {
+	sharesMutex.RLock()
+	defer sharesMutex.RUnlock()
+	results := []Share{}
+	for _, share := range loadedShares {
+		if keep(share) {
+			results = append(results, share)
+		}
+	}
+	return sortShares(results)
+}
+
+// Gives recipient access to a path of owner's storage. Sharing the same path again changes the access
+func Share_path(owner, shared_path, recipient, access string) (Share, error) {
+	if (access != Share_Read && access != Share_Read_Write) || recipient == owner || !User_exists(recipient) {
+		return Share{}, ErrInvalidShare
+	}
+	shared_path, err := common.CleanSandboxPath(shared_path)
+	if err != nil || shared_path == "." || is_shared_view(shared_path) {
+		return Share{}, common.ErrInvalidPath
+	}
+	if _, err := User_sandbox(owner).Lstat(shared_path); errors.Is(err, os.ErrNotExist) {
+		return Share{}, ErrUnknownPath
+	} else if err != nil {
+		return Share{}, err
+	}
+
+	sharesMutex.Lock()
+	share, found := Share{}, false
+	names := map[string]bool{}
+	for _, existing := range loadedShares {
+		if existing.Owner != owner || existing.Recipient != recipient {
+			continue
+		}
+		if existing.Path == shared_path {
+			share, found = existing, true
+		}
+		names[existing.Name] = true
+	}
+	if found {
+		share.Access = access
+	} else {
+		share = Share{
+			ID:         history_id(),
+			Owner:      owner,
+			Recipient:  recipient,
+			Path:       shared_path,
+			Name:       path.Base(shared_path),
+			Access:     access,
+			Created_At: time.Now(),
+		}
+		// Two shared folders with the same name would hide each other
+		for i := 2; names[share.Name]; i++ {
+			share.Name = path.Base(shared_path) + " (" + strconv.Itoa(i) + ")"
+		}
+	}
+	loadedShares[share.ID] = share
+	save_shares()
+	sharesMutex.Unlock()
+	if !found {
+		publishFileChange(recipient, share_view(share), "created")
+	}
+	return share, nil
+}
+
+// What username shares with the others
+func List_shares(username string) []Share {
+	return filterShares(func(share Share) bool { return share.Owner == username })
+}
+
+// What the others share with username
+func List_incoming_shares(username string) []Share {
+	return filterShares(func(share Share) bool { return share.Recipient == username })
+}
+
+// The owner stops sharing, or the recipient drops a share they don't want anymore
+func Revoke_share(username, id string) error {
+	sharesMutex.Lock()
+	share, exists := loadedShares[id]
+	if !exists || (share.Owner != username && share.Recipient != username) {
+		sharesMutex.Unlock()
+		return ErrUnknownShare
+	}
+	delete(loadedShares, id)
+	save_shares()
+	sharesMutex.Unlock()
+	publishFileChange(share.Recipient, share_view(share), "deleted")
+	return nil
+}
+
+// Drops every share from and to a removed user
+func remove_user_shares(username string) {
+	sharesMutex.Lock()
+	defer sharesMutex.Unlock()
+	for id, share := range loadedShares {
+		if share.Owner == username || share.Recipient == username {
+			delete(loadedShares, id)
+		}
+	}
+	save_shares()
+}
+
+// Shares follow their path when it is moved in the owner's storage
+func move_shares(owner, from, to string) {
+	sharesMutex.Lock()
+	defer sharesMutex.Unlock()
+	changed := false
+	for id, share := range loadedShares {
+		if share.Owner != owner {
+			continue
+		}
+		if share.Path == from || strings.HasPrefix(share.Path, from+"/") {
+			share.Path = to + strings.TrimPrefix(share.Path, from)
+			loadedShares[id] = share
+			changed = true
+		}
+	}
+	if changed {
+		save_shares()
+	}
+}
+
+// Recipients and where a path of owner's storage shows up for each of them
+func share_views(owner, owner_path string) map[string]string {
+	views := map[string]string{}
+	for _, share := range filterShares(func(share Share) bool { return share.Owner == owner }) {
+		if owner_path == share.Path || strings.HasPrefix(owner_path, share.Path+"/") {
+			views[share.Recipient] = share_view(share) + strings.TrimPrefix(owner_path, share.Path)
+		}
+	}
+	return views
+}
+
+// ===========================
+// Resolution
+// ===========================
+
+func share_view(share Share) string {
+	return Shared_folder + "/" + share.Owner + "/" + share.Name
+}
+
+func is_shared_view(cleaned string) bool {
+	return cleaned == Shared_folder || strings.HasPrefix(cleaned, Shared_folder+"/")
+}
+
+// Where a path given by a user really is: in their own storage, or in the storage of a user who shares it
+type user_path struct {
+	owner string
+	path  string // Cleaned, relative to the owner's storage
+	share *Share // Nil in the user's own storage
+}
+
+func (p user_path) sandbox() common.Sandbox {
+	return User_sandbox(p.owner)
+}
+
+// Turns a path of the owner's storage back into the one the user sees
+func (p user_path) view(owner_path string) string {
+	if p.share == nil {
+		return owner_path
+	}
+	return share_view(*p.share) + strings.TrimPrefix(owner_path, p.share.Path)
+}
+
+// Whether this is the shared folder itself, which only its owner can move or delete
+func (p user_path) is_share_root() bool {
+	return p.share != nil && p.path == p.share.Path
+}
+
+// Checks the access to a path. "Shared with me" and the folders of the owners in it aren't real, they give
+// ErrSharedFolder and are listed with shared_entries
+func resolve_path(username, name string, write bool) (user_path, error) {
+	cleaned, err := common.CleanSandboxPath(name)
+	if err != nil {
+		return user_path{}, err
+	}
+	if !is_shared_view(cleaned) {
+		return user_path{owner: username, path: cleaned}, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(cleaned, Shared_folder), "/", 4)
+	if len(parts) < 3 {
+		return user_path{}, ErrSharedFolder
+	}
+	for _, share := range List_incoming_shares(username) {
+		if share.Owner != parts[1] || share.Name != parts[2] {
+			continue
+		}
+		if write && share.Access != Share_Read_Write {
+			return user_path{}, ErrReadOnly
+		}
+		resolved := user_path{owner: share.Owner, path: share.Path, share: &share}
+		if len(parts) == 4 {
+			resolved.path = path.Join(share.Path, parts[3])
+		}
+		return resolved, nil
+	}
+	return user_path{}, ErrUnknownPath
+}
+
+// Content of "Shared with me" and of the owners' folders in it, found is false for any other path
+func shared_entries(username, name string) (entries []Folder_Entry, found bool, err error) {
+	cleaned, err := common.CleanSandboxPath(name)
+	if err != nil || !is_shared_view(cleaned) || strings.Count(cleaned, "/") > 1 {
+		return nil, false, err
+	}
+	owner := strings.TrimPrefix(strings.TrimPrefix(cleaned, Shared_folder), "/")
+	entries = []Folder_Entry{}
+	seen := map[string]bool{}
+	for _, share := range List_incoming_shares(username) {
+		switch {
+		case owner == "" && !seen[share.Owner]:
+			seen[share.Owner] = true
+			entries = append(entries, virtual_entry(share.Owner, share.Created_At))
+		case owner == share.Owner:
+			info, err := User_sandbox(share.Owner).Lstat(share.Path)
+			if err != nil {
+				// Deleted by its owner
+				continue
+			}
+			entries = append(entries, folder_entry(share.Name, "", Own_file_info(User_sandbox(share.Owner), share.Path, info)))
+		}
+	}
+	if owner != "" && len(entries) == 0 {
+		return nil, true, ErrUnknownPath
+	}
+	return entries, true, nil
+}
+
+func virtual_entry(name string, modified time.Time) Folder_Entry {
+	return Folder_Entry{
+		Name:     name,
+		Type:     os.ModeDir.String(),
+		Modified: modified,
+		Mode:     (os.ModeDir | 0500).String(),
+	}
+}
@@ -0,0 +1,164 @@
+package User_Handler
+
+import (
+	common "ServerController/src/Common"
+	"errors"
+	"os"
+	"testing"
+)
+
+func entryNames(entries []Folder_Entry) map[string]bool {
+	names := map[string]bool{}
+	for _, entry := range entries {
+		names[entry.Name] = true
+	}
+	return names
+}
+
+func TestResolveSharedPaths(t *testing.T) {
+	testUsers(t, "alice", "bob")
+	writeTestFile(t, "alice", "docs/report.txt", "report")
+	writeTestFile(t, "alice", "photos/cat.jpg", "cat")
+	writeTestFile(t, "alice", "private.txt", "secret")
+	if _, err := Share_path("alice", "docs", "bob", Share_Read_Write); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Share_path("alice", "photos", "bob", Share_Read); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		write bool
+		owner string
+		path  string
+		err   error
+	}{
+		{"report.txt", false, "bob", "report.txt", nil},
+		{"Shared with me/alice/docs", false, "alice", "docs", nil},
+		{"Shared with me/alice/docs/report.txt", true, "alice", "docs/report.txt", nil},
+		{"Shared with me/alice/photos/cat.jpg", false, "alice", "photos/cat.jpg", nil},
+		{"Shared with me/alice/photos/cat.jpg", true, "", "", ErrReadOnly},
+		{"Shared with me/alice/photos/new.jpg", true, "", "", ErrReadOnly},
+		{"Shared with me/alice/private.txt", false, "", "", ErrUnknownPath},
+		{"Shared with me/carol/docs", false, "", "", ErrUnknownPath},
+		{"Shared with me/alice", true, "", "", ErrSharedFolder},
+		{"Shared with me", true, "", "", ErrSharedFolder},
+		// No way up, out of a share into the rest of the owner's storage or anywhere else
+		{"Shared with me/alice/docs/../../../private.txt", false, "", "", common.ErrInvalidPath},
+		{"Shared with me/alice/docs/../photos/cat.jpg", true, "", "", common.ErrInvalidPath},
+		{"Shared with me/alice/docs/..", false, "", "", common.ErrInvalidPath},
+		{"../alice/private.txt", false, "", "", common.ErrInvalidPath},
+		{"Shared with me/alice/docs/../../../../alice/private.txt", false, "", "", common.ErrInvalidPath},
+	}
+	for _, test := range tests {
+		resolved, err := resolve_path("bob", test.name, test.write)
+		if !errors.Is(err, test.err) {
+			t.Errorf("resolve_path(%q, write %v): %v, want %v", test.name, test.write, err, test.err)
+			continue
+		}
+		if err == nil && (resolved.owner != test.owner || resolved.path != test.path) {
+			t.Errorf("resolve_path(%q) = %s's %q, want %s's %q", test.name, resolved.owner, resolved.path, test.owner, test.path)
+		}
+	}
+
+	// What resolves to a read-only share can't be changed through the file commands either
+	if err := Write_user_file("bob", "Shared with me/alice/photos/cat.jpg", []byte("dog")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("writing into a read-only share: %v", err)
+	}
+	if err := Move_user_path("bob", "Shared with me/alice/docs/report.txt", "Shared with me/alice/photos/report.txt"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("moving into a read-only share: %v", err)
+	}
+	if err := Write_user_file("bob", "Shared with me/alice/docs/notes.txt", []byte("notes")); err != nil {
+		t.Errorf("writing into a read-write share: %v", err)
+	}
+	if _, err := User_sandbox("alice").Stat("docs/notes.txt"); err != nil {
+		t.Errorf("the file written through the share isn't in alice's storage: %v", err)
+	}
+}
+
+func TestSharedEntries(t *testing.T) {
+	testUsers(t, "alice", "bob", "carol")
+	writeTestFile(t, "alice", "docs/report.txt", "report")
+	writeTestFile(t, "alice", "work/docs/plan.txt", "plan")
+	writeTestFile(t, "carol", "music/song.mp3", "song")
+
+	first, err := Share_path("alice", "docs", "bob", Share_Read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Share_path("alice", "work/docs", "bob", Share_Read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Share_path("carol", "music", "bob", Share_Read); err != nil {
+		t.Fatal(err)
+	}
+	// Two shared folders named alike get apart
+	if first.Name != "docs" || second.Name != "docs (2)" {
+		t.Errorf("shares named %q and %q, want docs and docs (2)", first.Name, second.Name)
+	}
+	if entries, err := List_user_folder("bob", "Shared with me/alice/docs (2)"); err != nil || !entryNames(entries)["plan.txt"] {
+		t.Errorf("listing the second share: %v %v", entries, err)
+	}
+
+	entries, found, err := shared_entries("bob", "Shared with me")
+	if !found || err != nil {
+		t.Fatalf("shared_entries(Shared with me): found %v, %v", found, err)
+	}
+	if names := entryNames(entries); len(names) != 2 || !names["alice"] || !names["carol"] {
+		t.Errorf("Shared with me lists %v, want alice and carol", names)
+	}
+	entries, _, err = shared_entries("bob", "Shared with me/alice")
+	if names := entryNames(entries); err != nil || len(names) != 2 || !names["docs"] || !names["docs (2)"] {
+		t.Errorf("Shared with me/alice lists %v (%v), want docs and docs (2)", names, err)
+	}
+	if _, found, _ := shared_entries("bob", "Shared with me/alice/docs"); found {
+		t.Error("a shared folder is listed from the owner's storage, not by shared_entries")
+	}
+	if root, _ := List_user_folder("alice", "."); entryNames(root)[Shared_folder] {
+		t.Error("alice has nothing shared with her but sees Shared with me")
+	}
+
+	// A revoked share is gone from the listings and can't be reached anymore
+	if err := Revoke_share("alice", first.ID); err != nil {
+		t.Fatal(err)
+	}
+	entries, _, _ = shared_entries("bob", "Shared with me/alice")
+	if names := entryNames(entries); names["docs"] || !names["docs (2)"] {
+		t.Errorf("after the revocation Shared with me/alice lists %v", names)
+	}
+	if _, err := resolve_path("bob", "Shared with me/alice/docs/report.txt", false); !errors.Is(err, ErrUnknownPath) {
+		t.Errorf("resolving into a revoked share: %v", err)
+	}
+	if err := Revoke_share("alice", second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := shared_entries("bob", "Shared with me/alice"); !errors.Is(err, ErrUnknownPath) {
+		t.Errorf("listing an owner who shares nothing anymore: %v", err)
+	}
+	entries, _, _ = shared_entries("bob", "Shared with me")
+	if names := entryNames(entries); names["alice"] || !names["carol"] {
+		t.Errorf("after the revocations Shared with me lists %v", names)
+	}
+}
+
+// A real "Shared with me" would be hidden by the virtual one
+func TestSharedFolderNameIsReserved(t *testing.T) {
+	testUsers(t, "alice")
+	writeTestFile(t, "alice", "notes.txt", "notes")
+	for _, name := range []string{"Shared with me", "Shared with me/notes.txt", "Shared with me/alice/folder"} {
+		if err := Create_user_folder("alice", name); err == nil {
+			t.Errorf("Create_user_folder(%q) succeeded", name)
+		}
+		if err := Write_user_file("alice", name, []byte("content")); err == nil {
+			t.Errorf("Write_user_file(%q) succeeded", name)
+		}
+		if err := Move_user_path("alice", "notes.txt", name); err == nil {
+			t.Errorf("Move_user_path(notes.txt, %q) succeeded", name)
+		}
+	}
+	if _, err := os.Stat(User_folder("alice") + "/" + Shared_folder); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a real %s was created: %v", Shared_folder, err)
+	}
+}
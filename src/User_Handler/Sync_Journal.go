@@ -0,0 +1,252 @@
+package User_Handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every change to a user's storage goes to their journal, numbered by a cursor that only goes up. A sync client
+// remembers the cursor it reached and asks for what happened since, one .jsonl file per user
+const Journal_folder = "users_journal/"
+
+// Past this many entries the oldest half is dropped, the clients that were further behind list everything again
+const journalMaxEntries = 10000
+
+// Most changes given by one call of Sync_changes
+const syncChangesLimit = 1000
+
+// Size and Modified are the ones of the file when the change happened, so a client can tell its own changes apart
+type Sync_Change struct {
+	Cursor   uint64    `json:"cursor"`
+	Path     string    `json:"path"`
+	Change   string    `json:"change"`         // created, written or deleted
+	Type     string    `json:"type,omitempty"` // file or folder, empty for a deletion
+	Size     int64     `json:"size,omitempty"`
+	Modified time.Time `json:"modified,omitzero"`
+}
+
+type Sync_Changes struct {
+	Cursor  uint64        `json:"cursor"` // Where to ask from next time
+	Reset   bool          `json:"reset"`  // The journal doesn't go back that far, everything has to be listed again
+	More    bool          `json:"more"`   // There are more changes after Cursor
+	Changes []Sync_Change `json:"changes"`
+}
+
+type journal struct {
+	first   uint64 // Cursor of the oldest entry kept
+	last    uint64
+	entries int
+}
+
+var journals = map[string]*journal{}
+var journalMutex sync.Mutex
+
+func journal_file(username string) string {
+	return Journal_folder + username + ".jsonl"
+}
+
+func read_journal(username string) []Sync_Change {
+	file, err := os.Open(journal_file(username))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	var changes []Sync_Change
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var change Sync_Change
+		// A line cut by a crash is skipped
+		if json.Unmarshal(scanner.Bytes(), &change) == nil {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// Must be called with journalMutex held
+func load_journal(username string) *journal {
+	if loaded, exists := journals[username]; exists {
+		return loaded
+	}
+	loaded := &journal{}
+	changes := read_journal(username)
+	if len(changes) > 0 {
+		loaded.first = changes[0].Cursor
+		loaded.last = changes[len(changes)-1].Cursor
+		loaded.entries = len(changes)
+	}
+	journals[username] = loaded
+	return loaded
+}
+
+// Must be called with journalMutex held
+func compact_journal(username string, loaded *journal) {
+	changes := read_journal(username)
+	changes = changes[max(len(changes)-journalMaxEntries/2, 0):]
+	var content strings.Builder
+	for _, change := range changes {
+		line, _ := json.Marshal(change)
+		content.Write(line)
+		content.WriteByte('\n')
+	}
+	temporary := journal_file(username) + ".tmp"
+	if err := os.WriteFile(temporary, []byte(content.String()), 0600); err != nil {
+		println("Could not compact the journal of " + username + ": " + err.Error())
+		return
+	}
+	if err := os.Rename(temporary, journal_file(username)); err != nil {
+		os.Remove(temporary)
+		return
+	}
+	loaded.entries = len(changes)
+	if len(changes) > 0 {
+		loaded.first = changes[0].Cursor
+	}
+}
+
+func append_journal(username string, changes []Sync_Change) {
+	if len(changes) == 0 {
+		return
+	}
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	loaded := load_journal(username)
+	if err := os.MkdirAll(Journal_folder, 0700); err != nil {
+		return
+	}
+	file, err := os.OpenFile(journal_file(username), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		println("Could not write the journal of " + username + ": " + err.Error())
+		return
+	}
+	writer := bufio.NewWriter(file)
+	for _, change := range changes {
+		loaded.last++
+		change.Cursor = loaded.last
+		line, _ := json.Marshal(change)
+		writer.Write(line)
+		writer.WriteByte('\n')
+		if loaded.first == 0 {
+			loaded.first = change.Cursor
+		}
+	}
+	writer.Flush()
+	file.Close()
+	loaded.entries += len(changes)
+	if loaded.entries > journalMaxEntries {
+		compact_journal(username, loaded)
+	}
+}
+
+// Writes a change of a path the user sees. A folder that shows up brings everything in it along
+func journal_change(username, view, change string) {
+	if change == "deleted" {
+		append_journal(username, []Sync_Change{{Path: view, Change: change}})
+		return
+	}
+	resolved, err := resolve_path(username, view, false)
+	if err != nil {
+		// "Shared with me" and the owners' folders in it aren't real
+		return
+	}
+	var changes []Sync_Change
+	resolved.sandbox().WalkDir(resolved.path, func(entry_path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || !(info.IsDir() || info.Mode().IsRegular()) {
+			return nil
+		}
+		info = Own_file_info(resolved.sandbox(), entry_path, info)
+		entry_change := Sync_Change{Path: resolved.view(entry_path), Change: "created", Type: "file", Size: info.Size(), Modified: info.ModTime()}
+		if entry_path == resolved.path {
+			entry_change.Change = change
+		}
+		if info.IsDir() {
+			entry_change.Type, entry_change.Size = "folder", 0
+		}
+		changes = append(changes, entry_change)
+		return nil
+	})
+	append_journal(username, changes)
+}
+
+// The changes after the cursor since. Without a cursor (nil) only the current one is given, a client starting
+// from scratch asks for it before listing everything
+func Sync_changes(username string, since *uint64) Sync_Changes {
+	journalMutex.Lock()
+	loaded := load_journal(username)
+	result := Sync_Changes{Cursor: loaded.last, Changes: []Sync_Change{}}
+	if since == nil || *since > loaded.last || (loaded.entries > 0 && *since+1 < loaded.first) {
+		result.Reset = since != nil
+		journalMutex.Unlock()
+		return result
+	}
+	journalMutex.Unlock()
+
+	for _, change := range read_journal(username) {
+		if change.Cursor <= *since {
+			continue
+		}
+		if len(result.Changes) == syncChangesLimit {
+			result.More = true
+			break
+		}
+		result.Changes = append(result.Changes, change)
+	}
+	if len(result.Changes) > 0 {
+		result.Cursor = result.Changes[len(result.Changes)-1].Cursor
+	} else {
+		result.Cursor = max(result.Cursor, *since)
+	}
+	return result
+}
+
+func remove_user_journal(username string) {
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	delete(journals, username)
+	os.Remove(journal_file(username))
+}
+
+// ===========================
+// Conflicts
+// ===========================
+
+// A sync client sends the hash of the content its change was made on. Base_New says it made a new file
+const Base_New = "none"
+
+// Hash of the file at target, empty when there is no file
+func current_hash(target user_path) string {
+	real, err := target.sandbox().Resolve(target.path)
+	if err != nil {
+		return ""
+	}
+	if info, err := os.Lstat(real); err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	hash, _ := hash_file(real)
+	return hash
+}
+
+// "notes (conflict copy 2026-10-19 153012).txt", next to the file and not taken yet
+func conflict_copy_path(target user_path) string {
+	extension := path.Ext(target.path)
+	stem := strings.TrimSuffix(target.path, extension) + " (conflict copy " + time.Now().Format("2006-01-02 150405")
+	candidate := stem + ")" + extension
+	for i := 2; ; i++ {
+		if _, err := target.sandbox().Lstat(candidate); err != nil {
+			return candidate
+		}
+		candidate = stem + " " + strconv.Itoa(i) + ")" + extension
+	}
+}
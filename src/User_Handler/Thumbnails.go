@@ -0,0 +1,425 @@
+package User_Handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Thumbnails of the JPEG, PNG and GIF files, made in the background when a file changes or on the first request.
+// They are cached by the SHA-256 of the content, so identical images share them and a changed file gets new ones
+const Thumbnails_folder = "users_thumbnails/"
+
+// Longest side of each thumbnail, the image itself is never enlarged
+var Thumbnail_Sizes = []int{128, 256, 512}
+
+const Thumbnail_Default_Size = 256
+
+// Bigger images are refused, a small file can decode into gigabytes
+const thumbnailMaxPixels = 50_000_000
+
+const thumbnailQuality = 85
+
+// Thumbnails nobody asked for during this long are removed by the janitor
+const thumbnailLifetime = 30 * 24 * time.Hour
+
+// Past this many, the hashes remembered for the files are forgotten
+const thumbnailHashMemoSize = 10000
+
+var (
+	ErrNotAnImage           = errors.New("not a JPEG, PNG or GIF image")
+	ErrImageTooBig          = errors.New("the image is too big for a thumbnail")
+	ErrInvalidThumbnailSize = errors.New("the thumbnail size must be 128, 256 or 512")
+)
+
+type Thumbnail struct {
+	Size   int    `json:"size"` // Longest side asked for
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Mime   string `json:"mime"`
+	Length int64  `json:"length"`
+	Hash   string `json:"hash"` // SHA-256 of the image it was made from
+}
+
+type hash_memo struct {
+	size     int64
+	modified time.Time
+	hash     string
+}
+
+var thumbnailHashes = map[string]hash_memo{}
+var thumbnailHashesMutex sync.Mutex
+
+// Files that changed, to make the thumbnails of before anyone asks
+var thumbnailQueue = make(chan index_job, 1024)
+
+// Keeps two requests from making the same thumbnails at once
+var thumbnailMutex sync.Mutex
+
+func is_image_name(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
+func thumbnail_path(hash string, size int) string {
+	return Thumbnails_folder + hash[:2] + "/" + hash + "-" + strconv.Itoa(size)
+}
+
+// Hash of the content, remembered as long as the size and modification time stay the same
+func content_hash(owner, file_path string, file *os.File, info fs.FileInfo) (string, error) {
+	key := owner + "/" + file_path
+	thumbnailHashesMutex.Lock()
+	memo, known := thumbnailHashes[key]
+	thumbnailHashesMutex.Unlock()
+	if known && memo.size == info.Size() && memo.modified.Equal(info.ModTime()) {
+		return memo.hash, nil
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(file, 0, info.Size())); err != nil {
+		return "", err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	thumbnailHashesMutex.Lock()
+	if len(thumbnailHashes) >= thumbnailHashMemoSize {
+		thumbnailHashes = map[string]hash_memo{}
+	}
+	thumbnailHashes[key] = hash_memo{info.Size(), info.ModTime(), hash}
+	thumbnailHashesMutex.Unlock()
+	return hash, nil
+}
+
+// Makes every size missing from the cache with a single decoding of the image
+func make_thumbnails(file *os.File, info fs.FileInfo, hash string) error {
+	thumbnailMutex.Lock()
+	defer thumbnailMutex.Unlock()
+	missing := []int{}
+	for _, size := range Thumbnail_Sizes {
+		if _, err := os.Stat(thumbnail_path(hash, size)); err != nil {
+			missing = append(missing, size)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, info.Size()))
+	if err != nil {
+		return err
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || !slices.Contains([]string{"jpeg", "png", "gif"}, format) {
+		return ErrNotAnImage
+	}
+	if int64(config.Width)*int64(config.Height) > thumbnailMaxPixels {
+		return ErrImageTooBig
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ErrNotAnImage
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = exif_orientation(data)
+	}
+	source := image.NewRGBA(image.Rect(0, 0, decoded.Bounds().Dx(), decoded.Bounds().Dy()))
+	draw.Draw(source, source.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+	decoded, data = nil, nil
+
+	if err := os.MkdirAll(filepath.Dir(thumbnail_path(hash, missing[0])), 0700); err != nil {
+		return err
+	}
+	// The biggest first, each smaller one is made from the one before
+	slices.Reverse(missing)
+	current := source
+	for _, size := range missing {
+		current = downscale(current, size)
+		oriented := orient(current, orientation)
+		var encoded bytes.Buffer
+		// JPEG keeps photos small, PNG keeps the transparency of the others
+		if format == "jpeg" {
+			err = jpeg.Encode(&encoded, oriented, &jpeg.Options{Quality: thumbnailQuality})
+		} else {
+			err = png.Encode(&encoded, oriented)
+		}
+		if err != nil {
+			return err
+		}
+		target := thumbnail_path(hash, size)
+		temporary := target + "." + history_id()
+		if err := os.WriteFile(temporary, encoded.Bytes(), 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(temporary, target); err != nil {
+			os.Remove(temporary)
+			return err
+		}
+	}
+	return nil
+}
+
+// Opens the thumbnail of an image the user can read, made now when it isn't in the cache yet
+func Open_thumbnail(username, image_path string, size int) (Thumbnail, *os.File, error) {
+	if !slices.Contains(Thumbnail_Sizes, size) {
+		return Thumbnail{}, nil, ErrInvalidThumbnailSize
+	}
+	file, info, err := Open_user_file(username, image_path)
+	if errors.Is(err, ErrNotAFile) {
+		return Thumbnail{}, nil, ErrNotAnImage
+	}
+	if err != nil {
+		return Thumbnail{}, nil, err
+	}
+	defer file.Close()
+	if !is_image_name(info.Name()) {
+		return Thumbnail{}, nil, ErrNotAnImage
+	}
+	resolved, err := resolve_path(username, image_path, false)
+	if err != nil {
+		return Thumbnail{}, nil, err
+	}
+	hash, err := content_hash(resolved.owner, resolved.path, file, info)
+	if err != nil {
+		return Thumbnail{}, nil, err
+	}
+	if err := make_thumbnails(file, info, hash); err != nil {
+		return Thumbnail{}, nil, err
+	}
+
+	thumbnail, err := os.Open(thumbnail_path(hash, size))
+	if err != nil {
+		return Thumbnail{}, nil, err
+	}
+	config, format, err := image.DecodeConfig(thumbnail)
+	if err == nil {
+		_, err = thumbnail.Seek(0, io.SeekStart)
+	}
+	thumbnail_info, statErr := thumbnail.Stat()
+	if err == nil {
+		err = statErr
+	}
+	if err != nil {
+		thumbnail.Close()
+		return Thumbnail{}, nil, err
+	}
+	// Tells the janitor it is still used
+	now := time.Now()
+	os.Chtimes(thumbnail.Name(), now, now)
+	return Thumbnail{size, config.Width, config.Height, "image/" + format, thumbnail_info.Size(), hash}, thumbnail, nil
+}
+
+// Called for every change of a path of the owner's storage
+func thumbnail_change(owner, changed_path, change string) {
+	if change == "deleted" || is_shared_view(changed_path) {
+		return
+	}
+	select {
+	case thumbnailQueue <- index_job{owner, changed_path}:
+	default:
+		// They will be made on the first request instead
+	}
+}
+
+// Makes the thumbnails of the images under a changed path
+func thumbnail_path_images(owner, root string) {
+	sandbox := User_sandbox(owner)
+	sandbox.WalkDir(root, func(entry_path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() || !is_image_name(entry.Name()) {
+			return nil
+		}
+		file, err := sandbox.Open(entry_path)
+		if err != nil {
+			return nil
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return nil
+		}
+		if hash, err := content_hash(owner, entry_path, file, info); err == nil {
+			make_thumbnails(file, info, hash)
+		}
+		return nil
+	})
+}
+
+func Start_thumbnailer(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-thumbnailQueue:
+			thumbnail_path_images(job.owner, job.path)
+		}
+	}
+}
+
+func purgeThumbnails() {
+	removed := 0
+	filepath.WalkDir(Thumbnails_folder, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > thumbnailLifetime && os.Remove(path) == nil {
+			removed++
+		}
+		return nil
+	})
+	if removed > 0 {
+		fmt.Printf("Janitor removed %d unused thumbnails\n", removed)
+	}
+}
+
+// ===========================
+// Images
+// ===========================
+
+// Shrinks the image so its longest side is at most size, each pixel being the average of the ones it covers
+func downscale(source *image.RGBA, size int) *image.RGBA {
+	width, height := source.Bounds().Dx(), source.Bounds().Dy()
+	if width <= size && height <= size {
+		return source
+	}
+	target_width, target_height := size, max(height*size/width, 1)
+	if height > width {
+		target_width, target_height = max(width*size/height, 1), size
+	}
+	target := image.NewRGBA(image.Rect(0, 0, target_width, target_height))
+	for y := range target_height {
+		y0, y1 := y*height/target_height, max((y+1)*height/target_height, y*height/target_height+1)
+		for x := range target_width {
+			x0, x1 := x*width/target_width, max((x+1)*width/target_width, x*width/target_width+1)
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				row := source.Pix[sy*source.Stride+x0*4 : sy*source.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					r += uint64(row[i])
+					g += uint64(row[i+1])
+					b += uint64(row[i+2])
+					a += uint64(row[i+3])
+					count++
+				}
+			}
+			offset := y*target.Stride + x*4
+			target.Pix[offset] = uint8(r / count)
+			target.Pix[offset+1] = uint8(g / count)
+			target.Pix[offset+2] = uint8(b / count)
+			target.Pix[offset+3] = uint8(a / count)
+		}
+	}
+	return target
+}
+
+// Turns the image the way the EXIF orientation says the camera was held, 1 being upright
+func orient(source *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return source
+	}
+	width, height := source.Bounds().Dx(), source.Bounds().Dy()
+	target_width, target_height := width, height
+	if orientation >= 5 {
+		target_width, target_height = height, width
+	}
+	target := image.NewRGBA(image.Rect(0, 0, target_width, target_height))
+	for y := range height {
+		for x := range width {
+			tx, ty := x, y
+			switch orientation {
+			case 2:
+				tx = width - 1 - x
+			case 3:
+				tx, ty = width-1-x, height-1-y
+			case 4:
+				ty = height - 1 - y
+			case 5:
+				tx, ty = y, x
+			case 6:
+				tx, ty = height-1-y, x
+			case 7:
+				tx, ty = height-1-y, width-1-x
+			case 8:
+				tx, ty = y, width-1-x
+			}
+			copy(target.Pix[ty*target.Stride+tx*4:ty*target.Stride+tx*4+4], source.Pix[y*source.Stride+x*4:y*source.Stride+x*4+4])
+		}
+	}
+	return target
+}
+
+// The orientation tag of the EXIF block of a JPEG, 1 when there is none
+func exif_orientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1
+	}
+	for position := 2; position+4 <= len(data); {
+		if data[position] != 0xff {
+			return 1
+		}
+		marker := data[position+1]
+		length := int(data[position+2])<<8 | int(data[position+3])
+		// The image data starts after SOS, no EXIF comes later
+		if marker == 0xda || length < 2 || position+2+length > len(data) {
+			return 1
+		}
+		segment := data[position+4 : position+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiff_orientation(segment[6:])
+		}
+		position += 2 + length
+	}
+	return 1
+}
+
+// Looks for the orientation (tag 0x0112) in the first IFD of the TIFF structure EXIF is made of
+func tiff_orientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var read16 func([]byte) int
+	var read32 func([]byte) int
+	switch string(tiff[:2]) {
+	case "II":
+		read16 = func(b []byte) int { return int(b[0]) | int(b[1])<<8 }
+		read32 = func(b []byte) int { return int(b[0]) | int(b[1])<<8 | int(b[2])<<16 | int(b[3])<<24 }
+	case "MM":
+		read16 = func(b []byte) int { return int(b[0])<<8 | int(b[1]) }
+		read32 = func(b []byte) int { return int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3]) }
+	default:
+		return 1
+	}
+	ifd := read32(tiff[4:8])
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := read16(tiff[ifd:])
+	for i := range entries {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if read16(tiff[entry:]) == 0x0112 {
+			return read16(tiff[entry+8:])
+		}
+	}
+	return 1
+}
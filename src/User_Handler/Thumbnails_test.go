@@ -0,0 +1,123 @@
+package User_Handler
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"testing"
+)
+
+func TestDownscale(t *testing.T) {
+	tests := []struct {
+		width, height, size         int
+		target_width, target_height int
+	}{
+		{100, 50, 256, 100, 50},
+		{256, 256, 256, 256, 256},
+		{1000, 500, 256, 256, 128},
+		{500, 1000, 256, 128, 256},
+		{3000, 1, 128, 128, 1},
+		{1, 3000, 128, 1, 128},
+		{513, 512, 512, 512, 511},
+	}
+	for _, test := range tests {
+		scaled := downscale(image.NewRGBA(image.Rect(0, 0, test.width, test.height)), test.size)
+		if scaled.Bounds().Dx() != test.target_width || scaled.Bounds().Dy() != test.target_height {
+			t.Errorf("downscale of %dx%d to %d is %dx%d, want %dx%d", test.width, test.height, test.size,
+				scaled.Bounds().Dx(), scaled.Bounds().Dy(), test.target_width, test.target_height)
+		}
+	}
+}
+
+func TestDownscaleAverages(t *testing.T) {
+	black, white := color.RGBA{0, 0, 0, 255}, color.RGBA{255, 255, 255, 255}
+	halves := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	checkered := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := range 4 {
+		for x := range 4 {
+			halves.SetRGBA(x, y, black)
+			if x >= 2 {
+				halves.SetRGBA(x, y, white)
+			}
+			checkered.SetRGBA(x, y, black)
+			if (x+y)%2 == 0 {
+				checkered.SetRGBA(x, y, white)
+			}
+		}
+	}
+	scaled := downscale(halves, 2)
+	for y := range 2 {
+		if scaled.RGBAAt(0, y) != black || scaled.RGBAAt(1, y) != white {
+			t.Errorf("row %d of the halves is %v %v", y, scaled.RGBAAt(0, y), scaled.RGBAAt(1, y))
+		}
+	}
+	gray := color.RGBA{127, 127, 127, 255}
+	scaled = downscale(checkered, 2)
+	for y := range 2 {
+		for x := range 2 {
+			if scaled.RGBAAt(x, y) != gray {
+				t.Errorf("pixel %d,%d of the checkered image is %v, want %v", x, y, scaled.RGBAAt(x, y), gray)
+			}
+		}
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	for _, orientation := range []int{1, 3, 6, 8} {
+		data, err := os.ReadFile(fmt.Sprintf("testdata/orientation_%d.jpg", orientation))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := exif_orientation(data); got != orientation {
+			t.Errorf("orientation_%d.jpg: orientation %d", orientation, got)
+		}
+		// Cut anywhere, the file is no orientation at all rather than a crash
+		for cut := range min(len(data), 100) {
+			if got := exif_orientation(data[:cut]); got != 1 && got != orientation {
+				t.Errorf("orientation_%d.jpg cut at %d: orientation %d", orientation, cut, got)
+			}
+		}
+	}
+	if got := exif_orientation([]byte("not a jpeg")); got != 1 {
+		t.Errorf("orientation of garbage: %d", got)
+	}
+}
+
+// The fixtures all show a 48x32 picture with a red top left corner once turned the way their orientation says
+func TestThumbnailsAreUpright(t *testing.T) {
+	fixtures := map[string][]byte{}
+	for _, orientation := range []int{1, 3, 6, 8} {
+		name := fmt.Sprintf("orientation_%d.jpg", orientation)
+		data, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fixtures[name] = data
+	}
+	testUsers(t, "alice")
+	for name, data := range fixtures {
+		writeTestFile(t, "alice", name, string(data))
+		thumbnail, file, err := Open_thumbnail("alice", name, 128)
+		if err != nil {
+			t.Fatalf("Open_thumbnail(%s): %v", name, err)
+		}
+		decoded, err := jpeg.Decode(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if thumbnail.Width != 48 || thumbnail.Height != 32 || decoded.Bounds().Dx() != 48 || decoded.Bounds().Dy() != 32 {
+			t.Errorf("%s: thumbnail of %dx%d, want 48x32", name, decoded.Bounds().Dx(), decoded.Bounds().Dy())
+			continue
+		}
+		corners := map[string]image.Point{"top left": {4, 4}, "top right": {43, 4}, "bottom left": {4, 27}, "bottom right": {43, 27}}
+		for corner, point := range corners {
+			r, _, b, _ := decoded.At(point.X, point.Y).RGBA()
+			if red := r > b; red != (corner == "top left") {
+				t.Errorf("%s: the %s corner is %v", name, corner, decoded.At(point.X, point.Y))
+			}
+		}
+	}
+}
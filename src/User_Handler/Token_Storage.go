@@ -0,0 +1,60 @@
+package User_Handler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Bearer tokens live as long as the web login cookie
+const tokenLifetime = 24 * time.Hour
+
+type access_token struct {
+	username   string
+	expires_at time.Time
+}
+
+// Keyed by the token hash, so a memory dump doesn't leak usable tokens
+var tokens = map[string]access_token{}
+var tokensMutex sync.Mutex
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func Create_token(username string) (string, time.Time) {
+	bytes := make([]byte, 32)
+	rand.Read(bytes)
+	token := hex.EncodeToString(bytes)
+	expires_at := time.Now().Add(tokenLifetime)
+
+	tokensMutex.Lock()
+	defer tokensMutex.Unlock()
+	for key, t := range tokens {
+		if time.Now().After(t.expires_at) {
+			delete(tokens, key)
+		}
+	}
+	tokens[hashToken(token)] = access_token{username, expires_at}
+	return token, expires_at
+}
+
+// Returns the user the token belongs to, if it's still valid
+func Token_user(token string) (string, bool) {
+	tokensMutex.Lock()
+	defer tokensMutex.Unlock()
+	t, exists := tokens[hashToken(token)]
+	if !exists || time.Now().After(t.expires_at) || !User_exists(t.username) {
+		return "", false
+	}
+	return t.username, true
+}
+
+func Revoke_token(token string) {
+	tokensMutex.Lock()
+	defer tokensMutex.Unlock()
+	delete(tokens, hashToken(token))
+}
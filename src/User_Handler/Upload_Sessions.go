@@ -0,0 +1,381 @@
+package User_Handler
+
+import (
+	common "ServerController/src/Common"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Partial uploads live here until they are committed, one .part file and one .json file per upload
+const Upload_staging_folder = "users_data_staging/"
+
+// Uploads left untouched for this long are deleted
+const Upload_timeout = 24 * time.Hour
+
+var (
+	ErrUnknownUpload    = errors.New("unknown upload")
+	ErrInvalidHash      = errors.New("the hash must be a hex encoded sha256")
+	ErrUploadOffset     = errors.New("the chunk doesn't start where the upload stopped")
+	ErrUploadTooBig     = errors.New("the chunk goes past the announced size")
+	ErrUploadIncomplete = errors.New("the upload is not complete")
+	ErrHashMismatch     = errors.New("the content doesn't match the hash")
+	ErrNotEnoughSpace   = errors.New("not enough free space on the server for the upload")
+)
+
+type Upload_Session struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	Hash       string    `json:"hash"`
+	Base       string    `json:"base,omitempty"` // Hash of the content the file was changed from, see is_conflict
+	Received   int64     `json:"received"`
+	Created_At time.Time `json:"created_at"`
+	Updated_At time.Time `json:"updated_at"`
+}
+
+// Where a committed upload went, as the user sees it
+type Upload_Result struct {
+	Path     string `json:"path"`
+	Conflict bool   `json:"conflict"`
+}
+
+type upload struct {
+	Upload_Session
+	mutex sync.Mutex // Chunks of the same upload are written one at a time
+}
+
+var uploads = map[string]*upload{}
+var uploadsMutex sync.Mutex
+
+func staging_path(id, extension string) string {
+	return Upload_staging_folder + id + extension
+}
+
+// Reads the uploads left by the previous run, so they can be resumed
+func Load_uploads() {
+	os.MkdirAll(Upload_staging_folder, 0700)
+	entries, err := os.ReadDir(Upload_staging_folder)
+	if err != nil {
+		println("Could not read the upload staging folder: " + err.Error())
+		return
+	}
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), deltaStagingPrefix) {
+			os.Remove(Upload_staging_folder + entry.Name())
+			continue
+		}
+		id, is_metadata := strings.CutSuffix(entry.Name(), ".json")
+		if !is_metadata {
+			continue
+		}
+		data, err := os.ReadFile(staging_path(id, ".json"))
+		if err != nil {
+			continue
+		}
+		session := &upload{}
+		if json.Unmarshal(data, &session.Upload_Session) != nil || session.ID != id {
+			continue
+		}
+		// The metadata is saved after the chunk is written, the file is the reference
+		if info, err := os.Stat(staging_path(id, ".part")); err == nil {
+			session.Received = min(info.Size(), session.Size)
+		}
+		uploads[id] = session
+	}
+	cleanupUploads()
+}
+
+// Must be called with uploadsMutex held. Uploads busy with a chunk are not expired
+func cleanupUploads() {
+	for id, session := range uploads {
+		if !session.mutex.TryLock() {
+			continue
+		}
+		expired := time.Since(session.Updated_At) > Upload_timeout
+		session.mutex.Unlock()
+		if expired {
+			delete(uploads, id)
+			os.Remove(staging_path(id, ".part"))
+			os.Remove(staging_path(id, ".json"))
+		}
+	}
+}
+
+// Must be called with uploadsMutex held. The new upload and what the others still have to receive must fit on the
+// disk, so a single upload can't fill it
+func checkUploadSpace(size int64) error {
+	os.MkdirAll(Upload_staging_folder, 0700)
+	free, _, err := common.GetDiskSpace(Upload_staging_folder)
+	if err != nil {
+		// Nothing to check against
+		return nil
+	}
+	needed := size
+	for id, session := range uploads {
+		received := int64(0)
+		if info, err := os.Stat(staging_path(id, ".part")); err == nil {
+			received = info.Size()
+		}
+		needed += max(session.Size-received, 0)
+	}
+	if uint64(needed) > free {
+		return ErrNotEnoughSpace
+	}
+	return nil
+}
+
+func (session *upload) save() error {
+	data, err := json.Marshal(session.Upload_Session)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(staging_path(session.ID, ".json"), data, 0600)
+}
+
+// Copy of the session that is safe to hand out
+func (session *upload) snapshot() Upload_Session {
+	return session.Upload_Session
+}
+
+// Starts an upload, or returns the unfinished one with the same path, size and hashes so it can be resumed.
+// With a base, a file changed since is kept and the upload goes to a conflict copy
+func Begin_upload(username, path string, size int64, hash, base string) (Upload_Session, error) {
+	hash, base = strings.ToLower(hash), strings.ToLower(base)
+	if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+		return Upload_Session{}, ErrInvalidHash
+	}
+	if decoded, err := hex.DecodeString(base); base != "" && base != Base_New && (err != nil || len(decoded) != sha256.Size) {
+		return Upload_Session{}, ErrInvalidHash
+	}
+	if size < 0 {
+		return Upload_Session{}, ErrUploadTooBig
+	}
+	// Checked now rather than at the commit, after the whole file was sent
+	path, err := common.CleanSandboxPath(path)
+	if err != nil || path == "." {
+		return Upload_Session{}, common.ErrInvalidPath
+	}
+	if _, err := resolve_path(username, path, true); err != nil {
+		return Upload_Session{}, err
+	}
+
+	uploadsMutex.Lock()
+	cleanupUploads()
+	for _, session := range uploads {
+		if session.Username == username && session.Path == path && session.Size == size && session.Hash == hash && session.Base == base {
+			uploadsMutex.Unlock()
+			session.mutex.Lock()
+			defer session.mutex.Unlock()
+			return session.snapshot(), nil
+		}
+	}
+	defer uploadsMutex.Unlock()
+	if err := checkUploadSpace(size); err != nil {
+		return Upload_Session{}, err
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	now := time.Now()
+	session := &upload{Upload_Session: Upload_Session{
+		ID:         hex.EncodeToString(id),
+		Username:   username,
+		Path:       path,
+		Size:       size,
+		Hash:       hash,
+		Base:       base,
+		Created_At: now,
+		Updated_At: now,
+	}}
+	os.MkdirAll(Upload_staging_folder, 0700)
+	if err := os.WriteFile(staging_path(session.ID, ".part"), nil, 0600); err != nil {
+		return Upload_Session{}, err
+	}
+	if err := session.save(); err != nil {
+		os.Remove(staging_path(session.ID, ".part"))
+		return Upload_Session{}, err
+	}
+	uploads[session.ID] = session
+	return session.snapshot(), nil
+}
+
+// Uploads only belong to the user who started them
+func get_upload(username, id string) (*upload, error) {
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+	session, exists := uploads[id]
+	if !exists || session.Username != username {
+		return nil, ErrUnknownUpload
+	}
+	return session, nil
+}
+
+func Get_upload(username, id string) (Upload_Session, error) {
+	session, err := get_upload(username, id)
+	if err != nil {
+		return Upload_Session{}, err
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.snapshot(), nil
+}
+
+// Appends a chunk, which has to start where the upload stopped. What was written before an error is kept,
+// the returned session tells where to continue from
+func Write_upload_chunk(username, id string, offset int64, content io.Reader) (Upload_Session, error) {
+	session, err := get_upload(username, id)
+	if err != nil {
+		return Upload_Session{}, err
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if offset != session.Received {
+		return session.snapshot(), ErrUploadOffset
+	}
+
+	file, err := os.OpenFile(staging_path(id, ".part"), os.O_WRONLY, 0600)
+	if err != nil {
+		return session.snapshot(), err
+	}
+	defer file.Close()
+	if err := file.Truncate(offset); err != nil {
+		return session.snapshot(), err
+	}
+	// One byte more than allowed is enough to know the chunk is too big
+	written, err := io.Copy(io.NewOffsetWriter(file, offset), io.LimitReader(content, session.Size-offset+1))
+	if err == nil && offset+written > session.Size {
+		file.Truncate(session.Size)
+		written = session.Size - offset
+		err = ErrUploadTooBig
+	}
+	session.Received = offset + written
+	session.Updated_At = time.Now()
+	if saveErr := session.save(); err == nil {
+		err = saveErr
+	}
+	return session.snapshot(), err
+}
+
+// Checks the hash of the complete upload, then moves it to its place in the user's storage, or to a conflict copy
+// when the file changed since its base
+func Commit_upload(username, id string) (Upload_Result, error) {
+	session, err := get_upload(username, id)
+	if err != nil {
+		return Upload_Result{}, err
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.Received != session.Size {
+		return Upload_Result{}, ErrUploadIncomplete
+	}
+
+	part := staging_path(id, ".part")
+	file, err := os.Open(part)
+	if err != nil {
+		return Upload_Result{}, err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	file.Close()
+	if err != nil {
+		return Upload_Result{}, err
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != session.Hash {
+		// The content can't be trusted anymore, the upload starts over
+		os.Truncate(part, 0)
+		session.Received = 0
+		session.save()
+		return Upload_Result{}, ErrHashMismatch
+	}
+
+	// A share can be revoked while uploading to it
+	target, err := resolve_path(username, session.Path, true)
+	if err != nil {
+		return Upload_Result{}, err
+	}
+	// A file deleted since comes back, one changed since is kept and the upload goes next to it
+	conflict := false
+	if session.Base != "" {
+		current := current_hash(target)
+		if current == session.Hash {
+			os.Remove(part)
+			forget_upload(id)
+			return Upload_Result{target.view(target.path), false}, nil
+		}
+		conflict = current != "" && (session.Base == Base_New || current != session.Base)
+	}
+	if conflict {
+		target.path = conflict_copy_path(target)
+	}
+	if err := place_staged_file(target, part, session.Hash); err != nil {
+		return Upload_Result{}, err
+	}
+	forget_upload(id)
+	return Upload_Result{target.view(target.path), conflict}, nil
+}
+
+// Moves a complete file of the staging folder to target, the previous content becoming a version
+func place_staged_file(target user_path, staged, hash string) error {
+	sandbox := target.sandbox()
+	if err := sandbox.MkdirAll(path.Dir(target.path), 0700); err != nil {
+		return err
+	}
+	destination, err := sandbox.Resolve(target.path)
+	if err != nil {
+		return err
+	}
+	restore_previous, err := keep_version(target.owner, target.path)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(staged, destination); err != nil {
+		restore_previous()
+		// The staging folder may be on another disk
+		content, openErr := os.Open(staged)
+		if openErr != nil {
+			return err
+		}
+		err = save_file(target.owner, target.path, content)
+		content.Close()
+		if err != nil {
+			return err
+		}
+		os.Remove(staged)
+		return nil
+	}
+	store_blob(target.owner, target.path, hash)
+	publishFileChange(target.owner, target.path, "written")
+	return nil
+}
+
+func Abort_upload(username, id string) error {
+	session, err := get_upload(username, id)
+	if err != nil {
+		return err
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	os.Remove(staging_path(id, ".part"))
+	forget_upload(id)
+	return nil
+}
+
+// Drops a finished or cancelled upload, its .part file is already gone
+func forget_upload(id string) {
+	os.Remove(staging_path(id, ".json"))
+	uploadsMutex.Lock()
+	delete(uploads, id)
+	uploadsMutex.Unlock()
+}
@@ -0,0 +1,189 @@
+package User_Handler
+
+import (
+	common "ServerController/src/Common"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Starts the users with empty storages in a temporary folder, the server keeps its files relative to the working directory
+func testUsers(t *testing.T, usernames ...string) {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	os.MkdirAll("res/config_files", 0700)
+	users, shares := LoadedUsers, loadedShares
+	t.Cleanup(func() { LoadedUsers, loadedShares = users, shares })
+	LoadedUsers = map[string]User{}
+	loadedShares = map[string]Share{}
+	for _, username := range usernames {
+		LoadedUsers[username] = User{Username: username}
+		if err := os.MkdirAll(User_folder(username), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// The uploads of the other tests are not seen, nor left behind
+func testUploads(t *testing.T, usernames ...string) {
+	t.Helper()
+	testUsers(t, usernames...)
+	previous := uploads
+	t.Cleanup(func() { uploads = previous })
+	uploads = map[string]*upload{}
+}
+
+func TestUploadInChunks(t *testing.T) {
+	testUploads(t, "alice", "bob")
+	content := strings.Repeat("chunked upload ", 100)
+	session, err := Begin_upload("alice", "docs/big.txt", int64(len(content)), sha256Hex(content), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Asking again gives the same upload, to resume it
+	if again, err := Begin_upload("alice", "docs/big.txt", int64(len(content)), strings.ToUpper(sha256Hex(content)), ""); err != nil || again.ID != session.ID {
+		t.Errorf("beginning again gave %s, %v, want %s", again.ID, err, session.ID)
+	}
+	if _, err := Get_upload("bob", session.ID); !errors.Is(err, ErrUnknownUpload) {
+		t.Errorf("bob getting alice's upload: %v, want ErrUnknownUpload", err)
+	}
+	if _, err := Write_upload_chunk("bob", session.ID, 0, strings.NewReader(content)); !errors.Is(err, ErrUnknownUpload) {
+		t.Errorf("bob writing to alice's upload: %v, want ErrUnknownUpload", err)
+	}
+
+	if _, err := Write_upload_chunk("alice", session.ID, 0, strings.NewReader(content[:500])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Commit_upload("alice", session.ID); !errors.Is(err, ErrUploadIncomplete) {
+		t.Errorf("committing half the file: %v, want ErrUploadIncomplete", err)
+	}
+	// A chunk sent twice, or one skipping ahead, is refused with where to continue from
+	for _, offset := range []int64{0, 499, 501} {
+		progress, err := Write_upload_chunk("alice", session.ID, offset, strings.NewReader("x"))
+		if !errors.Is(err, ErrUploadOffset) || progress.Received != 500 {
+			t.Errorf("chunk at %d: received %d, %v, want 500 and ErrUploadOffset", offset, progress.Received, err)
+		}
+	}
+	if progress, err := Write_upload_chunk("alice", session.ID, 500, strings.NewReader(content[500:])); err != nil || progress.Received != progress.Size {
+		t.Fatalf("last chunk: received %d of %d, %v", progress.Received, progress.Size, err)
+	}
+	if _, err := Commit_upload("alice", session.ID); err != nil {
+		t.Fatal(err)
+	}
+	if written, err := os.ReadFile(User_folder("alice") + "/docs/big.txt"); err != nil || string(written) != content {
+		t.Errorf("committed %d bytes, %v, want %d", len(written), err, len(content))
+	}
+	if _, err := Get_upload("alice", session.ID); !errors.Is(err, ErrUnknownUpload) {
+		t.Errorf("the upload is still there after the commit: %v", err)
+	}
+	if entries, _ := os.ReadDir(Upload_staging_folder); len(entries) != 0 {
+		t.Errorf("%d files left in the staging folder", len(entries))
+	}
+}
+
+func TestInvalidUploads(t *testing.T) {
+	testUploads(t, "alice")
+	hash := sha256Hex("content")
+	tests := []struct {
+		name, path, hash string
+		size             int64
+		err              error
+	}{
+		{"hash too short", "file.txt", hash[:10], 7, ErrInvalidHash},
+		{"hash not hex", "file.txt", strings.Repeat("z", 64), 7, ErrInvalidHash},
+		{"negative size", "file.txt", hash, -1, ErrUploadTooBig},
+		{"outside the storage", "../file.txt", hash, 7, common.ErrInvalidPath},
+		{"the storage itself", ".", hash, 7, common.ErrInvalidPath},
+		{"more than the disk holds", "file.txt", hash, 1 << 62, ErrNotEnoughSpace},
+	}
+	for _, test := range tests {
+		if _, err := Begin_upload("alice", test.path, test.size, test.hash, ""); !errors.Is(err, test.err) {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+	}
+	if len(uploads) != 0 {
+		t.Errorf("%d uploads started", len(uploads))
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	testUploads(t, "alice")
+	session, err := Begin_upload("alice", "file.txt", 7, sha256Hex("content"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// What fits is kept, the rest is refused
+	progress, err := Write_upload_chunk("alice", session.ID, 0, strings.NewReader("contents"))
+	if !errors.Is(err, ErrUploadTooBig) || progress.Received != 7 {
+		t.Errorf("a chunk too long: received %d, %v, want 7 and ErrUploadTooBig", progress.Received, err)
+	}
+
+	// A content that doesn't match the hash can't be trusted, the upload starts over
+	other, err := Begin_upload("alice", "other.txt", 7, sha256Hex("content"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Write_upload_chunk("alice", other.ID, 0, strings.NewReader("CONTENT"))
+	if _, err := Commit_upload("alice", other.ID); !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("committing the wrong content: %v, want ErrHashMismatch", err)
+	}
+	if progress, _ := Get_upload("alice", other.ID); progress.Received != 0 {
+		t.Errorf("received %d after the hash mismatch, want 0", progress.Received)
+	}
+	if _, err := os.Stat(User_folder("alice") + "/other.txt"); err == nil {
+		t.Error("the wrong content was placed")
+	}
+
+	if err := Abort_upload("alice", other.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(staging_path(other.ID, ".part")); err == nil {
+		t.Error("the aborted upload is still staged")
+	}
+	if err := Abort_upload("alice", other.ID); !errors.Is(err, ErrUnknownUpload) {
+		t.Errorf("aborting twice: %v, want ErrUnknownUpload", err)
+	}
+}
+
+// A restart keeps the uploads to resume, and drops the ones nobody touched for too long
+func TestLoadUploads(t *testing.T) {
+	testUploads(t, "alice")
+	resumed, err := Begin_upload("alice", "resumed.txt", 7, sha256Hex("content"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Write_upload_chunk("alice", resumed.ID, 0, strings.NewReader("cont"))
+	stale, err := Begin_upload("alice", "stale.txt", 7, sha256Hex("content"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads[stale.ID].Updated_At = time.Now().Add(-Upload_timeout - time.Minute)
+	uploads[stale.ID].save()
+
+	uploads = map[string]*upload{}
+	Load_uploads()
+	if progress, err := Get_upload("alice", resumed.ID); err != nil || progress.Received != 4 || progress.Path != "resumed.txt" {
+		t.Errorf("after the restart: %+v, %v", progress, err)
+	}
+	if _, err := Get_upload("alice", stale.ID); !errors.Is(err, ErrUnknownUpload) {
+		t.Errorf("the stale upload is still there: %v", err)
+	}
+	if _, err := os.Stat(staging_path(stale.ID, ".part")); err == nil {
+		t.Error("the stale upload is still staged")
+	}
+	if _, err := Write_upload_chunk("alice", resumed.ID, 4, strings.NewReader("ent")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Commit_upload("alice", resumed.ID); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,176 @@
+package User_Handler
+
+import (
+	common "ServerController/src/Common"
+	"ServerController/src/Event_Handler"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+var ErrUnknownPath = errors.New("unknown path")
+var ErrNotAFile = errors.New("not a file")
+
+type Folder_Entry struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path,omitempty"` // Set in the recursive listings, relative to the user's storage
+	Type     string    `json:"type"`           // Type bits of the mode, "d---------" for a folder
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Mode     string    `json:"mode"`
+}
+
+// Root of the user's private storage, the folder of all of them for an empty name. A name that isn't a single
+// plain name gets no folder, so its sandbox refuses everything
+func User_folder(username string) string {
+	if username != "" && !Valid_username(username) {
+		return ""
+	}
+	return "users_data/" + username
+}
+
+// Every file operation on the user's storage goes through it, so no path can reach the other users or the server files
+func User_sandbox(username string) common.Sandbox {
+	return common.NewSandbox(User_folder(username))
+}
+
+// The root of the storage also holds "Shared with me" once something is shared with the user
+func List_user_folder(username, path string) ([]Folder_Entry, error) {
+	if entries, found, err := shared_entries(username, path); found {
+		return entries, err
+	}
+	resolved, err := resolve_path(username, path, false)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := resolved.sandbox().ReadDir(resolved.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrUnknownPath
+	}
+	if err != nil {
+		return nil, err
+	}
+	results := []Folder_Entry{}
+	root := resolved.share == nil && resolved.path == "."
+	for _, e := range entries {
+		if root && e.Name() == Shared_folder {
+			// Hidden by the virtual one
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// Deleted since the folder was read
+			continue
+		}
+		results = append(results, folder_entry(e.Name(), "", Own_file_info(resolved.sandbox(), resolved.path+"/"+e.Name(), info)))
+	}
+	if incoming := List_incoming_shares(username); root && len(incoming) > 0 {
+		results = append(results, virtual_entry(Shared_folder, incoming[len(incoming)-1].Created_At))
+	}
+	return results, nil
+}
+
+func Create_user_folder(username, path string) error {
+	resolved, err := resolve_path(username, path, true)
+	if err != nil {
+		return err
+	}
+	err = resolved.sandbox().MkdirAll(resolved.path, 0700)
+	if err != nil {
+		return err
+	}
+	publishFileChange(resolved.owner, resolved.path, "created")
+	return nil
+}
+
+func Write_user_file(username, path string, content []byte) error {
+	return Save_user_file(username, path, bytes.NewReader(content))
+}
+
+// Writes the file from a stream, a failed copy doesn't leave half a file behind.
+// The content it replaces is kept as a previous version
+func Save_user_file(username, path string, content io.Reader) error {
+	resolved, err := resolve_path(username, path, true)
+	if err != nil {
+		return err
+	}
+	return save_file(resolved.owner, resolved.path, content)
+}
+
+// Save_user_file once the path is resolved to the owner's storage
+func save_file(username, path string, content io.Reader) error {
+	sandbox := User_sandbox(username)
+	restore_previous, err := keep_version(username, path)
+	if err != nil {
+		return err
+	}
+	if err := unlink_previous(username, path); err != nil {
+		restore_previous()
+		return err
+	}
+	file, err := sandbox.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0700)
+	if err != nil {
+		restore_previous()
+		return err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(file, io.TeeReader(content, hasher))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		sandbox.Remove(path)
+		restore_previous()
+		return err
+	}
+	store_blob(username, path, hex.EncodeToString(hasher.Sum(nil)))
+	publishFileChange(username, path, "written")
+	return nil
+}
+
+// Opens a file of the user's storage for reading, the caller closes it
+func Open_user_file(username, path string) (*os.File, os.FileInfo, error) {
+	resolved, err := resolve_path(username, path, false)
+	if errors.Is(err, ErrSharedFolder) {
+		return nil, nil, ErrNotAFile
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := resolved.sandbox().Open(resolved.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, ErrUnknownPath
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = ErrNotAFile
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, Own_file_info(resolved.sandbox(), resolved.path, info), nil
+}
+
+// Tells the owner, and the users the path is shared with, each with the path they see
+func publishFileChange(username, path, change string) {
+	index_change(username, path)
+	thumbnail_change(username, path, change)
+	views := share_views(username, path)
+	views[username] = path
+	for recipient, view := range views {
+		journal_change(recipient, view, change)
+		Event_Handler.Publish(Event_Handler.Event{
+			Topic:    Event_Handler.FileChanged,
+			Data:     map[string]string{"path": view, "change": change},
+			Username: recipient,
+		})
+	}
+}
@@ -0,0 +1,484 @@
+package User_Handler
+
+import (
+	common "ServerController/src/Common"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deleted files and the previous versions of overwritten files live next to the users' storage, out of their reach.
+// Each entry is its content (a file, or a folder for the trash) and a .json file with its details
+const (
+	Trash_folder    = "users_trash/"
+	Versions_folder = "users_versions/"
+)
+
+// How often the janitor removes the expired trash and versions
+const janitorInterval = time.Hour
+
+var ErrUnknownTrashEntry = errors.New("unknown trash entry")
+var ErrUnknownVersion = errors.New("unknown version")
+
+// The trash and the versions are changed one operation at a time
+var historyMutex sync.Mutex
+
+type Trash_Entry struct {
+	ID         string    `json:"id"`
+	Path       string    `json:"path"` // Where it was deleted from
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	Deleted_At time.Time `json:"deleted_at"`
+}
+
+type File_Version struct {
+	ID          string    `json:"id"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	Modified    time.Time `json:"modified"` // Modification time of the content, before it was replaced
+	Replaced_At time.Time `json:"replaced_at"`
+}
+
+type Storage_Usage struct {
+	Files    int64 `json:"files"`
+	Trash    int64 `json:"trash"`
+	Versions int64 `json:"versions"`
+	Total    int64 `json:"total"`
+}
+
+func trash_folder(username string) string {
+	return Trash_folder + username + "/"
+}
+
+func versions_folder(username string) string {
+	return Versions_folder + username + "/"
+}
+
+func history_id() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Ids come from the clients, anything else than what history_id makes could be a path
+func valid_history_id(id string) bool {
+	decoded, err := hex.DecodeString(id)
+	return err == nil && len(decoded) == 16
+}
+
+func readHistory[T any](folder string) []T {
+	entries, _ := os.ReadDir(folder)
+	results := []T{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(folder + entry.Name())
+		if err != nil {
+			continue
+		}
+		var value T
+		if json.Unmarshal(data, &value) == nil {
+			results = append(results, value)
+		}
+	}
+	return results
+}
+
+func writeHistory(folder, id string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(folder+id+".json", data, 0600)
+}
+
+func removeHistory(folder, id string) {
+	os.Remove(folder + id + ".json")
+	os.RemoveAll(folder + id)
+}
+
+// Size of a file, or of everything in a folder
+func pathSize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// ===========================
+// Trash
+// ===========================
+
+// Moves a file or folder to the trash, where it can be restored from until the janitor removes it
+func Move_to_trash(username, path string) (Trash_Entry, error) {
+	sandbox := User_sandbox(username)
+	path, err := common.CleanSandboxPath(path)
+	if err != nil || path == "." {
+		return Trash_Entry{}, common.ErrInvalidPath
+	}
+	info, err := sandbox.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Trash_Entry{}, ErrUnknownPath
+	}
+	if err != nil {
+		return Trash_Entry{}, err
+	}
+	source, err := sandbox.Resolve(path)
+	if err != nil {
+		return Trash_Entry{}, err
+	}
+
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	folder := trash_folder(username)
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return Trash_Entry{}, err
+	}
+	entry := Trash_Entry{
+		ID:         history_id(),
+		Path:       path,
+		Type:       info.Mode().Type().String(),
+		Size:       pathSize(source),
+		Deleted_At: time.Now(),
+	}
+	if err := os.Rename(source, folder+entry.ID); err != nil {
+		return Trash_Entry{}, err
+	}
+	move_blob_metadata(source, folder+entry.ID)
+	if err := writeHistory(folder, entry.ID, entry); err != nil {
+		// Without its details the entry couldn't be restored, better not delete it at all
+		if os.Rename(folder+entry.ID, source) == nil {
+			move_blob_metadata(folder+entry.ID, source)
+		}
+		return Trash_Entry{}, err
+	}
+	publishFileChange(username, path, "deleted")
+	return entry, nil
+}
+
+// Newest first
+func List_trash(username string) []Trash_Entry {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	entries := readHistory[Trash_Entry](trash_folder(username))
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Deleted_At.After(entries[j].Deleted_At) })
+	return entries
+}
+
+// Puts a trash entry back where it was deleted from, or at to when it isn't empty. Nothing gets overwritten
+func Restore_from_trash(username, id, to string) (string, error) {
+	if !valid_history_id(id) {
+		return "", ErrUnknownTrashEntry
+	}
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	folder := trash_folder(username)
+	var entry Trash_Entry
+	data, err := os.ReadFile(folder + id + ".json")
+	if err != nil || json.Unmarshal(data, &entry) != nil {
+		return "", ErrUnknownTrashEntry
+	}
+	if to == "" {
+		to = entry.Path
+	}
+	destination, err := restoreDestination(username, to)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(folder+id, destination); err != nil {
+		return "", err
+	}
+	move_blob_metadata(folder+id, destination)
+	os.Remove(folder + id + ".json")
+	to, _ = common.CleanSandboxPath(to)
+	publishFileChange(username, to, "created")
+	return to, nil
+}
+
+// Real path where something can be restored to, its folder is created when needed
+func restoreDestination(username, to string) (string, error) {
+	sandbox := User_sandbox(username)
+	to, err := common.CleanSandboxPath(to)
+	if err != nil || to == "." || is_shared_view(to) {
+		return "", common.ErrInvalidPath
+	}
+	if _, err := sandbox.Lstat(to); err == nil {
+		return "", ErrPathExists
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if err := sandbox.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return "", err
+	}
+	return sandbox.Resolve(to)
+}
+
+func Empty_trash(username string) error {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	return os.RemoveAll(trash_folder(username))
+}
+
+// ===========================
+// Versions
+// ===========================
+
+// Moves the current content of path aside as a version, before it gets overwritten. The returned function puts it
+// back, for when the new content couldn't be written. Nothing is kept when path isn't a file or versioning is off
+func keep_version(username, path string) (func(), error) {
+	nothing := func() {}
+	if common.Config.Max_File_Versions <= 0 {
+		return nothing, nil
+	}
+	sandbox := User_sandbox(username)
+	path, err := common.CleanSandboxPath(path)
+	if err != nil {
+		return nothing, err
+	}
+	info, err := sandbox.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nothing, nil
+	}
+	source, err := sandbox.Resolve(path)
+	if err != nil {
+		return nothing, err
+	}
+
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	folder := versions_folder(username)
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nothing, err
+	}
+	version := File_Version{
+		ID:          history_id(),
+		Path:        path,
+		Size:        info.Size(),
+		Modified:    own_info(source, info).ModTime(),
+		Replaced_At: time.Now(),
+	}
+	if err := os.Rename(source, folder+version.ID); err != nil {
+		return nothing, err
+	}
+	move_blob_metadata(source, folder+version.ID)
+	if err := writeHistory(folder, version.ID, version); err != nil {
+		if os.Rename(folder+version.ID, source) == nil {
+			move_blob_metadata(folder+version.ID, source)
+		}
+		return nothing, err
+	}
+	pruneVersions(username, path)
+	return func() {
+		historyMutex.Lock()
+		defer historyMutex.Unlock()
+		if os.Rename(folder+version.ID, source) == nil {
+			move_blob_metadata(folder+version.ID, source)
+			os.Remove(folder + version.ID + ".json")
+		}
+	}, nil
+}
+
+// Must be called with historyMutex held. Keeps the newest Max_File_Versions versions of path
+func pruneVersions(username, path string) {
+	versions := versionsOf(username, path)
+	for _, version := range versions[min(len(versions), max(common.Config.Max_File_Versions, 0)):] {
+		removeHistory(versions_folder(username), version.ID)
+	}
+}
+
+// Must be called with historyMutex held. Newest first
+func versionsOf(username, path string) []File_Version {
+	var results []File_Version
+	for _, version := range readHistory[File_Version](versions_folder(username)) {
+		if version.Path == path {
+			results = append(results, version)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Replaced_At.After(results[j].Replaced_At) })
+	return results
+}
+
+// Previous versions of a file, newest first. The versions of a shared file are kept by its owner
+func List_file_versions(username, path string) ([]File_Version, error) {
+	resolved, err := resolve_path(username, path, false)
+	if err != nil {
+		return nil, err
+	}
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	versions := versionsOf(resolved.owner, resolved.path)
+	if versions == nil {
+		versions = []File_Version{}
+	}
+	for i := range versions {
+		versions[i].Path = resolved.view(versions[i].Path)
+	}
+	return versions, nil
+}
+
+// Brings a previous version back, the current content becoming a version in turn
+func Restore_file_version(username, path, id string) error {
+	resolved, err := resolve_path(username, path, true)
+	if err != nil {
+		return err
+	}
+	username, path = resolved.owner, resolved.path
+	if path == "." {
+		return common.ErrInvalidPath
+	}
+	if !valid_history_id(id) {
+		return ErrUnknownVersion
+	}
+	folder := versions_folder(username)
+
+	// The version is taken out first, so making room for the current content can't prune it
+	historyMutex.Lock()
+	var version File_Version
+	data, err := os.ReadFile(folder + id + ".json")
+	if err != nil || json.Unmarshal(data, &version) != nil || version.Path != path {
+		historyMutex.Unlock()
+		return ErrUnknownVersion
+	}
+	restoring := folder + id + ".restoring"
+	err = os.Rename(folder+id, restoring)
+	if err == nil {
+		move_blob_metadata(folder+id, restoring)
+		os.Remove(folder + id + ".json")
+	}
+	historyMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	undo, err := keep_version(username, path)
+	if err == nil {
+		var destination string
+		destination, err = restoreDestination(username, path)
+		if err == nil {
+			err = os.Rename(restoring, destination)
+		}
+		if err == nil {
+			move_blob_metadata(restoring, destination)
+		}
+		if err != nil {
+			undo()
+		}
+	}
+	if err != nil {
+		// The version goes back to the list
+		historyMutex.Lock()
+		if os.Rename(restoring, folder+id) == nil {
+			move_blob_metadata(restoring, folder+id)
+			writeHistory(folder, id, version)
+		}
+		historyMutex.Unlock()
+		return err
+	}
+	publishFileChange(username, path, "written")
+	return nil
+}
+
+// ===========================
+// Expiration
+// ===========================
+
+// Removes the trash entries and versions older than age, returns how many were removed
+func Purge_history(username string, age time.Duration) int {
+	return purgeTrash(username, age) + purgeVersions(username, age)
+}
+
+func purgeTrash(username string, age time.Duration) int {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	removed := 0
+	for _, entry := range readHistory[Trash_Entry](trash_folder(username)) {
+		if time.Since(entry.Deleted_At) > age {
+			removeHistory(trash_folder(username), entry.ID)
+			removed++
+		}
+	}
+	return removed
+}
+
+func purgeVersions(username string, age time.Duration) int {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	removed := 0
+	for _, version := range readHistory[File_Version](versions_folder(username)) {
+		if time.Since(version.Replaced_At) > age {
+			removeHistory(versions_folder(username), version.ID)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Removes the expired trash entries, versions, share links and unused blobs every hour, until ctx is done
+func Start_janitor(ctx context.Context) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		runJanitor()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func runJanitor() {
+	days := func(count int) time.Duration { return time.Duration(count) * 24 * time.Hour }
+	removed := 0
+	if entries, err := os.ReadDir(Trash_folder); err == nil {
+		for _, entry := range entries {
+			removed += purgeTrash(entry.Name(), days(common.Config.Trash_Retention_Days))
+		}
+	}
+	if entries, err := os.ReadDir(Versions_folder); err == nil {
+		for _, entry := range entries {
+			removed += purgeVersions(entry.Name(), days(common.Config.Version_Retention_Days))
+		}
+	}
+	if removed > 0 {
+		fmt.Printf("Janitor removed %d expired trash entries and versions\n", removed)
+	}
+	// Abandoned uploads would otherwise wait for the next upload or restart
+	uploadsMutex.Lock()
+	cleanupUploads()
+	uploadsMutex.Unlock()
+	purgeShareLinks()
+	purgeThumbnails()
+	runBlobCollector()
+}
+
+// What the user takes on the disk: the files, plus the trash and the versions
+func Get_storage_usage(username string) Storage_Usage {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	usage := Storage_Usage{
+		Files:    pathSize(User_folder(username)),
+		Trash:    pathSize(trash_folder(username)),
+		Versions: pathSize(versions_folder(username)),
+	}
+	usage.Total = usage.Files + usage.Trash + usage.Versions
+	return usage
+}
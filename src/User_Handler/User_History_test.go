@@ -0,0 +1,158 @@
+package User_Handler
+
+import (
+	common "ServerController/src/Common"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, username, name, content string) {
+	t.Helper()
+	if err := User_sandbox(username).MkdirAll(path.Dir(name), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := Write_user_file(username, name, []byte(content)); err != nil {
+		t.Fatalf("Write_user_file(%s, %s): %v", username, name, err)
+	}
+}
+
+func readTestFile(t *testing.T, username, name string) string {
+	t.Helper()
+	content, err := os.ReadFile(User_folder(username) + "/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestTrash(t *testing.T) {
+	testUsers(t, "alice", "bob")
+	writeTestFile(t, "alice", "docs/report.txt", "report")
+	writeTestFile(t, "alice", "docs/notes/monday.txt", "monday")
+	file, err := Move_to_trash("alice", "docs/report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder, err := Move_to_trash("alice", "docs/notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Size != 6 || folder.Size != 6 || folder.Type != os.ModeDir.String() {
+		t.Errorf("trashed %+v and %+v", file, folder)
+	}
+	if _, err := os.Stat(User_folder("alice") + "/docs/notes"); err == nil {
+		t.Error("the trashed folder is still there")
+	}
+	for _, path := range []string{"docs/report.txt", ".", "../bob"} {
+		if _, err := Move_to_trash("alice", path); err == nil {
+			t.Errorf("trashing %q worked", path)
+		}
+	}
+	if trash := List_trash("alice"); len(trash) != 2 || trash[0].ID != folder.ID || trash[1].ID != file.ID {
+		t.Errorf("alice's trash %+v, want the folder then the file", trash)
+	}
+	if trash := List_trash("bob"); len(trash) != 0 {
+		t.Errorf("bob's trash %+v", trash)
+	}
+
+	// Back where it was deleted from, or elsewhere, nothing gets overwritten
+	if _, err := Restore_from_trash("bob", file.ID, ""); !errors.Is(err, ErrUnknownTrashEntry) {
+		t.Errorf("bob restoring alice's file: %v, want ErrUnknownTrashEntry", err)
+	}
+	if _, err := Restore_from_trash("alice", "../../users_data/alice/docs", ""); !errors.Is(err, ErrUnknownTrashEntry) {
+		t.Errorf("restoring a path as an id: %v, want ErrUnknownTrashEntry", err)
+	}
+	if path, err := Restore_from_trash("alice", file.ID, ""); err != nil || path != "docs/report.txt" || readTestFile(t, "alice", path) != "report" {
+		t.Errorf("restoring the file: %q, %v", path, err)
+	}
+	writeTestFile(t, "alice", "docs/notes", "a file where the folder was")
+	if _, err := Restore_from_trash("alice", folder.ID, ""); !errors.Is(err, ErrPathExists) {
+		t.Errorf("restoring over a file: %v, want ErrPathExists", err)
+	}
+	if _, err := Restore_from_trash("alice", folder.ID, "../elsewhere"); !errors.Is(err, common.ErrInvalidPath) {
+		t.Errorf("restoring outside the storage: %v, want ErrInvalidPath", err)
+	}
+	if path, err := Restore_from_trash("alice", folder.ID, "old/notes"); err != nil || readTestFile(t, "alice", path+"/monday.txt") != "monday" {
+		t.Errorf("restoring the folder elsewhere: %q, %v", path, err)
+	}
+	if trash := List_trash("alice"); len(trash) != 0 {
+		t.Errorf("%d entries left in the trash", len(trash))
+	}
+
+	Move_to_trash("alice", "docs/report.txt")
+	if err := Empty_trash("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if trash := List_trash("alice"); len(trash) != 0 {
+		t.Errorf("%d entries left after emptying the trash", len(trash))
+	}
+}
+
+func TestFileVersions(t *testing.T) {
+	testUsers(t, "alice")
+	versions := common.Config.Max_File_Versions
+	t.Cleanup(func() { common.Config.Max_File_Versions = versions })
+	common.Config.Max_File_Versions = 2
+	for _, content := range []string{"first", "second", "third", "fourth"} {
+		writeTestFile(t, "alice", "file.txt", content)
+	}
+	// Only the newest ones are kept
+	listed, err := List_file_versions("alice", "file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].Size != int64(len("third")) || listed[1].Size != int64(len("second")) {
+		t.Fatalf("versions %+v, want third then second", listed)
+	}
+
+	if err := Restore_file_version("alice", "other.txt", listed[1].ID); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("restoring the version of another file: %v, want ErrUnknownVersion", err)
+	}
+	if err := Restore_file_version("alice", "file.txt", "../file.txt"); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("restoring a path as an id: %v, want ErrUnknownVersion", err)
+	}
+	if err := Restore_file_version("alice", "file.txt", listed[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestFile(t, "alice", "file.txt"); content != "second" {
+		t.Errorf("restored %q, want second", content)
+	}
+	// The replaced content became a version in turn
+	listed, _ = List_file_versions("alice", "file.txt")
+	if len(listed) != 2 || listed[0].Size != int64(len("fourth")) || listed[1].Size != int64(len("third")) {
+		t.Errorf("versions after the restore %+v, want fourth then third", listed)
+	}
+
+	common.Config.Max_File_Versions = 0
+	writeTestFile(t, "alice", "unversioned.txt", "first")
+	writeTestFile(t, "alice", "unversioned.txt", "second")
+	if listed, _ := List_file_versions("alice", "unversioned.txt"); len(listed) != 0 {
+		t.Errorf("%d versions kept with versioning off", len(listed))
+	}
+}
+
+func TestPurgeHistory(t *testing.T) {
+	testUsers(t, "alice")
+	writeTestFile(t, "alice", "file.txt", "first")
+	writeTestFile(t, "alice", "file.txt", "second")
+	writeTestFile(t, "alice", "deleted.txt", "deleted")
+	Move_to_trash("alice", "deleted.txt")
+
+	usage := Get_storage_usage("alice")
+	// The trash and the versions count their details too
+	if usage.Files != 6 || usage.Trash < 7 || usage.Versions < 5 || usage.Total != usage.Files+usage.Trash+usage.Versions {
+		t.Errorf("usage %+v", usage)
+	}
+	if removed := Purge_history("alice", time.Hour); removed != 0 {
+		t.Errorf("purging what is older than an hour removed %d", removed)
+	}
+	if removed := Purge_history("alice", 0); removed != 2 {
+		t.Errorf("purging everything removed %d, want 2", removed)
+	}
+	if usage := Get_storage_usage("alice"); usage.Total != 6 {
+		t.Errorf("usage after the purge %+v", usage)
+	}
+}
@@ -1,14 +1,23 @@
 package User_Handler
 
 import (
+	common "ServerController/src/Common"
+	"ServerController/src/Event_Handler"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"os"
+	"strings"
 	"time"
 )
 
+var (
+	ErrInvalidUsername = errors.New("invalid username: it must be a single name, without / or \\ and not . or ..")
+	ErrUserExists      = errors.New("user already exists")
+)
+
 type User struct {
 	Username    string `json:"username"`
 	Password    string `json:"password"`
@@ -21,6 +30,12 @@ type User struct {
 
 var LoadedUsers map[string]User
 
+// The username names the user's folders, so it has to stay a single plain name
+func Valid_username(username string) bool {
+	cleaned, err := common.CleanSandboxPath(username)
+	return err == nil && username != "" && cleaned == username && cleaned != "." && !strings.Contains(username, "/")
+}
+
 func generateRandomPassword() string {
 	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	bytes := make([]byte, 12)
@@ -56,6 +71,13 @@ func Load_users() {
 		// Parse JSON and load users
 		_ = json.Unmarshal(file, &LoadedUsers)
 	}
+	// A name leading out of users_data would get the folders of someone else, or the server's files
+	for username := range LoadedUsers {
+		if !Valid_username(username) {
+			println("Ignoring the user with an invalid name: " + username)
+			delete(LoadedUsers, username)
+		}
+	}
 
 	if LoadedUsers == nil {
 		// Inform user about the creation of a new user map with default admin
@@ -101,9 +123,12 @@ func Save_users() {
 		return
 	}
 }
-func Add_user(username, password string, admin bool, admin_grade uint8) bool {
+func Add_user(username, password string, admin bool, admin_grade uint8, added_by string) error {
+	if !Valid_username(username) {
+		return ErrInvalidUsername
+	}
 	if User_exists(username) {
-		return false
+		return ErrUserExists
 	}
 	salt := generateSalt()
 	LoadedUsers[username] = User{
@@ -116,11 +141,20 @@ func Add_user(username, password string, admin bool, admin_grade uint8) bool {
 		Admin_Grade: admin_grade,
 	}
 	Save_users()
-	return true
+	Event_Handler.Publish(Event_Handler.Event{
+		Topic:      Event_Handler.UserAdded,
+		Data:       map[string]string{"username": username, "added_by": added_by},
+		Admin_only: true,
+	})
+	return nil
 }
 func Remove_user(username string) {
 	delete(LoadedUsers, username)
 	Save_users()
+	remove_user_shares(username)
+	remove_user_share_links(username)
+	remove_user_journal(username)
+	remove_user_index(username)
 }
 func Authenticate_user(username, password string) bool {
 	if !User_exists(username) {
@@ -0,0 +1,28 @@
+package User_Handler
+
+import "testing"
+
+func TestValidUsername(t *testing.T) {
+	names := map[string]bool{
+		"alice":        true,
+		"bob.smith":    true,
+		"...":          true,
+		"":             false,
+		".":            false,
+		"..":           false,
+		"../alice":     false,
+		"alice/files":  false,
+		"alice\\files": false,
+		"/alice":       false,
+		"alice\x00":    false,
+		"./alice":      false,
+	}
+	for name, valid := range names {
+		if Valid_username(name) != valid {
+			t.Errorf("Valid_username(%q) = %v, want %v", name, !valid, valid)
+		}
+		if folder := User_folder(name); name != "" && !valid && folder != "" {
+			t.Errorf("User_folder(%q) = %q, want no folder", name, folder)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package User_Handler
+
+import (
+	common "ServerController/src/Common"
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// How long the space used by a user is remembered, a PROPFIND asks for it on every folder
+const davUsageLifetime = time.Minute
+
+var davQuotaAvailable = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+var davQuotaUsed = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+
+type dav_usage struct {
+	used       int64
+	checked_at time.Time
+}
+
+var davUsage = map[string]dav_usage{}
+var davUsageMutex sync.Mutex
+
+// A user's storage served over WebDAV. Everything goes through the sandbox, deleted files go to the trash and
+// overwritten ones become versions, like with the other file commands
+type dav_storage struct {
+	username string
+}
+
+func User_webdav_storage(username string) webdav.FileSystem {
+	return dav_storage{username}
+}
+
+// WebDAV names start with a slash, the root being "/"
+func dav_path(name string) (string, error) {
+	return common.CleanSandboxPath(strings.TrimPrefix(name, "/"))
+}
+
+// Nothing can be created under the name of "Shared with me", the other clients would never see it
+func dav_write_path(name string) (string, error) {
+	name, err := dav_path(name)
+	if err == nil && is_shared_view(name) {
+		return "", ErrSharedFolder
+	}
+	return name, err
+}
+
+func (s dav_storage) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name, err := dav_write_path(name)
+	if err != nil {
+		return err
+	}
+	if err := User_sandbox(s.username).Mkdir(name, 0700); err != nil {
+		return err
+	}
+	publishFileChange(s.username, name, "created")
+	return nil
+}
+
+func (s dav_storage) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	writing := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	var err error
+	if writing || flag&os.O_CREATE != 0 {
+		name, err = dav_write_path(name)
+	} else {
+		name, err = dav_path(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	restore_previous := func() {}
+	if writing && flag&os.O_TRUNC != 0 {
+		if restore_previous, err = keep_version(s.username, name); err != nil {
+			return nil, err
+		}
+		if err := unlink_previous(s.username, name); err != nil {
+			restore_previous()
+			return nil, err
+		}
+	} else if writing {
+		// Written in place, the other files linked to the same blob must not change
+		if err := detach_blob(s.username, name); err != nil {
+			return nil, err
+		}
+	}
+	file, err := User_sandbox(s.username).OpenFile(name, flag, 0700)
+	if err != nil {
+		restore_previous()
+		return nil, err
+	}
+	return &dav_file{File: file, storage: s, path: name, writing: writing}, nil
+}
+
+// A missing path is no error, like os.RemoveAll
+func (s dav_storage) RemoveAll(ctx context.Context, name string) error {
+	name, err := dav_path(name)
+	if err != nil {
+		return err
+	}
+	if _, err := Move_to_trash(s.username, name); err != nil && !errors.Is(err, ErrUnknownPath) {
+		return err
+	}
+	return nil
+}
+
+// The handler deletes the destination first when it may be overwritten
+func (s dav_storage) Rename(ctx context.Context, oldName, newName string) error {
+	from, err := dav_path(oldName)
+	if err != nil {
+		return err
+	}
+	to, err := dav_write_path(newName)
+	if err != nil {
+		return err
+	}
+	if err := User_sandbox(s.username).Rename(from, to); err != nil {
+		return err
+	}
+	move_sandbox_metadata(User_sandbox(s.username), from, to)
+	move_shares(s.username, from, to)
+	move_share_links(s.username, from, to)
+	publishFileChange(s.username, from, "deleted")
+	publishFileChange(s.username, to, "created")
+	return nil
+}
+
+func (s dav_storage) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name, err := dav_path(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := User_sandbox(s.username).Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return Own_file_info(User_sandbox(s.username), name, info), nil
+}
+
+// Space taken by the user's files, walked at most once a minute
+func (s dav_storage) used() int64 {
+	davUsageMutex.Lock()
+	defer davUsageMutex.Unlock()
+	usage, known := davUsage[s.username]
+	if !known || time.Since(usage.checked_at) > davUsageLifetime {
+		usage = dav_usage{pathSize(User_folder(s.username)), time.Now()}
+		davUsage[s.username] = usage
+	}
+	return usage.used
+}
+
+type dav_file struct {
+	*os.File
+	storage dav_storage
+	path    string
+	writing bool
+}
+
+func (f *dav_file) Close() error {
+	err := f.File.Close()
+	if f.writing {
+		dedupe_path(f.storage.username, f.path)
+		publishFileChange(f.storage.username, f.path, "written")
+	}
+	return err
+}
+
+// The listings and properties show the time and permissions of the user's own copy
+func (f *dav_file) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return Own_file_info(User_sandbox(f.storage.username), f.path, info), nil
+}
+
+func (f *dav_file) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	for i, info := range infos {
+		infos[i] = Own_file_info(User_sandbox(f.storage.username), path.Join(f.path, info.Name()), info)
+	}
+	return infos, err
+}
+
+// The free space (RFC 4331) is given on the folders, so the file managers can show it
+func (f *dav_file) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := map[xml.Name]webdav.Property{}
+	info, err := f.Stat()
+	if err != nil || !info.IsDir() {
+		return props, nil
+	}
+	if free, _, err := common.GetDiskSpace(User_sandbox(f.storage.username).Path); err == nil {
+		props[davQuotaAvailable] = webdav.Property{XMLName: davQuotaAvailable, InnerXML: []byte(strconv.FormatUint(free, 10))}
+	}
+	props[davQuotaUsed] = webdav.Property{XMLName: davQuotaUsed, InnerXML: []byte(strconv.FormatInt(f.storage.used(), 10))}
+	return props, nil
+}
+
+// No property can be set
+func (f *dav_file) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	refused := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, prop := range patch.Props {
+			refused.Props = append(refused.Props, webdav.Property{XMLName: prop.XMLName})
+		}
+	}
+	return []webdav.Propstat{refused}, nil
+}
@@ -0,0 +1,30 @@
+package User_Handler
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+// WebDAV reaches the storage without resolve_path, it mustn't create what "Shared with me" would hide
+func TestWebDAVSharedFolderNameIsReserved(t *testing.T) {
+	testUsers(t, "alice")
+	ctx := context.Background()
+	storage := User_webdav_storage("alice")
+	if err := storage.Mkdir(ctx, "/notes", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Mkdir(ctx, "/Shared with me", 0700); !errors.Is(err, ErrSharedFolder) {
+		t.Errorf("Mkdir: %v", err)
+	}
+	if _, err := storage.OpenFile(ctx, "/Shared with me/file.txt", os.O_CREATE|os.O_WRONLY, 0600); !errors.Is(err, ErrSharedFolder) {
+		t.Errorf("OpenFile: %v", err)
+	}
+	if err := storage.Rename(ctx, "/notes", "/Shared with me"); !errors.Is(err, ErrSharedFolder) {
+		t.Errorf("Rename: %v", err)
+	}
+	if _, err := os.Stat(User_folder("alice") + "/" + Shared_folder); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a real %s was created: %v", Shared_folder, err)
+	}
+}
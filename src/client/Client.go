@@ -0,0 +1,500 @@
+// Package client talks to the Home Server Controller TCP API.
+//
+// A Client keeps one connection open, runs the commands sent over it concurrently and hands the
+// event frames pushed by the server to the Events channel. When the connection drops it is
+// re-established on the next command, logging in and subscribing again as needed.
+// File content is sent as binary frames, compressed with the codec agreed on at the handshake.
+package client
+
+import (
+	common "ServerController/src/Common"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StatusSuccess      = "success"
+	StatusFail         = "fail"
+	StatusUnauthorized = "Unauthorized"
+	StatusEvent        = "event"
+	StatusShuttingDown = "server_shutting_down"
+	StatusKicked       = "connection_kicked"
+)
+
+// Size of the Events channel, events arriving while it's full are dropped
+const eventsBuffer = 256
+
+var (
+	ErrClosed         = errors.New("client is closed")
+	ErrConnectionLost = errors.New("connection lost before the response arrived")
+)
+
+// Frame sent to the server
+type Request struct {
+	Command string   `json:"cmd"`
+	Args    []string `json:"args"`
+	Binary  bool     `json:"binary,omitempty"`
+	ID      uint64   `json:"id,omitempty"`
+	Async   bool     `json:"async,omitempty"`
+}
+
+// Frame received for every command
+type Response struct {
+	Status       string `json:"status"`
+	Process_Type string `json:"process_type"`
+	Message      string `json:"message"`
+	ID           uint64 `json:"id,omitempty"`
+}
+
+// Commands the server runs in order, as they change the session
+var sessionCommands = map[string]bool{
+	"login_attempt": true,
+	"hello":         true,
+	"subscribe":     true,
+	"unsubscribe":   true,
+	"exit":          true,
+}
+
+// Frame pushed by the server after a subscribe
+type Event struct {
+	Topic    string    `json:"topic"`
+	Sequence uint64    `json:"seq"`
+	Missed   uint64    `json:"missed"`
+	Time     time.Time `json:"time"`
+	Message  string    `json:"message"`
+}
+
+// The command was delivered, but the server refused it
+type CommandError struct {
+	Command  string
+	Response Response
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", e.Command, e.Response.Message, e.Response.Status)
+}
+
+func (r Response) OK() bool {
+	return strings.EqualFold(r.Status, StatusSuccess)
+}
+
+// Decodes the JSON carried in the message of the response
+func (r Response) Decode(value any) error {
+	return json.Unmarshal([]byte(r.Message), value)
+}
+
+type Options struct {
+	// Used to open every connection, defaults to a net.Dialer with a 10 second timeout
+	Dial func(ctx context.Context, address string) (net.Conn, error)
+	// How many times a dropped connection is re-established before giving up on a command
+	Reconnect_Attempts int
+	// Compression offered to the server, by order of preference. Defaults to zstd then gzip,
+	// use []string{"none"} to send everything uncompressed
+	Codecs []string
+	// Shown to the admins in list_connections, defaults to go-client
+	Client_Name string
+}
+
+type Client struct {
+	address string
+	options Options
+	Events  chan Event
+
+	// Only one goroutine opens the connection again after it dropped
+	connectMutex sync.Mutex
+
+	stateMutex sync.Mutex
+	conn       *connection
+	closed     bool
+	username   string
+	password   string
+	topics     map[string]bool
+}
+
+// One physical connection, with the goroutine reading from it
+type connection struct {
+	conn  net.Conn
+	codec byte
+	// Keeps the frames of concurrent commands (and the streams) from interleaving
+	writeMutex sync.Mutex
+
+	pendingMutex sync.Mutex
+	nextID       uint64
+	pending      map[uint64]*pendingCommand
+
+	done chan struct{}
+	err  error
+}
+
+// A command waiting for its response. With an output, a successful response is preceded by a stream written to it
+type pendingCommand struct {
+	responses chan Response
+	streamed  bool
+
+	outputMutex sync.Mutex
+	output      io.Writer // Set to nil when the caller gives up
+	outputErr   error
+}
+
+// Receives the stream, the frames keep being read (and skipped) once the output failed or the caller left
+func (command *pendingCommand) Write(p []byte) (int, error) {
+	command.outputMutex.Lock()
+	defer command.outputMutex.Unlock()
+	if command.output != nil && command.outputErr == nil {
+		_, command.outputErr = command.output.Write(p)
+	}
+	return len(p), nil
+}
+
+// Connects to the TCP API at host:port
+func Dial(ctx context.Context, address string, options Options) (*Client, error) {
+	if options.Dial == nil {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		options.Dial = func(ctx context.Context, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", address)
+		}
+	}
+	if options.Reconnect_Attempts <= 0 {
+		options.Reconnect_Attempts = 3
+	}
+	if len(options.Codecs) == 0 {
+		options.Codecs = []string{"zstd", "gzip"}
+	}
+	if options.Client_Name == "" {
+		options.Client_Name = "go-client"
+	}
+	c := &Client{
+		address: address,
+		options: options,
+		Events:  make(chan Event, eventsBuffer),
+		topics:  map[string]bool{},
+	}
+	if _, err := c.connection(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Asks the web server where the TCP API is listening and connects to it.
+// webURL is the address of the web panel, e.g. http://192.168.1.10:8080
+func DialWebServer(ctx context.Context, webURL string, options Options) (*Client, error) {
+	address, err := Discover(ctx, webURL)
+	if err != nil {
+		return nil, err
+	}
+	return Dial(ctx, address, options)
+}
+
+// Returns the host:port of the TCP API, as advertised by /WebServerController/details
+func Discover(ctx context.Context, webURL string) (string, error) {
+	parsed, err := url.Parse(webURL)
+	if err != nil {
+		return "", err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(webURL, "/")+"/WebServerController/details", nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	var details struct {
+		Status string `json:"status"`
+		Port   int    `json:"port"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&details); err != nil {
+		return "", fmt.Errorf("invalid server details: %w", err)
+	}
+	if details.Port == 0 {
+		return "", errors.New("the server didn't advertise a TCP port, is it running?")
+	}
+	return net.JoinHostPort(parsed.Hostname(), strconv.Itoa(details.Port)), nil
+}
+
+func (c *Client) Address() string {
+	return c.address
+}
+
+// Sends a command and waits for its response. A response with a failed status is not an error here,
+// the typed methods turn those into a *CommandError.
+// Commands sent from several goroutines run concurrently on the server, except the ones changing the session
+func (c *Client) Do(ctx context.Context, command string, args ...string) (Response, error) {
+	return c.DoStream(ctx, command, nil, args...)
+}
+
+// Like Do, with the content of body sent after the command as a stream of binary frames
+func (c *Client) DoStream(ctx context.Context, command string, body io.Reader, args ...string) (Response, error) {
+	return c.do(ctx, command, body, nil, args)
+}
+
+// Like Do, for the commands answering with a stream of binary frames: it is written to output before the response returns
+func (c *Client) DoDownload(ctx context.Context, command string, output io.Writer, args ...string) (Response, error) {
+	return c.do(ctx, command, nil, output, args)
+}
+
+func (c *Client) do(ctx context.Context, command string, body io.Reader, output io.Writer, args []string) (Response, error) {
+	if args == nil {
+		args = []string{}
+	}
+	var lastErr error
+	for attempt := 0; attempt <= c.options.Reconnect_Attempts; attempt++ {
+		conn, err := c.connection(ctx)
+		if err != nil {
+			var commandErr *CommandError
+			if errors.Is(err, ErrClosed) || errors.As(err, &commandErr) || ctx.Err() != nil {
+				return Response{}, err
+			}
+			lastErr = err
+			continue
+		}
+		request := Request{Command: command, Args: args, Binary: body != nil, Async: body == nil && !sessionCommands[command]}
+		response, sent, err := c.roundTrip(ctx, conn, request, body, output)
+		if err == nil {
+			return response, nil
+		}
+		lastErr = err
+		// A cancelled command doesn't break the connection, its response is just ignored when it comes
+		if ctx.Err() != nil {
+			return Response{}, err
+		}
+		c.dropConnection(conn)
+		// Once the server has the command it may have run it, so it's not sent twice
+		if sent {
+			return Response{}, err
+		}
+	}
+	return Response{}, lastErr
+}
+
+func (c *Client) roundTrip(ctx context.Context, conn *connection, request Request, body io.Reader, output io.Writer) (Response, bool, error) {
+	select {
+	case <-conn.done:
+		return Response{}, false, fmt.Errorf("%w: %v", ErrConnectionLost, conn.err)
+	default:
+	}
+	command := &pendingCommand{responses: make(chan Response, 1), streamed: output != nil, output: output}
+	conn.pendingMutex.Lock()
+	conn.nextID++
+	request.ID = conn.nextID
+	conn.pending[request.ID] = command
+	conn.pendingMutex.Unlock()
+	defer func() {
+		conn.pendingMutex.Lock()
+		delete(conn.pending, request.ID)
+		conn.pendingMutex.Unlock()
+		command.outputMutex.Lock()
+		command.output = nil
+		command.outputMutex.Unlock()
+	}()
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return Response{}, false, err
+	}
+	if sent, err := conn.send(ctx, data, body); err != nil {
+		return Response{}, sent, err
+	}
+	select {
+	case response := <-command.responses:
+		command.outputMutex.Lock()
+		err := command.outputErr
+		command.outputMutex.Unlock()
+		return response, true, err
+	case <-conn.done:
+		return Response{}, true, fmt.Errorf("%w: %v", ErrConnectionLost, conn.err)
+	case <-ctx.Done():
+		return Response{}, true, ctx.Err()
+	}
+}
+
+// Writes the command, and its content as binary frames when there is one. Tells whether the command went out
+func (conn *connection) send(ctx context.Context, data []byte, body io.Reader) (bool, error) {
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.conn.SetWriteDeadline(deadline)
+	} else {
+		conn.conn.SetWriteDeadline(time.Time{})
+	}
+	if _, err := conn.conn.Write(append(data, '\n')); err != nil {
+		return false, err
+	}
+	if body != nil {
+		err := common.WriteStream(func(frame []byte) error {
+			_, err := conn.conn.Write(frame)
+			return err
+		}, conn.codec, body)
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// Returns the live connection, opening a new one (and logging in again) if needed
+func (c *Client) connection(ctx context.Context) (*connection, error) {
+	c.connectMutex.Lock()
+	defer c.connectMutex.Unlock()
+	c.stateMutex.Lock()
+	if c.closed {
+		c.stateMutex.Unlock()
+		return nil, ErrClosed
+	}
+	if c.conn != nil {
+		conn := c.conn
+		c.stateMutex.Unlock()
+		return conn, nil
+	}
+	username, password := c.username, c.password
+	var topics []string
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	c.stateMutex.Unlock()
+
+	raw, err := c.options.Dial(ctx, c.address)
+	if err != nil {
+		return nil, err
+	}
+	conn := &connection{
+		conn:    raw,
+		pending: map[uint64]*pendingCommand{},
+		done:    make(chan struct{}),
+	}
+	go c.readLoop(conn)
+
+	// Servers that predate the handshake answer it with a failure, the binary frames then stay uncompressed
+	response, _, err := c.roundTrip(ctx, conn, Request{Command: "hello", Args: append([]string{"client=" + c.options.Client_Name}, c.options.Codecs...)}, nil, nil)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	var hello struct {
+		Codec string `json:"codec"`
+	}
+	if response.OK() && response.Decode(&hello) == nil {
+		conn.codec, _ = common.CodecByName(hello.Codec)
+	}
+
+	// Restore the session before anyone else uses the connection
+	if username != "" {
+		response, _, err := c.roundTrip(ctx, conn, Request{Command: "login_attempt", Args: []string{username, password}}, nil, nil)
+		if err == nil && !response.OK() {
+			err = &CommandError{"login_attempt", response}
+		}
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+	}
+	if len(topics) > 0 {
+		if _, _, err := c.roundTrip(ctx, conn, Request{Command: "subscribe", Args: topics}, nil, nil); err != nil {
+			raw.Close()
+			return nil, err
+		}
+	}
+
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	if c.closed {
+		raw.Close()
+		return nil, ErrClosed
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+func (c *Client) dropConnection(conn *connection) {
+	c.stateMutex.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.stateMutex.Unlock()
+	conn.conn.Close()
+}
+
+func (c *Client) readLoop(conn *connection) {
+	reader := common.NewFrameReader(conn.conn)
+	defer close(conn.done)
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			conn.err = err
+			c.dropConnection(conn)
+			return
+		}
+		// Streams nobody waits for anymore
+		if frame.Binary {
+			continue
+		}
+		line := frame.Data
+		var response Response
+		if err := json.Unmarshal(line, &response); err != nil {
+			continue
+		}
+		switch response.Status {
+		case StatusEvent:
+			var event Event
+			json.Unmarshal(line, &event)
+			select {
+			case c.Events <- event:
+			default:
+			}
+		case StatusShuttingDown, StatusKicked:
+			// The socket is about to close, the next command will reconnect
+			conn.err = errors.New(response.Message)
+			c.dropConnection(conn)
+			return
+		default:
+			// Nobody waits for the response of a cancelled command, it's dropped
+			conn.pendingMutex.Lock()
+			command, exists := conn.pending[response.ID]
+			conn.pendingMutex.Unlock()
+			if !exists {
+				continue
+			}
+			if command.streamed && response.OK() {
+				if _, err := io.Copy(command, reader.Stream()); err != nil {
+					conn.err = err
+					c.dropConnection(conn)
+					return
+				}
+			}
+			select {
+			case command.responses <- response:
+			default:
+			}
+		}
+	}
+}
+
+// Closes the connection, the client can't be used afterwards
+func (c *Client) Close() error {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.conn != nil {
+		c.conn.writeMutex.Lock()
+		c.conn.conn.Write([]byte(`{"cmd":"exit","args":[]}` + "\n"))
+		c.conn.writeMutex.Unlock()
+		err := c.conn.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
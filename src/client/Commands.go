@@ -0,0 +1,911 @@
+package client
+
+import (
+	common "ServerController/src/Common"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Scripts struct {
+	Public  []string `json:"scripts"`
+	Private []string `json:"private"`
+}
+
+type ScriptResult struct {
+	Output string `json:"results"`
+	Error  string `json:"errors"`
+}
+
+type FolderEntry struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path,omitempty"` // Set in the recursive listings
+	Type     string    `json:"type"`           // Type bits of the mode, "d---------" for a folder
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Mode     string    `json:"mode"`
+}
+
+func (e FolderEntry) IsFolder() bool {
+	return strings.HasPrefix(e.Type, "d")
+}
+
+// How to list a folder, the zero value lists it whole sorted by name
+type ListOptions struct {
+	Recursive  bool
+	Sort       string // name, size, modified or type
+	Descending bool
+	Page       int // Starting at 1, 0 for everything
+	Per_Page   int
+}
+
+type TrashEntry struct {
+	ID         string    `json:"id"`
+	Path       string    `json:"path"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	Deleted_At time.Time `json:"deleted_at"`
+}
+
+type FileVersion struct {
+	ID          string    `json:"id"`
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	Modified    time.Time `json:"modified"`
+	Replaced_At time.Time `json:"replaced_at"`
+}
+
+type StorageUsage struct {
+	Files    int64 `json:"files"`
+	Trash    int64 `json:"trash"`
+	Versions int64 `json:"versions"`
+	Total    int64 `json:"total"`
+}
+
+// Access given to another user, Recipient finds it under "Shared with me/<Owner>/<Name>"
+type Share struct {
+	ID         string    `json:"id"`
+	Owner      string    `json:"owner"`
+	Recipient  string    `json:"recipient"`
+	Path       string    `json:"path"`
+	Name       string    `json:"name"`
+	Access     string    `json:"access"`
+	Created_At time.Time `json:"created_at"`
+}
+
+type ShareLink struct {
+	ID            string    `json:"id"`
+	Owner         string    `json:"owner"`
+	Path          string    `json:"path"`
+	URL           string    `json:"url"`
+	Has_Password  bool      `json:"has_password"`
+	Expires_At    time.Time `json:"expires_at"` // Zero when it never expires
+	Max_Downloads int       `json:"max_downloads"`
+	Downloads     int       `json:"downloads"`
+	Created_At    time.Time `json:"created_at"`
+}
+
+// Limits of a share link, the zero values mean no password, no expiry and no download limit
+type ShareLinkOptions struct {
+	Password     string
+	ExpiresIn    time.Duration
+	MaxDownloads int
+}
+
+// Space of the whole server: Logical as the users see it, Real as the disk holds it
+type StorageReport struct {
+	Deduplication string `json:"deduplication"` // "active", "off", or why it can't work
+	Logical       int64  `json:"logical"`
+	Real          int64  `json:"real"`
+	Saved         int64  `json:"saved"`
+	Blobs         int    `json:"blobs"`
+	References    uint64 `json:"references"`
+	Unreferenced  int    `json:"unreferenced"`
+}
+
+type BlobGCResult struct {
+	Removed int   `json:"removed"`
+	Freed   int64 `json:"freed"`
+}
+
+type BlobDamage struct {
+	Hash       string `json:"hash"`
+	Actual     string `json:"actual"`
+	Size       int64  `json:"size"`
+	References uint64 `json:"references"`
+}
+
+type FsckResult struct {
+	Checked   int          `json:"checked"`
+	Corrupted []BlobDamage `json:"corrupted"`
+}
+
+type BlobScanResult struct {
+	Scanned      int   `json:"scanned"`
+	Deduplicated int   `json:"deduplicated"`
+	Saved        int64 `json:"saved"`
+}
+
+// Change of the user's storage, Size and Modified are the ones of the file when it happened
+type SyncChange struct {
+	Cursor   uint64    `json:"cursor"`
+	Path     string    `json:"path"`
+	Change   string    `json:"change"` // created, written or deleted
+	Type     string    `json:"type"`   // file or folder, empty for a deletion
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+type SyncChanges struct {
+	Cursor  uint64       `json:"cursor"`
+	Reset   bool         `json:"reset"` // The server lost track of the cursor, everything has to be listed again
+	More    bool         `json:"more"`
+	Changes []SyncChange `json:"changes"`
+}
+
+// Where a committed upload went, a conflict copy when the file changed since the base
+type UploadResult struct {
+	Path     string `json:"path"`
+	Conflict bool   `json:"conflict"`
+}
+
+type SearchResult struct {
+	Path     string    `json:"path"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"` // file or folder
+	Mime     string    `json:"mime"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+type SearchResults struct {
+	Total   int            `json:"total"` // How many matched, the results stop at the limit
+	Results []SearchResult `json:"results"`
+}
+
+type Thumbnail struct {
+	Size   int    `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Mime   string `json:"mime"`
+	Length int64  `json:"length"`
+	Hash   string `json:"hash"` // SHA-256 of the image it was made from
+}
+
+type FolderPage struct {
+	Items    []FolderEntry `json:"items"`
+	Page     int           `json:"page"`
+	Per_Page int           `json:"per_page"`
+	Total    int           `json:"total"`
+}
+
+type Connection struct {
+	ID              uint64    `json:"id"`
+	Transport       string    `json:"transport"`
+	Remote_Address  string    `json:"remote_address"`
+	Username        string    `json:"username"`
+	Client          string    `json:"client"`
+	Connected_At    time.Time `json:"connected_at"`
+	Bytes_In        uint64    `json:"bytes_in"`
+	Bytes_Out       uint64    `json:"bytes_out"`
+	Last_Command    string    `json:"last_command"`
+	Last_Command_At time.Time `json:"last_command_at"`
+}
+
+type FileDetails struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Offset   int64     `json:"offset"`
+	Length   int64     `json:"length"`
+}
+
+// Entry of the command catalogue returned by describe
+type CommandInfo struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Arguments   []CommandArgument `json:"arguments"`
+	Permission  string            `json:"permission"`
+	Since       int               `json:"since"`
+	Binary      bool              `json:"binary"`
+	Async       bool              `json:"async"`
+}
+
+type CommandArgument struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+	Variadic    bool   `json:"variadic"`
+	Description string `json:"description"`
+}
+
+type AccountRequest struct {
+	Username   string `json:"username"`
+	Request_At string `json:"request_at"`
+}
+
+// Sends the command and turns a failed response into a *CommandError
+func (c *Client) call(ctx context.Context, command string, args ...string) (Response, error) {
+	return c.callStream(ctx, command, nil, args...)
+}
+
+func (c *Client) callStream(ctx context.Context, command string, body io.Reader, args ...string) (Response, error) {
+	response, err := c.DoStream(ctx, command, body, args...)
+	if err != nil {
+		return response, err
+	}
+	if !response.OK() {
+		return response, &CommandError{command, response}
+	}
+	return response, nil
+}
+
+// Logs in. The credentials are kept, so the session is restored after a reconnect
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	if _, err := c.call(ctx, "login_attempt", username, password); err != nil {
+		return err
+	}
+	c.stateMutex.Lock()
+	c.username, c.password = username, password
+	c.stateMutex.Unlock()
+	return nil
+}
+
+func (c *Client) RequestAccount(ctx context.Context, username, password string) error {
+	_, err := c.call(ctx, "request_account", username, password)
+	return err
+}
+
+func (c *Client) ListAccountRequests(ctx context.Context) (map[string]AccountRequest, error) {
+	response, err := c.call(ctx, "list_account_requests")
+	if err != nil {
+		return nil, err
+	}
+	requests := map[string]AccountRequest{}
+	err = response.Decode(&requests)
+	return requests, err
+}
+
+func (c *Client) AcceptAccountRequest(ctx context.Context, username string, admin bool, grade uint8) error {
+	_, err := c.call(ctx, "accept_account_request", username, strconv.FormatBool(admin), strconv.Itoa(int(grade)))
+	return err
+}
+
+// Runs a shell command on the server, admins only. The result is the raw JSON with the output and error
+func (c *Client) ConsoleCommand(ctx context.Context, args ...string) (string, error) {
+	response, err := c.call(ctx, "console_cmd", args...)
+	return response.Message, err
+}
+
+func (c *Client) ListUserFolder(ctx context.Context, path string) ([]FolderEntry, error) {
+	response, err := c.call(ctx, "list_user_folder", path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []FolderEntry
+	err = response.Decode(&entries)
+	return entries, err
+}
+
+func (c *Client) ListUserFolderWith(ctx context.Context, path string, options ListOptions) (FolderPage, error) {
+	args := []string{path}
+	if options.Recursive {
+		args = append(args, "recursive=true")
+	}
+	if options.Sort != "" {
+		args = append(args, "sort="+options.Sort)
+	}
+	if options.Descending {
+		args = append(args, "order=desc")
+	}
+	paged := options.Page > 0 || options.Per_Page > 0
+	if options.Page > 0 {
+		args = append(args, "page="+strconv.Itoa(options.Page))
+	}
+	if options.Per_Page > 0 {
+		args = append(args, "per_page="+strconv.Itoa(options.Per_Page))
+	}
+	var page FolderPage
+	response, err := c.call(ctx, "list_user_folder", args...)
+	if err != nil {
+		return page, err
+	}
+	if !paged {
+		err = response.Decode(&page.Items)
+		page.Page, page.Per_Page, page.Total = 1, len(page.Items), len(page.Items)
+		return page, err
+	}
+	err = response.Decode(&page)
+	return page, err
+}
+
+func (c *Client) StatUserPath(ctx context.Context, path string) (FolderEntry, error) {
+	var entry FolderEntry
+	response, err := c.call(ctx, "stat_user_path", path)
+	if err != nil {
+		return entry, err
+	}
+	err = response.Decode(&entry)
+	return entry, err
+}
+
+func (c *Client) DeleteUserPath(ctx context.Context, path string) error {
+	_, err := c.call(ctx, "delete_user_path", path)
+	return err
+}
+
+func (c *Client) MoveUserPath(ctx context.Context, from, to string) error {
+	_, err := c.call(ctx, "move_user_path", from, to)
+	return err
+}
+
+func (c *Client) CopyUserPath(ctx context.Context, from, to string) error {
+	_, err := c.call(ctx, "copy_user_path", from, to)
+	return err
+}
+
+func (c *Client) ListTrash(ctx context.Context) ([]TrashEntry, error) {
+	response, err := c.call(ctx, "list_trash")
+	if err != nil {
+		return nil, err
+	}
+	var entries []TrashEntry
+	err = response.Decode(&entries)
+	return entries, err
+}
+
+// Puts a trash entry back, at to when it isn't empty. The answer tells where it went
+func (c *Client) RestoreFromTrash(ctx context.Context, id, to string) (string, error) {
+	args := []string{id}
+	if to != "" {
+		args = append(args, to)
+	}
+	response, err := c.call(ctx, "restore_from_trash", args...)
+	return response.Message, err
+}
+
+func (c *Client) EmptyTrash(ctx context.Context) error {
+	_, err := c.call(ctx, "empty_trash")
+	return err
+}
+
+func (c *Client) ListFileVersions(ctx context.Context, path string) ([]FileVersion, error) {
+	response, err := c.call(ctx, "list_file_versions", path)
+	if err != nil {
+		return nil, err
+	}
+	var versions []FileVersion
+	err = response.Decode(&versions)
+	return versions, err
+}
+
+func (c *Client) RestoreFileVersion(ctx context.Context, path, id string) error {
+	_, err := c.call(ctx, "restore_file_version", path, id)
+	return err
+}
+
+func (c *Client) PurgeHistory(ctx context.Context, olderThanDays int) (string, error) {
+	response, err := c.call(ctx, "purge_history", strconv.Itoa(olderThanDays))
+	return response.Message, err
+}
+
+func (c *Client) StorageUsage(ctx context.Context) (StorageUsage, error) {
+	var usage StorageUsage
+	response, err := c.call(ctx, "storage_usage")
+	if err != nil {
+		return usage, err
+	}
+	err = response.Decode(&usage)
+	return usage, err
+}
+
+// Access is "read" or "read-write", sharing the same path again changes it
+func (c *Client) SharePath(ctx context.Context, path, username, access string) (Share, error) {
+	var share Share
+	response, err := c.call(ctx, "share_path", path, username, access)
+	if err != nil {
+		return share, err
+	}
+	err = response.Decode(&share)
+	return share, err
+}
+
+func (c *Client) ListShares(ctx context.Context) ([]Share, error) {
+	response, err := c.call(ctx, "list_shares")
+	if err != nil {
+		return nil, err
+	}
+	var shares []Share
+	err = response.Decode(&shares)
+	return shares, err
+}
+
+func (c *Client) ListSharedWithMe(ctx context.Context) ([]Share, error) {
+	response, err := c.call(ctx, "list_shared_with_me")
+	if err != nil {
+		return nil, err
+	}
+	var shares []Share
+	err = response.Decode(&shares)
+	return shares, err
+}
+
+func (c *Client) RevokeShare(ctx context.Context, id string) error {
+	_, err := c.call(ctx, "revoke_share", id)
+	return err
+}
+
+func (c *Client) CreateShareLink(ctx context.Context, path string, options ShareLinkOptions) (ShareLink, error) {
+	args := []string{path}
+	if options.Password != "" {
+		args = append(args, "password="+options.Password)
+	}
+	if options.ExpiresIn > 0 {
+		args = append(args, "expires_in="+options.ExpiresIn.String())
+	}
+	if options.MaxDownloads > 0 {
+		args = append(args, "max_downloads="+strconv.Itoa(options.MaxDownloads))
+	}
+	var link ShareLink
+	response, err := c.call(ctx, "create_share_link", args...)
+	if err != nil {
+		return link, err
+	}
+	err = response.Decode(&link)
+	return link, err
+}
+
+// With all, the active links of every user (admins only)
+func (c *Client) ListShareLinks(ctx context.Context, all bool) ([]ShareLink, error) {
+	var args []string
+	if all {
+		args = append(args, "all=true")
+	}
+	response, err := c.call(ctx, "list_share_links", args...)
+	if err != nil {
+		return nil, err
+	}
+	var links []ShareLink
+	err = response.Decode(&links)
+	return links, err
+}
+
+func (c *Client) RevokeShareLink(ctx context.Context, id string) error {
+	_, err := c.call(ctx, "revoke_share_link", id)
+	return err
+}
+
+// The blob store commands are for the admins and take no argument
+func (c *Client) blobCommand(ctx context.Context, name string, result any) error {
+	response, err := c.call(ctx, name)
+	if err != nil {
+		return err
+	}
+	return response.Decode(result)
+}
+
+func (c *Client) StorageReport(ctx context.Context) (StorageReport, error) {
+	var report StorageReport
+	err := c.blobCommand(ctx, "storage_report", &report)
+	return report, err
+}
+
+// Deletes the blobs no file uses anymore
+func (c *Client) CollectBlobs(ctx context.Context) (BlobGCResult, error) {
+	var result BlobGCResult
+	err := c.blobCommand(ctx, "blob_gc", &result)
+	return result, err
+}
+
+// Hashes every blob again, this reads the whole store
+func (c *Client) CheckBlobs(ctx context.Context) (FsckResult, error) {
+	var result FsckResult
+	err := c.blobCommand(ctx, "blob_fsck", &result)
+	return result, err
+}
+
+// Deduplicates the files written before deduplication was turned on
+func (c *Client) ScanBlobs(ctx context.Context) (BlobScanResult, error) {
+	var result BlobScanResult
+	err := c.blobCommand(ctx, "blob_scan", &result)
+	return result, err
+}
+
+// The cursor to start from, asked for before listing everything
+func (c *Client) SyncCursor(ctx context.Context) (uint64, error) {
+	var changes SyncChanges
+	response, err := c.call(ctx, "sync_changes")
+	if err != nil {
+		return 0, err
+	}
+	err = response.Decode(&changes)
+	return changes.Cursor, err
+}
+
+// The changes after since, ask again from the returned cursor while More is set
+func (c *Client) SyncChanges(ctx context.Context, since uint64) (SyncChanges, error) {
+	var changes SyncChanges
+	response, err := c.call(ctx, "sync_changes", strconv.FormatUint(since, 10))
+	if err != nil {
+		return changes, err
+	}
+	err = response.Decode(&changes)
+	return changes, err
+}
+
+// Searches the files with words and filters like name:*.pdf, type:image, after:2026-01-01 or size>10MB.
+// A limit of 0 lets the server pick one
+func (c *Client) SearchFiles(ctx context.Context, query string, limit int) (SearchResults, error) {
+	var results SearchResults
+	args := []string{query}
+	if limit > 0 {
+		args = append(args, "limit="+strconv.Itoa(limit))
+	}
+	response, err := c.call(ctx, "search_files", args...)
+	if err != nil {
+		return results, err
+	}
+	err = response.Decode(&results)
+	return results, err
+}
+
+func (c *Client) CreateUserFolder(ctx context.Context, path string) error {
+	_, err := c.call(ctx, "create_user_folder", path)
+	return err
+}
+
+func (c *Client) UploadUserFile(ctx context.Context, path string, content []byte) error {
+	return c.UploadUserFileFrom(ctx, path, bytes.NewReader(content))
+}
+
+// Uploads the file as a stream of binary frames, so it can be of any size.
+// The stream can't be replayed, so the upload isn't retried when the connection drops
+func (c *Client) UploadUserFileFrom(ctx context.Context, path string, content io.Reader) error {
+	_, err := c.callStream(ctx, "upload_user_file", content, path)
+	return err
+}
+
+// Writes the file to output
+func (c *Client) DownloadUserFile(ctx context.Context, path string, output io.Writer) (FileDetails, error) {
+	return c.DownloadUserFileRange(ctx, path, 0, -1, output)
+}
+
+// Writes length bytes of the file, starting at offset, to output. A negative length reads up to the end
+func (c *Client) DownloadUserFileRange(ctx context.Context, path string, offset, length int64, output io.Writer) (FileDetails, error) {
+	var details FileDetails
+	args := []string{path, strconv.FormatInt(offset, 10)}
+	if length >= 0 {
+		args = append(args, strconv.FormatInt(length, 10))
+	}
+	counter := &countingWriter{writer: output}
+	response, err := c.DoDownload(ctx, "download_user_file", counter, args...)
+	if err != nil {
+		return details, err
+	}
+	if !response.OK() {
+		return details, &CommandError{"download_user_file", response}
+	}
+	if err := response.Decode(&details); err != nil {
+		return details, err
+	}
+	// The server can't report a read error in the middle of the stream, it shows as missing bytes
+	if counter.count != details.Length {
+		return details, fmt.Errorf("download_user_file: received %d bytes out of %d", counter.count, details.Length)
+	}
+	return details, nil
+}
+
+// Writes a thumbnail of the image to output. A size of 0 lets the server pick, otherwise 128, 256 or 512
+func (c *Client) GetThumbnail(ctx context.Context, path string, size int, output io.Writer) (Thumbnail, error) {
+	var thumbnail Thumbnail
+	args := []string{path}
+	if size > 0 {
+		args = append(args, strconv.Itoa(size))
+	}
+	counter := &countingWriter{writer: output}
+	response, err := c.DoDownload(ctx, "get_thumbnail", counter, args...)
+	if err != nil {
+		return thumbnail, err
+	}
+	if !response.OK() {
+		return thumbnail, &CommandError{"get_thumbnail", response}
+	}
+	if err := response.Decode(&thumbnail); err != nil {
+		return thumbnail, err
+	}
+	if counter.count != thumbnail.Length {
+		return thumbnail, fmt.Errorf("get_thumbnail: received %d bytes out of %d", counter.count, thumbnail.Length)
+	}
+	return thumbnail, nil
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+// Size of the chunks sent by UploadUserFileResumable
+const UploadChunkSize = 4 << 20
+
+type UploadProgress struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// Uploads the file in chunks through an upload session. After a dropped connection or a failed chunk the upload
+// carries on from where the server stopped, and calling it again later with the same file resumes it too
+func (c *Client) UploadUserFileResumable(ctx context.Context, path string, file io.ReadSeeker) error {
+	_, err := c.uploadResumable(ctx, path, file)
+	return err
+}
+
+// UploadUserFileResumable for the sync: base is the hash of the content the file was changed from, or "none" for a
+// new file. When the file changed on the server since, the upload goes to a conflict copy next to it
+func (c *Client) UploadSyncedFile(ctx context.Context, path string, file io.ReadSeeker, base string) (UploadResult, error) {
+	return c.uploadResumable(ctx, path, file, "base="+base)
+}
+
+func (c *Client) uploadResumable(ctx context.Context, path string, file io.ReadSeeker, options ...string) (UploadResult, error) {
+	var result UploadResult
+	hasher := sha256.New()
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return result, err
+	}
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return result, err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	var lastErr error
+	for attempt := 0; attempt <= c.options.Reconnect_Attempts; attempt++ {
+		// Starting again with the same arguments gives back the unfinished upload
+		progress, err := c.UploadBegin(ctx, path, size, hash, options...)
+		for err == nil && progress.Offset < progress.Size {
+			if _, err = file.Seek(progress.Offset, io.SeekStart); err != nil {
+				return result, err
+			}
+			progress, err = c.UploadChunk(ctx, progress.ID, progress.Offset, io.LimitReader(file, UploadChunkSize))
+		}
+		if err == nil {
+			// A hash mismatch means the file changed while it was sent, that's not retried
+			response, err := c.call(ctx, "upload_commit", progress.ID)
+			if err != nil {
+				return result, err
+			}
+			err = response.Decode(&result)
+			return result, err
+		}
+		if ctx.Err() != nil || errors.Is(err, ErrClosed) {
+			return result, err
+		}
+		lastErr = err
+	}
+	return result, lastErr
+}
+
+// Signature of the blocks of a file, blockSize 0 lets the server pick one from the size
+func (c *Client) FileSignature(ctx context.Context, path string, blockSize int) (common.FileSignature, error) {
+	var signature common.FileSignature
+	args := []string{path}
+	if blockSize > 0 {
+		args = append(args, strconv.Itoa(blockSize))
+	}
+	var blocks bytes.Buffer
+	response, err := c.DoDownload(ctx, "file_signature", &blocks, args...)
+	if err != nil {
+		return signature, err
+	}
+	if !response.OK() {
+		return signature, &CommandError{"file_signature", response}
+	}
+	if err := response.Decode(&signature); err != nil {
+		return signature, err
+	}
+	if !common.ValidDeltaBlockSize(signature.Block_Size) {
+		return signature, common.ErrInvalidBlockSize
+	}
+	if signature.Blocks, err = common.ReadSignature(&blocks); err != nil {
+		return signature, err
+	}
+	// A read error in the middle of the stream shows as missing blocks
+	if expected := (signature.Size + int64(signature.Block_Size) - 1) / int64(signature.Block_Size); int64(len(signature.Blocks)) != expected {
+		return signature, fmt.Errorf("file_signature: received %d blocks out of %d", len(signature.Blocks), expected)
+	}
+	return signature, nil
+}
+
+// Sends only what changed since the version of the file on the server, the server rebuilds the rest from it.
+// A file the server doesn't have yet, or that changed while the delta was made, is uploaded whole
+func (c *Client) UploadFileDelta(ctx context.Context, path string, file io.ReadSeeker) (common.DeltaStats, error) {
+	var stats common.DeltaStats
+	hasher := sha256.New()
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return stats, err
+	}
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return stats, err
+	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	uploadWhole := func() (common.DeltaStats, error) {
+		return common.DeltaStats{Literal: size}, c.UploadUserFileResumable(ctx, path, file)
+	}
+
+	signature, err := c.FileSignature(ctx, path, 0)
+	var commandErr *CommandError
+	if errors.As(err, &commandErr) {
+		return uploadWhole()
+	}
+	if err != nil {
+		return stats, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return stats, err
+	}
+	reader, writer := io.Pipe()
+	made := make(chan common.DeltaStats, 1)
+	go func() {
+		stats, err := common.WriteDelta(writer, file, signature)
+		writer.CloseWithError(err)
+		made <- stats
+	}()
+	_, err = c.callStream(ctx, "upload_file_delta", reader, path, strconv.Itoa(signature.Block_Size), strconv.FormatInt(size, 10), hash)
+	// Ends the delta when the command failed before reading all of it
+	reader.Close()
+	stats = <-made
+	if errors.As(err, &commandErr) && commandErr.Response.Message == "the content doesn't match the hash" {
+		return uploadWhole()
+	}
+	return stats, err
+}
+
+// Options are name=value pairs, like base=SHA256
+func (c *Client) UploadBegin(ctx context.Context, path string, size int64, sha256 string, options ...string) (UploadProgress, error) {
+	var progress UploadProgress
+	args := append([]string{path, strconv.FormatInt(size, 10), sha256}, options...)
+	response, err := c.call(ctx, "upload_begin", args...)
+	if err != nil {
+		return progress, err
+	}
+	err = response.Decode(&progress)
+	return progress, err
+}
+
+func (c *Client) UploadChunk(ctx context.Context, id string, offset int64, content io.Reader) (UploadProgress, error) {
+	var progress UploadProgress
+	response, err := c.callStream(ctx, "upload_chunk", content, id, strconv.FormatInt(offset, 10))
+	if err != nil {
+		return progress, err
+	}
+	err = response.Decode(&progress)
+	return progress, err
+}
+
+func (c *Client) UploadAbort(ctx context.Context, id string) error {
+	_, err := c.call(ctx, "upload_abort", id)
+	return err
+}
+
+func (c *Client) ListScripts(ctx context.Context) (Scripts, error) {
+	var scripts Scripts
+	response, err := c.call(ctx, "list_scripts")
+	if err != nil {
+		return scripts, err
+	}
+	err = response.Decode(&scripts)
+	return scripts, err
+}
+
+func (c *Client) UploadScript(ctx context.Context, public bool, name string, content []byte) error {
+	_, err := c.callStream(ctx, "upload_script", bytes.NewReader(content), strconv.FormatBool(public), name)
+	return err
+}
+
+// Runs a script and waits for it to finish. A script that fails still returns its output,
+// along with a *CommandError
+func (c *Client) RunScript(ctx context.Context, name string, private bool) (ScriptResult, error) {
+	args := []string{name}
+	if private {
+		args = append(args, "private")
+	}
+	var result ScriptResult
+	response, err := c.Do(ctx, "run_script", args...)
+	if err != nil {
+		return result, err
+	}
+	if decodeErr := response.Decode(&result); decodeErr != nil && response.OK() {
+		return result, decodeErr
+	}
+	if !response.OK() {
+		return result, &CommandError{"run_script", response}
+	}
+	return result, nil
+}
+
+// Starts receiving the events of the given topics on the Events channel, all of them when called without arguments
+func (c *Client) Subscribe(ctx context.Context, topics ...string) error {
+	if len(topics) == 0 {
+		topics = []string{"*"}
+	}
+	if _, err := c.call(ctx, "subscribe", topics...); err != nil {
+		return err
+	}
+	c.stateMutex.Lock()
+	for _, topic := range topics {
+		c.topics[topic] = true
+	}
+	c.stateMutex.Unlock()
+	return nil
+}
+
+// Stops the given topics, or all of them when called without arguments
+func (c *Client) Unsubscribe(ctx context.Context, topics ...string) error {
+	if _, err := c.call(ctx, "unsubscribe", topics...); err != nil {
+		return err
+	}
+	c.stateMutex.Lock()
+	if len(topics) == 0 {
+		c.topics = map[string]bool{}
+	}
+	for _, topic := range topics {
+		delete(c.topics, topic)
+	}
+	c.stateMutex.Unlock()
+	return nil
+}
+
+// Live connections of the TCP API, admins only
+func (c *Client) ListConnections(ctx context.Context) ([]Connection, error) {
+	response, err := c.call(ctx, "list_connections")
+	if err != nil {
+		return nil, err
+	}
+	var connections []Connection
+	err = response.Decode(&connections)
+	return connections, err
+}
+
+func (c *Client) KickConnection(ctx context.Context, id uint64) error {
+	_, err := c.call(ctx, "kick_connection", strconv.FormatUint(id, 10))
+	return err
+}
+
+// Commands the session may call, with their arguments. Without names, the whole catalogue
+func (c *Client) Describe(ctx context.Context, names ...string) ([]CommandInfo, error) {
+	var commands []CommandInfo
+	for _, name := range names {
+		response, err := c.call(ctx, "describe", name)
+		if err != nil {
+			return nil, err
+		}
+		var described []CommandInfo
+		if err := response.Decode(&described); err != nil {
+			return nil, err
+		}
+		commands = append(commands, described...)
+	}
+	if len(names) > 0 {
+		return commands, nil
+	}
+	response, err := c.call(ctx, "describe")
+	if err != nil {
+		return nil, err
+	}
+	err = response.Decode(&commands)
+	return commands, err
+}
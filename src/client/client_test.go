@@ -0,0 +1,448 @@
+package client
+
+import (
+	"ServerController/src/API_Handler"
+	common "ServerController/src/Common"
+	"ServerController/src/User_Handler"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Address of the TCP API started by TestMain
+var testAddress string
+
+const (
+	testUser     = "alice"
+	testPassword = "alice-password"
+	testAdmin    = "root"
+	testAdminPwd = "root-password"
+)
+
+// Runs the server in-process, in a temporary folder since it keeps its files relative to the working directory
+func TestMain(m *testing.M) {
+	folder, err := os.MkdirTemp("", "client-test-")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(folder); err != nil {
+		panic(err)
+	}
+	common.LoadServerConfig()
+	common.Config.API_Port = 0
+	User_Handler.Load_users()
+	User_Handler.Load_requests()
+	User_Handler.Load_uploads()
+	User_Handler.Load_shares()
+	User_Handler.Load_share_links()
+	User_Handler.Load_blob_metadata()
+	User_Handler.Add_user(testUser, testPassword, false, 5, "test")
+	User_Handler.Add_user(testAdmin, testAdminPwd, true, 0, "test")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	API_Handler.StartAPIHoster(ctx, make(chan bool, 1))
+	for start := time.Now(); API_Handler.GetServerPort() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			panic("the TCP API didn't start")
+		}
+	}
+	testAddress = net.JoinHostPort("127.0.0.1", fmt.Sprint(API_Handler.GetServerPort()))
+
+	code := m.Run()
+	cancel()
+	API_Handler.WaitForAPIHoster()
+	os.RemoveAll(folder)
+	os.Exit(code)
+}
+
+// A connection whose responses the test can hold back
+type gatedConn struct {
+	net.Conn
+	gate *sync.RWMutex
+}
+
+func (c gatedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.gate.RLock()
+	c.gate.RUnlock()
+	return n, err
+}
+
+// Dial options keeping track of the connections opened
+type testDialer struct {
+	dials atomic.Int32
+	gate  sync.RWMutex
+
+	mutex sync.Mutex
+	last  net.Conn
+}
+
+func (d *testDialer) options() Options {
+	return Options{Dial: func(ctx context.Context, address string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		d.dials.Add(1)
+		d.mutex.Lock()
+		d.last = conn
+		d.mutex.Unlock()
+		return gatedConn{conn, &d.gate}, nil
+	}}
+}
+
+// Closes the current connection under the client's feet
+func (d *testDialer) drop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.last.Close()
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func dialLoggedIn(t *testing.T, ctx context.Context, username, password string, options Options) *Client {
+	c, err := Dial(ctx, testAddress, options)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Login(ctx, username, password); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	return c
+}
+
+func TestDialAndLogin(t *testing.T) {
+	ctx := testContext(t)
+	c, err := Dial(ctx, testAddress, Options{})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	if c.Address() != testAddress {
+		t.Errorf("Address() = %s, want %s", c.Address(), testAddress)
+	}
+
+	// Logged out, the file commands are refused
+	_, err = c.ListUserFolder(ctx, "")
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) {
+		t.Fatalf("ListUserFolder logged out: %v, want a *CommandError", err)
+	}
+
+	// So are the commands describe hides, whatever their handler checks
+	if response, err := c.Do(ctx, "run_script", "hello.sh"); err != nil || response.Status != StatusUnauthorized {
+		t.Errorf("run_script logged out = %+v, %v, want %s", response, err, StatusUnauthorized)
+	}
+
+	err = c.Login(ctx, testUser, "wrong password")
+	if !errors.As(err, &commandErr) || commandErr.Command != "login_attempt" {
+		t.Fatalf("Login with a wrong password: %v, want a *CommandError", err)
+	}
+	if err := c.Login(ctx, testUser, testPassword); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	if _, err := c.ListUserFolder(ctx, ""); err != nil {
+		t.Errorf("ListUserFolder logged in: %v", err)
+	}
+}
+
+func TestDialUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	if _, err := Dial(testContext(t), address, Options{}); err == nil {
+		t.Error("Dial to a closed port succeeded")
+	}
+}
+
+func TestClosedClient(t *testing.T) {
+	ctx := testContext(t)
+	c, err := Dial(ctx, testAddress, Options{})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c.Close()
+	if _, err := c.Do(ctx, "ping"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Do on a closed client: %v, want ErrClosed", err)
+	}
+}
+
+func TestFileCommands(t *testing.T) {
+	ctx := testContext(t)
+	c := dialLoggedIn(t, ctx, testUser, testPassword, Options{})
+
+	if err := c.CreateUserFolder(ctx, "docs"); err != nil {
+		t.Fatalf("CreateUserFolder: %v", err)
+	}
+	content := bytes.Repeat([]byte("0123456789abcdef"), 100000)
+	if err := c.UploadUserFile(ctx, "docs/data.bin", content); err != nil {
+		t.Fatalf("UploadUserFile: %v", err)
+	}
+
+	entries, err := c.ListUserFolder(ctx, "docs")
+	if err != nil {
+		t.Fatalf("ListUserFolder: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Name != "data.bin" || entries[0].Size != int64(len(content)) || entries[0].IsFolder() {
+		t.Fatalf("ListUserFolder(docs) = %+v", entries)
+	}
+	stat, err := c.StatUserPath(ctx, "docs")
+	if err != nil || !stat.IsFolder() {
+		t.Errorf("StatUserPath(docs) = %+v, %v", stat, err)
+	}
+
+	var downloaded bytes.Buffer
+	details, err := c.DownloadUserFile(ctx, "docs/data.bin", &downloaded)
+	if err != nil {
+		t.Fatalf("DownloadUserFile: %v", err)
+	}
+	if details.Size != int64(len(content)) || !bytes.Equal(downloaded.Bytes(), content) {
+		t.Errorf("downloaded %d bytes (details %+v), want the %d uploaded", downloaded.Len(), details, len(content))
+	}
+	var part bytes.Buffer
+	if _, err := c.DownloadUserFileRange(ctx, "docs/data.bin", 16, 10, &part); err != nil || part.String() != "0123456789" {
+		t.Errorf("DownloadUserFileRange = %q, %v", part.String(), err)
+	}
+
+	if err := c.MoveUserPath(ctx, "docs/data.bin", "docs/moved.bin"); err != nil {
+		t.Fatalf("MoveUserPath: %v", err)
+	}
+	if err := c.CopyUserPath(ctx, "docs/moved.bin", "docs/copy.bin"); err != nil {
+		t.Fatalf("CopyUserPath: %v", err)
+	}
+	if err := c.DeleteUserPath(ctx, "docs/moved.bin"); err != nil {
+		t.Fatalf("DeleteUserPath: %v", err)
+	}
+	trash, err := c.ListTrash(ctx)
+	if err != nil || len(trash) != 1 {
+		t.Fatalf("ListTrash = %+v, %v", trash, err)
+	}
+	if _, err := c.RestoreFromTrash(ctx, trash[0].ID, ""); err != nil {
+		t.Errorf("RestoreFromTrash: %v", err)
+	}
+
+	_, err = c.StatUserPath(ctx, "docs/missing.bin")
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) || commandErr.Command != "stat_user_path" {
+		t.Errorf("StatUserPath of a missing file: %v, want a *CommandError", err)
+	}
+	if _, err := c.StatUserPath(ctx, "../escape"); !errors.As(err, &commandErr) {
+		t.Errorf("StatUserPath outside the storage: %v, want a *CommandError", err)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	ctx := testContext(t)
+	c, err := Dial(ctx, testAddress, Options{})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	// The catalogue only shows what the session may run
+	if _, err := c.Describe(ctx, "download_user_file"); err == nil {
+		t.Error("Describe(download_user_file) logged out succeeded")
+	}
+	if err := c.Login(ctx, testUser, testPassword); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	commands, err := c.Describe(ctx, "download_user_file")
+	if err != nil {
+		t.Fatalf("Describe: %v", err)
+	}
+	if len(commands) != 1 || commands[0].Name != "download_user_file" {
+		t.Errorf("Describe(download_user_file) = %+v", commands)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ctx := testContext(t)
+	c := dialLoggedIn(t, ctx, testUser, testPassword, Options{})
+	if err := c.Subscribe(ctx, "file.changed"); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if err := c.UploadUserFile(ctx, "event.txt", []byte("hello")); err != nil {
+		t.Fatalf("UploadUserFile: %v", err)
+	}
+	select {
+	case event := <-c.Events:
+		if event.Topic != "file.changed" || !strings.Contains(event.Message, "event.txt") {
+			t.Errorf("received %+v", event)
+		}
+	case <-ctx.Done():
+		t.Fatal("no file.changed event")
+	}
+}
+
+func TestSubscribeToEverything(t *testing.T) {
+	ctx := testContext(t)
+	c := dialLoggedIn(t, ctx, testUser, testPassword, Options{})
+	if err := c.Subscribe(ctx); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if err := c.UploadUserFile(ctx, "everything.txt", []byte("hello")); err != nil {
+		t.Fatalf("UploadUserFile: %v", err)
+	}
+	select {
+	case event := <-c.Events:
+		if event.Topic != "file.changed" {
+			t.Errorf("received %+v", event)
+		}
+	case <-ctx.Done():
+		t.Fatal("no event")
+	}
+}
+
+func TestReconnectLogsInAgain(t *testing.T) {
+	ctx := testContext(t)
+	dialer := &testDialer{}
+	c := dialLoggedIn(t, ctx, testUser, testPassword, dialer.options())
+	if err := c.Subscribe(ctx, "file.changed"); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	dialer.drop()
+	// The first command after the drop may still find the dead connection, it's sent again on a new one
+	if _, err := c.ListUserFolder(ctx, ""); err != nil {
+		t.Fatalf("ListUserFolder after the connection dropped: %v", err)
+	}
+	if dials := dialer.dials.Load(); dials != 2 {
+		t.Errorf("%d connections opened, want 2", dials)
+	}
+
+	// The subscription came back with the session
+	if err := c.UploadUserFile(ctx, "reconnected.txt", []byte("again")); err != nil {
+		t.Fatalf("UploadUserFile: %v", err)
+	}
+	for {
+		select {
+		case event := <-c.Events:
+			if strings.Contains(event.Message, "reconnected.txt") {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("no file.changed event after the reconnect")
+		}
+	}
+}
+
+func TestReconnectAfterKick(t *testing.T) {
+	ctx := testContext(t)
+	c := dialLoggedIn(t, ctx, testUser, testPassword, Options{Client_Name: "kicked-client"})
+	admin := dialLoggedIn(t, ctx, testAdmin, testAdminPwd, Options{})
+
+	connections, err := admin.ListConnections(ctx)
+	if err != nil {
+		t.Fatalf("ListConnections: %v", err)
+	}
+	kicked := false
+	for _, connection := range connections {
+		if connection.Client == "kicked-client" {
+			if err := admin.KickConnection(ctx, connection.ID); err != nil {
+				t.Fatalf("KickConnection: %v", err)
+			}
+			kicked = true
+		}
+	}
+	if !kicked {
+		t.Fatalf("the client isn't in %+v", connections)
+	}
+	// A command that reached the server before the notice isn't sent twice, it fails with the connection
+	if _, err := c.ListUserFolder(ctx, ""); err != nil && !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("ListUserFolder while being kicked: %v", err)
+	}
+	if _, err := c.ListUserFolder(ctx, ""); err != nil {
+		t.Errorf("ListUserFolder after being kicked: %v", err)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	ctx := testContext(t)
+	dialer := &testDialer{}
+	c := dialLoggedIn(t, ctx, testUser, testPassword, dialer.options())
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.ListUserFolder(cancelled, ""); !errors.Is(err, context.Canceled) {
+		t.Errorf("ListUserFolder with a cancelled context: %v, want context.Canceled", err)
+	}
+
+	// The response is held back until the deadline passed
+	dialer.gate.Lock()
+	short, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShort()
+	start := time.Now()
+	_, err := c.ListUserFolder(short, "")
+	dialer.gate.Unlock()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ListUserFolder past its deadline: %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("ListUserFolder returned %s after its deadline", elapsed)
+	}
+
+	// The late response is dropped and the connection stays usable
+	if _, err := c.ListUserFolder(ctx, ""); err != nil {
+		t.Errorf("ListUserFolder after a cancelled command: %v", err)
+	}
+	if dials := dialer.dials.Load(); dials != 1 {
+		t.Errorf("%d connections opened, want 1", dials)
+	}
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	ctx := testContext(t)
+	c := dialLoggedIn(t, ctx, testUser, testPassword, Options{})
+	if err := c.CreateUserFolder(ctx, "concurrent"); err != nil {
+		t.Fatalf("CreateUserFolder: %v", err)
+	}
+
+	const workers = 16
+	var group sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := range workers {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			path := fmt.Sprintf("concurrent/file-%d.txt", i)
+			content := bytes.Repeat([]byte{byte('a' + i)}, 50000+i)
+			if err := c.UploadUserFile(ctx, path, content); err != nil {
+				errs <- fmt.Errorf("upload %s: %w", path, err)
+				return
+			}
+			var downloaded bytes.Buffer
+			if _, err := c.DownloadUserFile(ctx, path, &downloaded); err != nil {
+				errs <- fmt.Errorf("download %s: %w", path, err)
+				return
+			}
+			if !bytes.Equal(downloaded.Bytes(), content) {
+				errs <- fmt.Errorf("%s came back different", path)
+			}
+		}()
+	}
+	group.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	entries, err := c.ListUserFolder(ctx, "concurrent")
+	if err != nil || len(entries) != workers {
+		t.Errorf("ListUserFolder(concurrent) = %d entries, %v, want %d", len(entries), err, workers)
+	}
+}
@@ -0,0 +1,614 @@
+// Package foldersync keeps a local folder and a folder of the server the same, both ways. It is the sync of hsctl
+// and of the controller binary's sync mode
+package foldersync
+
+import (
+	"ServerController/src/client"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What the last sync saw is kept in the local folder, so a sync started again carries on where it stopped
+const (
+	syncStateFile       = ".hsctl-sync.json"
+	syncTemporaryPrefix = ".hsctl-sync-"
+	// Virtual folder of the server, the shares are left out of the sync
+	syncSharedFolder = "Shared with me"
+	// Saving a file is often several writes, the sync waits for them to stop
+	syncSettleDelay = 500 * time.Millisecond
+)
+
+// A file or folder as it was when both sides last agreed
+type syncedFile struct {
+	Folder          bool      `json:"folder,omitempty"`
+	Hash            string    `json:"hash,omitempty"`
+	Size            int64     `json:"size"`
+	Modified        time.Time `json:"modified"` // Of the local file
+	Remote_Size     int64     `json:"remote_size"`
+	Remote_Modified time.Time `json:"remote_modified"`
+}
+
+type syncState struct {
+	Remote  string                 `json:"remote"`
+	Cursor  uint64                 `json:"cursor"`
+	Started bool                   `json:"started"` // The first full sync went through
+	Files   map[string]*syncedFile `json:"files"`   // By path relative to the synced folders
+}
+
+type Syncer struct {
+	Name   string // Of the program, the errors start with it
+	client *client.Client
+	local  string
+	remote string
+	state  syncState
+}
+
+// Syncs local with the remote folder of the logged in user, all of the storage for an empty remote
+func New(c *client.Client, local, remote string) (*Syncer, error) {
+	s := &Syncer{Name: "sync", client: c, local: local, remote: strings.Trim(path.Clean("/"+remote), "/")}
+	if err := os.MkdirAll(s.local, 0700); err != nil {
+		return nil, err
+	}
+	if err := s.loadState(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Syncs until ctx is done. The server's changes wake the sync up, and the local ones are watched for. Where the
+// folder can't be watched it is checked every interval instead
+func (s *Syncer) Run(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("the interval must be positive")
+	}
+	if err := s.client.Subscribe(ctx, "file.changed"); err != nil {
+		return err
+	}
+	var polling <-chan time.Time
+	startPolling := func(err error) {
+		s.warn("%s can't be watched, it is checked every %s: %v", s.local, interval, err)
+		ticker := time.NewTicker(interval)
+		context.AfterFunc(ctx, ticker.Stop)
+		polling = ticker.C
+	}
+	watcher, err := watchFolder(ctx, s.local)
+	if err != nil {
+		watcher = &folderWatcher{}
+		startPolling(err)
+	}
+	fmt.Printf("Syncing %s with %s, stop with Ctrl+C\n", s.local, s.RemoteName())
+	for {
+		if err := s.Cycle(ctx); err != nil && ctx.Err() == nil {
+			s.warn("%v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-polling:
+		case _, open := <-watcher.changes:
+			if !open {
+				if ctx.Err() != nil {
+					return nil
+				}
+				watcher.changes = nil
+				startPolling(watcher.err)
+				continue
+			}
+			watcher.settle(ctx)
+		case <-s.client.Events:
+			// One pass is enough for the changes that came together
+			for len(s.client.Events) > 0 {
+				<-s.client.Events
+			}
+		}
+	}
+}
+
+func (s *Syncer) warn(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, s.Name+": sync: "+format+"\n", args...)
+}
+
+func (s *Syncer) RemoteName() string {
+	if s.remote == "" {
+		return "your storage"
+	}
+	return s.remote
+}
+
+func (s *Syncer) loadState() error {
+	s.state = syncState{Remote: s.remote, Files: map[string]*syncedFile{}}
+	data, err := os.ReadFile(filepath.Join(s.local, syncStateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved syncState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("unreadable %s, delete it to sync from scratch: %w", syncStateFile, err)
+	}
+	if saved.Remote != s.remote {
+		return fmt.Errorf("%s is synced with %q, delete %s to sync it with another folder", s.local, saved.Remote, syncStateFile)
+	}
+	if saved.Files == nil {
+		saved.Files = map[string]*syncedFile{}
+	}
+	s.state = saved
+	return nil
+}
+
+func (s *Syncer) saveState() error {
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := filepath.Join(s.local, syncTemporaryPrefix+"state")
+	if err := os.WriteFile(temporary, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, filepath.Join(s.local, syncStateFile))
+}
+
+// Syncs once. Local changes go first, so a file changed on both sides reaches the server as a conflict copy
+func (s *Syncer) Cycle(ctx context.Context) error {
+	if !s.state.Started {
+		if err := s.fullSync(ctx); err != nil {
+			return err
+		}
+	}
+	err := s.push(ctx)
+	if err == nil {
+		err = s.pull(ctx)
+	}
+	if saveErr := s.saveState(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+func (s *Syncer) remotePath(relative string) string {
+	if s.remote == "" {
+		return relative
+	}
+	return s.remote + "/" + relative
+}
+
+func (s *Syncer) localPath(relative string) string {
+	return filepath.Join(s.local, filepath.FromSlash(relative))
+}
+
+// Path in the synced folders of a path of the server, false when it is outside of them
+func (s *Syncer) relative(remote_path string) (string, bool) {
+	if s.remote == "" {
+		shared := remote_path == syncSharedFolder || strings.HasPrefix(remote_path, syncSharedFolder+"/")
+		return remote_path, !shared && remote_path != ""
+	}
+	relative, found := strings.CutPrefix(remote_path, s.remote+"/")
+	return relative, found
+}
+
+// A failure answered by the server, rather than a lost connection
+func isCommandError(err error) bool {
+	var commandErr *client.CommandError
+	return errors.As(err, &commandErr)
+}
+
+// ===========================
+// Local side
+// ===========================
+
+type localEntry struct {
+	folder   bool
+	size     int64
+	modified time.Time
+}
+
+func (s *Syncer) scanLocal() (map[string]localEntry, error) {
+	entries := map[string]localEntry{}
+	err := filepath.WalkDir(s.local, func(file_path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(s.local, file_path)
+		if err != nil || relative == "." {
+			return err
+		}
+		relative = filepath.ToSlash(relative)
+		if strings.HasPrefix(entry.Name(), syncTemporaryPrefix) || relative == syncStateFile ||
+			(s.remote == "" && relative == syncSharedFolder) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		// Symlinks and devices are left out
+		if info.IsDir() || info.Mode().IsRegular() {
+			entries[relative] = localEntry{info.IsDir(), info.Size(), info.ModTime()}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func hashLocalFile(file_path string) (string, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Whether the local file is still the one of the last sync
+func (known *syncedFile) unchanged(entry localEntry) bool {
+	return known != nil && known.Folder == entry.folder &&
+		(entry.folder || (known.Size == entry.size && known.Modified.Equal(entry.modified)))
+}
+
+func sortedPaths[T any](entries map[string]T) []string {
+	paths := make([]string, 0, len(entries))
+	for entry_path := range entries {
+		paths = append(paths, entry_path)
+	}
+	// Folders come before what is in them
+	sort.Strings(paths)
+	return paths
+}
+
+// ===========================
+// Transfers
+// ===========================
+
+// Downloads next to the local file, so it is replaced in one step
+func (s *Syncer) download(ctx context.Context, relative string) error {
+	target := s.localPath(relative)
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	temporary, err := os.CreateTemp(filepath.Dir(target), syncTemporaryPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	hasher := sha256.New()
+	details, err := s.client.DownloadUserFile(ctx, s.remotePath(relative), io.MultiWriter(temporary, hasher))
+	if closeErr := temporary.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(temporary.Name(), target); err != nil {
+		return err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	s.state.Files[relative] = &syncedFile{
+		Hash:            hex.EncodeToString(hasher.Sum(nil)),
+		Size:            info.Size(),
+		Modified:        info.ModTime(),
+		Remote_Size:     details.Size,
+		Remote_Modified: details.Modified,
+	}
+	fmt.Println("↓ " + relative)
+	return nil
+}
+
+// Uploads a local file made from the content with the hash base, "none" for a new file. When the server's file
+// changed since, the local one lands next to it as a conflict copy and the server's one is downloaded
+func (s *Syncer) upload(ctx context.Context, relative, hash, base string) error {
+	file, err := os.Open(s.localPath(relative))
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	result, err := s.client.UploadSyncedFile(ctx, s.remotePath(relative), file, base)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if result.Conflict {
+		fmt.Printf("! %s changed on both sides, yours is kept as %s\n", relative, result.Path)
+		return s.download(ctx, relative)
+	}
+	remote, err := s.client.StatUserPath(ctx, result.Path)
+	if err != nil {
+		return err
+	}
+	s.state.Files[relative] = &syncedFile{
+		Hash:            hash,
+		Size:            info.Size(),
+		Modified:        info.ModTime(),
+		Remote_Size:     remote.Size,
+		Remote_Modified: remote.Modified,
+	}
+	fmt.Println("↑ " + relative)
+	return nil
+}
+
+// ===========================
+// Full sync
+// ===========================
+
+// Brings both sides together without knowing what happened before: everything missing on a side is copied, and a
+// file that differs on both sides is kept twice
+func (s *Syncer) fullSync(ctx context.Context) error {
+	// Taken first, so the changes made during the listing come with the next pull
+	cursor, err := s.client.SyncCursor(ctx)
+	if err != nil {
+		return err
+	}
+	remoteEntries := map[string]client.FolderEntry{}
+	root := s.remote
+	if root == "" {
+		root = "."
+	} else if _, err := s.client.StatUserPath(ctx, root); isCommandError(err) {
+		if err := s.client.CreateUserFolder(ctx, root); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	listing, err := s.client.ListUserFolderWith(ctx, root, client.ListOptions{Recursive: true})
+	if err != nil {
+		return err
+	}
+	for _, entry := range listing.Items {
+		if relative, inside := s.relative(entry.Path); inside {
+			remoteEntries[relative] = entry
+		}
+	}
+	localEntries, err := s.scanLocal()
+	if err != nil {
+		return err
+	}
+
+	s.state.Files = map[string]*syncedFile{}
+	for _, relative := range sortedPaths(remoteEntries) {
+		remote := remoteEntries[relative]
+		local, exists := localEntries[relative]
+		switch {
+		case remote.IsFolder():
+			if err := os.MkdirAll(s.localPath(relative), 0700); err != nil {
+				return err
+			}
+			s.state.Files[relative] = &syncedFile{Folder: true}
+		case exists && !local.folder:
+			if err := s.mergeFile(ctx, relative); err != nil {
+				return err
+			}
+		case !exists:
+			if err := s.download(ctx, relative); err != nil {
+				return err
+			}
+		default:
+			s.warn("%s is a folder here and a file on the server, left out", relative)
+		}
+	}
+	for _, relative := range sortedPaths(localEntries) {
+		if _, exists := remoteEntries[relative]; exists {
+			continue
+		}
+		if err := s.pushEntry(ctx, relative, localEntries[relative]); err != nil {
+			return err
+		}
+	}
+	s.state.Cursor = cursor
+	s.state.Started = true
+	return s.saveState()
+}
+
+// A file on both sides before the first sync: the same content is kept once, otherwise both are kept
+func (s *Syncer) mergeFile(ctx context.Context, relative string) error {
+	hash, err := hashLocalFile(s.localPath(relative))
+	if err != nil {
+		return err
+	}
+	return s.upload(ctx, relative, hash, "none")
+}
+
+// ===========================
+// Push and pull
+// ===========================
+
+func (s *Syncer) pushEntry(ctx context.Context, relative string, entry localEntry) error {
+	known := s.state.Files[relative]
+	if known.unchanged(entry) {
+		return nil
+	}
+	if entry.folder {
+		err := s.client.CreateUserFolder(ctx, s.remotePath(relative))
+		if err != nil && !isCommandError(err) {
+			return err
+		}
+		s.state.Files[relative] = &syncedFile{Folder: true}
+		return nil
+	}
+	hash, err := hashLocalFile(s.localPath(relative))
+	if err != nil {
+		return err
+	}
+	base := "none"
+	if known != nil && !known.Folder {
+		if known.Hash == hash {
+			// Touched but not changed
+			known.Size, known.Modified = entry.size, entry.modified
+			return nil
+		}
+		base = known.Hash
+	}
+	return s.upload(ctx, relative, hash, base)
+}
+
+// Sends the local changes. A file deleted here is only deleted on the server if nobody changed it there since
+func (s *Syncer) push(ctx context.Context) error {
+	localEntries, err := s.scanLocal()
+	if err != nil {
+		return err
+	}
+	for _, relative := range sortedPaths(localEntries) {
+		if err := s.pushEntry(ctx, relative, localEntries[relative]); err != nil {
+			if !isCommandError(err) {
+				return err
+			}
+			s.warn("%s: %v", relative, err)
+		}
+	}
+
+	deleted := []string{}
+	for relative := range s.state.Files {
+		if _, exists := localEntries[relative]; !exists {
+			deleted = append(deleted, relative)
+		}
+	}
+	// What is in a folder goes before the folder
+	sort.Sort(sort.Reverse(sort.StringSlice(deleted)))
+	for _, relative := range deleted {
+		known := s.state.Files[relative]
+		delete(s.state.Files, relative)
+		remote, err := s.client.StatUserPath(ctx, s.remotePath(relative))
+		if isCommandError(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if known.Folder {
+			content, err := s.client.ListUserFolder(ctx, s.remotePath(relative))
+			if err != nil || len(content) > 0 {
+				// Something new in it, it comes back with the pull
+				continue
+			}
+		} else if remote.Size != known.Remote_Size || !remote.Modified.Equal(known.Remote_Modified) {
+			continue
+		}
+		if err := s.client.DeleteUserPath(ctx, s.remotePath(relative)); err != nil && !isCommandError(err) {
+			return err
+		}
+		fmt.Println("✗ " + relative + " (server)")
+	}
+	return nil
+}
+
+// Applies the server's changes since the cursor
+func (s *Syncer) pull(ctx context.Context) error {
+	for {
+		changes, err := s.client.SyncChanges(ctx, s.state.Cursor)
+		if err != nil {
+			return err
+		}
+		if changes.Reset {
+			fmt.Println("The server lost track of this sync, comparing everything again")
+			s.state.Started = false
+			return s.fullSync(ctx)
+		}
+		for _, change := range changes.Changes {
+			if err := s.apply(ctx, change); err != nil {
+				if !isCommandError(err) {
+					return err
+				}
+				// Gone again since, a later change tells what became of it
+				s.warn("%s: %v", change.Path, err)
+			}
+			s.state.Cursor = change.Cursor
+		}
+		s.state.Cursor = max(s.state.Cursor, changes.Cursor)
+		if !changes.More {
+			return nil
+		}
+	}
+}
+
+func (s *Syncer) apply(ctx context.Context, change client.SyncChange) error {
+	relative, inside := s.relative(change.Path)
+	if !inside {
+		return nil
+	}
+	if change.Change == "deleted" {
+		return s.removeLocal(relative)
+	}
+	if change.Type == "folder" {
+		s.state.Files[relative] = &syncedFile{Folder: true}
+		return os.MkdirAll(s.localPath(relative), 0700)
+	}
+	known := s.state.Files[relative]
+	if known != nil && known.Remote_Size == change.Size && known.Remote_Modified.Equal(change.Modified) {
+		// Already here, most likely sent from here
+		return nil
+	}
+	info, err := os.Stat(s.localPath(relative))
+	if err == nil && !known.unchanged(localEntry{info.IsDir(), info.Size(), info.ModTime()}) {
+		// Changed here as well, the next push sends it as a conflict copy
+		return nil
+	}
+	return s.download(ctx, relative)
+}
+
+// Deletes what the server deleted, unless it was changed here since
+func (s *Syncer) removeLocal(relative string) error {
+	root := s.localPath(relative)
+	_, err := os.Lstat(root)
+	existed := err == nil
+	var folders []string
+	err = filepath.WalkDir(root, func(file_path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		entry_relative, _ := filepath.Rel(s.local, file_path)
+		entry_relative = filepath.ToSlash(entry_relative)
+		if entry.IsDir() {
+			folders = append(folders, file_path)
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		if s.state.Files[entry_relative].unchanged(localEntry{false, info.Size(), info.ModTime()}) {
+			os.Remove(file_path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Emptied folders go, the ones with changes in them stay
+	for i := len(folders) - 1; i >= 0; i-- {
+		os.Remove(folders[i])
+	}
+	for known := range s.state.Files {
+		if known == relative || strings.HasPrefix(known, relative+"/") {
+			delete(s.state.Files, known)
+		}
+	}
+	if _, err := os.Lstat(root); existed && errors.Is(err, os.ErrNotExist) {
+		fmt.Println("✗ " + relative)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package foldersync
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Wakes the sync up when something changes in the local folder
+type folderWatcher struct {
+	changes chan struct{} // Closed when the watcher stops working, err tells why
+	err     error
+}
+
+// One pending change is enough, the sync looks at the whole folder
+func (w *folderWatcher) notify() {
+	select {
+	case w.changes <- struct{}{}:
+	default:
+	}
+}
+
+// Waits for the changes to stop coming
+func (w *folderWatcher) settle(ctx context.Context) {
+	timer := time.NewTimer(syncSettleDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			return
+		case _, open := <-w.changes:
+			if !open {
+				return
+			}
+			timer.Reset(syncSettleDelay)
+		}
+	}
+}
+
+// The sync's own state and temporary files, watching them would only wake it up again
+func ignoredChange(root, folder, name string) bool {
+	return strings.HasPrefix(name, syncTemporaryPrefix) || (name == syncStateFile && filepath.Clean(folder) == filepath.Clean(root))
+}
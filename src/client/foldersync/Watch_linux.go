@@ -0,0 +1,104 @@
+//go:build linux
+
+package foldersync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_DELETE |
+	unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+// inotify watches folders one by one, so every folder of the tree gets a watch, and the new ones as they come
+func watchFolder(ctx context.Context, root string) (*folderWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	// Non-blocking, so closing it stops the read below
+	events := os.NewFile(uintptr(fd), "inotify")
+	folders := map[int]string{}
+	if err := addWatches(fd, root, folders); err != nil {
+		events.Close()
+		return nil, err
+	}
+	context.AfterFunc(ctx, func() { events.Close() })
+
+	w := &folderWatcher{changes: make(chan struct{}, 1)}
+	go func() {
+		defer close(w.changes)
+		buffer := make([]byte, 64*1024)
+		for {
+			n, err := events.Read(buffer)
+			if err != nil {
+				w.err = err
+				return
+			}
+			for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+				event := (*unix.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+				name_start := offset + unix.SizeofInotifyEvent
+				offset = name_start + int(event.Len)
+				name := strings.TrimRight(string(buffer[name_start:offset]), "\x00")
+				folder, known := folders[int(event.Wd)]
+				switch {
+				case event.Mask&unix.IN_Q_OVERFLOW != 0:
+					// Some changes were missed, the sync looks at everything anyway
+					w.notify()
+				case event.Mask&unix.IN_IGNORED != 0:
+					delete(folders, int(event.Wd))
+				case !known || ignoredChange(root, folder, name):
+				default:
+					if event.Mask&unix.IN_ISDIR != 0 && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+						err := addWatches(fd, filepath.Join(folder, name), folders)
+						if err != nil && !errors.Is(err, fs.ErrNotExist) {
+							w.err = err
+							return
+						}
+					}
+					w.notify()
+				}
+			}
+			if len(folders) == 0 {
+				w.err = errors.New("the folder is gone")
+				return
+			}
+		}
+	}()
+	return w, nil
+}
+
+func addWatches(fd int, folder string, folders map[int]string) error {
+	return filepath.WalkDir(folder, func(file_path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if file_path == folder {
+				return err
+			}
+			// Deleted meanwhile
+			return nil
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), syncTemporaryPrefix) {
+			return filepath.SkipDir
+		}
+		wd, err := unix.InotifyAddWatch(fd, file_path, inotifyMask)
+		if errors.Is(err, unix.ENOSPC) {
+			return fmt.Errorf("too many folders to watch (fs.inotify.max_user_watches): %w", err)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", file_path, err)
+		}
+		folders[wd] = file_path
+		return nil
+	})
+}
@@ -0,0 +1,73 @@
+package foldersync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func expectChange(t *testing.T, w *folderWatcher, want bool, what string) {
+	t.Helper()
+	select {
+	case _, open := <-w.changes:
+		if !open {
+			t.Fatalf("the watcher stopped: %v", w.err)
+		}
+		if !want {
+			t.Errorf("%s woke the sync up", what)
+		}
+	case <-time.After(300 * time.Millisecond):
+		if want {
+			t.Errorf("%s went unnoticed", what)
+		}
+	}
+}
+
+func TestWatchFolder(t *testing.T) {
+	root := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w, err := watchFolder(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(filepath.Join(root, "notes.txt"), []byte("notes"), 0600)
+	expectChange(t, w, true, "a new file")
+	w.settle(ctx)
+	os.WriteFile(filepath.Join(root, syncStateFile), []byte("{}"), 0600)
+	os.WriteFile(filepath.Join(root, syncTemporaryPrefix+"download"), nil, 0600)
+	expectChange(t, w, false, "the sync's own files")
+
+	// A new folder is watched too, with what was put in it before its watch
+	os.MkdirAll(filepath.Join(root, "photos", "2024"), 0700)
+	expectChange(t, w, true, "a new folder")
+	w.settle(ctx)
+	os.WriteFile(filepath.Join(root, "photos", "2024", "beach.jpg"), []byte("beach"), 0600)
+	expectChange(t, w, true, "a file in a new folder")
+	w.settle(ctx)
+	os.Rename(filepath.Join(root, "notes.txt"), filepath.Join(root, "photos", "notes.txt"))
+	expectChange(t, w, true, "a move")
+	w.settle(ctx)
+
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		for range w.changes {
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the watcher didn't stop with its context")
+	}
+}
+
+func TestWatchMissingFolder(t *testing.T) {
+	if _, err := watchFolder(context.Background(), filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("a missing folder was watched")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package foldersync
+
+import (
+	"context"
+	"errors"
+	"runtime"
+)
+
+func watchFolder(ctx context.Context, root string) (*folderWatcher, error) {
+	return nil, errors.New("folders can't be watched on " + runtime.GOOS)
+}
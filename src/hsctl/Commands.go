@@ -0,0 +1,1321 @@
+package main
+
+import (
+	"ServerController/src/client"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	commandTree["login"] = map[string]subcommand{"": {
+		"login --web URL | --address HOST:PORT --user NAME", "Log in and save the connection as a profile",
+		[]string{"--web", "--address", "--user", "--password", "--name"}, runLogin}}
+	commandTree["logout"] = map[string]subcommand{"": {
+		"logout [--name PROFILE]", "Forget a saved profile",
+		[]string{"--name"}, runLogout}}
+	commandTree["profiles"] = map[string]subcommand{"": {
+		"profiles", "List the saved profiles",
+		nil, runProfiles}}
+	commandTree["status"] = map[string]subcommand{"": {
+		"status", "Show the server status",
+		nil, runStatus}}
+	commandTree["shell"] = map[string]subcommand{"": {
+		"shell COMMAND [ARGS...]", "Run a shell command on the server (admins only)",
+		nil, runShell}}
+	commandTree["events"] = map[string]subcommand{"": {
+		"events [TOPIC...]", "Print the server events as they happen (default: all)",
+		nil, runEvents}}
+	commandTree["describe"] = map[string]subcommand{"": {
+		"describe [COMMAND...]", "Show the TCP API commands you may call",
+		nil, runDescribe}}
+	commandTree["sync"] = map[string]subcommand{"": {
+		"sync LOCAL [--remote PATH] [--interval DURATION] [--once]", "Keep a local folder and a folder of your storage the same, both ways",
+		[]string{"--remote", "--interval", "--once"}, runSync}}
+	commandTree["completion"] = map[string]subcommand{"": {
+		"completion bash|zsh|fish", "Print the shell completion script",
+		nil, runCompletion}}
+	commandTree["users"] = map[string]subcommand{
+		"requests": {"users requests", "List the pending account requests",
+			nil, runUsersRequests},
+		"request": {"users request NAME [--password P]", "Ask for an account",
+			[]string{"--password"}, runUsersRequest},
+		"accept": {"users accept NAME [--grade N] [--admin]", "Accept an account request",
+			[]string{"--grade", "--admin"}, runUsersAccept},
+	}
+	commandTree["scripts"] = map[string]subcommand{
+		"list": {"scripts list", "List the scripts",
+			nil, runScriptsList},
+		"run": {"scripts run NAME [--private]", "Run a script and print its output",
+			[]string{"--private"}, runScriptsRun},
+		"put": {"scripts put LOCAL [--name NAME] [--public]", "Upload a script",
+			[]string{"--name", "--public"}, runScriptsPut},
+	}
+	commandTree["connections"] = map[string]subcommand{
+		"list": {"connections list", "List the live TCP connections (admins only)",
+			nil, runConnectionsList},
+		"kick": {"connections kick ID", "Close a TCP connection (admins only)",
+			nil, runConnectionsKick},
+	}
+	commandTree["storage"] = map[string]subcommand{
+		"report": {"storage report", "Show the space the users' files take and what the deduplication saves (admins only)",
+			nil, runStorageReport},
+		"gc": {"storage gc", "Delete the blobs no file uses anymore (admins only)",
+			nil, runStorageGC},
+		"fsck": {"storage fsck", "Hash every blob again and list the damaged ones (admins only)",
+			nil, runStorageFsck},
+		"scan": {"storage scan", "Deduplicate the files written before deduplication was turned on (admins only)",
+			nil, runStorageScan},
+	}
+	commandTree["shares"] = map[string]subcommand{
+		"list": {"shares list [--incoming]", "List what you share, or what is shared with you",
+			[]string{"--incoming"}, runSharesList},
+		"add": {"shares add PATH USERNAME [--write]", "Share a file or folder with another user, read only unless --write",
+			[]string{"--write"}, runSharesAdd},
+		"revoke": {"shares revoke ID", "Stop sharing, or drop something shared with you",
+			nil, runSharesRevoke},
+	}
+	commandTree["links"] = map[string]subcommand{
+		"create": {"links create PATH [--password TEXT] [--expires DURATION] [--max N]", "Make a public link to a file or folder",
+			[]string{"--password", "--expires", "--max"}, runLinksCreate},
+		"list": {"links list [--all]", "List your public links, or every active link (admins only)",
+			[]string{"--all"}, runLinksList},
+		"revoke": {"links revoke ID", "Disable a public link",
+			nil, runLinksRevoke},
+	}
+	commandTree["trash"] = map[string]subcommand{
+		"list": {"trash list", "List the deleted files and folders",
+			nil, runTrashList},
+		"restore": {"trash restore ID [TO]", "Put a deleted file or folder back",
+			nil, runTrashRestore},
+		"empty": {"trash empty", "Delete everything in the trash for good",
+			nil, runTrashEmpty},
+		"purge": {"trash purge DAYS", "Delete the trash entries and versions older than DAYS for good",
+			nil, runTrashPurge},
+	}
+	commandTree["files"] = map[string]subcommand{
+		"ls": {"files ls [PATH] [-l] [-r] [--sort KEY] [--desc]", "List a folder of your storage",
+			[]string{"-l", "-r", "--sort", "--desc"}, runFilesList},
+		"search": {"files search QUERY... [--limit N]", "Search your files by words, name:, type:, path:, after:, before:, size>, size<",
+			[]string{"--limit"}, runFilesSearch},
+		"stat": {"files stat PATH", "Show the size, modification time and mode of a path",
+			nil, runFilesStat},
+		"rm": {"files rm PATH", "Move a file or a folder with everything in it to the trash",
+			nil, runFilesRemove},
+		"mv": {"files mv FROM TO", "Rename or move a file or folder",
+			nil, runFilesMove},
+		"cp": {"files cp FROM TO", "Copy a file or folder",
+			nil, runFilesCopy},
+		"versions": {"files versions PATH", "List the previous versions of a file",
+			nil, runFilesVersions},
+		"revert": {"files revert PATH VERSION_ID", "Bring a previous version of a file back",
+			nil, runFilesRevert},
+		"usage": {"files usage", "Show the space taken by your files, trash and versions",
+			nil, runFilesUsage},
+		"mkdir": {"files mkdir PATH", "Create a folder in your storage",
+			nil, runFilesMkdir},
+		"put": {"files put LOCAL REMOTE [--delta]", "Upload a file to your storage",
+			[]string{"--delta"}, runFilesPut},
+		"get": {"files get REMOTE [LOCAL]", "Download a file of your storage (- for stdout)",
+			nil, runFilesGet},
+		"thumb": {"files thumb REMOTE [LOCAL] [--size N]", "Download a thumbnail of an image of your storage (- for stdout)",
+			[]string{"--size"}, runFilesThumb},
+	}
+}
+
+func expectArgs(flags *flag.FlagSet, min, max int) error {
+	if flags.NArg() < min || (max >= 0 && flags.NArg() > max) {
+		return fmt.Errorf("wrong number of arguments for %s", flags.Name())
+	}
+	return nil
+}
+
+func readPassword(given string) (string, error) {
+	if given != "" {
+		return given, nil
+	}
+	if env := os.Getenv("HSCTL_PASSWORD"); env != "" {
+		return env, nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func printSuccess(app *cli, message string) {
+	app.print(map[string]string{"status": client.StatusSuccess, "message": message}, func() {
+		fmt.Println(message)
+	})
+}
+
+// ===========================
+// Profiles
+// ===========================
+
+func runLogin(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("login")
+	var current profile
+	var name string
+	flags.StringVar(&current.Web_URL, "web", "", "web panel address, the TCP port is discovered from it")
+	flags.StringVar(&current.Address, "address", "", "TCP API address (host:port)")
+	flags.StringVar(&current.Username, "user", "", "username")
+	flags.StringVar(&current.Password, "password", "", "password (default: $HSCTL_PASSWORD or asked)")
+	flags.StringVar(&name, "name", "default", "name of the profile")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if (current.Web_URL == "") == (current.Address == "") {
+		return errors.New("give either --web or --address")
+	}
+	if current.Username == "" {
+		return errors.New("--user is required")
+	}
+	password, err := readPassword(current.Password)
+	if err != nil {
+		return err
+	}
+	current.Password = password
+
+	ctx, cancel := context.WithTimeout(ctx, app.timeout)
+	defer cancel()
+	c, err := dialProfile(ctx, current)
+	if err != nil {
+		return err
+	}
+	c.Close()
+
+	profiles, err := loadProfiles(app.profiles_path)
+	if err != nil {
+		return err
+	}
+	profiles.Profiles[name] = current
+	profiles.Default = name
+	if err := saveProfiles(app.profiles_path, profiles); err != nil {
+		return err
+	}
+	printSuccess(app, "Logged in as "+current.Username+", saved as profile "+name)
+	return nil
+}
+
+func runLogout(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("logout")
+	name := flags.String("name", "", "profile to forget (default: the current one)")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	profiles, err := loadProfiles(app.profiles_path)
+	if err != nil {
+		return err
+	}
+	if *name == "" {
+		*name = profiles.Default
+	}
+	if _, exists := profiles.Profiles[*name]; !exists {
+		return fmt.Errorf("unknown profile %q", *name)
+	}
+	delete(profiles.Profiles, *name)
+	if profiles.Default == *name {
+		profiles.Default = ""
+	}
+	if err := saveProfiles(app.profiles_path, profiles); err != nil {
+		return err
+	}
+	printSuccess(app, "Profile "+*name+" removed")
+	return nil
+}
+
+func runProfiles(ctx context.Context, app *cli, args []string) error {
+	if err := parseInterspersed(app.flagSet("profiles"), args); err != nil {
+		return err
+	}
+	profiles, err := loadProfiles(app.profiles_path)
+	if err != nil {
+		return err
+	}
+	type listed struct {
+		Name     string `json:"name"`
+		Server   string `json:"server"`
+		Username string `json:"username"`
+		Default  bool   `json:"default"`
+	}
+	result := []listed{}
+	for name, current := range profiles.Profiles {
+		server := current.Web_URL
+		if server == "" {
+			server = current.Address
+		}
+		result = append(result, listed{name, server, current.Username, name == profiles.Default})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	app.print(result, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSERVER\tUSER\t")
+		for _, p := range result {
+			marker := ""
+			if p.Default {
+				marker = "*"
+			}
+			fmt.Fprintf(w, "%s%s\t%s\t%s\t\n", p.Name, marker, p.Server, p.Username)
+		}
+		w.Flush()
+	})
+	return nil
+}
+
+// ===========================
+// Server
+// ===========================
+
+func runStatus(ctx context.Context, app *cli, args []string) error {
+	if err := parseInterspersed(app.flagSet("status"), args); err != nil {
+		return err
+	}
+	current, err := app.currentProfile()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, app.timeout)
+	defer cancel()
+	c, err := dialProfile(ctx, current)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	status := map[string]any{"address": c.Address(), "username": current.Username}
+	// Usage numbers are only published by the web server
+	if current.Web_URL != "" {
+		if err := fetchWebStatus(ctx, current, status); err != nil {
+			return err
+		}
+	}
+	app.print(status, func() {
+		keys := []string{}
+		for key := range status {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s:\t%v\n", key, status[key])
+		}
+		w.Flush()
+	})
+	return nil
+}
+
+func fetchWebStatus(ctx context.Context, current profile, status map[string]any) error {
+	base := strings.TrimSuffix(current.Web_URL, "/") + "/api/v1"
+	body, _ := json.Marshal(map[string]string{"username": current.Username, "password": current.Password})
+	request, _ := http.NewRequestWithContext(ctx, http.MethodPost, base+"/auth/token", bytes.NewReader(body))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	var token struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(response.Body).Decode(&token)
+	response.Body.Close()
+	if token.Token == "" {
+		return fmt.Errorf("unable to get a token from the web server (%s)", response.Status)
+	}
+	defer func() {
+		request, _ := http.NewRequestWithContext(ctx, http.MethodDelete, base+"/auth/token", nil)
+		request.Header.Set("Authorization", "Bearer "+token.Token)
+		if response, err := http.DefaultClient.Do(request); err == nil {
+			response.Body.Close()
+		}
+	}()
+
+	request, _ = http.NewRequestWithContext(ctx, http.MethodGet, base+"/system/status", nil)
+	request.Header.Set("Authorization", "Bearer "+token.Token)
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(&status)
+}
+
+func runShell(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("shell")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, -1); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		out, err := c.ConsoleCommand(ctx, flags.Args()...)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Output string `json:"out"`
+			Err    string `json:"error"`
+		}
+		json.Unmarshal([]byte(out), &result)
+		app.print(result, func() {
+			fmt.Print(result.Output)
+			if result.Err != "" {
+				fmt.Fprintln(os.Stderr, result.Err)
+			}
+		})
+		return nil
+	})
+}
+
+func runEvents(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("events")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	topics := flags.Args()
+	if len(topics) == 0 {
+		topics = []string{"*"}
+	}
+	c, err := app.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Subscribe(ctx, topics...); err != nil {
+		return err
+	}
+	// Subscribing again every now and then notices a dropped connection, and reconnects
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-keepAlive.C:
+			if err := c.Subscribe(ctx, topics...); err != nil && ctx.Err() == nil {
+				return err
+			}
+		case event := <-c.Events:
+			app.print(event, func() {
+				fmt.Printf("%s  %-16s #%d  %s\n", event.Time.Format(time.TimeOnly), event.Topic, event.Sequence, event.Message)
+			})
+		}
+	}
+}
+
+// ===========================
+// Users
+// ===========================
+
+func runUsersRequests(ctx context.Context, app *cli, args []string) error {
+	if err := parseInterspersed(app.flagSet("users requests"), args); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		requests, err := c.ListAccountRequests(ctx)
+		if err != nil {
+			return err
+		}
+		list := []client.AccountRequest{}
+		for _, request := range requests {
+			list = append(list, request)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Request_At < list[j].Request_At })
+		app.print(list, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "USERNAME\tREQUESTED AT\t")
+			for _, request := range list {
+				fmt.Fprintf(w, "%s\t%s\t\n", request.Username, request.Request_At)
+			}
+			w.Flush()
+		})
+		return nil
+	})
+}
+
+func runUsersRequest(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("users request")
+	password := flags.String("password", "", "password of the new account (default: $HSCTL_PASSWORD or asked)")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	secret, err := readPassword(*password)
+	if err != nil {
+		return err
+	}
+	current, err := app.currentProfile()
+	if err != nil {
+		return err
+	}
+	// Asking for an account doesn't need one, so don't log in
+	current.Username = ""
+	ctx, cancel := context.WithTimeout(ctx, app.timeout)
+	defer cancel()
+	c, err := dialProfile(ctx, current)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.RequestAccount(ctx, flags.Arg(0), secret); err != nil {
+		return err
+	}
+	printSuccess(app, "Account requested, an admin has to accept it")
+	return nil
+}
+
+func runUsersAccept(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("users accept")
+	grade := flags.Uint("grade", 5, "admin grade of the new user")
+	admin := flags.Bool("admin", false, "make the new user an admin")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	if *grade > 255 {
+		return errors.New("--grade must be between 0 and 255")
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if err := c.AcceptAccountRequest(ctx, flags.Arg(0), *admin, uint8(*grade)); err != nil {
+			return err
+		}
+		printSuccess(app, "User "+flags.Arg(0)+" accepted")
+		return nil
+	})
+}
+
+// ===========================
+// Scripts
+// ===========================
+
+func runScriptsList(ctx context.Context, app *cli, args []string) error {
+	if err := parseInterspersed(app.flagSet("scripts list"), args); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		scripts, err := c.ListScripts(ctx)
+		if err != nil {
+			return err
+		}
+		app.print(scripts, func() {
+			for _, name := range scripts.Public {
+				fmt.Println(name)
+			}
+			for _, name := range scripts.Private {
+				fmt.Println(name, "(private)")
+			}
+		})
+		return nil
+	})
+}
+
+func runScriptsRun(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("scripts run")
+	private := flags.Bool("private", false, "run the private script with this name")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		result, err := c.RunScript(ctx, flags.Arg(0), *private)
+		app.print(result, func() {
+			fmt.Print(result.Output)
+		})
+		return err
+	})
+}
+
+func runScriptsPut(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("scripts put")
+	name := flags.String("name", "", "name of the script on the server (default: the file name)")
+	public := flags.Bool("public", false, "let every user run it")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	content, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *name == "" {
+		*name = filepath.Base(flags.Arg(0))
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if err := c.UploadScript(ctx, *public, *name, content); err != nil {
+			return err
+		}
+		printSuccess(app, "Script "+*name+" uploaded")
+		return nil
+	})
+}
+
+func runDescribe(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("describe")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		commands, err := c.Describe(ctx, flags.Args()...)
+		if err != nil {
+			return err
+		}
+		app.print(commands, func() {
+			for _, command := range commands {
+				usage := command.Name
+				for _, argument := range command.Arguments {
+					name := argument.Name
+					if argument.Variadic {
+						name += "..."
+					}
+					if !argument.Required {
+						name = "[" + name + "]"
+					}
+					usage += " " + name
+				}
+				fmt.Printf("%s\n    %s (%s, since v%d)\n", usage, command.Description, command.Permission, command.Since)
+			}
+		})
+		return nil
+	})
+}
+
+// ===========================
+// Connections
+// ===========================
+
+func runConnectionsList(ctx context.Context, app *cli, args []string) error {
+	if err := parseInterspersed(app.flagSet("connections list"), args); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		connections, err := c.ListConnections(ctx)
+		if err != nil {
+			return err
+		}
+		app.print(connections, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID	TRANSPORT	ADDRESS	USER	CLIENT	CONNECTED	IN	OUT	LAST COMMAND	")
+			for _, connection := range connections {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t\n", connection.ID, connection.Transport,
+					connection.Remote_Address, connection.Username, connection.Client,
+					time.Since(connection.Connected_At).Round(time.Second), connection.Bytes_In, connection.Bytes_Out,
+					connection.Last_Command)
+			}
+			w.Flush()
+		})
+		return nil
+	})
+}
+
+func runConnectionsKick(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("connections kick")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	id, err := strconv.ParseUint(flags.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid connection id %q", flags.Arg(0))
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if err := c.KickConnection(ctx, id); err != nil {
+			return err
+		}
+		printSuccess(app, "Connection "+flags.Arg(0)+" closed")
+		return nil
+	})
+}
+
+// ===========================
+// Storage
+// ===========================
+
+func runStorageReport(ctx context.Context, app *cli, args []string) error {
+	if err := parseInterspersed(app.flagSet("storage report"), args); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		report, err := c.StorageReport(ctx)
+		if err != nil {
+			return err
+		}
+		app.print(report, func() {
+			fmt.Printf("Deduplication: %s\nLogical:      %d\nReal:         %d\nSaved:        %d\nBlobs:        %d\nReferences:   %d\nUnreferenced: %d\n",
+				report.Deduplication, report.Logical, report.Real, report.Saved, report.Blobs, report.References, report.Unreferenced)
+		})
+		return nil
+	})
+}
+
+func runStorageGC(ctx context.Context, app *cli, args []string) error {
+	if err := parseInterspersed(app.flagSet("storage gc"), args); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		result, err := c.CollectBlobs(ctx)
+		if err != nil {
+			return err
+		}
+		app.print(result, func() {
+			fmt.Printf("%d blobs removed, %d bytes freed\n", result.Removed, result.Freed)
+		})
+		return nil
+	})
+}
+
+func runStorageFsck(ctx context.Context, app *cli, args []string) error {
+	if err := parseInterspersed(app.flagSet("storage fsck"), args); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		result, err := c.CheckBlobs(ctx)
+		if err != nil {
+			return err
+		}
+		app.print(result, func() {
+			fmt.Printf("%d blobs checked, %d damaged\n", result.Checked, len(result.Corrupted))
+			if len(result.Corrupted) == 0 {
+				return
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "HASH	SIZE	FILES	NOW HASHES TO	")
+			for _, damage := range result.Corrupted {
+				fmt.Fprintf(w, "%s\t%d\t%d\t%s\t\n", damage.Hash, damage.Size, damage.References, damage.Actual)
+			}
+			w.Flush()
+		})
+		if len(result.Corrupted) > 0 {
+			return errors.New("the blob store is damaged")
+		}
+		return nil
+	})
+}
+
+func runStorageScan(ctx context.Context, app *cli, args []string) error {
+	if err := parseInterspersed(app.flagSet("storage scan"), args); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		result, err := c.ScanBlobs(ctx)
+		if err != nil {
+			return err
+		}
+		app.print(result, func() {
+			fmt.Printf("%d files scanned, %d deduplicated, %d bytes saved\n", result.Scanned, result.Deduplicated, result.Saved)
+		})
+		return nil
+	})
+}
+
+// ===========================
+// Files
+// ===========================
+
+func runFilesList(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("files ls")
+	long := flags.Bool("l", false, "show the size, modification time and mode")
+	recursive := flags.Bool("r", false, "list everything under the folder")
+	sortBy := flags.String("sort", "name", "sort by name, size, modified or type")
+	descending := flags.Bool("desc", false, "reverse the order")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 0, 1); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		options := client.ListOptions{Recursive: *recursive, Sort: *sortBy, Descending: *descending}
+		page, err := c.ListUserFolderWith(ctx, flags.Arg(0), options)
+		if err != nil {
+			return err
+		}
+		entries := page.Items
+		app.print(entries, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			for _, entry := range entries {
+				name := entry.Name
+				if entry.Path != "" {
+					name = entry.Path
+				}
+				if entry.IsFolder() {
+					name += "/"
+				}
+				if *long {
+					fmt.Fprintf(w, "%s\t%d\t%s\t%s\t\n", entry.Mode, entry.Size, entry.Modified.Local().Format(time.DateTime), name)
+				} else {
+					fmt.Fprintln(w, name)
+				}
+			}
+			w.Flush()
+		})
+		return nil
+	})
+}
+
+func runFilesSearch(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("files search")
+	limit := flags.Int("limit", 0, "most results to show (default: 100)")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, -1); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		results, err := c.SearchFiles(ctx, strings.Join(flags.Args(), " "), *limit)
+		if err != nil {
+			return err
+		}
+		app.print(results, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			for _, result := range results.Results {
+				name := result.Path
+				if result.Type == "folder" {
+					name += "/"
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t\n", result.Size, result.Modified.Local().Format(time.DateTime), name)
+			}
+			w.Flush()
+			if results.Total > len(results.Results) {
+				fmt.Printf("%d more, use --limit to see them\n", results.Total-len(results.Results))
+			}
+		})
+		return nil
+	})
+}
+
+func runFilesStat(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("files stat")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		entry, err := c.StatUserPath(ctx, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		app.print(entry, func() {
+			fmt.Printf("Path:     %s\nMode:     %s\nSize:     %d\nModified: %s\n",
+				entry.Path, entry.Mode, entry.Size, entry.Modified.Local().Format(time.DateTime))
+		})
+		return nil
+	})
+}
+
+func runFilesRemove(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("files rm")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if err := c.DeleteUserPath(ctx, flags.Arg(0)); err != nil {
+			return err
+		}
+		printSuccess(app, flags.Arg(0)+" deleted")
+		return nil
+	})
+}
+
+func runFilesMove(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("files mv")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 2, 2); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if err := c.MoveUserPath(ctx, flags.Arg(0), flags.Arg(1)); err != nil {
+			return err
+		}
+		printSuccess(app, "Moved "+flags.Arg(0)+" to "+flags.Arg(1))
+		return nil
+	})
+}
+
+func runFilesCopy(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("files cp")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 2, 2); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if err := c.CopyUserPath(ctx, flags.Arg(0), flags.Arg(1)); err != nil {
+			return err
+		}
+		printSuccess(app, "Copied "+flags.Arg(0)+" to "+flags.Arg(1))
+		return nil
+	})
+}
+
+func runFilesMkdir(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("files mkdir")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if err := c.CreateUserFolder(ctx, flags.Arg(0)); err != nil {
+			return err
+		}
+		printSuccess(app, "Folder "+flags.Arg(0)+" created")
+		return nil
+	})
+}
+
+func runFilesPut(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("files put")
+	delta := flags.Bool("delta", false, "only send the blocks that changed since the version on the server")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 2, 2); err != nil {
+		return err
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if *delta {
+			stats, err := c.UploadFileDelta(ctx, flags.Arg(1), file)
+			if err != nil {
+				return err
+			}
+			printSuccess(app, fmt.Sprintf("Uploaded %s to %s (%d bytes sent, %d reused)", flags.Arg(0), flags.Arg(1), stats.Literal, stats.Copied))
+			return nil
+		}
+		// Big files go in chunks, so an interrupted upload can be resumed by running the same command again
+		if info.Size() > client.UploadChunkSize {
+			err = c.UploadUserFileResumable(ctx, flags.Arg(1), file)
+		} else {
+			err = c.UploadUserFileFrom(ctx, flags.Arg(1), file)
+		}
+		if err != nil {
+			return err
+		}
+		printSuccess(app, "Uploaded "+flags.Arg(0)+" to "+flags.Arg(1))
+		return nil
+	})
+}
+
+func runFilesGet(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("files get")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 2); err != nil {
+		return err
+	}
+	remote := flags.Arg(0)
+	local := filepath.Base(remote)
+	if flags.NArg() == 2 {
+		local = flags.Arg(1)
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if local == "-" {
+			_, err := c.DownloadUserFile(ctx, remote, os.Stdout)
+			return err
+		}
+		file, err := os.Create(local)
+		if err != nil {
+			return err
+		}
+		details, err := c.DownloadUserFile(ctx, remote, file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(local)
+			return err
+		}
+		printSuccess(app, fmt.Sprintf("Downloaded %s to %s (%d bytes)", remote, local, details.Size))
+		return nil
+	})
+}
+
+func runFilesThumb(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("files thumb")
+	size := flags.Int("size", 0, "longest side: 128, 256 or 512 (default: 256)")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 2); err != nil {
+		return err
+	}
+	remote := flags.Arg(0)
+	// Thumbnails of JPEG files are JPEG, the others PNG
+	extension := strings.ToLower(filepath.Ext(remote))
+	local := strings.TrimSuffix(filepath.Base(remote), filepath.Ext(remote)) + ".thumb"
+	if extension == ".jpg" || extension == ".jpeg" {
+		local += extension
+	} else {
+		local += ".png"
+	}
+	if flags.NArg() == 2 {
+		local = flags.Arg(1)
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if local == "-" {
+			_, err := c.GetThumbnail(ctx, remote, *size, os.Stdout)
+			return err
+		}
+		file, err := os.Create(local)
+		if err != nil {
+			return err
+		}
+		thumbnail, err := c.GetThumbnail(ctx, remote, *size, file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(local)
+			return err
+		}
+		printSuccess(app, fmt.Sprintf("Saved the thumbnail of %s to %s (%dx%d)", remote, local, thumbnail.Width, thumbnail.Height))
+		return nil
+	})
+}
+
+func runFilesVersions(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("files versions")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		versions, err := c.ListFileVersions(ctx, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		app.print(versions, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID	SIZE	MODIFIED	REPLACED	")
+			for _, version := range versions {
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\t\n", version.ID, version.Size,
+					version.Modified.Local().Format(time.DateTime), version.Replaced_At.Local().Format(time.DateTime))
+			}
+			w.Flush()
+		})
+		return nil
+	})
+}
+
+func runFilesRevert(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("files revert")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 2, 2); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if err := c.RestoreFileVersion(ctx, flags.Arg(0), flags.Arg(1)); err != nil {
+			return err
+		}
+		printSuccess(app, "Version "+flags.Arg(1)+" of "+flags.Arg(0)+" restored")
+		return nil
+	})
+}
+
+func runFilesUsage(ctx context.Context, app *cli, args []string) error {
+	if err := parseInterspersed(app.flagSet("files usage"), args); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		usage, err := c.StorageUsage(ctx)
+		if err != nil {
+			return err
+		}
+		app.print(usage, func() {
+			fmt.Printf("Files:    %d\nTrash:    %d\nVersions: %d\nTotal:    %d\n", usage.Files, usage.Trash, usage.Versions, usage.Total)
+		})
+		return nil
+	})
+}
+
+// ===========================
+// Trash
+// ===========================
+
+func runTrashList(ctx context.Context, app *cli, args []string) error {
+	if err := parseInterspersed(app.flagSet("trash list"), args); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		entries, err := c.ListTrash(ctx)
+		if err != nil {
+			return err
+		}
+		app.print(entries, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID	DELETED	SIZE	PATH	")
+			for _, entry := range entries {
+				path := entry.Path
+				if strings.HasPrefix(entry.Type, "d") {
+					path += "/"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t\n", entry.ID, entry.Deleted_At.Local().Format(time.DateTime), entry.Size, path)
+			}
+			w.Flush()
+		})
+		return nil
+	})
+}
+
+func runTrashRestore(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("trash restore")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 2); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		message, err := c.RestoreFromTrash(ctx, flags.Arg(0), flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		printSuccess(app, message)
+		return nil
+	})
+}
+
+func runTrashEmpty(ctx context.Context, app *cli, args []string) error {
+	if err := parseInterspersed(app.flagSet("trash empty"), args); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if err := c.EmptyTrash(ctx); err != nil {
+			return err
+		}
+		printSuccess(app, "Trash emptied")
+		return nil
+	})
+}
+
+func runTrashPurge(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("trash purge")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	days, err := strconv.Atoi(flags.Arg(0))
+	if err != nil || days < 0 {
+		return fmt.Errorf("DAYS must be a positive number or 0")
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		message, err := c.PurgeHistory(ctx, days)
+		if err != nil {
+			return err
+		}
+		printSuccess(app, message)
+		return nil
+	})
+}
+
+// ===========================
+// Shares
+// ===========================
+
+func runSharesList(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("shares list")
+	incoming := flags.Bool("incoming", false, "list what the others share with you")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 0, 0); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		var shares []client.Share
+		var err error
+		if *incoming {
+			shares, err = c.ListSharedWithMe(ctx)
+		} else {
+			shares, err = c.ListShares(ctx)
+		}
+		if err != nil {
+			return err
+		}
+		app.print(shares, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			if *incoming {
+				fmt.Fprintln(w, "ID	OWNER	ACCESS	PATH	")
+				for _, share := range shares {
+					fmt.Fprintf(w, "%s\t%s\t%s\tShared with me/%s/%s\t\n", share.ID, share.Owner, share.Access, share.Owner, share.Name)
+				}
+			} else {
+				fmt.Fprintln(w, "ID	WITH	ACCESS	PATH	")
+				for _, share := range shares {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", share.ID, share.Recipient, share.Access, share.Path)
+				}
+			}
+			w.Flush()
+		})
+		return nil
+	})
+}
+
+func runSharesAdd(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("shares add")
+	write := flags.Bool("write", false, "let the user change the content too")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 2, 2); err != nil {
+		return err
+	}
+	access := "read"
+	if *write {
+		access = "read-write"
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		share, err := c.SharePath(ctx, flags.Arg(0), flags.Arg(1), access)
+		if err != nil {
+			return err
+		}
+		app.print(share, func() {
+			fmt.Printf("%s shared with %s (%s), id %s\n", share.Path, share.Recipient, share.Access, share.ID)
+		})
+		return nil
+	})
+}
+
+func runSharesRevoke(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("shares revoke")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if err := c.RevokeShare(ctx, flags.Arg(0)); err != nil {
+			return err
+		}
+		printSuccess(app, "Share revoked")
+		return nil
+	})
+}
+
+// ===========================
+// Links
+// ===========================
+
+func runLinksCreate(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("links create")
+	password := flags.String("password", "", "ask for this password before the download")
+	expires := flags.Duration("expires", 0, "disable the link after this long, like 72h")
+	maxDownloads := flags.Int("max", 0, "disable the link after this many downloads")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		options := client.ShareLinkOptions{Password: *password, ExpiresIn: *expires, MaxDownloads: *maxDownloads}
+		link, err := c.CreateShareLink(ctx, flags.Arg(0), options)
+		if err != nil {
+			return err
+		}
+		app.print(link, func() {
+			fmt.Println(link.URL)
+		})
+		return nil
+	})
+}
+
+func runLinksList(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("links list")
+	all := flags.Bool("all", false, "list the active links of every user (admins only)")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 0, 0); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		links, err := c.ListShareLinks(ctx, *all)
+		if err != nil {
+			return err
+		}
+		app.print(links, func() {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID	OWNER	PATH	EXPIRES	DOWNLOADS	URL	")
+			for _, link := range links {
+				expires, downloads := "never", strconv.Itoa(link.Downloads)
+				if !link.Expires_At.IsZero() {
+					expires = link.Expires_At.Local().Format(time.DateTime)
+				}
+				if link.Max_Downloads > 0 {
+					downloads += "/" + strconv.Itoa(link.Max_Downloads)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t\n", link.ID, link.Owner, link.Path, expires, downloads, link.URL)
+			}
+			w.Flush()
+		})
+		return nil
+	})
+}
+
+func runLinksRevoke(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("links revoke")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	return app.withClient(ctx, func(ctx context.Context, c *client.Client) error {
+		if err := c.RevokeShareLink(ctx, flags.Arg(0)); err != nil {
+			return err
+		}
+		printSuccess(app, "Link revoked")
+		return nil
+	})
+}
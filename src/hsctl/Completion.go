@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Generated from commandTree, so new commands complete without touching this file
+func runCompletion(ctx context.Context, app *cli, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("give the shell: bash, zsh or fish")
+	}
+	switch args[0] {
+	case "bash":
+		fmt.Print(bashCompletion())
+	case "zsh":
+		// zsh understands the bash script through bashcompinit
+		fmt.Print("autoload -U +X bashcompinit && bashcompinit\n" + bashCompletion())
+	case "fish":
+		fmt.Print(fishCompletion())
+	default:
+		return fmt.Errorf("unsupported shell %q", args[0])
+	}
+	return nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := []string{}
+	for key := range m {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func bashCompletion() string {
+	var cases strings.Builder
+	for _, group := range sortedKeys(commandTree) {
+		subcommands := commandTree[group]
+		if command, exists := subcommands[""]; exists {
+			fmt.Fprintf(&cases, "        %s) words=\"%s\" ;;\n", group, strings.Join(append(command.flags, globalFlags...), " "))
+			continue
+		}
+		fmt.Fprintf(&cases, "        %s)\n", group)
+		fmt.Fprintf(&cases, "            if [ $COMP_CWORD -eq 2 ]; then words=\"%s\"; else\n", strings.Join(sortedKeys(subcommands), " "))
+		fmt.Fprintf(&cases, "            case \"${COMP_WORDS[2]}\" in\n")
+		for _, name := range sortedKeys(subcommands) {
+			fmt.Fprintf(&cases, "                %s) words=\"%s\" ;;\n", name, strings.Join(append(subcommands[name].flags, globalFlags...), " "))
+		}
+		fmt.Fprintf(&cases, "            esac; fi ;;\n")
+	}
+	return `# hsctl bash completion, load with: source <(hsctl completion bash)
+_hsctl() {
+    local current="${COMP_WORDS[COMP_CWORD]}" words=""
+    if [ $COMP_CWORD -eq 1 ]; then
+        words="` + strings.Join(sortedKeys(commandTree), " ") + `"
+    else
+        case "${COMP_WORDS[1]}" in
+` + cases.String() + `        esac
+    fi
+    if [[ "$current" != -* && $COMP_CWORD -gt 1 ]]; then
+        COMPREPLY=($(compgen -f -- "$current") $(compgen -W "$words" -- "$current"))
+    else
+        COMPREPLY=($(compgen -W "$words" -- "$current"))
+    fi
+}
+complete -F _hsctl hsctl
+`
+}
+
+func fishCompletion() string {
+	var out strings.Builder
+	out.WriteString("# hsctl fish completion, load with: hsctl completion fish | source\n")
+	out.WriteString("complete -c hsctl -f\n")
+	for _, flag := range globalFlags {
+		fmt.Fprintf(&out, "complete -c hsctl %s\n", fishFlag(flag))
+	}
+	for _, group := range sortedKeys(commandTree) {
+		subcommands := commandTree[group]
+		if command, exists := subcommands[""]; exists {
+			fmt.Fprintf(&out, "complete -c hsctl -n __fish_use_subcommand -a %s -d %q\n", group, command.description)
+			for _, flag := range command.flags {
+				fmt.Fprintf(&out, "complete -c hsctl -n '__fish_seen_subcommand_from %s' %s\n", group, fishFlag(flag))
+			}
+			continue
+		}
+		fmt.Fprintf(&out, "complete -c hsctl -n __fish_use_subcommand -a %s\n", group)
+		for _, name := range sortedKeys(subcommands) {
+			command := subcommands[name]
+			fmt.Fprintf(&out, "complete -c hsctl -n '__fish_seen_subcommand_from %s; and not __fish_seen_subcommand_from %s' -a %s -d %q\n",
+				group, strings.Join(sortedKeys(subcommands), " "), name, command.description)
+			for _, flag := range command.flags {
+				fmt.Fprintf(&out, "complete -c hsctl -n '__fish_seen_subcommand_from %s' %s\n", name, fishFlag(flag))
+			}
+		}
+	}
+	return out.String()
+}
+
+// --name is a long option for fish, -l an old style one
+func fishFlag(flag string) string {
+	if name, found := strings.CutPrefix(flag, "--"); found {
+		return "-l " + name
+	}
+	return "-o " + strings.TrimPrefix(flag, "-")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Where and as who to connect, saved by hsctl login
+type profile struct {
+	Web_URL  string `json:"web_url,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type profilesFile struct {
+	Default  string             `json:"default"`
+	Profiles map[string]profile `json:"profiles"`
+}
+
+func defaultProfilesPath() string {
+	if path := os.Getenv("HSCTL_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".hsctl.json"
+	}
+	return filepath.Join(dir, "hsctl", "profiles.json")
+}
+
+func loadProfiles(path string) (profilesFile, error) {
+	profiles := profilesFile{Profiles: map[string]profile{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return profiles, nil
+	}
+	if err != nil {
+		return profiles, err
+	}
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return profiles, err
+	}
+	if profiles.Profiles == nil {
+		profiles.Profiles = map[string]profile{}
+	}
+	return profiles, nil
+}
+
+// The file holds passwords, so only the owner may read it
+func saveProfiles(path string, profiles profilesFile) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
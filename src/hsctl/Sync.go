@@ -0,0 +1,35 @@
+package main
+
+import (
+	"ServerController/src/client/foldersync"
+	"context"
+	"time"
+)
+
+// hsctl sync keeps a local folder and a folder of the server the same, both ways, see the foldersync package
+func runSync(ctx context.Context, app *cli, args []string) error {
+	flags := app.flagSet("sync")
+	remote := flags.String("remote", "", "folder of your storage to sync with (default: all of it)")
+	interval := flags.Duration("interval", 5*time.Second, "how often the local folder is checked when it can't be watched")
+	once := flags.Bool("once", false, "sync once and stop")
+	if err := parseInterspersed(flags, args); err != nil {
+		return err
+	}
+	if err := expectArgs(flags, 1, 1); err != nil {
+		return err
+	}
+	c, err := app.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	s, err := foldersync.New(c, flags.Arg(0), *remote)
+	if err != nil {
+		return err
+	}
+	s.Name = "hsctl"
+	if *once {
+		return s.Cycle(ctx)
+	}
+	return s.Run(ctx, *interval)
+}
@@ -0,0 +1,200 @@
+// hsctl is the command-line client for Home Server Controller.
+// It speaks the same TCP protocol as the mobile and desktop apps, through the client package.
+package main
+
+import (
+	"ServerController/src/client"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+)
+
+// State shared by every subcommand
+type cli struct {
+	profiles_path string
+	profile_name  string
+	json_output   bool
+	timeout       time.Duration
+}
+
+// A leaf of the command tree: hsctl <group> <name> or hsctl <name>
+type subcommand struct {
+	usage       string
+	description string
+	flags       []string // Flag names, for the shell completion
+	run         func(ctx context.Context, app *cli, args []string) error
+}
+
+var commandTree = map[string]map[string]subcommand{}
+
+func main() {
+	app := &cli{profiles_path: defaultProfilesPath(), timeout: 5 * time.Minute}
+	global := app.flagSet("hsctl")
+	global.Usage = printUsage
+	if err := global.Parse(os.Args[1:]); err != nil {
+		os.Exit(2)
+	}
+	args := global.Args()
+	if len(args) == 0 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	command, rest, err := findCommand(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "hsctl:", err)
+		printUsage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := command.run(ctx, app, rest); err != nil {
+		var commandErr *client.CommandError
+		if app.json_output && errors.As(err, &commandErr) {
+			app.print(commandErr.Response, nil)
+		}
+		fmt.Fprintln(os.Stderr, "hsctl:", err)
+		os.Exit(1)
+	}
+}
+
+func findCommand(args []string) (subcommand, []string, error) {
+	group, exists := commandTree[args[0]]
+	if !exists {
+		return subcommand{}, nil, fmt.Errorf("unknown command %q", args[0])
+	}
+	// Top level commands are stored under an empty name
+	if command, exists := group[""]; exists {
+		return command, args[1:], nil
+	}
+	if len(args) < 2 {
+		return subcommand{}, nil, fmt.Errorf("%s needs a subcommand", args[0])
+	}
+	command, exists := group[args[1]]
+	if !exists {
+		return subcommand{}, nil, fmt.Errorf("unknown command %q", args[0]+" "+args[1])
+	}
+	return command, args[2:], nil
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: hsctl [--profile NAME] [--json] [--config FILE] <command> [args]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	var lines []string
+	for _, group := range commandTree {
+		for _, command := range group {
+			lines = append(lines, fmt.Sprintf("  %-45s %s", command.usage, command.description))
+		}
+	}
+	sort.Strings(lines)
+	fmt.Fprintln(os.Stderr, strings.Join(lines, "\n"))
+}
+
+// Flag set with the global flags already defined, so they can be given after the subcommand too
+func (app *cli) flagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&app.profiles_path, "config", app.profiles_path, "profile file")
+	flags.StringVar(&app.profile_name, "profile", app.profile_name, "profile to use (default: the last one logged in)")
+	flags.BoolVar(&app.json_output, "json", app.json_output, "print the results as JSON")
+	flags.DurationVar(&app.timeout, "timeout", app.timeout, "give up on a command after this long")
+	return flags
+}
+
+// Flags every subcommand accepts, for the shell completion
+var globalFlags = []string{"--config", "--profile", "--json", "--timeout"}
+
+// Like flag.Parse, but flags may come after the positional arguments (hsctl users accept NAME --grade 2)
+func parseInterspersed(flags *flag.FlagSet, args []string) error {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		if args[0] == "--" {
+			positional = append(positional, args[1:]...)
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	return flags.Parse(append([]string{"--"}, positional...))
+}
+
+func (app *cli) currentProfile() (profile, error) {
+	profiles, err := loadProfiles(app.profiles_path)
+	if err != nil {
+		return profile{}, fmt.Errorf("unable to read %s: %w", app.profiles_path, err)
+	}
+	name := app.profile_name
+	if name == "" {
+		name = profiles.Default
+	}
+	current, exists := profiles.Profiles[name]
+	if !exists {
+		return profile{}, errors.New("not logged in, run hsctl login first")
+	}
+	return current, nil
+}
+
+// Opens a connection with the selected profile, already logged in
+func (app *cli) connect(ctx context.Context) (*client.Client, error) {
+	current, err := app.currentProfile()
+	if err != nil {
+		return nil, err
+	}
+	return dialProfile(ctx, current)
+}
+
+func dialProfile(ctx context.Context, current profile) (*client.Client, error) {
+	var c *client.Client
+	var err error
+	if current.Web_URL != "" {
+		c, err = client.DialWebServer(ctx, current.Web_URL, client.Options{Client_Name: "hsctl"})
+	} else {
+		c, err = client.Dial(ctx, current.Address, client.Options{Client_Name: "hsctl"})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if current.Username != "" {
+		if err := c.Login(ctx, current.Username, current.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Prints value as JSON with --json, otherwise calls human (when there is one)
+func (app *cli) print(value any, human func()) {
+	if app.json_output || human == nil {
+		out, _ := json.MarshalIndent(value, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	human()
+}
+
+// Runs fn with a connected client and the command timeout
+func (app *cli) withClient(ctx context.Context, fn func(ctx context.Context, c *client.Client) error) error {
+	ctx, cancel := context.WithTimeout(ctx, app.timeout)
+	defer cancel()
+	c, err := app.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return fn(ctx, c)
+}